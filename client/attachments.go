@@ -0,0 +1,290 @@
+package client
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "fmt"
+    "mime"
+    "net/http"
+    "os"
+    "path/filepath"
+    "secure-messenger/shared"
+)
+
+// UploadAttachment encrypts a file and uploads it in chunks. An upload that
+// was interrupted resumes where the server left off when called again with
+// the same file. The returned attachment can be passed to SendMessage.
+func (nc *NetworkClient) UploadAttachment(path string) (*shared.Attachment, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read file: %v", err)
+    }
+    
+    sum := sha256.Sum256(data)
+    fingerprint := path + "\x00" + hex.EncodeToString(sum[:])
+    
+    mimeType := mime.TypeByExtension(filepath.Ext(path))
+    if mimeType == "" {
+        mimeType = http.DetectContentType(data)
+    }
+    
+    pending, err := nc.encryptAttachment(fingerprint, data, IsImage(mimeType))
+    if err != nil {
+        return nil, fmt.Errorf("failed to encrypt file: %v", err)
+    }
+    
+    hash, err := nc.uploadBlob(pending.ciphertext)
+    if err != nil {
+        return nil, err
+    }
+    
+    attachment := &shared.Attachment{
+        BlobHash: hash,
+        Name:     filepath.Base(path),
+        MimeType: mimeType,
+        Size:     int64(len(pending.ciphertext)),
+        Key:      base64.StdEncoding.EncodeToString(pending.key),
+    }
+    
+    if pending.preview != nil {
+        if attachment.PreviewHash, err = nc.uploadBlob(pending.preview); err != nil {
+            return nil, err
+        }
+        attachment.PreviewSize = int64(len(pending.preview))
+    }
+    
+    nc.uploadMu.Lock()
+    delete(nc.pendingUploads, fingerprint)
+    nc.uploadMu.Unlock()
+    
+    return attachment, nil
+}
+
+// pendingUpload keeps the encrypted form of a file and its preview until
+// the upload completes.
+type pendingUpload struct {
+    ciphertext []byte
+    key        []byte
+    preview    []byte
+}
+
+// encryptAttachment encrypts a file, reusing the result of an earlier failed
+// attempt at the same file so that the retry has the same hash and resumes.
+// Images also get a thumbnail, made before encryption so the server never
+// sees the picture.
+func (nc *NetworkClient) encryptAttachment(fingerprint string, data []byte, image bool) (*pendingUpload, error) {
+    nc.uploadMu.Lock()
+    defer nc.uploadMu.Unlock()
+    
+    if pending, ok := nc.pendingUploads[fingerprint]; ok {
+        return pending, nil
+    }
+    
+    ciphertext, key, err := nc.encryption.EncryptFile(data)
+    if err != nil {
+        return nil, err
+    }
+    pending := &pendingUpload{ciphertext: ciphertext, key: key}
+    
+    // Files that merely claim to be images are sent without a preview
+    if image {
+        if thumbnail, err := MakeThumbnail(data); err == nil {
+            if pending.preview, err = nc.encryption.EncryptFileWithKey(thumbnail, key); err != nil {
+                return nil, err
+            }
+        }
+    }
+    
+    nc.pendingUploads[fingerprint] = pending
+    return pending, nil
+}
+
+// uploadBlob uploads ciphertext that the server does not have yet and
+// returns its hash.
+func (nc *NetworkClient) uploadBlob(ciphertext []byte) (string, error) {
+    sum := sha256.Sum256(ciphertext)
+    hash := hex.EncodeToString(sum[:])
+    
+    status, err := nc.uploadRequest(map[string]interface{}{
+        "action":    "begin_upload",
+        "blob_hash": hash,
+        "size":      len(ciphertext),
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to start upload: %v", err)
+    }
+    
+    for !status.Complete && status.Received < status.Size {
+        end := status.Received + shared.MaxChunkSize
+        if end > status.Size {
+            end = status.Size
+        }
+        
+        status, err = nc.uploadRequest(map[string]interface{}{
+            "action":    "upload_chunk",
+            "upload_id": status.UploadID,
+            "offset":    status.Received,
+            "chunk":     base64.StdEncoding.EncodeToString(ciphertext[status.Received:end]),
+        })
+        if err != nil {
+            return "", fmt.Errorf("failed to upload: %v", err)
+        }
+    }
+    
+    if !status.Complete {
+        status, err = nc.uploadRequest(map[string]interface{}{
+            "action":    "finish_upload",
+            "upload_id": status.UploadID,
+        })
+        if err != nil {
+            return "", fmt.Errorf("failed to finish upload: %v", err)
+        }
+    }
+    
+    return hash, nil
+}
+
+func (nc *NetworkClient) uploadRequest(request map[string]interface{}) (*shared.UploadStatus, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    request["token"] = nc.Session.Token
+    
+    msg, err := nc.request(request)
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        Success bool                 `json:"success"`
+        Error   string               `json:"error"`
+        Upload  *shared.UploadStatus `json:"upload"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success || response.Upload == nil {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    return response.Upload, nil
+}
+
+// DownloadAttachment downloads and decrypts an attachment into destPath.
+// The encrypted data is kept in destPath plus ".part" until it is complete,
+// so an interrupted download resumes from there.
+func (nc *NetworkClient) DownloadAttachment(attachment *shared.Attachment, destPath string) error {
+    data, err := nc.FetchAttachment(attachment, destPath+".part")
+    if err != nil {
+        return err
+    }
+    
+    if err := os.WriteFile(destPath, data, 0600); err != nil {
+        return fmt.Errorf("failed to save file: %v", err)
+    }
+    
+    os.Remove(destPath + ".part")
+    return nil
+}
+
+// FetchAttachment downloads an attachment and returns its decrypted
+// contents. When partPath is set, the encrypted data is appended there as it
+// arrives and an existing partial download is resumed.
+func (nc *NetworkClient) FetchAttachment(attachment *shared.Attachment, partPath string) ([]byte, error) {
+    return nc.fetchBlob(attachment, false, partPath)
+}
+
+// FetchPreview downloads and decrypts the thumbnail of an image attachment.
+func (nc *NetworkClient) FetchPreview(attachment *shared.Attachment) ([]byte, error) {
+    if attachment.PreviewHash == "" {
+        return nil, fmt.Errorf("attachment has no preview")
+    }
+    return nc.fetchBlob(attachment, true, "")
+}
+
+func (nc *NetworkClient) fetchBlob(attachment *shared.Attachment, preview bool, partPath string) ([]byte, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    key, err := base64.StdEncoding.DecodeString(attachment.Key)
+    if err != nil {
+        return nil, fmt.Errorf("invalid attachment key: %v", err)
+    }
+    
+    hash, size := attachment.BlobHash, attachment.Size
+    if preview {
+        hash, size = attachment.PreviewHash, attachment.PreviewSize
+    }
+    
+    var ciphertext []byte
+    var part *os.File
+    if partPath != "" {
+        if ciphertext, err = os.ReadFile(partPath); err != nil && !os.IsNotExist(err) {
+            return nil, err
+        }
+        if part, err = os.OpenFile(partPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+            return nil, err
+        }
+        defer part.Close()
+    }
+    
+    for int64(len(ciphertext)) < size {
+        msg, err := nc.request(map[string]interface{}{
+            "action":        "download_chunk",
+            "token":         nc.Session.Token,
+            "attachment_id": attachment.ID,
+            "preview":       preview,
+            "offset":        len(ciphertext),
+            "length":        shared.MaxChunkSize,
+        })
+        if err != nil {
+            return nil, fmt.Errorf("failed to download: %v", err)
+        }
+        
+        var response struct {
+            Success bool   `json:"success"`
+            Error   string `json:"error"`
+            Chunk   string `json:"chunk"`
+            EOF     bool   `json:"eof"`
+        }
+        if err := decodeResponse(msg, &response); err != nil {
+            return nil, err
+        }
+        if !response.Success {
+            return nil, fmt.Errorf("failed to download: %s", response.Error)
+        }
+        
+        chunk, err := base64.StdEncoding.DecodeString(response.Chunk)
+        if err != nil {
+            return nil, fmt.Errorf("invalid chunk encoding: %v", err)
+        }
+        if part != nil {
+            if _, err := part.Write(chunk); err != nil {
+                return nil, err
+            }
+        }
+        ciphertext = append(ciphertext, chunk...)
+        
+        if response.EOF || len(chunk) == 0 {
+            break
+        }
+    }
+    
+    sum := sha256.Sum256(ciphertext)
+    if hex.EncodeToString(sum[:]) != hash {
+        if partPath != "" {
+            os.Remove(partPath)
+        }
+        return nil, fmt.Errorf("downloaded data does not match the attachment")
+    }
+    
+    data, err := nc.encryption.DecryptFile(ciphertext, key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decrypt attachment: %v", err)
+    }
+    
+    return data, nil
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "log"
+    "secure-messenger/shared"
+    "sync"
+    "time"
+)
+
+// draftSaveDelay is how long typing has to pause before a draft is saved.
+const draftSaveDelay = 2 * time.Second
+
+// SaveDraft encrypts and saves the draft of a channel, or of the direct
+// conversation with otherUserID. An empty text clears the draft.
+func (nc *NetworkClient) SaveDraft(channelID, otherUserID, text string) error {
+    if nc.Session == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    draft := &shared.Draft{ChannelID: channelID, OtherUserID: otherUserID}
+    if text != "" {
+        content, err := nc.encryptDraft(text)
+        if err != nil {
+            return err
+        }
+        draft.Content = content
+    }
+    
+    data, _ := json.Marshal(draft)
+    msg, err := nc.request(map[string]interface{}{
+        "action": "save_draft",
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    })
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    
+    return nil
+}
+
+// GetDrafts returns the user's saved drafts, decrypted. Drafts that cannot
+// be decrypted, such as ones saved before a password change, are skipped.
+func (nc *NetworkClient) GetDrafts() ([]*shared.Draft, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    msg, err := nc.request(map[string]interface{}{
+        "action": "get_drafts",
+        "token":  nc.Session.Token,
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        Success bool            `json:"success"`
+        Error   string          `json:"error"`
+        Drafts  []*shared.Draft `json:"drafts"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    var drafts []*shared.Draft
+    for _, draft := range response.Drafts {
+        text, err := nc.decryptDraft(draft.Content)
+        if err != nil {
+            log.Printf("Skipping unreadable draft: %v", err)
+            continue
+        }
+        draft.Content = text
+        drafts = append(drafts, draft)
+    }
+    
+    return drafts, nil
+}
+
+// OnDraftUpdated registers a handler for drafts saved on any of the user's
+// devices, including this one. The draft's content is decrypted, and empty
+// when it was cleared.
+func (nc *NetworkClient) OnDraftUpdated(handler func(draft *shared.Draft)) {
+    nc.OnEvent("draft_updated", func(event map[string]interface{}) {
+        var updated struct {
+            Draft *shared.Draft `json:"draft"`
+        }
+        
+        if err := decodeResponse(event, &updated); err != nil || updated.Draft == nil {
+            return
+        }
+        
+        text, err := nc.decryptDraft(updated.Draft.Content)
+        if err != nil {
+            return
+        }
+        updated.Draft.Content = text
+        
+        handler(updated.Draft)
+    })
+}
+
+func (nc *NetworkClient) encryptDraft(text string) (string, error) {
+    if len(nc.Session.DraftKey) == 0 {
+        return "", fmt.Errorf("encryption keys are not loaded")
+    }
+    
+    ciphertext, err := nc.encryption.EncryptFileWithKey([]byte(text), nc.Session.DraftKey)
+    if err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (nc *NetworkClient) decryptDraft(content string) (string, error) {
+    if content == "" {
+        return "", nil
+    }
+    if len(nc.Session.DraftKey) == 0 {
+        return "", fmt.Errorf("no draft key")
+    }
+    
+    ciphertext, err := base64.StdEncoding.DecodeString(content)
+    if err != nil {
+        return "", err
+    }
+    
+    plaintext, err := nc.encryption.DecryptFile(ciphertext, nc.Session.DraftKey)
+    if err != nil {
+        return "", err
+    }
+    return string(plaintext), nil
+}
+
+// DraftSaver saves drafts once typing pauses, so the server is not sent a
+// request for every keystroke.
+type DraftSaver struct {
+    client *NetworkClient
+    mu     sync.Mutex
+    timers map[string]*time.Timer
+}
+
+func NewDraftSaver(client *NetworkClient) *DraftSaver {
+    return &DraftSaver{
+        client: client,
+        timers: make(map[string]*time.Timer),
+    }
+}
+
+// Update schedules the text to be saved as the conversation's draft,
+// replacing any save still waiting for it.
+func (ds *DraftSaver) Update(channelID, otherUserID, text string) {
+    key := channelID + "/" + otherUserID
+    
+    ds.mu.Lock()
+    defer ds.mu.Unlock()
+    
+    if timer, ok := ds.timers[key]; ok {
+        timer.Stop()
+    }
+    
+    var timer *time.Timer
+    timer = time.AfterFunc(draftSaveDelay, func() {
+        ds.mu.Lock()
+        if ds.timers[key] == timer {
+            delete(ds.timers, key)
+        }
+        ds.mu.Unlock()
+        
+        if err := ds.client.SaveDraft(channelID, otherUserID, text); err != nil {
+            log.Printf("Failed to save draft: %v", err)
+        }
+    })
+    ds.timers[key] = timer
+}
+
+// Clear drops any waiting save and clears the conversation's draft, as when
+// its message has been sent.
+func (ds *DraftSaver) Clear(channelID, otherUserID string) {
+    key := channelID + "/" + otherUserID
+    
+    ds.mu.Lock()
+    if timer, ok := ds.timers[key]; ok {
+        timer.Stop()
+        delete(ds.timers, key)
+    }
+    ds.mu.Unlock()
+    
+    if err := ds.client.SaveDraft(channelID, otherUserID, ""); err != nil {
+        log.Printf("Failed to clear draft: %v", err)
+    }
+}
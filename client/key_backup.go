@@ -0,0 +1,123 @@
+package client
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "secure-messenger/crypto"
+)
+
+// CreateKeyBackup encrypts the user's identity keys under a newly generated
+// recovery phrase. The backup can be saved to a file or stored on the server
+// with UploadKeyBackup; either way it is useless without the phrase, which
+// only the user keeps.
+func (nc *NetworkClient) CreateKeyBackup() (string, []byte, error) {
+    if nc.Session == nil || nc.Session.User == nil {
+        return "", nil, fmt.Errorf("not authenticated")
+    }
+    
+    phrase, err := crypto.GenerateRecoveryPhrase()
+    if err != nil {
+        return "", nil, fmt.Errorf("failed to generate recovery phrase: %v", err)
+    }
+    backup, err := nc.keys.ExportBackup(nc.Session.User.ID, phrase)
+    if err != nil {
+        return "", nil, fmt.Errorf("failed to encrypt key backup: %v", err)
+    }
+    return phrase, backup, nil
+}
+
+// RestoreKeys replaces the user's keys on this device with those of a backup
+// made by CreateKeyBackup, protecting them with passphrase, and unlocks them
+// as EnsureKeys does. The restored keys are published if the server has
+// others, as the user chose them. Messages encrypted to the restored key can
+// be read again, but those of forward secret sessions cannot, as their keys
+// stayed on the lost device.
+func (nc *NetworkClient) RestoreKeys(backup []byte, phrase, passphrase string) error {
+    if nc.Session == nil || nc.Session.User == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    if len(passphrase) < crypto.MinPassphraseLength {
+        return fmt.Errorf("passphrase must be at least %d characters", crypto.MinPassphraseLength)
+    }
+    
+    restored := crypto.NewKeyManager()
+    if err := restored.ImportBackup(backup, nc.Session.User.ID, phrase); err != nil {
+        return err
+    }
+    
+    keyPath := nc.keyPath()
+    previous, err := os.ReadFile(filepath.Join(keyPath, "public.pem"))
+    if err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    publicKey, err := restored.PublicKeyPEM()
+    if err != nil {
+        return err
+    }
+    
+    if err := restored.SaveKeys(keyPath, passphrase); err != nil {
+        return fmt.Errorf("failed to save keys: %v", err)
+    }
+    
+    // Prekeys on this device were signed by the key just replaced
+    if previous != nil && string(previous) != publicKey {
+        if err := ResetSessions(keyPath); err != nil {
+            return fmt.Errorf("failed to reset sessions: %v", err)
+        }
+    }
+    
+    return nc.ReplacePublishedKeys(passphrase)
+}
+
+// UploadKeyBackup stores a key backup on the server, replacing any earlier
+// one.
+func (nc *NetworkClient) UploadKeyBackup(backup []byte) error {
+    return nc.keyBackupRequest(map[string]interface{}{
+        "action": "upload_key_backup",
+        "backup": backup,
+    }, nil)
+}
+
+// FetchKeyBackup returns the key backup stored on the server.
+func (nc *NetworkClient) FetchKeyBackup() ([]byte, error) {
+    var response struct {
+        Backup []byte `json:"backup"`
+    }
+    if err := nc.keyBackupRequest(map[string]interface{}{"action": "get_key_backup"}, &response); err != nil {
+        return nil, err
+    }
+    return response.Backup, nil
+}
+
+func (nc *NetworkClient) DeleteKeyBackup() error {
+    return nc.keyBackupRequest(map[string]interface{}{"action": "delete_key_backup"}, nil)
+}
+
+func (nc *NetworkClient) keyBackupRequest(request map[string]interface{}, result interface{}) error {
+    if nc.Session == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    request["token"] = nc.Session.Token
+    msg, err := nc.request(request)
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    
+    if result == nil {
+        return nil
+    }
+    return decodeResponse(msg, result)
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "time"
+)
+
+// KeyPin is the key a contact was first seen with, trusted from then on.
+type KeyPin struct {
+    Fingerprint string    `json:"fingerprint"`
+    PinnedAt    time.Time `json:"pinned_at"`
+}
+
+// KeyPinStore remembers, for each user of this machine, the key pinned for
+// each of their contacts, so a different key served later is noticed rather
+// than trusted.
+type KeyPinStore struct {
+    pinPath string
+}
+
+func NewKeyPinStore() *KeyPinStore {
+    // Use project-relative path
+    pinPath := "key_pins.json"
+    return &KeyPinStore{pinPath: pinPath}
+}
+
+func (ps *KeyPinStore) load() (map[string]map[string]*KeyPin, error) {
+    data, err := os.ReadFile(ps.pinPath)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return map[string]map[string]*KeyPin{}, nil
+        }
+        return nil, err
+    }
+    
+    pins := make(map[string]map[string]*KeyPin)
+    if err := json.Unmarshal(data, &pins); err != nil {
+        return nil, err
+    }
+    
+    return pins, nil
+}
+
+// GetPin returns the key pinned for the user's contact, or nil if none is.
+func (ps *KeyPinStore) GetPin(userID, contactID string) (*KeyPin, error) {
+    pins, err := ps.load()
+    if err != nil {
+        return nil, err
+    }
+    return pins[userID][contactID], nil
+}
+
+// Pin trusts the fingerprint as the contact's key, replacing any earlier pin.
+func (ps *KeyPinStore) Pin(userID, contactID, fingerprint string) error {
+    pins, err := ps.load()
+    if err != nil {
+        return err
+    }
+    
+    if pins[userID] == nil {
+        pins[userID] = make(map[string]*KeyPin)
+    }
+    pins[userID][contactID] = &KeyPin{
+        Fingerprint: fingerprint,
+        PinnedAt:    time.Now(),
+    }
+    
+    data, err := json.Marshal(pins)
+    if err != nil {
+        return err
+    }
+    
+    return os.WriteFile(ps.pinPath, data, 0600)
+}
+
+// KeyChangedError is returned instead of a contact's key when the server
+// serves a different key than the one pinned. Nothing is encrypted to the
+// new key until the user accepts it with AcceptKeyChange.
+type KeyChangedError struct {
+    UserID         string
+    OldFingerprint string
+    NewFingerprint string
+    WasVerified    bool
+}
+
+func (e *KeyChangedError) Error() string {
+    return fmt.Sprintf("the encryption key of user %s has changed", e.UserID)
+}
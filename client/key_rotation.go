@@ -0,0 +1,78 @@
+package client
+
+import (
+    "fmt"
+    "secure-messenger/crypto"
+)
+
+// Keys lists the user's keypairs on this device, the current one first.
+func (nc *NetworkClient) Keys() []crypto.KeyInfo {
+    return nc.keys.Keys()
+}
+
+// RotateKeys replaces the user's keypair with a new one, which the old key
+// signs so contacts move to it without a warning. Messages encrypted to the
+// old key stay readable on this device, whose keystore the passphrase must
+// open. Prekeys are signed again with the new key.
+func (nc *NetworkClient) RotateKeys(passphrase string) error {
+    if nc.Session == nil || nc.Session.User == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    if !nc.keys.HasKeys() {
+        return fmt.Errorf("encryption keys are not loaded")
+    }
+    
+    // Saved before it is published, so no message is ever encrypted to a key
+    // this device could lose
+    rotationSignature, err := nc.keys.RotateKeys(nc.keyPath(), passphrase)
+    if err != nil {
+        return fmt.Errorf("failed to rotate keys: %v", err)
+    }
+    
+    publicKey, err := nc.keys.PublicKeyPEM()
+    if err != nil {
+        return err
+    }
+    signature, err := nc.keys.SignSigningKey()
+    if err != nil {
+        return fmt.Errorf("failed to sign signing key: %v", err)
+    }
+    
+    msg, err := nc.request(map[string]interface{}{
+        "action":                 "rotate_public_key",
+        "token":                  nc.Session.Token,
+        "public_key":             publicKey,
+        "signing_key":            []byte(nc.keys.SigningPublicKey()),
+        "signing_key_signature":  signature,
+        "key_rotation_signature": rotationSignature,
+    })
+    if err != nil {
+        return fmt.Errorf("new key saved but not published: %v", err)
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    
+    if !response.Success {
+        return fmt.Errorf("new key saved but not published: %s", response.Error)
+    }
+    
+    nc.keyMu.Lock()
+    delete(nc.publicKeys, nc.Session.User.ID)
+    delete(nc.signingKeys, nc.Session.User.ID)
+    nc.keyMu.Unlock()
+    
+    // Contacts check prekeys against the published key
+    nc.sessionMu.Lock()
+    prekeys, err := nc.ratchets.LoadPrekeys()
+    nc.sessionMu.Unlock()
+    if err != nil {
+        return fmt.Errorf("failed to load prekeys: %v", err)
+    }
+    return nc.publishPrekeys(prekeys)
+}
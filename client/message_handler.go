@@ -4,6 +4,7 @@ import (
     "encoding/json"
     "os"
     "secure-messenger/shared"
+    "time"
 )
 
 type MessageHandler struct {
@@ -83,6 +84,53 @@ func (mh *MessageHandler) GetChannelMessages(channelID string) ([]*shared.Messag
     return filtered, nil
 }
 
+// RemoveMessages deletes the given messages from the local store.
+func (mh *MessageHandler) RemoveMessages(messageIDs []string) error {
+    remove := make(map[string]bool, len(messageIDs))
+    for _, id := range messageIDs {
+        remove[id] = true
+    }
+    
+    return mh.filterMessages(func(msg *shared.Message) bool {
+        return !remove[msg.ID]
+    })
+}
+
+// PurgeExpired deletes disappearing messages that have expired from the
+// local store, without waiting for the server to report them deleted.
+func (mh *MessageHandler) PurgeExpired(now time.Time) error {
+    return mh.filterMessages(func(msg *shared.Message) bool {
+        return !msg.Expired(now)
+    })
+}
+
+// filterMessages rewrites the local store keeping only the messages for
+// which keep returns true.
+func (mh *MessageHandler) filterMessages(keep func(msg *shared.Message) bool) error {
+    messages, err := mh.LoadMessages()
+    if err != nil {
+        return err
+    }
+    
+    var kept []*shared.Message
+    for _, msg := range messages {
+        if keep(msg) {
+            kept = append(kept, msg)
+        }
+    }
+    
+    if len(kept) == len(messages) {
+        return nil
+    }
+    
+    data, err := json.Marshal(kept)
+    if err != nil {
+        return err
+    }
+    
+    return os.WriteFile(mh.messagePath, data, 0644)
+}
+
 func (mh *MessageHandler) ClearMessages() error {
     return os.Remove(mh.messagePath)
 }
@@ -1,32 +1,83 @@
 package client
 
 import (
+    "crypto/ed25519"
+    "crypto/rsa"
     "crypto/tls"
     "crypto/x509"
     "encoding/json"
     "fmt"
     "io/ioutil"
+    "log"
     "net"
+    "secure-messenger/crypto"
     "secure-messenger/shared"
+    "strconv"
+    "sync"
     "time"
 )
 
+const responseTimeout = 30 * time.Second
+
+// EventHandler receives events the server pushes without a matching request.
+type EventHandler func(event map[string]interface{})
+
 type NetworkClient struct {
-    conn     net.Conn
-    protocol *shared.Protocol
-    Session  *Session
-    config   *Config
+    conn      net.Conn
+    protocol  *shared.Protocol
+    Session   *Session
+    config    *Config
+    responses chan map[string]interface{}
+    requestMu sync.Mutex
+    requestID int64 // of the last request sent, guarded by requestMu
+    handlerMu sync.RWMutex
+    handlers  map[string][]EventHandler
+    syncState *SyncState
+    syncMu    sync.Mutex
+    
+    updateHandlers []func(update *shared.Update)
+    resyncHandlers []func()
+    
+    ackMu      sync.Mutex
+    ackQueue   []string
+    ackRunning bool
+    
+    encryption     *crypto.EncryptionManager
+    keys           *crypto.KeyManager
+    keyMu          sync.Mutex
+    publicKeys     map[string]*rsa.PublicKey    // by user ID
+    signingKeys    map[string]ed25519.PublicKey // by user ID, nil for users who published none
+    verification   *VerificationStore
+    pins           *KeyPinStore
+    ratchets       *RatchetStore // set once the user's keys are loaded
+    sessionMu      sync.Mutex
+    uploadMu       sync.Mutex
+    pendingUploads map[string]*pendingUpload
 }
 
 type Session struct {
     Token    string
     User     *shared.User
     LastSeen time.Time
+    DraftKey []byte `json:"-"` // set when the keys are unlocked, see EnsureKeys
 }
 
 func NewNetworkClient() *NetworkClient {
     config, _ := LoadConfig()
-    return &NetworkClient{config: config}
+    keys := crypto.NewKeyManager()
+    return &NetworkClient{
+        config:    config,
+        handlers:  make(map[string][]EventHandler),
+        syncState: NewSyncState(),
+        
+        encryption:     crypto.NewEncryptionManager(keys),
+        keys:           keys,
+        publicKeys:     make(map[string]*rsa.PublicKey),
+        signingKeys:    make(map[string]ed25519.PublicKey),
+        verification:   NewVerificationStore(),
+        pins:           NewKeyPinStore(),
+        pendingUploads: make(map[string]*pendingUpload),
+    }
 }
 
 func (nc *NetworkClient) Connect() error {
@@ -52,13 +103,13 @@ func (nc *NetworkClient) Connect() error {
             InsecureSkipVerify: true, // Skip certificate verification for self-signed certs (development only)
         }
         
-        conn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", nc.config.ServerAddress, nc.config.ServerPort), tlsConfig)
+        conn, err = tls.Dial("tcp", nc.serverAddress(), tlsConfig)
         if err != nil {
             return fmt.Errorf("failed to connect to server: %v", err)
         }
     } else {
         // Plain TCP connection
-        conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", nc.config.ServerAddress, nc.config.ServerPort))
+        conn, err = net.Dial("tcp", nc.serverAddress())
         if err != nil {
             return fmt.Errorf("failed to connect to server: %v", err)
         }
@@ -66,10 +117,132 @@ func (nc *NetworkClient) Connect() error {
     
     nc.conn = conn
     nc.protocol = shared.NewProtocol(conn)
+    nc.responses = make(chan map[string]interface{}, 1)
+    
+    go nc.readLoop(nc.protocol, nc.responses)
+    
+    // Catch up on whatever happened while this session was offline
+    if nc.Session != nil {
+        go nc.Sync()
+    }
     
     return nil
 }
 
+func (nc *NetworkClient) serverAddress() string {
+    return net.JoinHostPort(nc.config.ServerAddress, strconv.Itoa(nc.config.ServerPort))
+}
+
+// OnEvent registers a handler for a server-pushed event such as
+// "reaction_updated". Handlers run on the connection's reader goroutine, so
+// they must not wait on requests of their own.
+func (nc *NetworkClient) OnEvent(event string, handler EventHandler) {
+    nc.handlerMu.Lock()
+    defer nc.handlerMu.Unlock()
+    
+    nc.handlers[event] = append(nc.handlers[event], handler)
+}
+
+// readLoop separates pushed events from responses so that an event arriving
+// between a request and its response is never mistaken for the response.
+func (nc *NetworkClient) readLoop(protocol *shared.Protocol, responses chan map[string]interface{}) {
+    defer close(responses)
+    
+    for {
+        msg, err := protocol.ReadMessage()
+        if err != nil {
+            return
+        }
+        
+        if event, ok := msg["event"].(string); ok {
+            nc.dispatchEvent(event, msg)
+            if event == "key_changed" || event == "signing_key_changed" {
+                nc.forgetPublicKey(msg)
+            }
+            if event == "sender_key" {
+                nc.receiveSenderKeyEvent(msg)
+            }
+            continue
+        }
+        
+        responses <- msg
+    }
+}
+
+func (nc *NetworkClient) dispatchEvent(event string, msg map[string]interface{}) {
+    nc.handlerMu.RLock()
+    handlers := append([]EventHandler(nil), nc.handlers[event]...)
+    nc.handlerMu.RUnlock()
+    
+    for _, handler := range handlers {
+        handler(msg)
+    }
+}
+
+// request sends a request and waits for its response. Requests are
+// serialized, and each carries a request ID that the server echoes, so a
+// late response to a request that timed out is dropped instead of being
+// taken for the response to the next one.
+func (nc *NetworkClient) request(request map[string]interface{}) (map[string]interface{}, error) {
+    if nc.protocol == nil {
+        return nil, fmt.Errorf("not connected")
+    }
+    
+    nc.requestMu.Lock()
+    defer nc.requestMu.Unlock()
+    
+    nc.requestID++
+    requestID := strconv.FormatInt(nc.requestID, 10)
+    request["request_id"] = requestID
+    
+    if err := nc.protocol.SendMessage(request); err != nil {
+        return nil, err
+    }
+    
+    timeout := time.After(responseTimeout)
+    for {
+        select {
+        case msg, ok := <-nc.responses:
+            if !ok {
+                return nil, fmt.Errorf("connection closed")
+            }
+            if msg["request_id"] != requestID {
+                continue
+            }
+            return msg, nil
+        case <-timeout:
+            return nil, fmt.Errorf("timed out waiting for server response")
+        }
+    }
+}
+
+// sendRequest sends a message, reconnecting and retrying once if the
+// connection fails before the response arrives. The request carries a
+// client message ID, so the server drops the retry if the first attempt
+// did get through.
+func (nc *NetworkClient) sendRequest(request map[string]interface{}) (map[string]interface{}, error) {
+    msg, err := nc.request(request)
+    if err == nil {
+        return msg, nil
+    }
+    
+    nc.Disconnect()
+    if connErr := nc.Connect(); connErr != nil {
+        return nil, err
+    }
+    
+    return nc.request(request)
+}
+
+// decodeResponse converts a raw response into a typed struct.
+func decodeResponse(msg map[string]interface{}, v interface{}) error {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
 func (nc *NetworkClient) Disconnect() error {
     if nc.conn != nil {
         return nc.conn.Close()
@@ -90,11 +263,7 @@ func (nc *NetworkClient) Register(username, email, password string) (*shared.Aut
         "data":   string(data),
     }
     
-    if err := nc.protocol.SendMessage(request); err != nil {
-        return nil, err
-    }
-    
-    msg, err := nc.protocol.ReadMessage()
+    msg, err := nc.request(request)
     if err != nil {
         return nil, err
     }
@@ -116,6 +285,8 @@ func (nc *NetworkClient) Register(username, email, password string) (*shared.Aut
     return &response, nil
 }
 
+// Login authenticates the user. Their keys are unlocked separately with
+// EnsureKeys, as they are protected by a passphrase of their own.
 func (nc *NetworkClient) Login(username, password string) (*shared.AuthResponse, error) {
     req := &shared.LoginRequest{
         Username: username,
@@ -128,11 +299,7 @@ func (nc *NetworkClient) Login(username, password string) (*shared.AuthResponse,
         "data":   string(data),
     }
     
-    if err := nc.protocol.SendMessage(request); err != nil {
-        return nil, err
-    }
-    
-    msg, err := nc.protocol.ReadMessage()
+    msg, err := nc.request(request)
     if err != nil {
         return nil, err
     }
@@ -154,14 +321,31 @@ func (nc *NetworkClient) Login(username, password string) (*shared.AuthResponse,
     return &response, nil
 }
 
-func (nc *NetworkClient) SendMessage(to, content string) error {
+// SendMessage sends a direct message, end-to-end encrypted for the recipient
+// and a copy for the sender's own history.
+func (nc *NetworkClient) SendMessage(to, content string, attachments ...*shared.Attachment) error {
     if nc.Session == nil {
         return fmt.Errorf("not authenticated")
     }
     
+    sealed, sealedAttachments, err := nc.sealDirect(to, content, attachments)
+    if err != nil {
+        return err
+    }
+    
+    clientMessageID := shared.NewSortableID()
+    signature, err := nc.signMessage(to, clientMessageID, sealed, sealedAttachments)
+    if err != nil {
+        return fmt.Errorf("failed to sign message: %v", err)
+    }
+    
     req := &shared.MessageRequest{
-        To:      to,
-        Content: content,
+        To:              to,
+        Content:         sealed,
+        Encrypted:       true,
+        ClientMessageID: clientMessageID,
+        Attachments:     sealedAttachments,
+        Signature:       signature,
     }
     
     data, _ := json.Marshal(req)
@@ -171,53 +355,222 @@ func (nc *NetworkClient) SendMessage(to, content string) error {
         "data":   string(data),
     }
     
-    return nc.protocol.SendMessage(request)
+    msg, err := nc.sendRequest(request)
+    if err != nil {
+        return err
+    }
+    
+    if success, _ := msg["success"].(bool); !success {
+        errMsg, _ := msg["error"].(string)
+        return fmt.Errorf("%s", errMsg)
+    }
+    
+    return nil
 }
 
-func (nc *NetworkClient) SendChannelMessage(channelID, content string) error {
+// SendChannelMessage sends a message to a channel, encrypted once with the
+// user's sender key for it. When the channel's members changed since the key
+// was made, a new one is distributed and the message sent again.
+func (nc *NetworkClient) SendChannelMessage(channelID, content string, attachments ...*shared.Attachment) (*shared.SendMessageResponse, error) {
     if nc.Session == nil {
-        return fmt.Errorf("not authenticated")
+        return nil, fmt.Errorf("not authenticated")
     }
     
-    req := &shared.ChannelMessageRequest{
-        ChannelID: channelID,
-        Content:   content,
+    clientMessageID := shared.NewSortableID()
+    for attempt := 0; ; attempt++ {
+        sealed, sealedAttachments, keyEpoch, err := nc.sealChannel(channelID, content, attachments)
+        if err != nil {
+            return nil, err
+        }
+        signature, err := nc.signMessage(channelID, clientMessageID, sealed, sealedAttachments)
+        if err != nil {
+            return nil, fmt.Errorf("failed to sign message: %v", err)
+        }
+        
+        // The server cannot parse mentions out of encrypted content
+        req := &shared.ChannelMessageRequest{
+            ChannelID:       channelID,
+            Content:         sealed,
+            Encrypted:       true,
+            Mentions:        shared.ParseMentions(content),
+            ClientMessageID: clientMessageID,
+            Attachments:     sealedAttachments,
+            KeyEpoch:        keyEpoch,
+            Signature:       signature,
+        }
+        
+        data, _ := json.Marshal(req)
+        request := map[string]interface{}{
+            "action": "send_channel_message",
+            "token":  nc.Session.Token,
+            "data":   string(data),
+        }
+        
+        msg, err := nc.sendRequest(request)
+        if err != nil {
+            return nil, err
+        }
+        
+        var response shared.SendMessageResponse
+        if err := decodeResponse(msg, &response); err != nil {
+            return nil, err
+        }
+        
+        if response.Success || response.Error != senderKeyOutdatedError || attempt > 0 {
+            return &response, nil
+        }
+        if err := nc.dropSenderKey(channelID); err != nil {
+            return nil, fmt.Errorf("failed to drop sender key: %v", err)
+        }
+    }
+}
+
+// GetMessages loads a page of the direct conversation with otherUserID,
+// newest first. Pass the oldest loaded message ID as page.Before to go back
+// in history.
+func (nc *NetworkClient) GetMessages(otherUserID string, page shared.Page) (*shared.MessagePage, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    request := map[string]interface{}{
+        "action":        "get_messages",
+        "token":         nc.Session.Token,
+        "other_user_id": otherUserID,
+    }
+    
+    return nc.requestPage(request, page)
+}
+
+// GetChannelMessages loads a page of a channel's history, newest first.
+func (nc *NetworkClient) GetChannelMessages(channelID string, page shared.Page) (*shared.MessagePage, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    // Picks up sender keys missed while the connection was down
+    if err := nc.fetchSenderKeys(channelID); err != nil {
+        log.Printf("Failed to fetch sender keys for %s: %v", channelID, err)
     }
     
-    data, _ := json.Marshal(req)
     request := map[string]interface{}{
-        "action": "send_channel_message",
+        "action":     "get_channel_messages",
+        "token":      nc.Session.Token,
+        "channel_id": channelID,
+    }
+    
+    return nc.requestPage(request, page)
+}
+
+// GetRecentMessages loads a page of messages across all of the user's
+// conversations, newest first.
+func (nc *NetworkClient) GetRecentMessages(page shared.Page) (*shared.MessagePage, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    request := map[string]interface{}{
+        "action": "get_recent_messages",
         "token":  nc.Session.Token,
-        "data":   string(data),
     }
     
-    return nc.protocol.SendMessage(request)
+    return nc.requestPage(request, page)
+}
+
+func (nc *NetworkClient) requestPage(request map[string]interface{}, page shared.Page) (*shared.MessagePage, error) {
+    if page.Limit > 0 {
+        request["limit"] = page.Limit
+    }
+    if page.Before != "" {
+        request["before"] = page.Before
+    }
+    if page.After != "" {
+        request["after"] = page.After
+    }
+    
+    data, err := nc.request(request)
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        shared.MessagePage
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    
+    if err := decodeResponse(data, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    nc.fetchSigningKeys(response.Messages...)
+    nc.decryptMessages(response.Messages...)
+    return &response.MessagePage, nil
 }
 
-func (nc *NetworkClient) GetMessages(otherUserID string, limit int) ([]*shared.Message, error) {
+func (nc *NetworkClient) CreateChannel(name, description string, members []string) (*shared.Channel, error) {
     if nc.Session == nil {
         return nil, fmt.Errorf("not authenticated")
     }
     
+    req := &shared.ChannelRequest{
+        Name:        name,
+        Description: description,
+        Members:     members,
+    }
+    
+    data, _ := json.Marshal(req)
     request := map[string]interface{}{
-        "action":        "get_messages",
-        "token":         nc.Session.Token,
-        "other_user_id": otherUserID,
-        "limit":         limit,
+        "action": "create_channel",
+        "token":  nc.Session.Token,
+        "data":   string(data),
     }
     
-    if err := nc.protocol.SendMessage(request); err != nil {
+    msg, err := nc.request(request)
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        Success bool             `json:"success"`
+        Channel *shared.Channel `json:"channel"`
+        Error   string           `json:"error"`
+    }
+    
+    responseData, _ := json.Marshal(msg)
+    if err := json.Unmarshal(responseData, &response); err != nil {
         return nil, err
     }
     
-    data, err := nc.protocol.ReadMessage()
+    if !response.Success {
+        return nil, fmt.Errorf(response.Error)
+    }
+    
+    return response.Channel, nil
+}
+
+func (nc *NetworkClient) GetUserChannels() ([]*shared.Channel, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    request := map[string]interface{}{
+        "action": "get_user_channels",
+        "token":  nc.Session.Token,
+    }
+    
+    data, err := nc.request(request)
     if err != nil {
         return nil, err
     }
     
     var response struct {
         Success  bool              `json:"success"`
-        Messages []*shared.Message `json:"messages"`
+        Channels []*shared.Channel `json:"channels"`
         Error    string            `json:"error"`
     }
     
@@ -230,26 +583,105 @@ func (nc *NetworkClient) GetMessages(otherUserID string, limit int) ([]*shared.M
         return nil, fmt.Errorf(response.Error)
     }
     
-    return response.Messages, nil
+    return response.Channels, nil
 }
 
-func (nc *NetworkClient) GetChannelMessages(channelID string, limit int) ([]*shared.Message, error) {
+func (nc *NetworkClient) AddUserToChannel(channelID, userID string) error {
     if nc.Session == nil {
-        return nil, fmt.Errorf("not authenticated")
+        return fmt.Errorf("not authenticated")
     }
     
     request := map[string]interface{}{
-        "action":     "get_channel_messages",
+        "action":     "add_user_to_channel",
         "token":      nc.Session.Token,
         "channel_id": channelID,
-        "limit":      limit,
+        "user_id":    userID,
     }
     
-    if err := nc.protocol.SendMessage(request); err != nil {
+    msg, err := nc.request(request)
+    if err != nil {
+        return err
+    }
+    
+    if success, _ := msg["success"].(bool); !success {
+        errMsg, _ := msg["error"].(string)
+        return fmt.Errorf("%s", errMsg)
+    }
+    
+    return nil
+}
+
+// GetMentions loads a page of the channel messages that mention the user,
+// newest first.
+func (nc *NetworkClient) GetMentions(page shared.Page) (*shared.MessagePage, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    request := map[string]interface{}{
+        "action": "get_mentions",
+        "token":  nc.Session.Token,
+    }
+    
+    return nc.requestPage(request, page)
+}
+
+func (nc *NetworkClient) PinMessage(messageID string) (*shared.Message, error) {
+    return nc.updatePin("pin_message", messageID)
+}
+
+func (nc *NetworkClient) UnpinMessage(messageID string) (*shared.Message, error) {
+    return nc.updatePin("unpin_message", messageID)
+}
+
+// updatePin pins or unpins a message and returns the system entry the server
+// added to the conversation history.
+func (nc *NetworkClient) updatePin(action, messageID string) (*shared.Message, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    req := &shared.PinRequest{MessageID: messageID}
+    
+    data, _ := json.Marshal(req)
+    request := map[string]interface{}{
+        "action": action,
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    }
+    
+    msg, err := nc.request(request)
+    if err != nil {
         return nil, err
     }
     
-    data, err := nc.protocol.ReadMessage()
+    var response shared.SendMessageResponse
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    return response.Message, nil
+}
+
+// GetPinned lists the pinned messages of a channel, or of the direct
+// conversation with otherUserID when channelID is empty.
+func (nc *NetworkClient) GetPinned(channelID, otherUserID string) ([]*shared.Message, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    request := map[string]interface{}{
+        "action":        "get_pinned",
+        "token":         nc.Session.Token,
+        "channel_id":    channelID,
+        "other_user_id": otherUserID,
+    }
+    
+    data, err := nc.request(request)
     if err != nil {
         return nil, err
     }
@@ -260,98 +692,470 @@ func (nc *NetworkClient) GetChannelMessages(channelID string, limit int) ([]*sha
         Error    string            `json:"error"`
     }
     
-    responseData, _ := json.Marshal(data)
-    if err := json.Unmarshal(responseData, &response); err != nil {
+    if err := decodeResponse(data, &response); err != nil {
         return nil, err
     }
     
     if !response.Success {
-        return nil, fmt.Errorf(response.Error)
+        return nil, fmt.Errorf("%s", response.Error)
     }
     
+    nc.fetchSigningKeys(response.Messages...)
+    nc.decryptMessages(response.Messages...)
     return response.Messages, nil
 }
 
-func (nc *NetworkClient) CreateChannel(name, description string, members []string) (*shared.Channel, error) {
+// AddReaction reacts to a message and returns the message's updated reactions.
+func (nc *NetworkClient) AddReaction(messageID, emoji string) ([]*shared.Reaction, error) {
+    return nc.updateReaction("add_reaction", messageID, emoji)
+}
+
+// RemoveReaction withdraws a reaction and returns the message's updated reactions.
+func (nc *NetworkClient) RemoveReaction(messageID, emoji string) ([]*shared.Reaction, error) {
+    return nc.updateReaction("remove_reaction", messageID, emoji)
+}
+
+func (nc *NetworkClient) updateReaction(action, messageID, emoji string) ([]*shared.Reaction, error) {
     if nc.Session == nil {
         return nil, fmt.Errorf("not authenticated")
     }
     
-    req := &shared.ChannelRequest{
-        Name:        name,
-        Description: description,
-        Members:     members,
+    req := &shared.ReactionRequest{
+        MessageID: messageID,
+        Emoji:     emoji,
     }
     
     data, _ := json.Marshal(req)
     request := map[string]interface{}{
-        "action": "create_channel",
+        "action": action,
         "token":  nc.Session.Token,
         "data":   string(data),
     }
     
-    if err := nc.protocol.SendMessage(request); err != nil {
-        return nil, err
-    }
-    
-    msg, err := nc.protocol.ReadMessage()
+    msg, err := nc.request(request)
     if err != nil {
         return nil, err
     }
     
     var response struct {
-        Success bool             `json:"success"`
-        Channel *shared.Channel `json:"channel"`
-        Error   string           `json:"error"`
+        Success   bool               `json:"success"`
+        Reactions []*shared.Reaction `json:"reactions"`
+        Error     string             `json:"error"`
     }
     
-    responseData, _ := json.Marshal(msg)
-    if err := json.Unmarshal(responseData, &response); err != nil {
+    if err := decodeResponse(msg, &response); err != nil {
         return nil, err
     }
     
     if !response.Success {
-        return nil, fmt.Errorf(response.Error)
+        return nil, fmt.Errorf("%s", response.Error)
     }
     
-    return response.Channel, nil
+    return response.Reactions, nil
 }
 
-func (nc *NetworkClient) GetUserChannels() ([]*shared.Channel, error) {
+// OnMessage registers a handler for messages delivered by the server, both
+// live and from the queue kept while the user was offline. A message is
+// acknowledged once the handler returns, so it may be delivered again if the
+// client stops before then or the acknowledgement does not reach the server.
+func (nc *NetworkClient) OnMessage(handler func(message *shared.Message)) {
+    nc.OnEvent("message", func(event map[string]interface{}) {
+        var delivery struct {
+            Message *shared.Message `json:"message"`
+        }
+        
+        if err := decodeResponse(event, &delivery); err != nil || delivery.Message == nil {
+            return
+        }
+        
+        // The reader goroutine cannot wait for the signing key of a sender
+        // not seen before, so that message is handled once it arrives
+        message := delivery.Message
+        if _, ok := nc.signingKeyFor(message.From); !ok && message.Type != shared.MessageTypeSystem {
+            go func() {
+                nc.fetchSigningKeys(message)
+                nc.decryptMessages(message)
+                handler(message)
+                nc.queueAck(message.ID)
+            }()
+            return
+        }
+        
+        nc.decryptMessages(message)
+        handler(message)
+        nc.queueAck(message.ID)
+    })
+}
+
+// AckMessages tells the server the messages were received so it stops
+// delivering them.
+func (nc *NetworkClient) AckMessages(messageIDs []string) error {
+    if nc.Session == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    msg, err := nc.request(map[string]interface{}{
+        "action":      "ack_messages",
+        "token":       nc.Session.Token,
+        "message_ids": messageIDs,
+    })
+    if err != nil {
+        return err
+    }
+    
+    if success, _ := msg["success"].(bool); !success {
+        errMsg, _ := msg["error"].(string)
+        return fmt.Errorf("%s", errMsg)
+    }
+    
+    return nil
+}
+
+// queueAck acknowledges a delivered message, called by OnMessage once its
+// handler has run. Handlers may run on the reader goroutine, which cannot
+// wait for a response itself, so acknowledgements are collected and sent in
+// batches from a separate goroutine.
+func (nc *NetworkClient) queueAck(messageID string) {
+    if messageID == "" {
+        return
+    }
+    
+    nc.ackMu.Lock()
+    nc.ackQueue = append(nc.ackQueue, messageID)
+    start := !nc.ackRunning
+    nc.ackRunning = true
+    nc.ackMu.Unlock()
+    
+    if start {
+        go nc.flushAcks()
+    }
+}
+
+func (nc *NetworkClient) flushAcks() {
+    for {
+        nc.ackMu.Lock()
+        messageIDs := nc.ackQueue
+        nc.ackQueue = nil
+        if len(messageIDs) == 0 {
+            nc.ackRunning = false
+            nc.ackMu.Unlock()
+            return
+        }
+        nc.ackMu.Unlock()
+        
+        // Unacknowledged messages are delivered again on the next connection
+        nc.AckMessages(messageIDs)
+    }
+}
+
+// OnReactionUpdated registers a handler for live reaction changes on any
+// message in the user's conversations.
+func (nc *NetworkClient) OnReactionUpdated(handler func(messageID string, reactions []*shared.Reaction)) {
+    nc.OnEvent("reaction_updated", func(event map[string]interface{}) {
+        var update struct {
+            MessageID string             `json:"message_id"`
+            Reactions []*shared.Reaction `json:"reactions"`
+        }
+        
+        if err := decodeResponse(event, &update); err != nil {
+            return
+        }
+        
+        handler(update.MessageID, update.Reactions)
+    })
+}
+
+// OnMention registers a handler for channel messages that mention the user.
+func (nc *NetworkClient) OnMention(handler func(message *shared.Message)) {
+    nc.OnEvent("mention", func(event map[string]interface{}) {
+        var mention struct {
+            Message *shared.Message `json:"message"`
+        }
+        
+        if err := decodeResponse(event, &mention); err != nil || mention.Message == nil {
+            return
+        }
+        
+        handler(mention.Message)
+    })
+}
+
+// OnPinUpdated registers a handler for messages being pinned or unpinned,
+// along with the system entry recorded in the history.
+func (nc *NetworkClient) OnPinUpdated(handler func(messageID string, pinned bool, systemMessage *shared.Message)) {
+    nc.OnEvent("pin_updated", func(event map[string]interface{}) {
+        var update struct {
+            MessageID string          `json:"message_id"`
+            Pinned    bool            `json:"pinned"`
+            Message   *shared.Message `json:"message"`
+        }
+        
+        if err := decodeResponse(event, &update); err != nil {
+            return
+        }
+        if update.Message != nil {
+            nc.verifyMessage(update.Message)
+        }
+        
+        handler(update.MessageID, update.Pinned, update.Message)
+    })
+}
+
+// OnMessagesDeleted registers a handler for messages the server deleted,
+// such as disappearing messages that expired.
+func (nc *NetworkClient) OnMessagesDeleted(handler func(messageIDs []string)) {
+    nc.OnEvent("messages_deleted", func(event map[string]interface{}) {
+        var deleted struct {
+            MessageIDs []string `json:"message_ids"`
+        }
+        
+        if err := decodeResponse(event, &deleted); err != nil {
+            return
+        }
+        
+        handler(deleted.MessageIDs)
+    })
+}
+
+// SetDisappearingTimer sets how long new messages of a channel, or of the
+// direct conversation with otherUserID when channelID is empty, are kept.
+// A timer of zero turns disappearing messages off. It returns the system
+// entry recording the change.
+func (nc *NetworkClient) SetDisappearingTimer(channelID, otherUserID string, timer time.Duration) (*shared.Message, error) {
     if nc.Session == nil {
         return nil, fmt.Errorf("not authenticated")
     }
     
+    req := &shared.DisappearingTimerRequest{
+        ChannelID:   channelID,
+        OtherUserID: otherUserID,
+        Seconds:     int64(timer / time.Second),
+    }
+    
+    data, _ := json.Marshal(req)
     request := map[string]interface{}{
-        "action": "get_user_channels",
+        "action": "set_disappearing_timer",
         "token":  nc.Session.Token,
+        "data":   string(data),
     }
     
-    if err := nc.protocol.SendMessage(request); err != nil {
+    msg, err := nc.request(request)
+    if err != nil {
         return nil, err
     }
     
-    data, err := nc.protocol.ReadMessage()
+    var response shared.SendMessageResponse
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    return response.Message, nil
+}
+
+// SetChannelRole makes a channel member an admin, or a plain member again.
+// Only the channel owner can. It returns the system entry recording the
+// change.
+func (nc *NetworkClient) SetChannelRole(channelID, userID, role string) (*shared.Message, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    req := &shared.ChannelRoleRequest{
+        ChannelID: channelID,
+        UserID:    userID,
+        Role:      role,
+    }
+    
+    data, _ := json.Marshal(req)
+    request := map[string]interface{}{
+        "action": "set_channel_role",
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    }
+    
+    msg, err := nc.request(request)
     if err != nil {
         return nil, err
     }
     
+    var response shared.SendMessageResponse
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    return response.Message, nil
+}
+
+// GetDisappearingTimer returns the timer of a channel, or of the direct
+// conversation with otherUserID when channelID is empty.
+func (nc *NetworkClient) GetDisappearingTimer(channelID, otherUserID string) (time.Duration, error) {
+    if nc.Session == nil {
+        return 0, fmt.Errorf("not authenticated")
+    }
+    
+    request := map[string]interface{}{
+        "action":        "get_disappearing_timer",
+        "token":         nc.Session.Token,
+        "channel_id":    channelID,
+        "other_user_id": otherUserID,
+    }
+    
+    data, err := nc.request(request)
+    if err != nil {
+        return 0, err
+    }
+    
     var response struct {
-        Success  bool              `json:"success"`
-        Channels []*shared.Channel `json:"channels"`
-        Error    string            `json:"error"`
+        Success bool   `json:"success"`
+        Seconds int64  `json:"seconds"`
+        Error   string `json:"error"`
     }
     
-    responseData, _ := json.Marshal(data)
-    if err := json.Unmarshal(responseData, &response); err != nil {
-        return nil, err
+    if err := decodeResponse(data, &response); err != nil {
+        return 0, err
     }
     
     if !response.Success {
-        return nil, fmt.Errorf(response.Error)
+        return 0, fmt.Errorf("%s", response.Error)
     }
     
-    return response.Channels, nil
+    return time.Duration(response.Seconds) * time.Second, nil
+}
+
+// OnUpdate registers a handler for updates fetched by Sync. Updates are
+// delivered in sequence order and may repeat changes already seen live.
+func (nc *NetworkClient) OnUpdate(handler func(update *shared.Update)) {
+    nc.handlerMu.Lock()
+    defer nc.handlerMu.Unlock()
+    
+    nc.updateHandlers = append(nc.updateHandlers, handler)
+}
+
+// OnResync registers a handler for when the missed updates are no longer
+// available and everything shown should be reloaded from scratch.
+func (nc *NetworkClient) OnResync(handler func()) {
+    nc.handlerMu.Lock()
+    defer nc.handlerMu.Unlock()
+    
+    nc.resyncHandlers = append(nc.resyncHandlers, handler)
+}
+
+// Sync fetches every update since the last sequence applied by this client
+// and hands them to the update handlers, persisting progress after each page.
+// If the server's log no longer covers that range, or a gap is found, the
+// resync handlers are called and syncing restarts from the latest sequence.
+func (nc *NetworkClient) Sync() error {
+    if nc.Session == nil || nc.Session.User == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    nc.syncMu.Lock()
+    defer nc.syncMu.Unlock()
+    
+    userID := nc.Session.User.ID
+    since := nc.syncState.LastSequence(userID)
+    
+    for {
+        msg, err := nc.request(map[string]interface{}{
+            "action": "sync",
+            "token":  nc.Session.Token,
+            "since":  since,
+        })
+        if err != nil {
+            return err
+        }
+        
+        var response struct {
+            Success bool   `json:"success"`
+            Error   string `json:"error"`
+            shared.SyncResult
+        }
+        if err := decodeResponse(msg, &response); err != nil {
+            return err
+        }
+        
+        if !response.Success {
+            return fmt.Errorf("%s", response.Error)
+        }
+        
+        if response.ResyncRequired {
+            return nc.resync(userID, response.LatestSequence)
+        }
+        
+        for _, update := range response.Updates {
+            if update.Sequence != since+1 {
+                return nc.resync(userID, response.LatestSequence)
+            }
+            nc.dispatchUpdate(update)
+            since = update.Sequence
+        }
+        
+        if err := nc.syncState.SetLastSequence(userID, since); err != nil {
+            return fmt.Errorf("failed to save sync state: %v", err)
+        }
+        
+        if !response.HasMore {
+            return nil
+        }
+    }
+}
+
+func (nc *NetworkClient) resync(userID string, latest int64) error {
+    if err := nc.syncState.SetLastSequence(userID, latest); err != nil {
+        return fmt.Errorf("failed to save sync state: %v", err)
+    }
+    
+    nc.handlerMu.RLock()
+    handlers := append([]func(){}, nc.resyncHandlers...)
+    nc.handlerMu.RUnlock()
+    
+    for _, handler := range handlers {
+        handler()
+    }
+    return nil
+}
+
+func (nc *NetworkClient) dispatchUpdate(update *shared.Update) {
+    if update.Type == shared.UpdateMessageNew {
+        update = nc.decryptUpdate(update)
+    }
+    
+    nc.handlerMu.RLock()
+    handlers := append([]func(update *shared.Update){}, nc.updateHandlers...)
+    nc.handlerMu.RUnlock()
+    
+    for _, handler := range handlers {
+        handler(update)
+    }
+}
+
+// decryptUpdate returns a new message update with its message decrypted.
+func (nc *NetworkClient) decryptUpdate(update *shared.Update) *shared.Update {
+    var payload map[string]json.RawMessage
+    if err := json.Unmarshal(update.Payload, &payload); err != nil {
+        return update
+    }
+    
+    var message shared.Message
+    if err := json.Unmarshal(payload["message"], &message); err != nil {
+        return update
+    }
+    
+    nc.fetchSigningKeys(&message)
+    nc.decryptMessages(&message)
+    payload["message"], _ = json.Marshal(&message)
+    
+    decrypted := *update
+    decrypted.Payload, _ = json.Marshal(payload)
+    return &decrypted
 }
 
 func (nc *NetworkClient) IsAuthenticated() bool {
@@ -0,0 +1,83 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "secure-messenger/shared"
+)
+
+// ChangePassword sets a new password for the user, who must give the current
+// one. The server logs the user out on every other device. Drafts stay
+// readable, since their key comes from the keystore rather than the
+// password.
+func (nc *NetworkClient) ChangePassword(currentPassword, newPassword string) error {
+    if nc.Session == nil || nc.Session.User == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    data, _ := json.Marshal(&shared.ChangePasswordRequest{
+        CurrentPassword: currentPassword,
+        NewPassword:     newPassword,
+    })
+    if err := nc.passwordRequest(map[string]interface{}{
+        "action": "change_password",
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    }); err != nil {
+        return err
+    }
+    
+    return nil
+}
+
+// RequestPasswordReset asks the server to mail a reset token to the account
+// with the email. It succeeds whether or not there is such an account.
+func (nc *NetworkClient) RequestPasswordReset(email string) error {
+    data, _ := json.Marshal(&shared.PasswordResetRequest{Email: email})
+    return nc.passwordRequest(map[string]interface{}{
+        "action": "request_password_reset",
+        "data":   string(data),
+    })
+}
+
+// ResetPassword sets a new password with a token mailed by
+// RequestPasswordReset. Every session of the user ends, so they log in
+// again with the new password.
+func (nc *NetworkClient) ResetPassword(token, newPassword string) error {
+    data, _ := json.Marshal(&shared.ResetPasswordRequest{
+        Token:       token,
+        NewPassword: newPassword,
+    })
+    return nc.passwordRequest(map[string]interface{}{
+        "action": "reset_password",
+        "data":   string(data),
+    })
+}
+
+// OnSessionRevoked registers a handler for the server ending this session,
+// as when the password was changed on another device.
+func (nc *NetworkClient) OnSessionRevoked(handler func()) {
+    nc.OnEvent("session_revoked", func(event map[string]interface{}) {
+        handler()
+    })
+}
+
+func (nc *NetworkClient) passwordRequest(request map[string]interface{}) error {
+    msg, err := nc.request(request)
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    return nil
+}
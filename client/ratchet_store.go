@@ -0,0 +1,321 @@
+package client
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "secure-messenger/crypto"
+)
+
+const (
+    // stateMagic starts every state file written encrypted, telling them
+    // from the plaintext ones of earlier versions.
+    stateMagic = "SMST"
+    
+    // maxSessionsPerContact is how many sessions with a contact are kept, so
+    // messages still in flight under an older one can be decrypted.
+    maxSessionsPerContact = 5
+    
+    // maxSenderKeysPerMember is how many sender keys of each channel member
+    // are kept, for the same reason.
+    maxSenderKeysPerMember = 5
+)
+
+// stateFiles are the files of a RatchetStore.
+var stateFiles = []string{"prekeys.json", "sessions.json", "sender_keys.json", "history.key", "history.json"}
+
+// RatchetStore keeps a device's forward secrecy state next to its keypair:
+// the private prekeys, the ratchet sessions with each contact, the sender
+// keys of each channel, and received messages already decrypted, since
+// their keys are deleted once used. Every file is encrypted under a key
+// derived from the keystore, so the state is as safe as the keys.
+type RatchetStore struct {
+    dir        string
+    encryption *crypto.EncryptionManager
+    key        []byte
+}
+
+// senderKeys is the layout of sender_keys.json: the device's own sender key
+// per channel, and the keys received from other members by channel and
+// member, newest first.
+type senderKeys struct {
+    Own      map[string]*ownSenderKey                  `json:"own"`
+    Received map[string]map[string][]*crypto.SenderKey `json:"received"`
+}
+
+type ownSenderKey struct {
+    KeyEpoch int64             `json:"key_epoch"`
+    Key      *crypto.SenderKey `json:"key"`
+}
+
+// OpenRatchetStore opens the state in dir under key. Files left in
+// plaintext by earlier versions are encrypted, and files that do not open
+// under key are removed: they were written under keys this device no longer
+// holds, after a key backup with other keys was restored.
+func OpenRatchetStore(dir string, encryption *crypto.EncryptionManager, key []byte) (*RatchetStore, error) {
+    rs := &RatchetStore{dir: dir, encryption: encryption, key: key}
+    
+    for _, name := range stateFiles {
+        path := filepath.Join(dir, name)
+        data, err := os.ReadFile(path)
+        if err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return nil, err
+        }
+        
+        if !bytes.HasPrefix(data, []byte(stateMagic)) {
+            if err := rs.writeFile(name, data); err != nil {
+                return nil, fmt.Errorf("failed to encrypt %s: %v", name, err)
+            }
+            continue
+        }
+        if _, err := rs.readFile(name); err != nil {
+            if err := os.Remove(path); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return rs, nil
+}
+
+// ResetSessions forgets the device's prekeys and sessions in dir, which
+// were set up with an identity key that is being replaced. New prekeys are
+// published on the next EnsureKeys.
+func ResetSessions(dir string) error {
+    for _, name := range []string{"prekeys.json", "sessions.json"} {
+        if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return nil
+}
+
+func (rs *RatchetStore) readFile(name string) ([]byte, error) {
+    data, err := os.ReadFile(filepath.Join(rs.dir, name))
+    if err != nil {
+        return nil, err
+    }
+    if !bytes.HasPrefix(data, []byte(stateMagic)) {
+        return nil, fmt.Errorf("%s is not encrypted", name)
+    }
+    
+    plaintext, err := rs.encryption.DecryptFile(data[len(stateMagic):], rs.key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decrypt %s", name)
+    }
+    return plaintext, nil
+}
+
+func (rs *RatchetStore) writeFile(name string, plaintext []byte) error {
+    ciphertext, err := rs.encryption.EncryptFileWithKey(plaintext, rs.key)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(filepath.Join(rs.dir, name), append([]byte(stateMagic), ciphertext...), 0600)
+}
+
+func (rs *RatchetStore) read(name string, v interface{}) error {
+    data, err := rs.readFile(name)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+func (rs *RatchetStore) write(name string, v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return rs.writeFile(name, data)
+}
+
+// LoadPrekeys returns the device's private prekeys, or an error satisfying
+// os.IsNotExist if none were generated yet.
+func (rs *RatchetStore) LoadPrekeys() (*crypto.PrekeySet, error) {
+    var prekeys crypto.PrekeySet
+    if err := rs.read("prekeys.json", &prekeys); err != nil {
+        return nil, err
+    }
+    if prekeys.OneTimePrekeys == nil {
+        prekeys.OneTimePrekeys = make(map[string][]byte)
+    }
+    return &prekeys, nil
+}
+
+func (rs *RatchetStore) SavePrekeys(prekeys *crypto.PrekeySet) error {
+    return rs.write("prekeys.json", prekeys)
+}
+
+// LoadSessions returns the sessions with a contact, the one to send with
+// first.
+func (rs *RatchetStore) LoadSessions(contactID string) ([]*crypto.RatchetSession, error) {
+    sessions := make(map[string][]*crypto.RatchetSession)
+    if err := rs.read("sessions.json", &sessions); err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    return sessions[contactID], nil
+}
+
+// SaveSession stores a session with a contact and makes it the one to send
+// with, dropping the oldest beyond maxSessionsPerContact.
+func (rs *RatchetStore) SaveSession(contactID string, session *crypto.RatchetSession) error {
+    sessions := make(map[string][]*crypto.RatchetSession)
+    if err := rs.read("sessions.json", &sessions); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    
+    kept := []*crypto.RatchetSession{session}
+    for _, existing := range sessions[contactID] {
+        if existing.ID != session.ID && len(kept) < maxSessionsPerContact {
+            kept = append(kept, existing)
+        }
+    }
+    sessions[contactID] = kept
+    
+    return rs.write("sessions.json", sessions)
+}
+
+// DeleteSessions drops all sessions with a contact, as when they move to a
+// new device whose prekeys the old sessions know nothing of.
+func (rs *RatchetStore) DeleteSessions(contactID string) error {
+    sessions := make(map[string][]*crypto.RatchetSession)
+    if err := rs.read("sessions.json", &sessions); err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    
+    delete(sessions, contactID)
+    return rs.write("sessions.json", sessions)
+}
+
+func (rs *RatchetStore) loadSenderKeys() (*senderKeys, error) {
+    keys := &senderKeys{}
+    if err := rs.read("sender_keys.json", keys); err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if keys.Own == nil {
+        keys.Own = make(map[string]*ownSenderKey)
+    }
+    if keys.Received == nil {
+        keys.Received = make(map[string]map[string][]*crypto.SenderKey)
+    }
+    return keys, nil
+}
+
+// LoadOwnSenderKey returns the device's sender key for a channel and the key
+// epoch it was made for, or nil if it has none.
+func (rs *RatchetStore) LoadOwnSenderKey(channelID string) (*crypto.SenderKey, int64, error) {
+    keys, err := rs.loadSenderKeys()
+    if err != nil {
+        return nil, 0, err
+    }
+    own, ok := keys.Own[channelID]
+    if !ok {
+        return nil, 0, nil
+    }
+    return own.Key, own.KeyEpoch, nil
+}
+
+// SaveOwnSenderKey stores the device's sender key for a channel. A nil key
+// deletes it, so the next message starts a new one.
+func (rs *RatchetStore) SaveOwnSenderKey(channelID string, keyEpoch int64, key *crypto.SenderKey) error {
+    keys, err := rs.loadSenderKeys()
+    if err != nil {
+        return err
+    }
+    
+    if key == nil {
+        delete(keys.Own, channelID)
+    } else {
+        keys.Own[channelID] = &ownSenderKey{KeyEpoch: keyEpoch, Key: key}
+    }
+    return rs.write("sender_keys.json", keys)
+}
+
+// LoadSenderKey returns a member's sender key for a channel by its ID, or
+// nil if it was never received.
+func (rs *RatchetStore) LoadSenderKey(channelID, memberID, keyID string) (*crypto.SenderKey, error) {
+    keys, err := rs.loadSenderKeys()
+    if err != nil {
+        return nil, err
+    }
+    for _, key := range keys.Received[channelID][memberID] {
+        if key.ID == keyID {
+            return key, nil
+        }
+    }
+    return nil, nil
+}
+
+// SaveSenderKey stores a member's sender key for a channel, replacing the
+// stored state of the same key, and drops the oldest beyond
+// maxSenderKeysPerMember.
+func (rs *RatchetStore) SaveSenderKey(channelID, memberID string, key *crypto.SenderKey) error {
+    keys, err := rs.loadSenderKeys()
+    if err != nil {
+        return err
+    }
+    if keys.Received[channelID] == nil {
+        keys.Received[channelID] = make(map[string][]*crypto.SenderKey)
+    }
+    
+    kept := []*crypto.SenderKey{key}
+    for _, existing := range keys.Received[channelID][memberID] {
+        if existing.ID != key.ID && len(kept) < maxSenderKeysPerMember {
+            kept = append(kept, existing)
+        }
+    }
+    keys.Received[channelID][memberID] = kept
+    
+    return rs.write("sender_keys.json", keys)
+}
+
+// HistoryKey returns the device's key for its own copies of messages,
+// creating it on first use. It never leaves the device.
+func (rs *RatchetStore) HistoryKey() ([]byte, error) {
+    key, err := rs.readFile("history.key")
+    if err == nil && len(key) == 32 {
+        return key, nil
+    }
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    
+    key = make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+    if err := rs.writeFile("history.key", key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// GetHistory returns the stored copy of a received message, encrypted under
+// the history key.
+func (rs *RatchetStore) GetHistory(messageID string) ([]byte, bool) {
+    history := make(map[string][]byte)
+    if err := rs.read("history.json", &history); err != nil {
+        return nil, false
+    }
+    sealed, ok := history[messageID]
+    return sealed, ok
+}
+
+func (rs *RatchetStore) SaveHistory(messageID string, sealed []byte) error {
+    history := make(map[string][]byte)
+    if err := rs.read("history.json", &history); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    
+    history[messageID] = sealed
+    return rs.write("history.json", history)
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "secure-messenger/shared"
+    "time"
+)
+
+// ScheduleMessage asks the server to send a message to a user, or to a
+// channel when channelID is set, at sendAt. Messages are encrypted and
+// signed now, as they would be when sent directly, so the server never
+// holds their content.
+func (nc *NetworkClient) ScheduleMessage(to, channelID, content string, sendAt time.Time, attachments ...*shared.Attachment) (*shared.ScheduledMessage, error) {
+    req := &shared.ScheduleMessageRequest{
+        To:              to,
+        ChannelID:       channelID,
+        Content:         content,
+        Attachments:     attachments,
+        ClientMessageID: shared.NewSortableID(),
+        SendAt:          sendAt,
+    }
+    return nc.sealAndSchedule("schedule_message", to, channelID, req)
+}
+
+// EditScheduledMessage replaces the content and send time of a scheduled
+// message, keeping its attachments. Messages scheduled before they were
+// signed are sent with their scheduled ID as client message ID. A channel
+// message that failed because the members changed is encrypted again with
+// a new sender key.
+func (nc *NetworkClient) EditScheduledMessage(scheduled *shared.ScheduledMessage, content string, sendAt time.Time) (*shared.ScheduledMessage, error) {
+    req := &shared.ScheduleMessageRequest{
+        ID:              scheduled.ID,
+        Content:         content,
+        Mentions:        scheduled.Mentions,
+        Attachments:     scheduled.Attachments,
+        ClientMessageID: scheduled.ClientMessageID,
+        SendAt:          sendAt,
+    }
+    if req.ClientMessageID == "" {
+        req.ClientMessageID = scheduled.ID
+    }
+    
+    return nc.sealAndSchedule("edit_scheduled_message", scheduled.To, scheduled.ChannelID, req)
+}
+
+// sealAndSchedule seals req and sends it with action. A channel message
+// sealed with a sender key made before the members changed is sealed again
+// with a new one, as SendChannelMessage does.
+func (nc *NetworkClient) sealAndSchedule(action, to, channelID string, req *shared.ScheduleMessageRequest) (*shared.ScheduledMessage, error) {
+    content, attachments := req.Content, req.Attachments
+    for attempt := 0; ; attempt++ {
+        req.Content, req.Attachments = content, attachments
+        if err := nc.sealScheduled(to, channelID, req); err != nil {
+            return nil, err
+        }
+        
+        scheduled, err := nc.scheduleRequest(action, req)
+        if err == nil || channelID == "" || err.Error() != senderKeyOutdatedError || attempt > 0 {
+            return scheduled, err
+        }
+        if err := nc.dropSenderKey(channelID); err != nil {
+            return nil, fmt.Errorf("failed to drop sender key: %v", err)
+        }
+    }
+}
+
+// sealScheduled encrypts a scheduled message for its recipient, or with the
+// sender key of its channel, and signs the message as it will be sent.
+func (nc *NetworkClient) sealScheduled(to, channelID string, req *shared.ScheduleMessageRequest) error {
+    if nc.Session == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    recipient := to
+    if channelID != "" {
+        sealed, sealedAttachments, keyEpoch, err := nc.sealChannel(channelID, req.Content, req.Attachments)
+        if err != nil {
+            return err
+        }
+        
+        // The server cannot parse mentions out of encrypted content
+        req.Mentions = shared.ParseMentions(req.Content)
+        req.Content, req.Attachments, req.KeyEpoch, req.Encrypted = sealed, sealedAttachments, keyEpoch, true
+        recipient = channelID
+    } else {
+        sealed, sealedAttachments, err := nc.sealDirect(to, req.Content, req.Attachments)
+        if err != nil {
+            return err
+        }
+        req.Content, req.Attachments, req.Encrypted = sealed, sealedAttachments, true
+    }
+    
+    signature, err := nc.signMessage(recipient, req.ClientMessageID, req.Content, req.Attachments)
+    if err != nil {
+        return fmt.Errorf("failed to sign message: %v", err)
+    }
+    req.Signature = signature
+    return nil
+}
+
+// openScheduled decrypts scheduled messages in place, from the sender's own
+// copy.
+func (nc *NetworkClient) openScheduled(scheduled ...*shared.ScheduledMessage) {
+    for _, s := range scheduled {
+        if s == nil || !s.Encrypted {
+            continue
+        }
+        if s.ChannelID != "" {
+            s.Content, s.Encrypted = nc.openChannel("", s.ChannelID, s.From, s.Content, s.Attachments)
+        } else {
+            s.Content, s.Encrypted = nc.openDirect("", s.From, s.Content, s.Attachments)
+        }
+    }
+}
+
+func (nc *NetworkClient) scheduleRequest(action string, req *shared.ScheduleMessageRequest) (*shared.ScheduledMessage, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    data, _ := json.Marshal(req)
+    msg, err := nc.request(map[string]interface{}{
+        "action": action,
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        Success   bool                     `json:"success"`
+        Error     string                   `json:"error"`
+        Scheduled *shared.ScheduledMessage `json:"scheduled"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    nc.openScheduled(response.Scheduled)
+    return response.Scheduled, nil
+}
+
+func (nc *NetworkClient) CancelScheduledMessage(scheduledID string) error {
+    if nc.Session == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    msg, err := nc.request(map[string]interface{}{
+        "action":       "cancel_scheduled_message",
+        "token":        nc.Session.Token,
+        "scheduled_id": scheduledID,
+    })
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    
+    return nil
+}
+
+// GetScheduledMessages lists the user's scheduled messages, soonest first,
+// including those that failed to send.
+func (nc *NetworkClient) GetScheduledMessages() ([]*shared.ScheduledMessage, error) {
+    if nc.Session == nil {
+        return nil, fmt.Errorf("not authenticated")
+    }
+    
+    msg, err := nc.request(map[string]interface{}{
+        "action": "get_scheduled_messages",
+        "token":  nc.Session.Token,
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        Success   bool                       `json:"success"`
+        Error     string                     `json:"error"`
+        Scheduled []*shared.ScheduledMessage `json:"scheduled"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    nc.openScheduled(response.Scheduled...)
+    return response.Scheduled, nil
+}
+
+// OnScheduledMessageFailed registers a handler for scheduled messages the
+// server could not send when they came due.
+func (nc *NetworkClient) OnScheduledMessageFailed(handler func(scheduled *shared.ScheduledMessage)) {
+    nc.OnEvent("scheduled_message_failed", func(event map[string]interface{}) {
+        var failed struct {
+            Scheduled *shared.ScheduledMessage `json:"scheduled"`
+        }
+        
+        if err := decodeResponse(event, &failed); err != nil || failed.Scheduled == nil {
+            return
+        }
+        
+        nc.openScheduled(failed.Scheduled)
+        handler(failed.Scheduled)
+    })
+}
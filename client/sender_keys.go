@@ -0,0 +1,265 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "secure-messenger/crypto"
+    "secure-messenger/shared"
+)
+
+// senderKeyOutdatedError is the server's answer for a channel message or
+// sender key made before the channel's members last changed.
+const senderKeyOutdatedError = "sender key is out of date"
+
+// senderKeyPayload is the plaintext of a sender key handed to another member.
+type senderKeyPayload struct {
+    ChannelID string            `json:"channel_id"`
+    KeyEpoch  int64             `json:"key_epoch"`
+    SenderKey *crypto.SenderKey `json:"sender_key"`
+}
+
+// senderKeyAD binds a channel message to its channel and sender.
+func senderKeyAD(channelID, from string) []byte {
+    return []byte(channelID + "\x00" + from)
+}
+
+// sealChannel encrypts a channel message once with the user's sender key for
+// the channel, distributing a new sender key first if there is none. It
+// returns the key epoch the message was encrypted for.
+func (nc *NetworkClient) sealChannel(channelID, content string, attachments []*shared.Attachment) (string, []*shared.Attachment, int64, error) {
+    if nc.ratchets == nil {
+        return "", nil, 0, fmt.Errorf("encryption keys are not loaded")
+    }
+    
+    nc.sessionMu.Lock()
+    key, keyEpoch, err := nc.ratchets.LoadOwnSenderKey(channelID)
+    nc.sessionMu.Unlock()
+    if err != nil {
+        return "", nil, 0, fmt.Errorf("failed to load sender key: %v", err)
+    }
+    if key == nil {
+        // Distributed without holding the lock, as incoming messages need it
+        if err := nc.rotateSenderKey(channelID); err != nil {
+            return "", nil, 0, err
+        }
+    }
+    
+    plaintext, sealedAttachments, err := nc.sealPayload(content, attachments)
+    if err != nil {
+        return "", nil, 0, err
+    }
+    
+    nc.sessionMu.Lock()
+    defer nc.sessionMu.Unlock()
+    
+    if key, keyEpoch, err = nc.ratchets.LoadOwnSenderKey(channelID); err != nil {
+        return "", nil, 0, fmt.Errorf("failed to load sender key: %v", err)
+    }
+    if key == nil {
+        return "", nil, 0, fmt.Errorf("sender key was dropped while sending")
+    }
+    
+    encrypted, err := key.Encrypt(plaintext, senderKeyAD(channelID, nc.Session.User.ID))
+    if err != nil {
+        return "", nil, 0, fmt.Errorf("failed to encrypt message: %v", err)
+    }
+    if err := nc.ratchets.SaveOwnSenderKey(channelID, keyEpoch, key); err != nil {
+        return "", nil, 0, fmt.Errorf("failed to save sender key: %v", err)
+    }
+    
+    self, err := nc.sealHistory(plaintext)
+    if err != nil {
+        return "", nil, 0, err
+    }
+    
+    sealed, err := crypto.EncodeSenderKeyEnvelope(encrypted, self)
+    if err != nil {
+        return "", nil, 0, err
+    }
+    return sealed, sealedAttachments, keyEpoch, nil
+}
+
+// rotateSenderKey makes a new sender key for a channel and sends it to every
+// other member, encrypted for each like a direct message. The key is only
+// used once the server has accepted it for the channel's current members.
+func (nc *NetworkClient) rotateSenderKey(channelID string) error {
+    channels, err := nc.GetUserChannels()
+    if err != nil {
+        return err
+    }
+    
+    var channel *shared.Channel
+    for _, c := range channels {
+        if c.ID == channelID {
+            channel = c
+            break
+        }
+    }
+    if channel == nil {
+        return fmt.Errorf("user is not a member of this channel")
+    }
+    
+    key, err := crypto.NewSenderKey()
+    if err != nil {
+        return fmt.Errorf("failed to generate sender key: %v", err)
+    }
+    payload, _ := json.Marshal(&senderKeyPayload{
+        ChannelID: channel.ID,
+        KeyEpoch:  channel.KeyEpoch,
+        SenderKey: key.Distribution(),
+    })
+    
+    upload := &shared.SenderKeyUpload{
+        ChannelID: channel.ID,
+        KeyEpoch:  channel.KeyEpoch,
+        Keys:      make(map[string]string),
+    }
+    for _, memberID := range channel.Members {
+        if memberID == nc.Session.User.ID {
+            continue
+        }
+        sealed, _, err := nc.sealDirect(memberID, string(payload), nil)
+        if err != nil {
+            return err
+        }
+        upload.Keys[memberID] = sealed
+    }
+    
+    data, _ := json.Marshal(upload)
+    msg, err := nc.request(map[string]interface{}{
+        "action": "distribute_sender_key",
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    })
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    
+    nc.sessionMu.Lock()
+    defer nc.sessionMu.Unlock()
+    if err := nc.ratchets.SaveOwnSenderKey(channel.ID, channel.KeyEpoch, key); err != nil {
+        return fmt.Errorf("failed to save sender key: %v", err)
+    }
+    return nil
+}
+
+// dropSenderKey forgets the user's sender key for a channel, so the next
+// message distributes a new one.
+func (nc *NetworkClient) dropSenderKey(channelID string) error {
+    nc.sessionMu.Lock()
+    defer nc.sessionMu.Unlock()
+    return nc.ratchets.SaveOwnSenderKey(channelID, 0, nil)
+}
+
+// fetchSenderKeys fetches the sender keys other members sent while this
+// device was offline, for one channel or all of them when channelID is
+// empty. Keys sent while it is online arrive as sender_key events.
+func (nc *NetworkClient) fetchSenderKeys(channelID string) error {
+    msg, err := nc.request(map[string]interface{}{
+        "action":     "get_sender_keys",
+        "token":      nc.Session.Token,
+        "channel_id": channelID,
+    })
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success    bool                            `json:"success"`
+        Error      string                          `json:"error"`
+        SenderKeys []*shared.SenderKeyDistribution `json:"sender_keys"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    
+    for _, distribution := range response.SenderKeys {
+        nc.receiveSenderKey(distribution)
+    }
+    return nil
+}
+
+// receiveSenderKeyEvent stores the sender key of a sender_key event.
+func (nc *NetworkClient) receiveSenderKeyEvent(event map[string]interface{}) {
+    var delivery struct {
+        SenderKey *shared.SenderKeyDistribution `json:"sender_key"`
+    }
+    if err := decodeResponse(event, &delivery); err != nil || delivery.SenderKey == nil {
+        return
+    }
+    nc.receiveSenderKey(delivery.SenderKey)
+}
+
+// receiveSenderKey decrypts a member's sender key and stores it, unless this
+// device already has it, possibly further along its chain.
+func (nc *NetworkClient) receiveSenderKey(distribution *shared.SenderKeyDistribution) {
+    if nc.ratchets == nil {
+        return
+    }
+    
+    content, encrypted := nc.openDirect(distribution.ID, distribution.From, distribution.Content, nil)
+    var payload senderKeyPayload
+    if !encrypted || content == UndecryptableContent || json.Unmarshal([]byte(content), &payload) != nil {
+        log.Printf("Failed to decrypt sender key %s from %s", distribution.ID, distribution.From)
+        return
+    }
+    if payload.ChannelID != distribution.ChannelID || payload.SenderKey == nil {
+        log.Printf("Ignoring sender key %s from %s made for another channel", distribution.ID, distribution.From)
+        return
+    }
+    
+    nc.sessionMu.Lock()
+    defer nc.sessionMu.Unlock()
+    
+    existing, err := nc.ratchets.LoadSenderKey(payload.ChannelID, distribution.From, payload.SenderKey.ID)
+    if err == nil && existing == nil {
+        err = nc.ratchets.SaveSenderKey(payload.ChannelID, distribution.From, payload.SenderKey)
+    }
+    if err != nil {
+        log.Printf("Failed to save sender key %s: %v", distribution.ID, err)
+    }
+}
+
+// openChannel decrypts content and attachment keys sealed by sealChannel. It
+// reports false when the content is not in encrypted form, as for messages
+// sent before channels were end-to-end encrypted.
+func (nc *NetworkClient) openChannel(messageID, channelID, from, content string, attachments []*shared.Attachment) (string, bool) {
+    msg, self, err := crypto.DecodeSenderKeyEnvelope(content)
+    if err != nil {
+        if crypto.IsEnvelope(content) {
+            return UndecryptableContent, true
+        }
+        return content, false
+    }
+    
+    return nc.openForwardSecret(messageID, from, self, attachments, func() ([]byte, error) {
+        key, err := nc.ratchets.LoadSenderKey(channelID, from, msg.KeyID)
+        if err != nil {
+            return nil, err
+        }
+        if key == nil {
+            return nil, fmt.Errorf("sender key has not been received")
+        }
+        
+        plaintext, err := key.Decrypt(msg, senderKeyAD(channelID, from))
+        if err != nil {
+            return nil, err
+        }
+        return plaintext, nc.ratchets.SaveSenderKey(channelID, from, key)
+    }), true
+}
@@ -0,0 +1,397 @@
+package client
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "secure-messenger/crypto"
+    "secure-messenger/shared"
+)
+
+const (
+    // prekeyBatch is how many one-time prekeys are published at a time.
+    prekeyBatch = 50
+    
+    // prekeyLowWater is how few one-time prekeys may be left on the server
+    // before another batch is published.
+    prekeyLowWater = 20
+    
+    // noPrekeysError is the server's answer for a contact whose client does
+    // not support forward secret sessions yet.
+    noPrekeysError = "user has not published prekeys"
+)
+
+// directPayload is the plaintext of a forward secret direct message. The
+// keys of its attachments are encrypted under AttachmentKey, so they can
+// travel with the attachments themselves.
+type directPayload struct {
+    Content       string `json:"content"`
+    AttachmentKey []byte `json:"attachment_key,omitempty"`
+}
+
+// ensurePrekeys publishes this device's prekeys when the server has none or
+// another device's, and tops up its one-time prekeys when they run low.
+func (nc *NetworkClient) ensurePrekeys() error {
+    nc.sessionMu.Lock()
+    prekeys, err := nc.ratchets.LoadPrekeys()
+    nc.sessionMu.Unlock()
+    
+    republish := false
+    if err != nil {
+        if !os.IsNotExist(err) {
+            return fmt.Errorf("failed to load prekeys: %v", err)
+        }
+        if prekeys, err = crypto.GeneratePrekeySet(); err != nil {
+            return fmt.Errorf("failed to generate prekeys: %v", err)
+        }
+        republish = true
+    }
+    
+    signedPrekeyID, count, err := nc.getPrekeyStatus()
+    if err != nil {
+        return err
+    }
+    if signedPrekeyID != prekeys.SignedPrekeyID {
+        republish = true
+    }
+    if !republish && count >= prekeyLowWater {
+        return nil
+    }
+    return nc.publishPrekeys(prekeys)
+}
+
+// publishPrekeys publishes the prekeys signed by the current key, along with
+// a new batch of one-time prekeys.
+func (nc *NetworkClient) publishPrekeys(prekeys *crypto.PrekeySet) error {
+    // The private halves are saved first, so no published prekey can be
+    // used before this device is able to accept it
+    nc.sessionMu.Lock()
+    oneTimePrekeys, err := prekeys.GenerateOneTimePrekeys(prekeyBatch)
+    if err == nil {
+        err = nc.ratchets.SavePrekeys(prekeys)
+    }
+    nc.sessionMu.Unlock()
+    if err != nil {
+        return fmt.Errorf("failed to save prekeys: %v", err)
+    }
+    
+    upload, err := prekeys.Upload(nc.keys, oneTimePrekeys)
+    if err != nil {
+        return fmt.Errorf("failed to sign prekeys: %v", err)
+    }
+    return nc.uploadPrekeys(upload)
+}
+
+func (nc *NetworkClient) uploadPrekeys(upload *shared.PrekeyUpload) error {
+    data, _ := json.Marshal(upload)
+    msg, err := nc.request(map[string]interface{}{
+        "action": "upload_prekeys",
+        "token":  nc.Session.Token,
+        "data":   string(data),
+    })
+    if err != nil {
+        return err
+    }
+    
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return err
+    }
+    
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    
+    return nil
+}
+
+func (nc *NetworkClient) getPrekeyStatus() (uint32, int, error) {
+    msg, err := nc.request(map[string]interface{}{
+        "action": "get_prekey_status",
+        "token":  nc.Session.Token,
+    })
+    if err != nil {
+        return 0, 0, err
+    }
+    
+    var response struct {
+        Success        bool   `json:"success"`
+        Error          string `json:"error"`
+        SignedPrekeyID uint32 `json:"signed_prekey_id"`
+        OneTimePrekeys int    `json:"one_time_prekeys"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return 0, 0, err
+    }
+    
+    if !response.Success {
+        return 0, 0, fmt.Errorf("%s", response.Error)
+    }
+    
+    return response.SignedPrekeyID, response.OneTimePrekeys, nil
+}
+
+// getPrekeyBundle fetches a contact's prekey bundle. It returns nil without
+// an error when the contact has not published prekeys.
+func (nc *NetworkClient) getPrekeyBundle(userID string) (*shared.PrekeyBundle, error) {
+    msg, err := nc.request(map[string]interface{}{
+        "action":  "get_prekey_bundle",
+        "token":   nc.Session.Token,
+        "user_id": userID,
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    var response struct {
+        Success bool                 `json:"success"`
+        Error   string               `json:"error"`
+        Bundle  *shared.PrekeyBundle `json:"bundle"`
+    }
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        if response.Error == noPrekeysError {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    
+    return response.Bundle, nil
+}
+
+// sealRatchet encrypts a direct message with the session with the recipient,
+// starting one from their prekey bundle if there is none yet. It reports
+// false when the recipient has no prekeys and the message has to be sealed
+// with their RSA key instead.
+func (nc *NetworkClient) sealRatchet(to string, recipientKey *rsa.PublicKey, content string, attachments []*shared.Attachment) (string, []*shared.Attachment, bool, error) {
+    // Messages to oneself are only ever read through the sender's copy
+    if nc.ratchets == nil || to == nc.Session.User.ID {
+        return "", nil, false, nil
+    }
+    
+    nc.sessionMu.Lock()
+    sessions, err := nc.ratchets.LoadSessions(to)
+    nc.sessionMu.Unlock()
+    if err != nil {
+        return "", nil, false, fmt.Errorf("failed to load sessions: %v", err)
+    }
+    
+    var bundle *shared.PrekeyBundle
+    if len(sessions) == 0 {
+        // Fetched without holding the lock, as incoming messages need it
+        if bundle, err = nc.getPrekeyBundle(to); err != nil {
+            return "", nil, false, err
+        }
+        if bundle == nil {
+            return "", nil, false, nil
+        }
+        if err := crypto.VerifyPrekeys(recipientKey, bundle.IdentityKey, bundle.SignedPrekey, bundle.Signature); err != nil {
+            return "", nil, false, fmt.Errorf("cannot encrypt for recipient: %v", err)
+        }
+    }
+    
+    plaintext, sealedAttachments, err := nc.sealPayload(content, attachments)
+    if err != nil {
+        return "", nil, false, err
+    }
+    
+    nc.sessionMu.Lock()
+    defer nc.sessionMu.Unlock()
+    
+    // A session may have been started by the contact in the meantime
+    if sessions, err = nc.ratchets.LoadSessions(to); err != nil {
+        return "", nil, false, fmt.Errorf("failed to load sessions: %v", err)
+    }
+    
+    var session *crypto.RatchetSession
+    if len(sessions) > 0 {
+        session = sessions[0]
+    } else {
+        prekeys, err := nc.ratchets.LoadPrekeys()
+        if err != nil {
+            return "", nil, false, fmt.Errorf("failed to load prekeys: %v", err)
+        }
+        if session, err = crypto.InitiateSession(prekeys, bundle); err != nil {
+            return "", nil, false, fmt.Errorf("failed to start session: %v", err)
+        }
+    }
+    
+    encrypted, err := session.Encrypt(plaintext)
+    if err != nil {
+        return "", nil, false, fmt.Errorf("failed to encrypt message: %v", err)
+    }
+    if err := nc.ratchets.SaveSession(to, session); err != nil {
+        return "", nil, false, fmt.Errorf("failed to save session: %v", err)
+    }
+    
+    self, err := nc.sealHistory(plaintext)
+    if err != nil {
+        return "", nil, false, err
+    }
+    
+    sealed, err := crypto.EncodeRatchetEnvelope(encrypted, self)
+    if err != nil {
+        return "", nil, false, err
+    }
+    return sealed, sealedAttachments, true, nil
+}
+
+// openRatchet decrypts a forward secret direct message.
+func (nc *NetworkClient) openRatchet(messageID, from string, msg *crypto.RatchetMessage, self []byte, attachments []*shared.Attachment) string {
+    return nc.openForwardSecret(messageID, from, self, attachments, func() ([]byte, error) {
+        return nc.ratchetDecrypt(from, msg)
+    })
+}
+
+// sealPayload encodes the content of a forward secret message, encrypting
+// the keys of its attachments under a new key that goes along with it. The
+// attachments are copied rather than changed.
+func (nc *NetworkClient) sealPayload(content string, attachments []*shared.Attachment) ([]byte, []*shared.Attachment, error) {
+    payload := &directPayload{Content: content}
+    var sealedAttachments []*shared.Attachment
+    if len(attachments) > 0 {
+        payload.AttachmentKey = make([]byte, 32)
+        if _, err := rand.Read(payload.AttachmentKey); err != nil {
+            return nil, nil, err
+        }
+        
+        for _, attachment := range attachments {
+            wrappedKey, err := nc.encryption.EncryptFileWithKey([]byte(attachment.Key), payload.AttachmentKey)
+            if err != nil {
+                return nil, nil, fmt.Errorf("failed to encrypt attachment key: %v", err)
+            }
+            wrapped := *attachment
+            wrapped.Key = base64.StdEncoding.EncodeToString(wrappedKey)
+            sealedAttachments = append(sealedAttachments, &wrapped)
+        }
+    }
+    
+    plaintext, _ := json.Marshal(payload)
+    return plaintext, sealedAttachments, nil
+}
+
+// sealHistory encrypts plaintext under the device's history key, for the
+// sender's own copy of a message. The caller holds sessionMu.
+func (nc *NetworkClient) sealHistory(plaintext []byte) ([]byte, error) {
+    historyKey, err := nc.ratchets.HistoryKey()
+    if err != nil {
+        return nil, err
+    }
+    return nc.encryption.EncryptFileWithKey(plaintext, historyKey)
+}
+
+// openForwardSecret decrypts a forward secret message, from the sender's own
+// copy if it is ours, or else from this device's history or with decrypt. A
+// received message can be decrypted only once, as its key is deleted after,
+// so the plaintext is kept under the history key. decrypt is called with
+// sessionMu held.
+func (nc *NetworkClient) openForwardSecret(messageID, from string, self []byte, attachments []*shared.Attachment, decrypt func() ([]byte, error)) string {
+    if nc.ratchets == nil {
+        return UndecryptableContent
+    }
+    
+    nc.sessionMu.Lock()
+    defer nc.sessionMu.Unlock()
+    
+    historyKey, err := nc.ratchets.HistoryKey()
+    if err != nil {
+        return UndecryptableContent
+    }
+    
+    var plaintext []byte
+    if from == nc.Session.User.ID {
+        plaintext, err = nc.encryption.DecryptFile(self, historyKey)
+    } else if sealed, ok := nc.ratchets.GetHistory(messageID); ok {
+        plaintext, err = nc.encryption.DecryptFile(sealed, historyKey)
+    } else {
+        plaintext, err = decrypt()
+        if err == nil && messageID != "" {
+            sealed, sealErr := nc.encryption.EncryptFileWithKey(plaintext, historyKey)
+            if sealErr == nil {
+                sealErr = nc.ratchets.SaveHistory(messageID, sealed)
+            }
+            if sealErr != nil {
+                log.Printf("Failed to keep decrypted message %s: %v", messageID, sealErr)
+            }
+        }
+    }
+    if err != nil {
+        return UndecryptableContent
+    }
+    
+    var payload directPayload
+    if err := json.Unmarshal(plaintext, &payload); err != nil {
+        return UndecryptableContent
+    }
+    
+    for _, attachment := range attachments {
+        wrappedKey, err := base64.StdEncoding.DecodeString(attachment.Key)
+        if err != nil {
+            continue
+        }
+        if key, err := nc.encryption.DecryptFile(wrappedKey, payload.AttachmentKey); err == nil {
+            attachment.Key = string(key)
+        }
+    }
+    
+    return payload.Content
+}
+
+// ratchetDecrypt decrypts a message with the session it names, accepting the
+// session first when the message is the sender's first in it. The caller
+// holds sessionMu.
+func (nc *NetworkClient) ratchetDecrypt(from string, msg *crypto.RatchetMessage) ([]byte, error) {
+    sessions, err := nc.ratchets.LoadSessions(from)
+    if err != nil {
+        return nil, err
+    }
+    
+    for _, session := range sessions {
+        if session.ID != msg.SessionID {
+            continue
+        }
+        
+        plaintext, err := session.Decrypt(msg)
+        if err != nil {
+            return nil, err
+        }
+        return plaintext, nc.ratchets.SaveSession(from, session)
+    }
+    
+    if msg.Initial == nil {
+        return nil, fmt.Errorf("unknown session")
+    }
+    
+    prekeys, err := nc.ratchets.LoadPrekeys()
+    if err != nil {
+        return nil, err
+    }
+    
+    session, err := crypto.AcceptSession(prekeys, msg.Initial)
+    if err != nil {
+        return nil, err
+    }
+    if session.ID != msg.SessionID {
+        return nil, fmt.Errorf("session does not match its initial header")
+    }
+    
+    plaintext, err := session.Decrypt(msg)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := nc.ratchets.SaveSession(from, session); err != nil {
+        return nil, err
+    }
+    return plaintext, nc.ratchets.SavePrekeys(prekeys)
+}
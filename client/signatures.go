@@ -0,0 +1,77 @@
+package client
+
+import (
+    "crypto/ed25519"
+    "secure-messenger/crypto"
+    "secure-messenger/shared"
+    "time"
+)
+
+// signMessage signs a message as it will be sent. The recipient is the
+// channel ID for channel messages and the user ID otherwise, and content and
+// attachments are as sent, so encrypted messages are signed in encrypted
+// form with their wrapped attachment keys.
+func (nc *NetworkClient) signMessage(to, clientMessageID, content string, attachments []*shared.Attachment) (*shared.MessageSignature, error) {
+    signedAt := time.Now()
+    signature, err := nc.keys.SignMessage(nc.Session.User.ID, to, clientMessageID, content, attachments, signedAt)
+    if err != nil {
+        return nil, err
+    }
+    return &shared.MessageSignature{SignedAt: signedAt, Signature: signature}, nil
+}
+
+// signingKeyFor returns the signing key a user's messages are checked
+// against, without asking the server. It reports false when the key has not
+// been fetched yet, and returns nil for a user who has not published one.
+func (nc *NetworkClient) signingKeyFor(userID string) (ed25519.PublicKey, bool) {
+    if userID == nc.Session.User.ID {
+        return nc.keys.SigningPublicKey(), true
+    }
+    
+    nc.keyMu.Lock()
+    defer nc.keyMu.Unlock()
+    signingKey, ok := nc.signingKeys[userID]
+    return signingKey, ok
+}
+
+// fetchSigningKeys fetches the signing keys of the senders of the messages
+// that are not known yet, checking them against the pinned keys as
+// GetPublicKey does. Senders whose key cannot be trusted are left out, and
+// their messages show as unverified.
+func (nc *NetworkClient) fetchSigningKeys(messages ...*shared.Message) {
+    if nc.Session == nil || nc.Session.User == nil {
+        return
+    }
+    
+    for _, message := range messages {
+        if message == nil || message.Type == shared.MessageTypeSystem {
+            continue
+        }
+        if _, ok := nc.signingKeyFor(message.From); !ok {
+            nc.GetPublicKey(message.From)
+        }
+    }
+}
+
+// verifyMessage checks the sender's signature of a received message, before
+// it is decrypted, and marks it unverified if the signature is missing or
+// does not check out. System messages come from the server and are not
+// signed; since the server also sets their type, they are marked unverified
+// unless they are plain text following one of the system actions.
+func (nc *NetworkClient) verifyMessage(message *shared.Message) {
+    if message.Type == shared.MessageTypeSystem {
+        message.Unverified = message.Encrypted || len(message.Attachments) > 0 ||
+            !shared.IsSystemMessageContent(message.Content)
+        return
+    }
+    
+    to := message.To
+    if message.ChannelID != "" {
+        to = message.ChannelID
+    }
+    
+    signingKey, _ := nc.signingKeyFor(message.From)
+    signature := message.Signature
+    message.Unverified = signature == nil || !crypto.VerifyMessage(signingKey, message.From, to,
+        message.ClientMessageID, message.Content, message.Attachments, signature.SignedAt, signature.Signature)
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+    "encoding/json"
+    "os"
+)
+
+// SyncState remembers the last update sequence applied for each user, so a
+// reconnecting client only asks for what it missed.
+type SyncState struct {
+    statePath string
+}
+
+func NewSyncState() *SyncState {
+    // Use project-relative path
+    statePath := "sync_state.json"
+    return &SyncState{statePath: statePath}
+}
+
+func (ss *SyncState) load() (map[string]int64, error) {
+    data, err := os.ReadFile(ss.statePath)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return map[string]int64{}, nil
+        }
+        return nil, err
+    }
+    
+    sequences := make(map[string]int64)
+    if err := json.Unmarshal(data, &sequences); err != nil {
+        return nil, err
+    }
+    
+    return sequences, nil
+}
+
+// LastSequence returns the last sequence applied for the user, or zero if
+// the user has never synced on this machine.
+func (ss *SyncState) LastSequence(userID string) int64 {
+    sequences, err := ss.load()
+    if err != nil {
+        return 0
+    }
+    return sequences[userID]
+}
+
+func (ss *SyncState) SetLastSequence(userID string, seq int64) error {
+    sequences, err := ss.load()
+    if err != nil {
+        sequences = make(map[string]int64)
+    }
+    
+    sequences[userID] = seq
+    
+    data, err := json.Marshal(sequences)
+    if err != nil {
+        return err
+    }
+    
+    return os.WriteFile(ss.statePath, data, 0600)
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "strings"
+    
+    // Decoders for the image formats previews are made of
+    _ "image/gif"
+    _ "image/png"
+)
+
+// ThumbnailSize is the longest side of a generated preview, in pixels.
+const ThumbnailSize = 256
+
+// IsImage reports whether an attachment of this MIME type gets a preview.
+func IsImage(mimeType string) bool {
+    switch strings.ToLower(mimeType) {
+    case "image/jpeg", "image/png", "image/gif":
+        return true
+    }
+    return false
+}
+
+// MakeThumbnail decodes an image and returns a JPEG scaled down so that its
+// longest side is at most ThumbnailSize.
+func MakeThumbnail(data []byte) ([]byte, error) {
+    src, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, scaleDown(src, ThumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+        return nil, err
+    }
+    
+    return buf.Bytes(), nil
+}
+
+// scaleDown shrinks an image to fit in a square of the given size, averaging
+// the source pixels that fall into each target pixel.
+func scaleDown(src image.Image, size int) image.Image {
+    bounds := src.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    if width <= size && height <= size {
+        return src
+    }
+    
+    dstWidth, dstHeight := size, height*size/width
+    if height > width {
+        dstWidth, dstHeight = width*size/height, size
+    }
+    if dstWidth < 1 {
+        dstWidth = 1
+    }
+    if dstHeight < 1 {
+        dstHeight = 1
+    }
+    
+    dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+    for y := 0; y < dstHeight; y++ {
+        y0 := bounds.Min.Y + y*height/dstHeight
+        y1 := bounds.Min.Y + (y+1)*height/dstHeight
+        for x := 0; x < dstWidth; x++ {
+            x0 := bounds.Min.X + x*width/dstWidth
+            x1 := bounds.Min.X + (x+1)*width/dstWidth
+            
+            var r, g, b, a, n uint64
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    cr, cg, cb, ca := src.At(sx, sy).RGBA()
+                    r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+                    n++
+                }
+            }
+            
+            dst.Set(x, y, color.RGBA64{
+                R: uint16(r / n),
+                G: uint16(g / n),
+                B: uint16(b / n),
+                A: uint16(a / n),
+            })
+        }
+    }
+    
+    return dst
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "secure-messenger/shared"
+    "time"
+)
+
+// LoginTwoFactor completes a login that Login answered with a challenge,
+// with a code from the user's authenticator app or one of their recovery
+// codes. If the login enrolled the user, the response carries their
+// recovery codes. The password is the one given to Login, which drafts are
+// encrypted with.
+func (nc *NetworkClient) LoginTwoFactor(password, challenge, code string) (*shared.AuthResponse, error) {
+    data, _ := json.Marshal(&shared.TwoFactorLoginRequest{
+        Challenge: challenge,
+        Code:      code,
+    })
+    msg, err := nc.request(map[string]interface{}{
+        "action": "login_two_factor",
+        "data":   string(data),
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    var response shared.AuthResponse
+    if err := decodeResponse(msg, &response); err != nil {
+        return nil, err
+    }
+    
+    if response.Success {
+        nc.Session = &Session{
+            Token:    response.Token,
+            User:     response.User,
+            LastSeen: time.Now(),
+        }
+    }
+    
+    return &response, nil
+}
+
+// TwoFactorStatus reports whether the user has two-factor authentication
+// enabled, whether the server requires it and how many recovery codes are
+// left.
+func (nc *NetworkClient) TwoFactorStatus() (*shared.TwoFactorStatus, error) {
+    var response struct {
+        Success bool                    `json:"success"`
+        Error   string                  `json:"error"`
+        Status  *shared.TwoFactorStatus `json:"status"`
+    }
+    if err := nc.twoFactorRequest("get_two_factor_status", nil, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    return response.Status, nil
+}
+
+// BeginTwoFactorSetup gets a new secret to add to an authenticator app,
+// with the URI to show as a QR code. Two-factor authentication is enabled
+// once ConfirmTwoFactorSetup is given a code from the app.
+func (nc *NetworkClient) BeginTwoFactorSetup() (*shared.TwoFactorSetup, error) {
+    var response struct {
+        Success bool                   `json:"success"`
+        Error   string                 `json:"error"`
+        Setup   *shared.TwoFactorSetup `json:"setup"`
+    }
+    if err := nc.twoFactorRequest("begin_two_factor_setup", nil, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    return response.Setup, nil
+}
+
+// ConfirmTwoFactorSetup enables two-factor authentication with a first code
+// from the app and returns the recovery codes, which are not shown again.
+func (nc *NetworkClient) ConfirmTwoFactorSetup(code string) ([]string, error) {
+    return nc.recoveryCodesRequest("confirm_two_factor_setup", &shared.TwoFactorCodeRequest{Code: code})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, given a code,
+// and returns the new ones.
+func (nc *NetworkClient) RegenerateRecoveryCodes(code string) ([]string, error) {
+    return nc.recoveryCodesRequest("regenerate_recovery_codes", &shared.TwoFactorCodeRequest{Code: code})
+}
+
+// DisableTwoFactor turns two-factor authentication off, given the user's
+// password and a code.
+func (nc *NetworkClient) DisableTwoFactor(password, code string) error {
+    var response struct {
+        Success bool   `json:"success"`
+        Error   string `json:"error"`
+    }
+    request := &shared.DisableTwoFactorRequest{Password: password, Code: code}
+    if err := nc.twoFactorRequest("disable_two_factor", request, &response); err != nil {
+        return err
+    }
+    
+    if !response.Success {
+        return fmt.Errorf("%s", response.Error)
+    }
+    return nil
+}
+
+func (nc *NetworkClient) recoveryCodesRequest(action string, request interface{}) ([]string, error) {
+    var response struct {
+        Success       bool     `json:"success"`
+        Error         string   `json:"error"`
+        RecoveryCodes []string `json:"recovery_codes"`
+    }
+    if err := nc.twoFactorRequest(action, request, &response); err != nil {
+        return nil, err
+    }
+    
+    if !response.Success {
+        return nil, fmt.Errorf("%s", response.Error)
+    }
+    return response.RecoveryCodes, nil
+}
+
+// twoFactorRequest sends an action of the logged in user, with the request
+// as its data if there is one, and decodes the reply into response.
+func (nc *NetworkClient) twoFactorRequest(action string, request, response interface{}) error {
+    if nc.Session == nil {
+        return fmt.Errorf("not authenticated")
+    }
+    
+    message := map[string]interface{}{
+        "action": action,
+        "token":  nc.Session.Token,
+    }
+    if request != nil {
+        data, _ := json.Marshal(request)
+        message["data"] = string(data)
+    }
+    
+    msg, err := nc.request(message)
+    if err != nil {
+        return err
+    }
+    return decodeResponse(msg, response)
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+    "encoding/json"
+    "os"
+    "time"
+)
+
+// Verification records that a contact's key was checked against their safety
+// number. It only holds while the contact still has the same key.
+type Verification struct {
+    Fingerprint string    `json:"fingerprint"`
+    VerifiedAt  time.Time `json:"verified_at"`
+}
+
+// VerificationStore remembers, for each user of this machine, which contacts
+// they have verified and for which key.
+type VerificationStore struct {
+    storePath string
+}
+
+func NewVerificationStore() *VerificationStore {
+    // Use project-relative path
+    storePath := "verified_contacts.json"
+    return &VerificationStore{storePath: storePath}
+}
+
+func (vs *VerificationStore) load() (map[string]map[string]*Verification, error) {
+    data, err := os.ReadFile(vs.storePath)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return map[string]map[string]*Verification{}, nil
+        }
+        return nil, err
+    }
+    
+    verified := make(map[string]map[string]*Verification)
+    if err := json.Unmarshal(data, &verified); err != nil {
+        return nil, err
+    }
+    
+    return verified, nil
+}
+
+func (vs *VerificationStore) save(verified map[string]map[string]*Verification) error {
+    data, err := json.Marshal(verified)
+    if err != nil {
+        return err
+    }
+    
+    return os.WriteFile(vs.storePath, data, 0600)
+}
+
+// Get returns the user's verification of a contact, or nil if they have not
+// verified them.
+func (vs *VerificationStore) Get(userID, contactID string) *Verification {
+    verified, err := vs.load()
+    if err != nil {
+        return nil
+    }
+    return verified[userID][contactID]
+}
+
+// MarkVerified records that the user verified the contact's key with the
+// given fingerprint.
+func (vs *VerificationStore) MarkVerified(userID, contactID, fingerprint string) error {
+    verified, err := vs.load()
+    if err != nil {
+        return err
+    }
+    
+    if verified[userID] == nil {
+        verified[userID] = make(map[string]*Verification)
+    }
+    verified[userID][contactID] = &Verification{
+        Fingerprint: fingerprint,
+        VerifiedAt:  time.Now(),
+    }
+    
+    return vs.save(verified)
+}
+
+func (vs *VerificationStore) ClearVerified(userID, contactID string) error {
+    verified, err := vs.load()
+    if err != nil {
+        return err
+    }
+    
+    if _, ok := verified[userID][contactID]; !ok {
+        return nil
+    }
+    delete(verified[userID], contactID)
+    
+    return vs.save(verified)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+)
+
+// keyBackupFileName is the name offered for a saved key backup.
+const keyBackupFileName = "secure-messenger-keys.backup"
+
+const (
+    restoreFromServer = "Backup stored on server"
+    restoreFromFile   = "Backup file"
+)
+
+// showKeyBackup backs up the user's keys under a new recovery phrase, to a
+// file or to the server. Every backup gets its own phrase.
+func (cw *ChatWindow) showKeyBackup() {
+    phrase, backup, err := cw.client.CreateKeyBackup()
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to back up keys: %v", err), cw.window)
+        return
+    }
+    
+    info := widget.NewLabel("Write this recovery phrase down and keep it somewhere safe. " +
+        "It is the only way to restore the backup, and anyone who has both can read your messages.")
+    info.Wrapping = fyne.TextWrapWord
+    
+    phraseLabel := widget.NewLabel(phrase)
+    phraseLabel.TextStyle = fyne.TextStyle{Monospace: true}
+    phraseLabel.Alignment = fyne.TextAlignCenter
+    
+    saveBtn := widget.NewButton("Save Backup File...", func() {
+        saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+            if err != nil {
+                dialog.ShowError(err, cw.window)
+                return
+            }
+            if writer == nil {
+                return
+            }
+            defer writer.Close()
+            
+            if _, err := writer.Write(backup); err != nil {
+                dialog.ShowError(fmt.Errorf("Failed to save backup: %v", err), cw.window)
+            }
+        }, cw.window)
+        saveDialog.SetFileName(keyBackupFileName)
+        saveDialog.Show()
+    })
+    
+    serverBtn := widget.NewButton("Store on Server", func() {
+        if err := cw.client.UploadKeyBackup(backup); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to store backup: %v", err), cw.window)
+            return
+        }
+        dialog.ShowInformation("Backup Stored", "The server keeps your encrypted backup, it cannot read it without the recovery phrase.", cw.window)
+    })
+    
+    content := container.NewVBox(info, phraseLabel, container.NewHBox(saveBtn, serverBtn))
+    backupDialog := dialog.NewCustom("Back Up Keys", "Done", content, cw.window)
+    backupDialog.Resize(fyne.NewSize(460, 260))
+    backupDialog.Show()
+}
+
+// handleRestore logs in and restores the user's keys on this device from a
+// backup, for a user whose machine was lost.
+func (lw *LoginWindow) handleRestore(username, password string) {
+    if username == "" || password == "" {
+        dialog.ShowError(fmt.Errorf("Please enter username and password"), lw.window)
+        return
+    }
+    
+    // Connect to server
+    if err := lw.client.Connect(); err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to connect to server: %v", err), lw.window)
+        return
+    }
+    
+    response, err := lw.client.Login(username, password)
+    if err == nil && !response.Success {
+        err = fmt.Errorf("%s", response.Error)
+    }
+    if err != nil {
+        lw.client.Disconnect()
+        dialog.ShowError(fmt.Errorf("Login failed: %v", err), lw.window)
+        return
+    }
+    
+    lw.promptRestore()
+}
+
+// promptRestore asks for the backup, its recovery phrase and the passphrase
+// to protect the restored keys with on this device.
+func (lw *LoginWindow) promptRestore() {
+    source := widget.NewRadioGroup([]string{restoreFromServer, restoreFromFile}, nil)
+    source.SetSelected(restoreFromServer)
+    phraseEntry := widget.NewEntry()
+    phraseEntry.SetPlaceHolder("XXXX-XXXX-XXXX-XXXX-XXXX-XXXX-XXXX-XXXX")
+    passphraseEntry := widget.NewPasswordEntry()
+    confirmEntry := widget.NewPasswordEntry()
+    
+    items := []*widget.FormItem{
+        widget.NewFormItem("Restore from", source),
+        widget.NewFormItem("Recovery phrase", phraseEntry),
+        widget.NewFormItem("New passphrase", passphraseEntry),
+        widget.NewFormItem("Confirm", confirmEntry),
+    }
+    
+    form := dialog.NewForm("Restore Keys", "Restore", "Cancel", items, func(ok bool) {
+        if !ok {
+            lw.client.Disconnect()
+            return
+        }
+        if passphraseEntry.Text != confirmEntry.Text {
+            dialog.ShowError(fmt.Errorf("Passphrases do not match"), lw.window)
+            lw.client.Disconnect()
+            return
+        }
+        
+        restore := func(backup []byte) {
+            if err := lw.client.RestoreKeys(backup, phraseEntry.Text, passphraseEntry.Text); err != nil {
+                lw.client.Disconnect()
+                dialog.ShowError(fmt.Errorf("Failed to restore keys: %v", err), lw.window)
+                return
+            }
+            lw.client.Disconnect()
+            lw.openChat()
+        }
+        
+        if source.Selected == restoreFromServer {
+            backup, err := lw.client.FetchKeyBackup()
+            if err != nil {
+                lw.client.Disconnect()
+                dialog.ShowError(fmt.Errorf("Failed to fetch backup: %v", err), lw.window)
+                return
+            }
+            restore(backup)
+            return
+        }
+        
+        dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+            if err != nil || reader == nil {
+                lw.client.Disconnect()
+                if err != nil {
+                    dialog.ShowError(err, lw.window)
+                }
+                return
+            }
+            defer reader.Close()
+            
+            backup, err := io.ReadAll(io.LimitReader(reader, 64*1024))
+            if err != nil {
+                lw.client.Disconnect()
+                dialog.ShowError(fmt.Errorf("Failed to read backup: %v", err), lw.window)
+                return
+            }
+            restore(backup)
+        }, lw.window)
+    }, lw.window)
+    form.Resize(fyne.NewSize(460, 300))
+    form.Show()
+}
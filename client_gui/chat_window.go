@@ -1,23 +1,38 @@
 package main
 
 import (
+    "bytes"
+    "encoding/json"
     "fmt"
+    "image"
+    "log"
     "fyne.io/fyne/v2"
     "fyne.io/fyne/v2/container"
     "fyne.io/fyne/v2/dialog"
     "fyne.io/fyne/v2/widget"
     "secure-messenger/client"
     "secure-messenger/shared"
+    "strings"
+    "sync"
+    "time"
 )
 
 type ChatWindow struct {
     app           fyne.App
     window        fyne.Window
     client        *client.NetworkClient
+    cache         *client.MessageHandler
+    drafts        *client.DraftSaver
+    syncedDraft   string // the draft last loaded into the entry
     messageList   *widget.List
     messageEntry  *widget.Entry
     sendBtn       *widget.Button
     messages      []*shared.Message
+    pinned        map[string]bool
+    previews      map[string]image.Image // decoded thumbnails by attachment ID
+    previewMu     sync.Mutex
+    hasMore       bool
+    loadingOlder  bool
     currentChat   string
     chatType      string // "user" or "channel"
 }
@@ -28,13 +43,29 @@ func NewChatWindow(app fyne.App) *ChatWindow {
     w.CenterOnScreen()
     
     cw := &ChatWindow{
-        app:    app,
-        window: w,
-        client: client.NewNetworkClient(),
+        app:      app,
+        window:   w,
+        client:   client.NewNetworkClient(),
+        cache:    client.NewMessageHandler(),
+        pinned:   make(map[string]bool),
+        previews: make(map[string]image.Image),
     }
     
+    cw.drafts = client.NewDraftSaver(cw.client)
     cw.setupUI()
+    cw.client.OnReactionUpdated(cw.handleReactionUpdated)
+    cw.client.OnMention(cw.handleMention)
+    cw.client.OnPinUpdated(cw.handlePinUpdated)
+    cw.client.OnMessage(cw.handleMessage)
+    cw.client.OnUpdate(cw.handleUpdate)
+    cw.client.OnResync(cw.loadRecentMessages)
+    cw.client.OnMessagesDeleted(cw.removeMessages)
+    cw.client.OnScheduledMessageFailed(cw.handleScheduledFailed)
+    cw.client.OnDraftUpdated(cw.handleDraftUpdated)
+    cw.client.OnKeyChanged(cw.warnKeyChanged)
+    cw.client.OnSessionRevoked(cw.handleSessionRevoked)
     cw.loadSession()
+    go cw.purgeExpired()
     return cw
 }
 
@@ -45,13 +76,50 @@ func (cw *ChatWindow) setupUI() {
             return len(cw.messages)
         },
         func() fyne.CanvasObject {
-            return widget.NewLabel("")
+            // Message text with a row of reaction chips underneath
+            return container.NewVBox(
+                widget.NewLabel(""),
+                container.NewHBox(widget.NewButton("+", nil)),
+            )
         },
         func(id widget.ListItemID, obj fyne.CanvasObject) {
+            // Reaching the top of the list pulls in the previous page
+            if id == 0 && cw.hasMore && !cw.loadingOlder {
+                cw.loadingOlder = true
+                go cw.loadOlderMessages()
+            }
+            
             if id < len(cw.messages) {
                 msg := cw.messages[id]
-                label := obj.(*widget.Label)
-                label.SetText(msg.Content)
+                row := obj.(*fyne.Container)
+                label := row.Objects[0].(*widget.Label)
+                chips := row.Objects[1].(*fyne.Container)
+                
+                // System entries such as pins are shown without actions,
+                // as coming from the server rather than the user named
+                if msg.Type == shared.MessageTypeSystem {
+                    label.TextStyle = fyne.TextStyle{Italic: true}
+                    text := "— Server: " + msg.Content + " —"
+                    if msg.Unverified {
+                        text = "⚠ Unverified: " + text
+                    }
+                    label.SetText(text)
+                    chips.Objects = nil
+                } else {
+                    label.TextStyle = fyne.TextStyle{}
+                    text := msg.Content
+                    if msg.ExpiresAt != nil {
+                        text = "⏱ " + text
+                    }
+                    // The sender's signature is missing or does not match
+                    if msg.Unverified {
+                        text = "⚠ Unverified: " + text
+                    }
+                    label.SetText(text)
+                    chips.Objects = append(cw.attachmentButtons(msg), cw.reactionChips(msg)...)
+                    chips.Objects = append(chips.Objects, cw.pinButton(msg))
+                }
+                chips.Refresh()
             }
         },
     )
@@ -59,12 +127,23 @@ func (cw *ChatWindow) setupUI() {
     // Message entry
     cw.messageEntry = widget.NewMultiLineEntry()
     cw.messageEntry.SetPlaceHolder("Type your message...")
+    cw.messageEntry.OnChanged = cw.saveDraft
     
     // Send button
     cw.sendBtn = widget.NewButton("Send", func() {
         cw.sendMessage()
     })
     
+    // Send later button
+    laterBtn := widget.NewButton("Later", func() {
+        cw.sendLater()
+    })
+    
+    // Attach button
+    attachBtn := widget.NewButton("Attach", func() {
+        cw.attachFile()
+    })
+    
     // Chat list (users and channels)
     chatList := widget.NewList(
         func() int {
@@ -79,10 +158,65 @@ func (cw *ChatWindow) setupUI() {
         },
     )
     
+    // Mentions button
+    mentionsBtn := widget.NewButton("Mentions", func() {
+        cw.showMentions()
+    })
+    
+    // Pinned messages button
+    pinnedBtn := widget.NewButton("Pinned", func() {
+        cw.showPinned()
+    })
+    
+    // Disappearing messages button
+    disappearingBtn := widget.NewButton("Disappearing", func() {
+        cw.showDisappearingTimer()
+    })
+    
+    // Channel roles button
+    rolesBtn := widget.NewButton("Roles", func() {
+        cw.showChannelRoles()
+    })
+    
+    // Scheduled messages button
+    scheduledBtn := widget.NewButton("Scheduled", func() {
+        cw.showScheduled()
+    })
+    
+    // Safety number verification button
+    verifyBtn := widget.NewButton("Verify", func() {
+        cw.showVerification()
+    })
+    
+    // Key passphrase button
+    passphraseBtn := widget.NewButton("Passphrase", func() {
+        cw.showChangePassphrase()
+    })
+    
+    // Key backup button
+    backupBtn := widget.NewButton("Backup", func() {
+        cw.showKeyBackup()
+    })
+    
+    // Keys button, to list and rotate keys
+    keysBtn := widget.NewButton("Keys", func() {
+        cw.showKeys()
+    })
+    
+    // Account password button
+    passwordBtn := widget.NewButton("Password", func() {
+        cw.showChangePassword()
+    })
+    
+    // Two-factor authentication button
+    twoFactorBtn := widget.NewButton("2FA", func() {
+        cw.showTwoFactor()
+    })
+    
     // Layout
     chatPanel := container.NewBorder(
-        nil,
-        container.NewHBox(cw.messageEntry, cw.sendBtn),
+        container.NewHBox(mentionsBtn, pinnedBtn, disappearingBtn, rolesBtn, scheduledBtn, verifyBtn, passphraseBtn, backupBtn, keysBtn, passwordBtn, twoFactorBtn),
+        container.NewHBox(cw.messageEntry, attachBtn, laterBtn, cw.sendBtn),
         nil,
         nil,
         cw.messageList,
@@ -113,8 +247,9 @@ func (cw *ChatWindow) loadSession() {
         return
     }
     
-    // Load recent messages
-    cw.loadRecentMessages()
+    // Unlock this device's keys so messages can be encrypted and read, then
+    // load recent messages
+    cw.promptUnlock()
 }
 
 func (cw *ChatWindow) sendMessage() {
@@ -129,37 +264,755 @@ func (cw *ChatWindow) sendMessage() {
     }
     
     var err error
+    var response *shared.SendMessageResponse
     if cw.chatType == "user" {
         err = cw.client.SendMessage(cw.currentChat, content)
     } else {
-        err = cw.client.SendChannelMessage(cw.currentChat, content)
+        response, err = cw.client.SendChannelMessage(cw.currentChat, content)
+        if err == nil && !response.Success {
+            err = fmt.Errorf("%s", response.Error)
+        }
     }
     
     if err != nil {
-        dialog.ShowError(fmt.Errorf("Failed to send message: %v", err), cw.window)
+        cw.showSendError("Failed to send message", err)
         return
     }
     
+    cw.clearDraft(cw.currentChat, cw.chatType)
     cw.messageEntry.SetText("")
     cw.loadRecentMessages()
+    
+    if response != nil && len(response.NonMemberMentions) > 0 {
+        cw.promptInvite(cw.currentChat, response.NonMemberMentions)
+    }
 }
 
+// attachFile lets the user pick a file, then encrypts, uploads and sends it
+// to the current chat along with any text in the message entry.
+func (cw *ChatWindow) attachFile() {
+    if cw.currentChat == "" {
+        dialog.ShowError(fmt.Errorf("Please select a chat"), cw.window)
+        return
+    }
+    
+    dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+        if err != nil {
+            dialog.ShowError(err, cw.window)
+            return
+        }
+        if reader == nil {
+            return
+        }
+        path := reader.URI().Path()
+        reader.Close()
+        
+        chatID, chatType, content := cw.currentChat, cw.chatType, cw.messageEntry.Text
+        go func() {
+            attachment, err := cw.client.UploadAttachment(path)
+            if err != nil {
+                dialog.ShowError(fmt.Errorf("Failed to upload file: %v", err), cw.window)
+                return
+            }
+            
+            if chatType == "user" {
+                err = cw.client.SendMessage(chatID, content, attachment)
+            } else {
+                var response *shared.SendMessageResponse
+                response, err = cw.client.SendChannelMessage(chatID, content, attachment)
+                if err == nil && !response.Success {
+                    err = fmt.Errorf("%s", response.Error)
+                }
+            }
+            
+            if err != nil {
+                cw.showSendError("Failed to send file", err)
+                return
+            }
+            
+            cw.clearDraft(chatID, chatType)
+            cw.messageEntry.SetText("")
+            cw.loadRecentMessages()
+        }()
+    }, cw.window)
+}
+
+func (cw *ChatWindow) attachmentButtons(msg *shared.Message) []fyne.CanvasObject {
+    var buttons []fyne.CanvasObject
+    
+    for _, attachment := range msg.Attachments {
+        attachment := attachment
+        
+        if client.IsImage(attachment.MimeType) && attachment.PreviewHash != "" {
+            open := func() {
+                NewImageViewer(cw.app, cw.client, attachment).Show()
+            }
+            
+            if preview := cw.preview(attachment); preview != nil {
+                buttons = append(buttons, NewThumbnail(preview, open))
+            } else {
+                buttons = append(buttons, widget.NewButton("🖼 "+attachment.Name, open))
+            }
+            continue
+        }
+        
+        buttons = append(buttons, widget.NewButton("📎 "+attachment.Name, func() {
+            cw.saveAttachment(attachment)
+        }))
+    }
+    
+    return buttons
+}
+
+// preview returns the decoded thumbnail of an attachment, starting to fetch
+// it in the background the first time it is asked for.
+func (cw *ChatWindow) preview(attachment *shared.Attachment) image.Image {
+    cw.previewMu.Lock()
+    defer cw.previewMu.Unlock()
+    
+    if preview, ok := cw.previews[attachment.ID]; ok {
+        return preview
+    }
+    
+    // A nil entry marks a fetch in progress, or one that failed
+    cw.previews[attachment.ID] = nil
+    go cw.loadPreview(attachment)
+    return nil
+}
+
+func (cw *ChatWindow) loadPreview(attachment *shared.Attachment) {
+    data, err := cw.client.FetchPreview(attachment)
+    if err != nil {
+        return
+    }
+    
+    preview, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return
+    }
+    
+    cw.previewMu.Lock()
+    cw.previews[attachment.ID] = preview
+    cw.previewMu.Unlock()
+    
+    cw.messageList.Refresh()
+}
+
+// saveAttachment asks where to save an attachment, then downloads and
+// decrypts it there.
+func (cw *ChatWindow) saveAttachment(attachment *shared.Attachment) {
+    saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+        if err != nil {
+            dialog.ShowError(err, cw.window)
+            return
+        }
+        if writer == nil {
+            return
+        }
+        path := writer.URI().Path()
+        writer.Close()
+        
+        go func() {
+            if err := cw.client.DownloadAttachment(attachment, path); err != nil {
+                dialog.ShowError(fmt.Errorf("Failed to download file: %v", err), cw.window)
+            }
+        }()
+    }, cw.window)
+    saveDialog.SetFileName(attachment.Name)
+    saveDialog.Show()
+}
+
+// promptInvite offers to add mentioned users who are not channel members,
+// since they will not see the message otherwise.
+func (cw *ChatWindow) promptInvite(channelID string, users []*shared.User) {
+    names := make([]string, len(users))
+    for i, user := range users {
+        names[i] = "@" + user.Username
+    }
+    
+    verb := "are"
+    if len(users) == 1 {
+        verb = "is"
+    }
+    message := fmt.Sprintf("%s %s not in this channel and won't be notified. Invite them?", strings.Join(names, ", "), verb)
+    
+    dialog.ShowConfirm("Invite to Channel", message, func(invite bool) {
+        if !invite {
+            return
+        }
+        
+        for _, user := range users {
+            if err := cw.client.AddUserToChannel(channelID, user.ID); err != nil {
+                dialog.ShowError(fmt.Errorf("Failed to invite %s: %v", user.Username, err), cw.window)
+                return
+            }
+        }
+    }, cw.window)
+}
+
+func (cw *ChatWindow) handleMention(msg *shared.Message) {
+    cw.app.SendNotification(fyne.NewNotification("You were mentioned", msg.Content))
+}
+
+func (cw *ChatWindow) showMentions() {
+    page, err := cw.client.GetMentions(shared.Page{Limit: 50})
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load mentions: %v", err), cw.window)
+        return
+    }
+    mentions := page.Messages
+    
+    list := widget.NewList(
+        func() int {
+            return len(mentions)
+        },
+        func() fyne.CanvasObject {
+            return widget.NewLabel("")
+        },
+        func(id widget.ListItemID, obj fyne.CanvasObject) {
+            msg := mentions[id]
+            obj.(*widget.Label).SetText(fmt.Sprintf("[%s] %s", msg.Timestamp.Format("Jan 2 15:04"), msg.Content))
+        },
+    )
+    
+    mentionsDialog := dialog.NewCustom("Mentions", "Close", list, cw.window)
+    mentionsDialog.Resize(fyne.NewSize(500, 400))
+    mentionsDialog.Show()
+}
+
+// messagePageSize is how many messages are fetched per history page.
+const messagePageSize = 50
+
 func (cw *ChatWindow) loadRecentMessages() {
     if cw.currentChat == "" {
         return
     }
     
-    var err error
+    page, err := cw.fetchMessages(shared.Page{Limit: messagePageSize})
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load messages: %v", err), cw.window)
+        return
+    }
+    
+    cw.messages = chronological(page.Messages)
+    cw.hasMore = page.HasMore
+    
+    cw.loadPinned()
+    cw.restoreDraft()
+    cw.messageList.Refresh()
+    cw.messageList.ScrollToBottom()
+}
+
+// loadOlderMessages prepends the page before the oldest loaded message. It is
+// triggered when the first row of the list becomes visible.
+func (cw *ChatWindow) loadOlderMessages() {
+    defer func() { cw.loadingOlder = false }()
+    
+    if len(cw.messages) == 0 {
+        return
+    }
+    
+    page, err := cw.fetchMessages(shared.Page{Before: cw.messages[0].ID, Limit: messagePageSize})
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load older messages: %v", err), cw.window)
+        return
+    }
+    
+    older := chronological(page.Messages)
+    cw.messages = append(older, cw.messages...)
+    cw.hasMore = page.HasMore
+    
+    cw.messageList.Refresh()
+    cw.messageList.ScrollTo(len(older))
+}
+
+func (cw *ChatWindow) fetchMessages(page shared.Page) (*shared.MessagePage, error) {
     if cw.chatType == "user" {
-        cw.messages, err = cw.client.GetMessages(cw.currentChat, 50)
+        return cw.client.GetMessages(cw.currentChat, page)
+    }
+    return cw.client.GetChannelMessages(cw.currentChat, page)
+}
+
+// chronological reverses a newest-first page so the list reads top to bottom.
+func chronological(messages []*shared.Message) []*shared.Message {
+    result := make([]*shared.Message, len(messages))
+    for i, msg := range messages {
+        result[len(messages)-1-i] = msg
+    }
+    return result
+}
+
+func (cw *ChatWindow) loadPinned() {
+    pinned, err := cw.fetchPinned()
+    if err != nil {
+        return
+    }
+    
+    cw.pinned = make(map[string]bool)
+    for _, msg := range pinned {
+        cw.pinned[msg.ID] = true
+    }
+}
+
+func (cw *ChatWindow) fetchPinned() ([]*shared.Message, error) {
+    if cw.chatType == "user" {
+        return cw.client.GetPinned("", cw.currentChat)
+    }
+    return cw.client.GetPinned(cw.currentChat, "")
+}
+
+// reactionPalette is offered when adding a new reaction to a message.
+var reactionPalette = []string{"👍", "❤️", "😂", "🎉", "😮", "😢"}
+
+func (cw *ChatWindow) reactionChips(msg *shared.Message) []fyne.CanvasObject {
+    var chips []fyne.CanvasObject
+    
+    for _, reaction := range msg.Reactions {
+        emoji := reaction.Emoji
+        chip := widget.NewButton(fmt.Sprintf("%s %d", emoji, reaction.Count), func() {
+            cw.toggleReaction(msg.ID, emoji)
+        })
+        if cw.hasReacted(reaction) {
+            chip.Importance = widget.HighImportance
+        }
+        chips = append(chips, chip)
+    }
+    
+    addBtn := widget.NewButton("+", func() {
+        cw.showReactionPicker(msg.ID)
+    })
+    
+    return append(chips, addBtn)
+}
+
+func (cw *ChatWindow) hasReacted(reaction *shared.Reaction) bool {
+    user := cw.client.GetUser()
+    if user == nil {
+        return false
+    }
+    
+    for _, userID := range reaction.Users {
+        if userID == user.ID {
+            return true
+        }
+    }
+    return false
+}
+
+func (cw *ChatWindow) showReactionPicker(messageID string) {
+    var picker dialog.Dialog
+    
+    buttons := container.NewHBox()
+    for _, emoji := range reactionPalette {
+        emoji := emoji
+        buttons.Add(widget.NewButton(emoji, func() {
+            picker.Hide()
+            cw.toggleReaction(messageID, emoji)
+        }))
+    }
+    
+    picker = dialog.NewCustom("Add Reaction", "Cancel", buttons, cw.window)
+    picker.Show()
+}
+
+// toggleReaction adds the emoji if the current user has not used it on the
+// message yet and removes it otherwise.
+func (cw *ChatWindow) toggleReaction(messageID, emoji string) {
+    msg := cw.findMessage(messageID)
+    if msg == nil {
+        return
+    }
+    
+    reacted := false
+    for _, reaction := range msg.Reactions {
+        if reaction.Emoji == emoji {
+            reacted = cw.hasReacted(reaction)
+            break
+        }
+    }
+    
+    var reactions []*shared.Reaction
+    var err error
+    if reacted {
+        reactions, err = cw.client.RemoveReaction(messageID, emoji)
     } else {
-        cw.messages, err = cw.client.GetChannelMessages(cw.currentChat, 50)
+        reactions, err = cw.client.AddReaction(messageID, emoji)
     }
     
     if err != nil {
-        dialog.ShowError(fmt.Errorf("Failed to load messages: %v", err), cw.window)
+        dialog.ShowError(fmt.Errorf("Failed to update reaction: %v", err), cw.window)
+        return
+    }
+    
+    msg.Reactions = reactions
+    cw.messageList.Refresh()
+}
+
+func (cw *ChatWindow) handleReactionUpdated(messageID string, reactions []*shared.Reaction) {
+    msg := cw.findMessage(messageID)
+    if msg == nil {
+        return
+    }
+    
+    msg.Reactions = reactions
+    cw.messageList.Refresh()
+}
+
+// handleUpdate applies updates missed while offline to the open chat.
+func (cw *ChatWindow) handleUpdate(update *shared.Update) {
+    switch update.Type {
+    case shared.UpdateMessageNew:
+        var payload struct {
+            Message *shared.Message `json:"message"`
+        }
+        if err := json.Unmarshal(update.Payload, &payload); err != nil || payload.Message == nil {
+            return
+        }
+        
+        cw.appendMessage(payload.Message)
+    case shared.UpdateMessagesDeleted:
+        var payload struct {
+            MessageIDs []string `json:"message_ids"`
+        }
+        if err := json.Unmarshal(update.Payload, &payload); err != nil {
+            return
+        }
+        
+        cw.removeMessages(payload.MessageIDs)
+    }
+}
+
+// removeMessages drops deleted messages from the open chat and the local
+// cache.
+func (cw *ChatWindow) removeMessages(messageIDs []string) {
+    if len(messageIDs) == 0 {
+        return
+    }
+    
+    remove := make(map[string]bool, len(messageIDs))
+    for _, id := range messageIDs {
+        remove[id] = true
+    }
+    
+    var kept []*shared.Message
+    for _, msg := range cw.messages {
+        if !remove[msg.ID] {
+            kept = append(kept, msg)
+        }
+    }
+    
+    if len(kept) != len(cw.messages) {
+        cw.messages = kept
+        cw.messageList.Refresh()
+    }
+    
+    cw.cache.RemoveMessages(messageIDs)
+}
+
+// expiryCheckInterval is how often expired disappearing messages are removed
+// locally.
+const expiryCheckInterval = 15 * time.Second
+
+// purgeExpired removes disappearing messages as soon as they expire rather
+// than waiting for the server, which deletes them on its own schedule.
+func (cw *ChatWindow) purgeExpired() {
+    for range time.Tick(expiryCheckInterval) {
+        now := time.Now()
+        
+        var expired []string
+        for _, msg := range cw.messages {
+            if msg.Expired(now) {
+                expired = append(expired, msg.ID)
+            }
+        }
+        
+        cw.removeMessages(expired)
+        cw.cache.PurgeExpired(now)
+    }
+}
+
+// showVerification opens the safety number of the current direct chat.
+func (cw *ChatWindow) showVerification() {
+    if cw.currentChat == "" || cw.chatType != "user" {
+        dialog.ShowError(fmt.Errorf("Select a direct chat to verify"), cw.window)
+        return
+    }
+    
+    NewVerificationWindow(cw.app, cw.client, cw.currentChat).Show()
+}
+
+// showDisappearingTimer lets the user change how long new messages of the
+// current chat are kept.
+func (cw *ChatWindow) showDisappearingTimer() {
+    if cw.currentChat == "" {
+        dialog.ShowError(fmt.Errorf("Please select a chat"), cw.window)
+        return
+    }
+    
+    channelID, otherUserID := conversationOf(cw.currentChat, cw.chatType)
+    current, err := cw.client.GetDisappearingTimer(channelID, otherUserID)
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load disappearing timer: %v", err), cw.window)
+        return
+    }
+    
+    timers := append([]time.Duration{0}, shared.DisappearingTimers...)
+    options := make([]string, len(timers))
+    for i, timer := range timers {
+        options[i] = shared.DisappearingTimerLabel(timer)
+    }
+    
+    selectTimer := widget.NewSelect(options, nil)
+    selectTimer.SetSelected(shared.DisappearingTimerLabel(current))
+    
+    dialog.ShowForm("Disappearing Messages", "Save", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Delete after", selectTimer),
+    }, func(ok bool) {
+        if !ok || selectTimer.SelectedIndex() < 0 {
+            return
+        }
+        
+        timer := timers[selectTimer.SelectedIndex()]
+        if timer == current {
+            return
+        }
+        
+        systemMessage, err := cw.client.SetDisappearingTimer(channelID, otherUserID, timer)
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to change disappearing timer: %v", err), cw.window)
+            return
+        }
+        
+        cw.appendMessage(systemMessage)
+    }, cw.window)
+}
+
+// showChannelRoles lets the owner of the current channel make a member an
+// admin, or a plain member again.
+func (cw *ChatWindow) showChannelRoles() {
+    if cw.currentChat == "" || cw.chatType == "user" {
+        dialog.ShowError(fmt.Errorf("Select a channel to change roles"), cw.window)
+        return
+    }
+    
+    channels, err := cw.client.GetUserChannels()
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load channel: %v", err), cw.window)
+        return
+    }
+    var members []string
+    for _, channel := range channels {
+        if channel.ID == cw.currentChat {
+            members = channel.Members
+        }
+    }
+    
+    selectMember := widget.NewSelect(members, nil)
+    selectRole := widget.NewSelect([]string{shared.ChannelRoleAdmin, shared.ChannelRoleMember}, nil)
+    selectRole.SetSelected(shared.ChannelRoleAdmin)
+    
+    dialog.ShowForm("Channel Roles", "Save", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Member", selectMember),
+        widget.NewFormItem("Role", selectRole),
+    }, func(ok bool) {
+        if !ok || selectMember.Selected == "" {
+            return
+        }
+        
+        systemMessage, err := cw.client.SetChannelRole(cw.currentChat, selectMember.Selected, selectRole.Selected)
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to change role: %v", err), cw.window)
+            return
+        }
+        
+        cw.appendMessage(systemMessage)
+    }, cw.window)
+}
+
+// handleMessage shows a delivered message in the open chat, or notifies
+// about it when it belongs to another conversation.
+func (cw *ChatWindow) handleMessage(msg *shared.Message) {
+    if !cw.isCurrentChat(msg) {
+        if msg.Type != shared.MessageTypeSystem {
+            cw.app.SendNotification(fyne.NewNotification("New message", msg.Content))
+        }
+        return
+    }
+    
+    cw.appendMessage(msg)
+}
+
+// appendMessage adds a message to the open chat unless it is already shown,
+// since sync and delivery can both report the same message.
+func (cw *ChatWindow) appendMessage(msg *shared.Message) {
+    if !cw.isCurrentChat(msg) || cw.findMessage(msg.ID) != nil {
+        return
+    }
+    
+    cw.messages = append(cw.messages, msg)
+    cw.messageList.Refresh()
+    cw.messageList.ScrollToBottom()
+}
+
+func (cw *ChatWindow) findMessage(messageID string) *shared.Message {
+    for _, msg := range cw.messages {
+        if msg.ID == messageID {
+            return msg
+        }
+    }
+    return nil
+}
+
+func (cw *ChatWindow) pinButton(msg *shared.Message) fyne.CanvasObject {
+    label := "Pin"
+    if cw.pinned[msg.ID] {
+        label = "Unpin"
+    }
+    
+    return widget.NewButton(label, func() {
+        cw.togglePin(msg.ID)
+    })
+}
+
+func (cw *ChatWindow) togglePin(messageID string) {
+    var systemMessage *shared.Message
+    var err error
+    if cw.pinned[messageID] {
+        systemMessage, err = cw.client.UnpinMessage(messageID)
+    } else {
+        systemMessage, err = cw.client.PinMessage(messageID)
+    }
+    
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to update pin: %v", err), cw.window)
+        return
+    }
+    
+    cw.applyPinUpdate(messageID, !cw.pinned[messageID], systemMessage)
+}
+
+func (cw *ChatWindow) handlePinUpdated(messageID string, pinned bool, systemMessage *shared.Message) {
+    cw.applyPinUpdate(messageID, pinned, systemMessage)
+}
+
+// applyPinUpdate records the pin state and appends the system entry, which
+// may already be present when the update is echoed back as an event.
+func (cw *ChatWindow) applyPinUpdate(messageID string, pinned bool, systemMessage *shared.Message) {
+    if systemMessage == nil || !cw.isCurrentChat(systemMessage) {
         return
     }
     
+    cw.pinned[messageID] = pinned
+    if cw.findMessage(systemMessage.ID) == nil {
+        cw.messages = append(cw.messages, systemMessage)
+    }
     cw.messageList.Refresh()
 }
+
+func (cw *ChatWindow) isCurrentChat(msg *shared.Message) bool {
+    if cw.chatType == "channel" {
+        return msg.ChannelID == cw.currentChat
+    }
+    return msg.ChannelID == "" && (msg.From == cw.currentChat || msg.To == cw.currentChat)
+}
+
+func (cw *ChatWindow) showPinned() {
+    if cw.currentChat == "" {
+        dialog.ShowError(fmt.Errorf("Please select a chat"), cw.window)
+        return
+    }
+    
+    pinned, err := cw.fetchPinned()
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load pinned messages: %v", err), cw.window)
+        return
+    }
+    
+    list := widget.NewList(
+        func() int {
+            return len(pinned)
+        },
+        func() fyne.CanvasObject {
+            return widget.NewLabel("")
+        },
+        func(id widget.ListItemID, obj fyne.CanvasObject) {
+            obj.(*widget.Label).SetText(pinned[id].Content)
+        },
+    )
+    
+    pinnedDialog := dialog.NewCustom("Pinned Messages", "Close", list, cw.window)
+    pinnedDialog.Resize(fyne.NewSize(500, 400))
+    pinnedDialog.Show()
+}
+
+// conversationOf returns the channel ID or other user ID of a chat, as used
+// by conversation settings and drafts.
+func conversationOf(chatID, chatType string) (string, string) {
+    if chatType == "user" {
+        return "", chatID
+    }
+    return chatID, ""
+}
+
+// saveDraft saves what is typed as the open conversation's draft once typing
+// pauses, so it can be picked up on another device.
+func (cw *ChatWindow) saveDraft(text string) {
+    if cw.currentChat == "" || text == cw.syncedDraft {
+        return
+    }
+    
+    channelID, otherUserID := conversationOf(cw.currentChat, cw.chatType)
+    cw.drafts.Update(channelID, otherUserID, text)
+}
+
+// clearDraft clears the draft of a chat whose message was sent.
+func (cw *ChatWindow) clearDraft(chatID, chatType string) {
+    if chatID == cw.currentChat {
+        cw.syncedDraft = ""
+    }
+    
+    channelID, otherUserID := conversationOf(chatID, chatType)
+    cw.drafts.Clear(channelID, otherUserID)
+}
+
+// restoreDraft loads the saved draft of the open conversation into the
+// message entry, unless something is already typed there.
+func (cw *ChatWindow) restoreDraft() {
+    if cw.messageEntry.Text != "" {
+        return
+    }
+    
+    drafts, err := cw.client.GetDrafts()
+    if err != nil {
+        log.Printf("Failed to load drafts: %v", err)
+        return
+    }
+    
+    channelID, otherUserID := conversationOf(cw.currentChat, cw.chatType)
+    for _, draft := range drafts {
+        if draft.ChannelID == channelID && draft.OtherUserID == otherUserID {
+            cw.syncedDraft = draft.Content
+            cw.messageEntry.SetText(draft.Content)
+            return
+        }
+    }
+}
+
+// handleDraftUpdated shows a draft saved on another device, as long as the
+// entry still holds the previous draft rather than something newly typed.
+func (cw *ChatWindow) handleDraftUpdated(draft *shared.Draft) {
+    channelID, otherUserID := conversationOf(cw.currentChat, cw.chatType)
+    if cw.currentChat == "" || draft.ChannelID != channelID || draft.OtherUserID != otherUserID {
+        return
+    }
+    
+    text := cw.messageEntry.Text
+    if text != cw.syncedDraft && text != draft.Content {
+        return
+    }
+    
+    cw.syncedDraft = draft.Content
+    if text != draft.Content {
+        cw.messageEntry.SetText(draft.Content)
+    }
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/canvas"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    "image"
+    "secure-messenger/client"
+    "secure-messenger/shared"
+    
+    // Decoders for the image formats attachments can preview
+    _ "image/gif"
+    _ "image/jpeg"
+    _ "image/png"
+)
+
+// thumbnailSize is how large previews are drawn in the message list.
+const thumbnailSize = 128
+
+// Thumbnail shows an image preview that can be tapped.
+type Thumbnail struct {
+    widget.BaseWidget
+    image *canvas.Image
+    onTap func()
+}
+
+func NewThumbnail(img image.Image, onTap func()) *Thumbnail {
+    t := &Thumbnail{
+        image: canvas.NewImageFromImage(img),
+        onTap: onTap,
+    }
+    t.image.FillMode = canvas.ImageFillContain
+    t.image.SetMinSize(fyne.NewSize(thumbnailSize, thumbnailSize))
+    t.ExtendBaseWidget(t)
+    return t
+}
+
+func (t *Thumbnail) CreateRenderer() fyne.WidgetRenderer {
+    return widget.NewSimpleRenderer(t.image)
+}
+
+func (t *Thumbnail) Tapped(*fyne.PointEvent) {
+    if t.onTap != nil {
+        t.onTap()
+    }
+}
+
+// ImageViewer shows an image attachment at full size.
+type ImageViewer struct {
+    window     fyne.Window
+    client     *client.NetworkClient
+    attachment *shared.Attachment
+    data       []byte
+}
+
+func NewImageViewer(app fyne.App, nc *client.NetworkClient, attachment *shared.Attachment) *ImageViewer {
+    w := app.NewWindow(attachment.Name)
+    w.Resize(fyne.NewSize(800, 600))
+    w.CenterOnScreen()
+    
+    iv := &ImageViewer{
+        window:     w,
+        client:     nc,
+        attachment: attachment,
+    }
+    
+    iv.window.SetContent(widget.NewLabel("Loading..."))
+    go iv.load()
+    return iv
+}
+
+func (iv *ImageViewer) Show() {
+    iv.window.Show()
+}
+
+func (iv *ImageViewer) load() {
+    data, err := iv.client.FetchAttachment(iv.attachment, "")
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load image: %v", err), iv.window)
+        return
+    }
+    
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to decode image: %v", err), iv.window)
+        return
+    }
+    iv.data = data
+    
+    full := canvas.NewImageFromImage(img)
+    full.FillMode = canvas.ImageFillContain
+    
+    saveBtn := widget.NewButton("Save As...", func() {
+        iv.saveAs()
+    })
+    
+    iv.window.SetContent(container.NewBorder(
+        nil,
+        container.NewHBox(saveBtn),
+        nil,
+        nil,
+        full,
+    ))
+}
+
+// saveAs writes the already decrypted image wherever the user chooses.
+func (iv *ImageViewer) saveAs() {
+    saveDialog := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+        if err != nil {
+            dialog.ShowError(err, iv.window)
+            return
+        }
+        if writer == nil {
+            return
+        }
+        defer writer.Close()
+        
+        if _, err := writer.Write(iv.data); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to save image: %v", err), iv.window)
+        }
+    }, iv.window)
+    saveDialog.SetFileName(iv.attachment.Name)
+    saveDialog.Show()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "fmt"
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+)
+
+// showKeys lists the user's keypairs on this device and lets them rotate to
+// a new one.
+func (cw *ChatWindow) showKeys() {
+    list := container.NewVBox()
+    for _, key := range cw.client.Keys() {
+        created := "created before key history"
+        if !key.CreatedAt.IsZero() {
+            created = "created " + key.CreatedAt.Local().Format("Jan 2 2006 15:04")
+        }
+        status := "current"
+        if !key.RetiredAt.IsZero() {
+            status = "retired " + key.RetiredAt.Local().Format("Jan 2 2006 15:04")
+        }
+        
+        label := widget.NewLabel(fmt.Sprintf("%s  %s, %s", key.ID, created, status))
+        label.TextStyle = fyne.TextStyle{Monospace: true}
+        list.Add(label)
+    }
+    
+    info := widget.NewLabel("Rotating replaces your key with a new one. Older messages stay readable " +
+        "with the retired keys, and contacts move to the new key without a warning.")
+    info.Wrapping = fyne.TextWrapWord
+    
+    var keysDialog dialog.Dialog
+    rotateBtn := widget.NewButton("Rotate Keys...", func() {
+        keysDialog.Hide()
+        cw.promptRotateKeys()
+    })
+    
+    content := container.NewBorder(container.NewVBox(info, rotateBtn), nil, nil, nil, container.NewVScroll(list))
+    keysDialog = dialog.NewCustom("Encryption Keys", "Close", content, cw.window)
+    keysDialog.Resize(fyne.NewSize(520, 320))
+    keysDialog.Show()
+}
+
+// promptRotateKeys asks for the key passphrase, which the new key is saved
+// under, and rotates the user's keys.
+func (cw *ChatWindow) promptRotateKeys() {
+    passphraseEntry := widget.NewPasswordEntry()
+    
+    dialog.ShowForm("Rotate Keys", "Rotate", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Passphrase", passphraseEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if err := cw.client.RotateKeys(passphraseEntry.Text); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to rotate keys: %v", err), cw.window)
+            return
+        }
+        
+        dialog.ShowInformation("Keys Rotated", "Your new key is published. Back up your keys again, "+
+            "earlier backups do not include it.", cw.window)
+    }, cw.window)
+}
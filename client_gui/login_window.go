@@ -7,7 +7,6 @@ import (
     "fyne.io/fyne/v2/dialog"
     "fyne.io/fyne/v2/widget"
     "secure-messenger/client"
-    "time"
 )
 
 type LoginWindow struct {
@@ -54,6 +53,16 @@ func (lw *LoginWindow) setupUI() {
         lw.handleRegister(usernameEntry.Text, emailEntry.Text, passwordEntry.Text)
     })
     
+    // Restore keys button, for a new machine
+    restoreBtn := widget.NewButton("Restore Keys", func() {
+        lw.handleRestore(usernameEntry.Text, passwordEntry.Text)
+    })
+    
+    // Forgotten password button
+    forgotBtn := widget.NewButton("Forgot Password", func() {
+        lw.showPasswordReset()
+    })
+    
     // Server config button
     configBtn := widget.NewButton("Server Config", func() {
         lw.showServerConfig()
@@ -71,9 +80,9 @@ func (lw *LoginWindow) setupUI() {
         usernameEntry,
         passwordEntry,
         emailEntry,
-        container.NewHBox(loginBtn, registerBtn),
+        container.NewHBox(loginBtn, registerBtn, restoreBtn),
         widget.NewSeparator(),
-        container.NewHBox(configBtn, certBtn),
+        container.NewHBox(configBtn, certBtn, forgotBtn),
     )
     
     lw.window.SetContent(form)
@@ -99,24 +108,16 @@ func (lw *LoginWindow) handleLogin(username, password string) {
         return
     }
     
+    if response.Challenge != "" {
+        lw.promptTwoFactor(password, response)
+        return
+    }
     if !response.Success {
         dialog.ShowError(fmt.Errorf("Login failed: %s", response.Error), lw.window)
         return
     }
     
-    // Save session
-    sessionManager := client.NewSessionManager()
-    session := &client.Session{
-        Token:    response.Token,
-        User:     response.User,
-        LastSeen: time.Now(),
-    }
-    sessionManager.SaveSession(session)
-    
-    // Show chat window
-    chatWindow := NewChatWindow(lw.app)
-    chatWindow.window.Show()
-    lw.window.Hide()
+    lw.openChat()
 }
 
 func (lw *LoginWindow) handleRegister(username, email, password string) {
@@ -139,19 +140,24 @@ func (lw *LoginWindow) handleRegister(username, email, password string) {
         return
     }
     
+    if response.Challenge != "" {
+        lw.promptTwoFactor(password, response)
+        return
+    }
     if !response.Success {
         dialog.ShowError(fmt.Errorf("Registration failed: %s", response.Error), lw.window)
         return
     }
     
+    lw.openChat()
+}
+
+// openChat saves the session of the logged in user and switches to the chat
+// window.
+func (lw *LoginWindow) openChat() {
     // Save session
     sessionManager := client.NewSessionManager()
-    session := &client.Session{
-        Token:    response.Token,
-        User:     response.User,
-        LastSeen: time.Now(),
-    }
-    sessionManager.SaveSession(session)
+    sessionManager.SaveSession(lw.client.Session)
     
     // Show chat window
     chatWindow := NewChatWindow(lw.app)
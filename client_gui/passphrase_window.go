@@ -0,0 +1,125 @@
+package main
+
+import (
+    "fmt"
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    "secure-messenger/client"
+)
+
+// promptUnlock asks for the passphrase protecting the user's keys on this
+// device, then loads the chats. Users without a keystore yet choose one,
+// which encrypts keys kept unencrypted by earlier versions or new keys on a
+// new device. Nothing can be read or sent until the keys are unlocked, so
+// cancelling quits.
+func (cw *ChatWindow) promptUnlock() {
+    creating := !cw.client.HasKeystore()
+    
+    passphraseEntry := widget.NewPasswordEntry()
+    confirmEntry := widget.NewPasswordEntry()
+    items := []*widget.FormItem{widget.NewFormItem("Passphrase", passphraseEntry)}
+    
+    title := "Unlock Keys"
+    if creating {
+        title = "Protect Your Keys"
+        items = append(items, widget.NewFormItem("Confirm", confirmEntry))
+    }
+    
+    form := dialog.NewForm(title, "Unlock", "Quit", items, func(ok bool) {
+        if !ok {
+            cw.app.Quit()
+            return
+        }
+        
+        var err error
+        if creating && passphraseEntry.Text != confirmEntry.Text {
+            err = fmt.Errorf("Passphrases do not match")
+        } else if err = cw.client.EnsureKeys(passphraseEntry.Text); err != nil {
+            if elsewhere, ok := err.(*client.KeysElsewhereError); ok {
+                cw.promptKeysElsewhere(passphraseEntry.Text, elsewhere)
+                return
+            }
+            err = fmt.Errorf("Failed to unlock encryption keys: %v", err)
+        }
+        if err != nil {
+            errorDialog := dialog.NewError(err, cw.window)
+            errorDialog.SetOnClosed(cw.promptUnlock)
+            errorDialog.Show()
+            return
+        }
+        
+        cw.loadRecentMessages()
+    }, cw.window)
+    form.Show()
+}
+
+// promptKeysElsewhere explains that the account's published keys are not on
+// this device, and lets the user either publish this device's keys or log
+// out to restore theirs from a backup at login.
+func (cw *ChatWindow) promptKeysElsewhere(passphrase string, elsewhere *client.KeysElsewhereError) {
+    text := "Your encryption keys are on another device.\n\n" +
+        "Log out and use Restore Keys at login to bring them here from a backup,\n" +
+        "or create new keys for this device. With new keys, messages sent to\n" +
+        "your old key cannot be read here and your contacts are warned that\n" +
+        "your key changed."
+    confirm := "Create New Keys"
+    if elsewhere.HasLocalKeys {
+        text = "The keys on this device are not the ones your account uses, which\n" +
+            "were created or rotated on another device.\n\n" +
+            "Log out and use Restore Keys at login to bring them here from a backup,\n" +
+            "or use this device's keys instead. Your contacts are then warned that\n" +
+            "your key changed, and your other devices cannot read new messages."
+        confirm = "Use These Keys"
+    }
+    
+    message := widget.NewLabel(text)
+    message.Wrapping = fyne.TextWrapWord
+    
+    prompt := dialog.NewCustomConfirm("Keys on Another Device", confirm, "Log Out", message, func(ok bool) {
+        if !ok {
+            client.NewSessionManager().ClearSession()
+            cw.app.Quit()
+            return
+        }
+        
+        if err := cw.client.ReplacePublishedKeys(passphrase); err != nil {
+            errorDialog := dialog.NewError(fmt.Errorf("Failed to set up encryption keys: %v", err), cw.window)
+            errorDialog.SetOnClosed(cw.promptUnlock)
+            errorDialog.Show()
+            return
+        }
+        
+        cw.loadRecentMessages()
+    }, cw.window)
+    prompt.Show()
+}
+
+// showChangePassphrase lets the user encrypt their keys on this device under
+// a new passphrase.
+func (cw *ChatWindow) showChangePassphrase() {
+    currentEntry := widget.NewPasswordEntry()
+    newEntry := widget.NewPasswordEntry()
+    confirmEntry := widget.NewPasswordEntry()
+    
+    dialog.ShowForm("Change Passphrase", "Change", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Current", currentEntry),
+        widget.NewFormItem("New", newEntry),
+        widget.NewFormItem("Confirm", confirmEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if newEntry.Text != confirmEntry.Text {
+            dialog.ShowError(fmt.Errorf("Passphrases do not match"), cw.window)
+            return
+        }
+        if err := cw.client.ChangeKeyPassphrase(currentEntry.Text, newEntry.Text); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to change passphrase: %v", err), cw.window)
+            return
+        }
+        
+        dialog.ShowInformation("Passphrase Changed", "Your keys on this device are now protected by the new passphrase.", cw.window)
+    }, cw.window)
+}
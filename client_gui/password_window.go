@@ -0,0 +1,116 @@
+package main
+
+import (
+    "fmt"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    "secure-messenger/client"
+)
+
+// showPasswordReset asks for the email of the account whose password was
+// forgotten and has a reset token mailed to it.
+func (lw *LoginWindow) showPasswordReset() {
+    emailEntry := widget.NewEntry()
+    emailEntry.SetPlaceHolder("Email")
+    
+    dialog.ShowForm("Forgot Password", "Send Token", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Email", emailEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        if emailEntry.Text == "" {
+            dialog.ShowError(fmt.Errorf("Please enter your email"), lw.window)
+            return
+        }
+        
+        if err := lw.client.Connect(); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to connect to server: %v", err), lw.window)
+            return
+        }
+        err := lw.client.RequestPasswordReset(emailEntry.Text)
+        lw.client.Disconnect()
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to request reset: %v", err), lw.window)
+            return
+        }
+        
+        lw.promptResetToken()
+    }, lw.window)
+}
+
+// promptResetToken asks for the mailed reset token and the new password.
+func (lw *LoginWindow) promptResetToken() {
+    tokenEntry := widget.NewEntry()
+    passwordEntry := widget.NewPasswordEntry()
+    confirmEntry := widget.NewPasswordEntry()
+    
+    info := widget.NewLabel("If the email belongs to an account, a reset token was sent to it.")
+    form := dialog.NewForm("Reset Password", "Reset", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("", info),
+        widget.NewFormItem("Reset token", tokenEntry),
+        widget.NewFormItem("New password", passwordEntry),
+        widget.NewFormItem("Confirm", confirmEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        if passwordEntry.Text != confirmEntry.Text {
+            dialog.ShowError(fmt.Errorf("Passwords do not match"), lw.window)
+            return
+        }
+        
+        if err := lw.client.Connect(); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to connect to server: %v", err), lw.window)
+            return
+        }
+        err := lw.client.ResetPassword(tokenEntry.Text, passwordEntry.Text)
+        lw.client.Disconnect()
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to reset password: %v", err), lw.window)
+            return
+        }
+        
+        dialog.ShowInformation("Password Reset", "Your password was changed and you were logged out everywhere. Log in with the new password.", lw.window)
+    }, lw.window)
+    form.Show()
+}
+
+// showChangePassword lets the user choose a new account password. Their
+// other devices are logged out.
+func (cw *ChatWindow) showChangePassword() {
+    currentEntry := widget.NewPasswordEntry()
+    newEntry := widget.NewPasswordEntry()
+    confirmEntry := widget.NewPasswordEntry()
+    
+    dialog.ShowForm("Change Password", "Change", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Current", currentEntry),
+        widget.NewFormItem("New", newEntry),
+        widget.NewFormItem("Confirm", confirmEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if newEntry.Text != confirmEntry.Text {
+            dialog.ShowError(fmt.Errorf("Passwords do not match"), cw.window)
+            return
+        }
+        if err := cw.client.ChangePassword(currentEntry.Text, newEntry.Text); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to change password: %v", err), cw.window)
+            return
+        }
+        
+        dialog.ShowInformation("Password Changed", "Your password was changed and your other devices were logged out.", cw.window)
+    }, cw.window)
+}
+
+// handleSessionRevoked tells the user their session was ended elsewhere,
+// as by a password change, and quits.
+func (cw *ChatWindow) handleSessionRevoked() {
+    client.NewSessionManager().ClearSession()
+    
+    info := dialog.NewInformation("Logged Out", "Your session was ended, for example because your password was changed. Log in again to continue.", cw.window)
+    info.SetOnClosed(cw.app.Quit)
+    info.Show()
+}
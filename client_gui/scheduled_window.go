@@ -0,0 +1,178 @@
+package main
+
+import (
+    "fmt"
+    "secure-messenger/shared"
+    "time"
+    
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+)
+
+// scheduleTimeLayout is how send times are entered and shown, in local time.
+const scheduleTimeLayout = "2006-01-02 15:04"
+
+// sendLater asks when to send the message in the entry and schedules it for
+// the current chat.
+func (cw *ChatWindow) sendLater() {
+    content := cw.messageEntry.Text
+    if content == "" {
+        return
+    }
+    
+    if cw.currentChat == "" {
+        dialog.ShowError(fmt.Errorf("Please select a chat"), cw.window)
+        return
+    }
+    
+    chatID, chatType := cw.currentChat, cw.chatType
+    cw.promptSendTime("Send Later", time.Now().Add(time.Hour), func(sendAt time.Time) {
+        var err error
+        if chatType == "user" {
+            _, err = cw.client.ScheduleMessage(chatID, "", content, sendAt)
+        } else {
+            _, err = cw.client.ScheduleMessage("", chatID, content, sendAt)
+        }
+        
+        if err != nil {
+            cw.showSendError("Failed to schedule message", err)
+            return
+        }
+        
+        cw.clearDraft(chatID, chatType)
+        cw.messageEntry.SetText("")
+        dialog.ShowInformation("Message Scheduled", "Your message will be sent "+sendAt.Format("Mon Jan 2 15:04")+".", cw.window)
+    })
+}
+
+// promptSendTime asks for a send time, starting from initial, and calls
+// onPicked with it.
+func (cw *ChatWindow) promptSendTime(title string, initial time.Time, onPicked func(sendAt time.Time)) {
+    timeEntry := widget.NewEntry()
+    timeEntry.SetText(initial.Format(scheduleTimeLayout))
+    timeEntry.Validator = func(text string) error {
+        _, err := parseSendTime(text)
+        return err
+    }
+    
+    dialog.ShowForm(title, "Schedule", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Send at", timeEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        sendAt, err := parseSendTime(timeEntry.Text)
+        if err != nil {
+            dialog.ShowError(err, cw.window)
+            return
+        }
+        
+        onPicked(sendAt)
+    }, cw.window)
+}
+
+func parseSendTime(text string) (time.Time, error) {
+    sendAt, err := time.ParseInLocation(scheduleTimeLayout, text, time.Local)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("Enter a time like %s", scheduleTimeLayout)
+    }
+    if !sendAt.After(time.Now()) {
+        return time.Time{}, fmt.Errorf("Send time must be in the future")
+    }
+    return sendAt, nil
+}
+
+// showScheduled lists the user's scheduled messages with actions to edit or
+// cancel each one.
+func (cw *ChatWindow) showScheduled() {
+    scheduled, err := cw.client.GetScheduledMessages()
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load scheduled messages: %v", err), cw.window)
+        return
+    }
+    
+    var scheduledDialog dialog.Dialog
+    list := widget.NewList(
+        func() int {
+            return len(scheduled)
+        },
+        func() fyne.CanvasObject {
+            return container.NewBorder(nil, nil, nil,
+                container.NewHBox(widget.NewButton("Edit", nil), widget.NewButton("Cancel", nil)),
+                widget.NewLabel(""),
+            )
+        },
+        func(id widget.ListItemID, obj fyne.CanvasObject) {
+            item := scheduled[id]
+            row := obj.(*fyne.Container)
+            label := row.Objects[0].(*widget.Label)
+            buttons := row.Objects[1].(*fyne.Container)
+            
+            text := fmt.Sprintf("[%s] %s", item.SendAt.Local().Format("Jan 2 15:04"), item.Content)
+            if item.Status == shared.ScheduledStatusFailed {
+                text = "⚠ " + text + " (failed: " + item.Error + ")"
+            }
+            label.SetText(text)
+            
+            buttons.Objects[0].(*widget.Button).OnTapped = func() {
+                scheduledDialog.Hide()
+                cw.editScheduled(item)
+            }
+            buttons.Objects[1].(*widget.Button).OnTapped = func() {
+                scheduledDialog.Hide()
+                cw.cancelScheduled(item)
+            }
+        },
+    )
+    
+    scheduledDialog = dialog.NewCustom("Scheduled Messages", "Close", list, cw.window)
+    scheduledDialog.Resize(fyne.NewSize(600, 400))
+    scheduledDialog.Show()
+}
+
+func (cw *ChatWindow) editScheduled(scheduled *shared.ScheduledMessage) {
+    contentEntry := widget.NewMultiLineEntry()
+    contentEntry.SetText(scheduled.Content)
+    
+    initial := scheduled.SendAt.Local()
+    if !initial.After(time.Now()) {
+        initial = time.Now().Add(time.Hour)
+    }
+    
+    dialog.ShowForm("Edit Scheduled Message", "Next", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Message", contentEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        cw.promptSendTime("Edit Scheduled Message", initial, func(sendAt time.Time) {
+            if _, err := cw.client.EditScheduledMessage(scheduled, contentEntry.Text, sendAt); err != nil {
+                cw.showSendError("Failed to edit scheduled message", err)
+                return
+            }
+            cw.showScheduled()
+        })
+    }, cw.window)
+}
+
+func (cw *ChatWindow) cancelScheduled(scheduled *shared.ScheduledMessage) {
+    dialog.ShowConfirm("Cancel Scheduled Message", "Don't send this message?", func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if err := cw.client.CancelScheduledMessage(scheduled.ID); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to cancel scheduled message: %v", err), cw.window)
+            return
+        }
+        cw.showScheduled()
+    }, cw.window)
+}
+
+func (cw *ChatWindow) handleScheduledFailed(scheduled *shared.ScheduledMessage) {
+    cw.app.SendNotification(fyne.NewNotification("Scheduled message not sent", scheduled.Error))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+    "fmt"
+    "secure-messenger/shared"
+    "strings"
+    
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/canvas"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    qrcode "github.com/skip2/go-qrcode"
+)
+
+// promptTwoFactor asks for the second factor of a login the server answered
+// with a challenge, first enrolling an authenticator app if the server
+// requires two-factor authentication and the user has none yet.
+func (lw *LoginWindow) promptTwoFactor(password string, response *shared.AuthResponse) {
+    codeEntry := widget.NewEntry()
+    codeEntry.SetPlaceHolder("123456")
+    
+    content := container.NewVBox()
+    if response.TwoFactorSetup != nil {
+        content.Add(widget.NewLabel("This server requires two-factor authentication. Scan the code\nwith your authenticator app, then enter the code it shows."))
+        content.Add(twoFactorSetupView(response.TwoFactorSetup))
+    } else {
+        content.Add(widget.NewLabel("Enter the code from your authenticator app,\nor one of your recovery codes."))
+    }
+    content.Add(codeEntry)
+    
+    dialog.ShowCustomConfirm("Two-Factor Authentication", "Verify", "Cancel", content, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if err := lw.client.Connect(); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to connect to server: %v", err), lw.window)
+            return
+        }
+        defer lw.client.Disconnect()
+        
+        result, err := lw.client.LoginTwoFactor(password, response.Challenge, codeEntry.Text)
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Login failed: %v", err), lw.window)
+            return
+        }
+        if !result.Success {
+            dialog.ShowError(fmt.Errorf("Login failed: %s", result.Error), lw.window)
+            return
+        }
+        
+        if len(result.RecoveryCodes) > 0 {
+            showRecoveryCodes(result.RecoveryCodes, lw.window, lw.openChat)
+            return
+        }
+        lw.openChat()
+    }, lw.window)
+}
+
+// showTwoFactor shows whether two-factor authentication is on and lets the
+// user enable or disable it and get new recovery codes.
+func (cw *ChatWindow) showTwoFactor() {
+    status, err := cw.client.TwoFactorStatus()
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load two-factor settings: %v", err), cw.window)
+        return
+    }
+    
+    var twoFactorDialog dialog.Dialog
+    content := container.NewVBox()
+    if !status.Enabled {
+        content.Add(widget.NewLabel("Two-factor authentication is off. With it on, logging in\nalso takes a code from an authenticator app on your phone."))
+        content.Add(widget.NewButton("Enable...", func() {
+            twoFactorDialog.Hide()
+            cw.promptEnableTwoFactor()
+        }))
+    } else {
+        content.Add(widget.NewLabel(fmt.Sprintf("Two-factor authentication is on. %d of your recovery codes are left.", status.RecoveryCodes)))
+        content.Add(widget.NewButton("New Recovery Codes...", func() {
+            twoFactorDialog.Hide()
+            cw.promptRegenerateRecoveryCodes()
+        }))
+        
+        disableBtn := widget.NewButton("Disable...", func() {
+            twoFactorDialog.Hide()
+            cw.promptDisableTwoFactor()
+        })
+        if status.Required {
+            disableBtn.Disable()
+            content.Add(widget.NewLabel("This server requires two-factor authentication."))
+        }
+        content.Add(disableBtn)
+    }
+    
+    twoFactorDialog = dialog.NewCustom("Two-Factor Authentication", "Close", content, cw.window)
+    twoFactorDialog.Show()
+}
+
+// promptEnableTwoFactor shows a new secret to scan and enables it once the
+// user enters a code their app made from it.
+func (cw *ChatWindow) promptEnableTwoFactor() {
+    setup, err := cw.client.BeginTwoFactorSetup()
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to start setup: %v", err), cw.window)
+        return
+    }
+    
+    codeEntry := widget.NewEntry()
+    codeEntry.SetPlaceHolder("123456")
+    content := container.NewVBox(
+        widget.NewLabel("Scan the code with your authenticator app,\nthen enter the code it shows."),
+        twoFactorSetupView(setup),
+        codeEntry,
+    )
+    
+    dialog.ShowCustomConfirm("Enable Two-Factor Authentication", "Enable", "Cancel", content, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        codes, err := cw.client.ConfirmTwoFactorSetup(codeEntry.Text)
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to enable two-factor authentication: %v", err), cw.window)
+            return
+        }
+        showRecoveryCodes(codes, cw.window, nil)
+    }, cw.window)
+}
+
+func (cw *ChatWindow) promptRegenerateRecoveryCodes() {
+    codeEntry := widget.NewEntry()
+    
+    dialog.ShowForm("New Recovery Codes", "Generate", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("", widget.NewLabel("Your old recovery codes will stop working.")),
+        widget.NewFormItem("Code", codeEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        codes, err := cw.client.RegenerateRecoveryCodes(codeEntry.Text)
+        if err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to generate recovery codes: %v", err), cw.window)
+            return
+        }
+        showRecoveryCodes(codes, cw.window, nil)
+    }, cw.window)
+}
+
+func (cw *ChatWindow) promptDisableTwoFactor() {
+    passwordEntry := widget.NewPasswordEntry()
+    codeEntry := widget.NewEntry()
+    
+    dialog.ShowForm("Disable Two-Factor Authentication", "Disable", "Cancel", []*widget.FormItem{
+        widget.NewFormItem("Password", passwordEntry),
+        widget.NewFormItem("Code", codeEntry),
+    }, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if err := cw.client.DisableTwoFactor(passwordEntry.Text, codeEntry.Text); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to disable two-factor authentication: %v", err), cw.window)
+            return
+        }
+        dialog.ShowInformation("Two-Factor Authentication", "Two-factor authentication is off.", cw.window)
+    }, cw.window)
+}
+
+// twoFactorSetupView shows a TOTP secret as a QR code for authenticator
+// apps to scan, and as text to type in where scanning is not possible.
+func twoFactorSetupView(setup *shared.TwoFactorSetup) fyne.CanvasObject {
+    var qrImage fyne.CanvasObject = widget.NewLabel("QR code unavailable")
+    code, err := qrcode.New(setup.URI, qrcode.Medium)
+    if err == nil {
+        image := canvas.NewImageFromImage(code.Image(256))
+        image.FillMode = canvas.ImageFillContain
+        image.SetMinSize(fyne.NewSize(256, 256))
+        qrImage = image
+    }
+    
+    // Groups of four, the way apps show secrets typed in by hand
+    var groups []string
+    for i := 0; i < len(setup.Secret); i += 4 {
+        groups = append(groups, setup.Secret[i:min(i+4, len(setup.Secret))])
+    }
+    secretLabel := widget.NewLabel(strings.Join(groups, " "))
+    secretLabel.TextStyle = fyne.TextStyle{Monospace: true}
+    secretLabel.Alignment = fyne.TextAlignCenter
+    
+    return container.NewVBox(qrImage, secretLabel)
+}
+
+// showRecoveryCodes shows newly made recovery codes, which the server does
+// not keep, and calls onClosed once the user has seen them.
+func showRecoveryCodes(codes []string, window fyne.Window, onClosed func()) {
+    codesEntry := widget.NewMultiLineEntry()
+    codesEntry.SetText(strings.Join(codes, "\n"))
+    codesEntry.TextStyle = fyne.TextStyle{Monospace: true}
+    codesEntry.SetMinRowsVisible(len(codes))
+    
+    info := widget.NewLabel("Write these recovery codes down and keep them safe. Each logs\nyou in once if you lose your phone. They are not shown again.")
+    codesDialog := dialog.NewCustom("Recovery Codes", "I Saved Them", container.NewVBox(info, codesEntry), window)
+    if onClosed != nil {
+        codesDialog.SetOnClosed(onClosed)
+    }
+    codesDialog.Show()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+    "fmt"
+    "secure-messenger/client"
+    "strings"
+    
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/canvas"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/widget"
+    qrcode "github.com/skip2/go-qrcode"
+)
+
+// safetyNumberQRPrefix marks a QR code as holding a safety number, so
+// scanning some other code is not mistaken for a mismatch.
+const safetyNumberQRPrefix = "secure-messenger-safety:"
+
+// VerificationWindow shows the safety number shared with a contact, so the
+// two users can compare it in person or over another channel and catch the
+// server handing out a key that is not the contact's.
+type VerificationWindow struct {
+    window    fyne.Window
+    client    *client.NetworkClient
+    contactID string
+    
+    statusLabel *widget.Label
+    verifyBtn   *widget.Button
+    clearBtn    *widget.Button
+}
+
+func NewVerificationWindow(app fyne.App, nc *client.NetworkClient, contactID string) *VerificationWindow {
+    w := app.NewWindow("Verify Safety Number")
+    w.Resize(fyne.NewSize(420, 560))
+    w.CenterOnScreen()
+    
+    vw := &VerificationWindow{
+        window:    w,
+        client:    nc,
+        contactID: contactID,
+    }
+    
+    vw.window.SetContent(widget.NewLabel("Loading..."))
+    go vw.load()
+    return vw
+}
+
+func (vw *VerificationWindow) Show() {
+    vw.window.Show()
+}
+
+func (vw *VerificationWindow) load() {
+    verification, err := vw.client.GetContactVerification(vw.contactID)
+    if err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to load safety number: %v", err), vw.window)
+        return
+    }
+    
+    // Two rows of six groups, the way it is read out
+    groups := strings.Fields(verification.SafetyNumber)
+    numberLabel := widget.NewLabel(strings.Join(groups[:len(groups)/2], " ") + "\n" + strings.Join(groups[len(groups)/2:], " "))
+    numberLabel.TextStyle = fyne.TextStyle{Monospace: true}
+    numberLabel.Alignment = fyne.TextAlignCenter
+    
+    var qrImage fyne.CanvasObject = widget.NewLabel("QR code unavailable")
+    code, err := qrcode.New(safetyNumberQRPrefix+strings.Join(groups, ""), qrcode.Medium)
+    if err == nil {
+        image := canvas.NewImageFromImage(code.Image(256))
+        image.FillMode = canvas.ImageFillContain
+        image.SetMinSize(fyne.NewSize(256, 256))
+        qrImage = image
+    }
+    
+    fingerprintLabel := widget.NewLabel("Key fingerprint:\n" + verification.Fingerprint)
+    fingerprintLabel.Wrapping = fyne.TextWrapWord
+    
+    vw.statusLabel = widget.NewLabel("")
+    vw.verifyBtn = widget.NewButton("Mark as Verified", func() {
+        vw.markVerified(verification.Fingerprint)
+    })
+    vw.clearBtn = widget.NewButton("Clear Verification", func() {
+        vw.clearVerified()
+    })
+    vw.setVerified(verification.Verified)
+    
+    closeBtn := widget.NewButton("Close", func() {
+        vw.window.Close()
+    })
+    
+    vw.window.SetContent(container.NewVBox(
+        widget.NewLabel("Compare these numbers with your contact's screen,\nor scan their code. If they match, your messages\ncannot be read by anyone else."),
+        widget.NewSeparator(),
+        numberLabel,
+        qrImage,
+        fingerprintLabel,
+        widget.NewSeparator(),
+        vw.statusLabel,
+        container.NewHBox(vw.verifyBtn, vw.clearBtn, closeBtn),
+    ))
+}
+
+func (vw *VerificationWindow) setVerified(verified bool) {
+    if verified {
+        vw.statusLabel.SetText("✔ Verified")
+        vw.verifyBtn.Disable()
+        vw.clearBtn.Enable()
+    } else {
+        vw.statusLabel.SetText("Not verified")
+        vw.verifyBtn.Enable()
+        vw.clearBtn.Disable()
+    }
+}
+
+func (vw *VerificationWindow) markVerified(fingerprint string) {
+    dialog.ShowConfirm("Mark as Verified", "Only do this if the safety numbers match exactly.", func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if err := vw.client.MarkContactVerified(vw.contactID, fingerprint); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to save verification: %v", err), vw.window)
+            return
+        }
+        vw.setVerified(true)
+    }, vw.window)
+}
+
+func (vw *VerificationWindow) clearVerified() {
+    if err := vw.client.ClearContactVerified(vw.contactID); err != nil {
+        dialog.ShowError(fmt.Errorf("Failed to clear verification: %v", err), vw.window)
+        return
+    }
+    vw.setVerified(false)
+}
+
+// showSendError reports a failed send, turning a changed key into the
+// warning the user has to acknowledge before anything is sent to it.
+func (cw *ChatWindow) showSendError(message string, err error) {
+    if change, ok := err.(*client.KeyChangedError); ok {
+        cw.warnKeyChanged(change)
+        return
+    }
+    dialog.ShowError(fmt.Errorf("%s: %v", message, err), cw.window)
+}
+
+// warnKeyChanged blocks on a contact's changed key until the user either
+// accepts the new key or leaves it untrusted, in which case sending to the
+// contact keeps failing.
+func (cw *ChatWindow) warnKeyChanged(change *client.KeyChangedError) {
+    text := fmt.Sprintf("The encryption key of %s has changed.\n\n"+
+        "This happens when they lose their keys or set up a new device\n"+
+        "without restoring them, but it can also mean someone is trying\n"+
+        "to intercept your messages.\n\n"+
+        "Old key: %s\nNew key: %s", change.UserID, change.OldFingerprint, change.NewFingerprint)
+    if change.WasVerified {
+        text += "\n\nYou had verified the old key. Verify the new safety number\nwith them before sending anything sensitive."
+    }
+    
+    message := widget.NewLabel(text)
+    message.Wrapping = fyne.TextWrapWord
+    
+    warning := dialog.NewCustomConfirm("⚠ Safety Number Changed", "Accept New Key", "Not Now", message, func(ok bool) {
+        if !ok {
+            return
+        }
+        
+        if err := cw.client.AcceptKeyChange(change.UserID, change.NewFingerprint); err != nil {
+            dialog.ShowError(fmt.Errorf("Failed to accept new key: %v", err), cw.window)
+            return
+        }
+        
+        if change.WasVerified {
+            NewVerificationWindow(cw.app, cw.client, change.UserID).Show()
+        }
+    }, cw.window)
+    warning.Resize(fyne.NewSize(520, 320))
+    warning.Show()
+}
@@ -0,0 +1,101 @@
+package crypto
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base32"
+    "fmt"
+    "strings"
+)
+
+const (
+    // recoveryEntropySize is the random part of a recovery phrase; a short
+    // checksum follows it to catch typing mistakes.
+    recoveryEntropySize  = 18
+    recoveryChecksumSize = 2
+    recoveryGroupSize    = 4
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryPhrase returns a new random recovery phrase of 144 bits,
+// written as eight groups of four letters and digits.
+func GenerateRecoveryPhrase() (string, error) {
+    entropy := make([]byte, recoveryEntropySize)
+    if _, err := rand.Read(entropy); err != nil {
+        return "", err
+    }
+    
+    checksum := sha256.Sum256(entropy)
+    encoded := recoveryEncoding.EncodeToString(append(entropy, checksum[:recoveryChecksumSize]...))
+    
+    var groups []string
+    for i := 0; i < len(encoded); i += recoveryGroupSize {
+        groups = append(groups, encoded[i:i+recoveryGroupSize])
+    }
+    return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryPhrase checks a recovery phrase as typed, in any case and
+// with or without separators, and returns it in the form backups are
+// encrypted under.
+func normalizeRecoveryPhrase(phrase string) (string, error) {
+    cleaned := strings.Map(func(r rune) rune {
+        if r == '-' || r == ' ' || r == '\t' || r == '\n' {
+            return -1
+        }
+        return r
+    }, strings.ToUpper(phrase))
+    
+    data, err := recoveryEncoding.DecodeString(cleaned)
+    if err != nil || len(data) != recoveryEntropySize+recoveryChecksumSize {
+        return "", fmt.Errorf("invalid recovery phrase")
+    }
+    
+    entropy := data[:recoveryEntropySize]
+    checksum := sha256.Sum256(entropy)
+    if !bytes.Equal(data[recoveryEntropySize:], checksum[:recoveryChecksumSize]) {
+        return "", fmt.Errorf("recovery phrase has a typo")
+    }
+    return cleaned, nil
+}
+
+// ExportBackup encrypts the user's identity keys under a recovery phrase,
+// in the keystore format. The backup names the user it belongs to.
+func (km *KeyManager) ExportBackup(userID, phrase string) ([]byte, error) {
+    if km.privateKey == nil || km.signingKey == nil {
+        return nil, fmt.Errorf("no private key loaded")
+    }
+    
+    normalized, err := normalizeRecoveryPhrase(phrase)
+    if err != nil {
+        return nil, err
+    }
+    
+    plaintext, err := km.marshalKeys(userID)
+    if err != nil {
+        return nil, err
+    }
+    return sealKeystoreData(plaintext, normalized)
+}
+
+// ImportBackup loads the identity keys of a backup made by ExportBackup for
+// the user. A backup made before keys had a data secret gets a new one, which
+// the caller saves along with the keys.
+func (km *KeyManager) ImportBackup(backup []byte, userID, phrase string) error {
+    normalized, err := normalizeRecoveryPhrase(phrase)
+    if err != nil {
+        return err
+    }
+    
+    plaintext, err := openKeystoreData(backup, normalized)
+    if err != nil {
+        return fmt.Errorf("wrong recovery phrase or damaged backup")
+    }
+    if err := km.unmarshalKeys(plaintext, userID); err != nil {
+        return err
+    }
+    _, err = km.ensureDataSecret()
+    return err
+}
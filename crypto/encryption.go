@@ -40,10 +40,15 @@ func (em *EncryptionManager) EncryptMessage(message string, recipientPublicKey *
     if err != nil {
         return "", err
     }
+    keyID, err := KeyID(recipientPublicKey)
+    if err != nil {
+        return "", err
+    }
     
     // Combine encrypted key and message
     result := map[string]string{
         "key":     base64.StdEncoding.EncodeToString(encryptedKey),
+        "key_id":  keyID,
         "message": base64.StdEncoding.EncodeToString(encryptedMessage),
     }
     
@@ -51,32 +56,174 @@ func (em *EncryptionManager) EncryptMessage(message string, recipientPublicKey *
     return base64.StdEncoding.EncodeToString(data), nil
 }
 
-func (em *EncryptionManager) DecryptMessage(encryptedData string) (string, error) {
-    // Decode base64
-    data, err := base64.StdEncoding.DecodeString(encryptedData)
+// EncryptMessageFor encrypts a message once and wraps its key for each
+// recipient, keyed by user ID, so the sender can include themselves and
+// read their own message later. Each wrapped key names the public key it was
+// wrapped with.
+func (em *EncryptionManager) EncryptMessageFor(message string, recipients map[string]*rsa.PublicKey) (string, error) {
+    // Generate random AES key
+    aesKey := make([]byte, 32)
+    if _, err := rand.Read(aesKey); err != nil {
+        return "", err
+    }
+    
+    // Encrypt message with AES
+    encryptedMessage, err := em.encryptAES(message, aesKey)
+    if err != nil {
+        return "", err
+    }
+    
+    // Encrypt AES key with each recipient's RSA key
+    keys := make(map[string]string, len(recipients))
+    keyIDs := make(map[string]string, len(recipients))
+    for userID, publicKey := range recipients {
+        encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, aesKey, nil)
+        if err != nil {
+            return "", err
+        }
+        keys[userID] = base64.StdEncoding.EncodeToString(encryptedKey)
+        if keyIDs[userID], err = KeyID(publicKey); err != nil {
+            return "", err
+        }
+    }
+    
+    data, _ := json.Marshal(&envelope{
+        Keys:    keys,
+        KeyIDs:  keyIDs,
+        Message: base64.StdEncoding.EncodeToString(encryptedMessage),
+    })
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// envelope is the encoded form of an encrypted message: the AES-GCM
+// ciphertext with its key wrapped either for a single recipient (Key) or for
+// several by user ID (Keys), along with the IDs of the public keys they were
+// wrapped with, which are missing from messages sent before keys could be
+// rotated. A forward secret message instead carries a
+// ratchet message for the recipient, or a sender key message for a channel,
+// and the sender's own copy (Self).
+type envelope struct {
+    Key       string            `json:"key,omitempty"`
+    KeyID     string            `json:"key_id,omitempty"`
+    Keys      map[string]string `json:"keys,omitempty"`
+    KeyIDs    map[string]string `json:"key_ids,omitempty"`
+    Message   string            `json:"message,omitempty"`
+    Ratchet   *RatchetMessage   `json:"ratchet,omitempty"`
+    SenderKey *SenderKeyMessage `json:"sender_key,omitempty"`
+    Self      []byte            `json:"self,omitempty"`
+}
+
+// EncodeRatchetEnvelope encodes a ratchet message together with the sender's
+// own copy of its plaintext, encrypted under a key of the sender's choosing.
+func EncodeRatchetEnvelope(msg *RatchetMessage, self []byte) (string, error) {
+    data, err := json.Marshal(&envelope{Ratchet: msg, Self: self})
     if err != nil {
         return "", err
     }
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeRatchetEnvelope decodes an envelope made by EncodeRatchetEnvelope.
+func DecodeRatchetEnvelope(encryptedData string) (*RatchetMessage, []byte, error) {
+    env, err := decodeEnvelope(encryptedData)
+    if err != nil {
+        return nil, nil, err
+    }
+    if env.Ratchet == nil {
+        return nil, nil, fmt.Errorf("not a forward secret message")
+    }
+    return env.Ratchet, env.Self, nil
+}
+
+// EncodeSenderKeyEnvelope encodes a channel message encrypted with a sender
+// key together with the sender's own copy of its plaintext.
+func EncodeSenderKeyEnvelope(msg *SenderKeyMessage, self []byte) (string, error) {
+    data, err := json.Marshal(&envelope{SenderKey: msg, Self: self})
+    if err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeSenderKeyEnvelope decodes an envelope made by EncodeSenderKeyEnvelope.
+func DecodeSenderKeyEnvelope(encryptedData string) (*SenderKeyMessage, []byte, error) {
+    env, err := decodeEnvelope(encryptedData)
+    if err != nil {
+        return nil, nil, err
+    }
+    if env.SenderKey == nil {
+        return nil, nil, fmt.Errorf("not a sender key message")
+    }
+    return env.SenderKey, env.Self, nil
+}
+
+func decodeEnvelope(encryptedData string) (*envelope, error) {
+    data, err := base64.StdEncoding.DecodeString(encryptedData)
+    if err != nil {
+        return nil, err
+    }
+    
+    var env envelope
+    if err := json.Unmarshal(data, &env); err != nil {
+        return nil, err
+    }
+    if env.Ratchet == nil && env.SenderKey == nil && (env.Message == "" || (env.Key == "" && len(env.Keys) == 0)) {
+        return nil, fmt.Errorf("not an encrypted message")
+    }
     
-    // Parse JSON
-    var result map[string]string
-    if err := json.Unmarshal(data, &result); err != nil {
+    return &env, nil
+}
+
+// IsEnvelope reports whether data looks like the output of EncryptMessage,
+// EncryptMessageFor, EncodeRatchetEnvelope or EncodeSenderKeyEnvelope.
+func IsEnvelope(data string) bool {
+    _, err := decodeEnvelope(data)
+    return err == nil
+}
+
+func (em *EncryptionManager) DecryptMessage(encryptedData string) (string, error) {
+    return em.DecryptMessageFor(encryptedData, "")
+}
+
+// DecryptMessageFor decrypts a message using the key wrapped for userID, or
+// the single key of a message encrypted with EncryptMessage. The private key
+// it was wrapped for may be a retired one; messages that do not name their
+// key are tried with every key.
+func (em *EncryptionManager) DecryptMessageFor(encryptedData, userID string) (string, error) {
+    env, err := decodeEnvelope(encryptedData)
+    if err != nil {
         return "", err
     }
+    if env.Ratchet != nil || env.SenderKey != nil {
+        return "", fmt.Errorf("forward secret messages are decrypted by their session")
+    }
+    
+    wrappedKey, keyID := env.Key, env.KeyID
+    if env.Keys != nil {
+        var ok bool
+        if wrappedKey, ok = env.Keys[userID]; !ok {
+            return "", fmt.Errorf("message was not encrypted for this user")
+        }
+        keyID = env.KeyIDs[userID]
+    }
     
     // Decode encrypted key and message
-    encryptedKey, err := base64.StdEncoding.DecodeString(result["key"])
+    encryptedKey, err := base64.StdEncoding.DecodeString(wrappedKey)
     if err != nil {
         return "", err
     }
     
-    encryptedMessage, err := base64.StdEncoding.DecodeString(result["message"])
+    encryptedMessage, err := base64.StdEncoding.DecodeString(env.Message)
     if err != nil {
         return "", err
     }
     
+    if em.keyManager.GetPrivateKey() == nil {
+        return "", fmt.Errorf("no private key loaded")
+    }
+    
     // Decrypt AES key with RSA
-    aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, em.keyManager.GetPrivateKey(), encryptedKey, nil)
+    aesKey, err := em.unwrapKey(encryptedKey, keyID)
     if err != nil {
         return "", err
     }
@@ -85,7 +232,43 @@ func (em *EncryptionManager) DecryptMessage(encryptedData string) (string, error
     return em.decryptAES(encryptedMessage, aesKey)
 }
 
+// unwrapKey decrypts a message key wrapped for the private key with the ID,
+// or for any of the user's keys when keyID is empty.
+func (em *EncryptionManager) unwrapKey(encryptedKey []byte, keyID string) ([]byte, error) {
+    if keyID != "" {
+        privateKey := em.keyManager.privateKeyFor(keyID)
+        if privateKey == nil {
+            return nil, fmt.Errorf("message was encrypted to a key this device does not have")
+        }
+        return rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKey, nil)
+    }
+    
+    var err error
+    for _, privateKey := range em.keyManager.privateKeys() {
+        var aesKey []byte
+        if aesKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKey, nil); err == nil {
+            return aesKey, nil
+        }
+    }
+    return nil, err
+}
+
 func (em *EncryptionManager) encryptAES(plaintext string, key []byte) ([]byte, error) {
+    return em.sealAES([]byte(plaintext), key)
+}
+
+func (em *EncryptionManager) decryptAES(ciphertext, key []byte) (string, error) {
+    plaintext, err := em.openAES(ciphertext, key)
+    if err != nil {
+        return "", err
+    }
+    
+    return string(plaintext), nil
+}
+
+// sealAES encrypts with AES-GCM under a random nonce, which is prepended to
+// the ciphertext.
+func (em *EncryptionManager) sealAES(plaintext, key []byte) ([]byte, error) {
     block, err := aes.NewCipher(key)
     if err != nil {
         return nil, err
@@ -101,36 +284,63 @@ func (em *EncryptionManager) encryptAES(plaintext string, key []byte) ([]byte, e
         return nil, err
     }
     
-    ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+    ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
     return ciphertext, nil
 }
 
-func (em *EncryptionManager) decryptAES(ciphertext, key []byte) (string, error) {
+func (em *EncryptionManager) openAES(ciphertext, key []byte) ([]byte, error) {
     block, err := aes.NewCipher(key)
     if err != nil {
-        return "", err
+        return nil, err
     }
     
     gcm, err := cipher.NewGCM(block)
     if err != nil {
-        return "", err
+        return nil, err
     }
     
     nonceSize := gcm.NonceSize()
     if len(ciphertext) < nonceSize {
-        return "", fmt.Errorf("ciphertext too short")
+        return nil, fmt.Errorf("ciphertext too short")
     }
     
     nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-    plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+    return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// EncryptFile encrypts file contents under a new random AES key, using the
+// same AES-GCM scheme as message bodies. It returns the ciphertext and key.
+func (em *EncryptionManager) EncryptFile(data []byte) ([]byte, []byte, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, nil, err
+    }
+    
+    ciphertext, err := em.sealAES(data, key)
     if err != nil {
-        return "", err
+        return nil, nil, err
     }
     
-    return string(plaintext), nil
+    return ciphertext, key, nil
+}
+
+// EncryptFileWithKey encrypts data under an existing file key, such as a
+// preview that travels with the file it belongs to.
+func (em *EncryptionManager) EncryptFileWithKey(data, key []byte) ([]byte, error) {
+    return em.sealAES(data, key)
+}
+
+func (em *EncryptionManager) DecryptFile(ciphertext, key []byte) ([]byte, error) {
+    return em.openAES(ciphertext, key)
 }
 
 func (em *EncryptionManager) LoadPublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+    return ParsePublicKey(publicKeyPEM)
+}
+
+// ParsePublicKey parses a PEM encoded RSA public key as written by
+// KeyManager.PublicKeyPEM.
+func ParsePublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
     block, _ := pem.Decode([]byte(publicKeyPEM))
     if block == nil {
         return nil, fmt.Errorf("failed to decode public key PEM")
@@ -0,0 +1,93 @@
+package crypto
+
+import (
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/sha512"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "strings"
+)
+
+const (
+    // safetyNumberVersion is mixed into every safety number, so a change to
+    // how they are computed never produces a matching number by accident.
+    safetyNumberVersion = 0
+    
+    // safetyNumberIterations slows down searching for a key whose safety
+    // number collides with another's.
+    safetyNumberIterations = 5200
+)
+
+// Fingerprint returns the SHA-256 digest of the public key, as groups of
+// hex digits for reading aloud.
+func Fingerprint(publicKey *rsa.PublicKey) (string, error) {
+    der, err := x509.MarshalPKIXPublicKey(publicKey)
+    if err != nil {
+        return "", err
+    }
+    
+    sum := sha256.Sum256(der)
+    digits := strings.ToUpper(hex.EncodeToString(sum[:]))
+    
+    var groups []string
+    for i := 0; i < len(digits); i += 4 {
+        groups = append(groups, digits[i:i+4])
+    }
+    return strings.Join(groups, " "), nil
+}
+
+// SafetyNumber returns the 60-digit number two users compare to check that
+// each holds the other's real public key. Both users get the same number,
+// whichever of them computes it.
+func SafetyNumber(userA string, keyA *rsa.PublicKey, userB string, keyB *rsa.PublicKey) (string, error) {
+    halfA, err := safetyNumberHalf(userA, keyA)
+    if err != nil {
+        return "", err
+    }
+    halfB, err := safetyNumberHalf(userB, keyB)
+    if err != nil {
+        return "", err
+    }
+    
+    if userA > userB {
+        halfA, halfB = halfB, halfA
+    }
+    return halfA + halfB, nil
+}
+
+// FormatSafetyNumber splits a safety number into groups of five digits.
+func FormatSafetyNumber(number string) string {
+    var groups []string
+    for i := 0; i+5 <= len(number); i += 5 {
+        groups = append(groups, number[i:i+5])
+    }
+    return strings.Join(groups, " ")
+}
+
+// safetyNumberHalf derives one user's 30 digits from their ID and key.
+func safetyNumberHalf(userID string, publicKey *rsa.PublicKey) (string, error) {
+    der, err := x509.MarshalPKIXPublicKey(publicKey)
+    if err != nil {
+        return "", err
+    }
+    
+    var version [2]byte
+    binary.BigEndian.PutUint16(version[:], safetyNumberVersion)
+    
+    hash := append(version[:], der...)
+    hash = append(hash, userID...)
+    for i := 0; i < safetyNumberIterations; i++ {
+        sum := sha512.Sum512(append(hash, der...))
+        hash = sum[:]
+    }
+    
+    var digits strings.Builder
+    for i := 0; i < 30; i += 5 {
+        chunk := uint64(hash[i])<<32 | uint64(hash[i+1])<<24 | uint64(hash[i+2])<<16 | uint64(hash[i+3])<<8 | uint64(hash[i+4])
+        fmt.Fprintf(&digits, "%05d", chunk%100000)
+    }
+    return digits.String(), nil
+}
@@ -1,22 +1,36 @@
 package crypto
 
 import (
+    "crypto/ed25519"
     "crypto/rand"
     "crypto/rsa"
+    "crypto/sha256"
     "crypto/x509"
     "encoding/pem"
     "fmt"
+    "io"
     "os"
     "path/filepath"
+    "time"
+    "golang.org/x/crypto/hkdf"
 )
 
 const (
     KeySize = 2048
+    
+    // dataSecretSize is the size of the random secret DataKey derives keys
+    // from.
+    dataSecretSize = 32
 )
 
 type KeyManager struct {
     privateKey *rsa.PrivateKey
     publicKey  *rsa.PublicKey
+    keyID      string
+    createdAt  time.Time
+    retired    []*retiredKey      // oldest first
+    signingKey ed25519.PrivateKey // signs the user's messages
+    dataSecret []byte             // never leaves the client unencrypted, see DataKey
 }
 
 func NewKeyManager() *KeyManager {
@@ -29,13 +43,71 @@ func (km *KeyManager) GenerateKeys() error {
         return err
     }
     
-    km.privateKey = privateKey
-    km.publicKey = &privateKey.PublicKey
+    if err := km.setPrivateKey(privateKey, time.Now()); err != nil {
+        return err
+    }
+    km.retired = nil
     
-    return nil
+    if _, km.signingKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+        return err
+    }
+    
+    km.dataSecret = nil
+    _, err = km.ensureDataSecret()
+    return err
 }
 
-func (km *KeyManager) LoadKeys(keyPath string) error {
+// ensureDataSecret generates the data secret of keys saved before there was
+// one, and reports whether it did so the keys can be saved again.
+func (km *KeyManager) ensureDataSecret() (bool, error) {
+    if len(km.dataSecret) > 0 {
+        return false, nil
+    }
+    
+    secret := make([]byte, dataSecretSize)
+    if _, err := rand.Read(secret); err != nil {
+        return false, err
+    }
+    km.dataSecret = secret
+    return true, nil
+}
+
+// DataKey derives a 256-bit key for data the client encrypts for itself,
+// such as drafts synced through the server. The key comes from a random
+// secret kept in the keystore and carried in key backups, so it is the same
+// on every device holding the user's keys and unknown to the server, unlike
+// anything derived from the login password. Each purpose gets its own key.
+func (km *KeyManager) DataKey(purpose string) ([]byte, error) {
+    if len(km.dataSecret) == 0 {
+        return nil, fmt.Errorf("no keys loaded")
+    }
+    
+    key := make([]byte, 32)
+    reader := hkdf.New(sha256.New, km.dataSecret, nil, []byte("secure-messenger "+purpose))
+    if _, err := io.ReadFull(reader, key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// LoadKeys loads the user's keys from the passphrase-encrypted keystore in
+// keyPath. Keys saved unencrypted by earlier versions are loaded from their
+// PEM files instead, moved into a keystore under the passphrase, and the
+// files removed. The error satisfies os.IsNotExist when there are no keys.
+func (km *KeyManager) LoadKeys(keyPath, passphrase string) error {
+    if KeystoreExists(keyPath) {
+        return km.openKeystore(keyPath, passphrase)
+    }
+    
+    // Checked before anything is loaded, so a short passphrase leaves no
+    // keys behind unprotected
+    if len(passphrase) < MinPassphraseLength {
+        if _, err := os.Stat(filepath.Join(keyPath, "private.pem")); err != nil {
+            return err
+        }
+        return fmt.Errorf("passphrase must be at least %d characters", MinPassphraseLength)
+    }
+    
     // Load private key
     privateKeyPath := filepath.Join(keyPath, "private.pem")
     privateKeyData, err := os.ReadFile(privateKeyPath)
@@ -53,46 +125,82 @@ func (km *KeyManager) LoadKeys(keyPath string) error {
         return err
     }
     
-    km.privateKey = privateKey
-    km.publicKey = &privateKey.PublicKey
+    if err := km.setPrivateKey(privateKey, time.Time{}); err != nil {
+        return err
+    }
     
+    if err := km.loadSigningKey(keyPath); err != nil {
+        return err
+    }
+    if _, err := km.ensureDataSecret(); err != nil {
+        return err
+    }
+    
+    if err := km.saveKeystore(keyPath, passphrase); err != nil {
+        return fmt.Errorf("failed to encrypt keys: %v", err)
+    }
+    for _, name := range []string{"private.pem", "signing.pem"} {
+        if err := os.Remove(filepath.Join(keyPath, name)); err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("failed to remove unencrypted key: %v", err)
+        }
+    }
     return nil
 }
 
-func (km *KeyManager) SaveKeys(keyPath string) error {
+// HasKeys reports whether a keypair has been generated or loaded.
+func (km *KeyManager) HasKeys() bool {
+    return km.privateKey != nil
+}
+
+// PublicKeyPEM returns the public key PEM encoded, for publishing it.
+func (km *KeyManager) PublicKeyPEM() (string, error) {
+    publicKeyBytes, err := x509.MarshalPKIXPublicKey(km.publicKey)
+    if err != nil {
+        return "", err
+    }
+    
+    return string(pem.EncodeToMemory(&pem.Block{
+        Type:  "RSA PUBLIC KEY",
+        Bytes: publicKeyBytes,
+    })), nil
+}
+
+// SaveKeys saves the private keys in a keystore in keyPath encrypted under
+// the passphrase, and the public key as PEM next to it.
+func (km *KeyManager) SaveKeys(keyPath, passphrase string) error {
     if err := os.MkdirAll(keyPath, 0700); err != nil {
         return err
     }
     
-    // Save private key
-    privateKeyPath := filepath.Join(keyPath, "private.pem")
-    privateKeyData := pem.EncodeToMemory(&pem.Block{
-        Type:  "RSA PRIVATE KEY",
-        Bytes: x509.MarshalPKCS1PrivateKey(km.privateKey),
-    })
-    
-    if err := os.WriteFile(privateKeyPath, privateKeyData, 0600); err != nil {
+    // Save private keys
+    if err := km.saveKeystore(keyPath, passphrase); err != nil {
         return err
     }
     
     // Save public key
     publicKeyPath := filepath.Join(keyPath, "public.pem")
-    publicKeyBytes, err := x509.MarshalPKIXPublicKey(km.publicKey)
+    publicKeyData, err := km.PublicKeyPEM()
     if err != nil {
         return err
     }
-    publicKeyData := pem.EncodeToMemory(&pem.Block{
-        Type:  "RSA PUBLIC KEY",
-        Bytes: publicKeyBytes,
-    })
     
-    if err := os.WriteFile(publicKeyPath, publicKeyData, 0644); err != nil {
+    if err := os.WriteFile(publicKeyPath, []byte(publicKeyData), 0644); err != nil {
         return err
     }
     
     return nil
 }
 
+// ChangePassphrase encrypts the keystore in keyPath under a new passphrase.
+// The current passphrase must open it.
+func (km *KeyManager) ChangePassphrase(keyPath, oldPassphrase, newPassphrase string) error {
+    stored := NewKeyManager()
+    if err := stored.openKeystore(keyPath, oldPassphrase); err != nil {
+        return err
+    }
+    return stored.saveKeystore(keyPath, newPassphrase)
+}
+
 func (km *KeyManager) GetPublicKey() *rsa.PublicKey {
     return km.publicKey
 }
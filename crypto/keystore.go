@@ -0,0 +1,275 @@
+package crypto
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+    "golang.org/x/crypto/argon2"
+)
+
+const (
+    // MinPassphraseLength is the shortest passphrase a keystore accepts.
+    MinPassphraseLength = 8
+    
+    keystoreFile    = "keystore.enc"
+    keystoreMagic   = "SMKS"
+    keystoreVersion = 1
+    keystoreKDF     = 1 // Argon2id
+    
+    // Argon2id parameters for new keystores, as recommended by RFC 9106
+    // for memory-constrained machines. Older keystores keep theirs.
+    keystoreTime    = 3
+    keystoreMemory  = 64 * 1024 // KiB
+    keystoreThreads = 4
+    
+    // maxKeystoreMemory and maxKeystoreTime bound the cost a keystore header
+    // can ask for, so a damaged or planted file cannot hang the client.
+    maxKeystoreMemory = 1024 * 1024 // KiB
+    maxKeystoreTime   = 100
+    
+    keystoreSaltSize   = 16
+    keystoreNonceSize  = 12
+    keystoreHeaderSize = len(keystoreMagic) + 2 + 4 + 4 + 1 + keystoreSaltSize + keystoreNonceSize
+)
+
+// keystoreParams are the key derivation parameters in a keystore header.
+type keystoreParams struct {
+    Time    uint32
+    Memory  uint32
+    Threads uint8
+    Salt    []byte
+}
+
+// keystoreContents is the plaintext of a keystore or key backup.
+type keystoreContents struct {
+    UserID      string               `json:"user_id,omitempty"` // set in backups, which leave the user's key directory
+    PrivateKey  []byte               `json:"private_key"`       // PKCS#1
+    CreatedAt   time.Time            `json:"created_at,omitempty"`
+    RetiredKeys []keystoreRetiredKey `json:"retired_keys,omitempty"` // oldest first
+    SigningKey  []byte               `json:"signing_key"`            // PKCS#8
+    DataSecret  []byte               `json:"data_secret,omitempty"`
+}
+
+// keystoreRetiredKey is a private key replaced by a rotation.
+type keystoreRetiredKey struct {
+    PrivateKey []byte    `json:"private_key"` // PKCS#1
+    CreatedAt  time.Time `json:"created_at,omitempty"`
+    RetiredAt  time.Time `json:"retired_at"`
+}
+
+// KeystoreExists reports whether the keys in keyPath are kept in a
+// passphrase-encrypted keystore.
+func KeystoreExists(keyPath string) bool {
+    _, err := os.Stat(filepath.Join(keyPath, keystoreFile))
+    return err == nil
+}
+
+// openKeystore decrypts the keystore in keyPath into the key manager. A
+// keystore saved before keys had a data secret is saved again with one.
+func (km *KeyManager) openKeystore(keyPath, passphrase string) error {
+    data, err := os.ReadFile(filepath.Join(keyPath, keystoreFile))
+    if err != nil {
+        return err
+    }
+    
+    plaintext, err := openKeystoreData(data, passphrase)
+    if err != nil {
+        return err
+    }
+    if err := km.unmarshalKeys(plaintext, ""); err != nil {
+        return err
+    }
+    
+    added, err := km.ensureDataSecret()
+    if err != nil || !added {
+        return err
+    }
+    return km.saveKeystore(keyPath, passphrase)
+}
+
+// unmarshalKeys loads the keys of a keystore's plaintext, checking that they
+// belong to the user when userID is set.
+func (km *KeyManager) unmarshalKeys(plaintext []byte, userID string) error {
+    var contents keystoreContents
+    if err := json.Unmarshal(plaintext, &contents); err != nil {
+        return fmt.Errorf("invalid keystore contents: %v", err)
+    }
+    if userID != "" && contents.UserID != userID {
+        return fmt.Errorf("keys belong to another user")
+    }
+    
+    privateKey, err := x509.ParsePKCS1PrivateKey(contents.PrivateKey)
+    if err != nil {
+        return fmt.Errorf("invalid private key in keystore: %v", err)
+    }
+    var retired []*retiredKey
+    for _, stored := range contents.RetiredKeys {
+        key, err := x509.ParsePKCS1PrivateKey(stored.PrivateKey)
+        if err != nil {
+            return fmt.Errorf("invalid retired key in keystore: %v", err)
+        }
+        keyID, err := KeyID(&key.PublicKey)
+        if err != nil {
+            return err
+        }
+        retired = append(retired, &retiredKey{
+            privateKey: key,
+            id:         keyID,
+            createdAt:  stored.CreatedAt,
+            retiredAt:  stored.RetiredAt,
+        })
+    }
+    key, err := x509.ParsePKCS8PrivateKey(contents.SigningKey)
+    if err != nil {
+        return fmt.Errorf("invalid signing key in keystore: %v", err)
+    }
+    signingKey, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return fmt.Errorf("signing key is not an Ed25519 key")
+    }
+    
+    if err := km.setPrivateKey(privateKey, contents.CreatedAt); err != nil {
+        return err
+    }
+    km.retired = retired
+    km.signingKey = signingKey
+    km.dataSecret = contents.DataSecret
+    return nil
+}
+
+// saveKeystore encrypts the key manager's private keys under the passphrase
+// into the keystore in keyPath, replacing it in one step so a crash leaves
+// either the old keystore or the new one.
+func (km *KeyManager) saveKeystore(keyPath, passphrase string) error {
+    if len(passphrase) < MinPassphraseLength {
+        return fmt.Errorf("passphrase must be at least %d characters", MinPassphraseLength)
+    }
+    
+    plaintext, err := km.marshalKeys("")
+    if err != nil {
+        return err
+    }
+    
+    data, err := sealKeystoreData(plaintext, passphrase)
+    if err != nil {
+        return err
+    }
+    
+    path := filepath.Join(keyPath, keystoreFile)
+    if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(path+".tmp", path)
+}
+
+func (km *KeyManager) marshalKeys(userID string) ([]byte, error) {
+    signingKey, err := x509.MarshalPKCS8PrivateKey(km.signingKey)
+    if err != nil {
+        return nil, err
+    }
+    
+    var retired []keystoreRetiredKey
+    for _, key := range km.retired {
+        retired = append(retired, keystoreRetiredKey{
+            PrivateKey: x509.MarshalPKCS1PrivateKey(key.privateKey),
+            CreatedAt:  key.createdAt,
+            RetiredAt:  key.retiredAt,
+        })
+    }
+    
+    return json.Marshal(&keystoreContents{
+        UserID:      userID,
+        PrivateKey:  x509.MarshalPKCS1PrivateKey(km.privateKey),
+        CreatedAt:   km.createdAt,
+        RetiredKeys: retired,
+        SigningKey:  signingKey,
+        DataSecret:  km.dataSecret,
+    })
+}
+
+// sealKeystoreData encrypts plaintext with AES-256-GCM under a key derived
+// from the passphrase with Argon2id. The header carries the format version
+// and the derivation parameters, and is authenticated along with the
+// ciphertext.
+func sealKeystoreData(plaintext []byte, passphrase string) ([]byte, error) {
+    params := keystoreParams{
+        Time:    keystoreTime,
+        Memory:  keystoreMemory,
+        Threads: keystoreThreads,
+        Salt:    make([]byte, keystoreSaltSize),
+    }
+    if _, err := rand.Read(params.Salt); err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, keystoreNonceSize)
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    
+    header := []byte(keystoreMagic)
+    header = append(header, keystoreVersion, keystoreKDF)
+    header = binary.BigEndian.AppendUint32(header, params.Time)
+    header = binary.BigEndian.AppendUint32(header, params.Memory)
+    header = append(header, params.Threads)
+    header = append(header, params.Salt...)
+    header = append(header, nonce...)
+    
+    gcm, err := keystoreCipher(passphrase, params)
+    if err != nil {
+        return nil, err
+    }
+    return gcm.Seal(header, nonce, plaintext, header), nil
+}
+
+func openKeystoreData(data []byte, passphrase string) ([]byte, error) {
+    if len(data) < keystoreHeaderSize || string(data[:len(keystoreMagic)]) != keystoreMagic {
+        return nil, fmt.Errorf("not a keystore")
+    }
+    
+    header := data[:keystoreHeaderSize]
+    rest := header[len(keystoreMagic):]
+    if version := rest[0]; version != keystoreVersion {
+        return nil, fmt.Errorf("unsupported keystore version %d", version)
+    }
+    if kdf := rest[1]; kdf != keystoreKDF {
+        return nil, fmt.Errorf("unsupported keystore key derivation %d", kdf)
+    }
+    
+    params := keystoreParams{
+        Time:    binary.BigEndian.Uint32(rest[2:6]),
+        Memory:  binary.BigEndian.Uint32(rest[6:10]),
+        Threads: rest[10],
+        Salt:    rest[11 : 11+keystoreSaltSize],
+    }
+    nonce := rest[11+keystoreSaltSize:]
+    if params.Time == 0 || params.Time > maxKeystoreTime || params.Threads == 0 || params.Memory > maxKeystoreMemory {
+        return nil, fmt.Errorf("invalid keystore parameters")
+    }
+    
+    gcm, err := keystoreCipher(passphrase, params)
+    if err != nil {
+        return nil, err
+    }
+    plaintext, err := gcm.Open(nil, nonce, data[keystoreHeaderSize:], header)
+    if err != nil {
+        return nil, fmt.Errorf("wrong passphrase or damaged keystore")
+    }
+    return plaintext, nil
+}
+
+func keystoreCipher(passphrase string, params keystoreParams) (cipher.AEAD, error) {
+    key := argon2.IDKey([]byte(passphrase), params.Salt, params.Time, params.Memory, params.Threads, 32)
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
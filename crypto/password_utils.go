@@ -3,49 +3,177 @@ package crypto
 import (
     "crypto/rand"
     "crypto/sha256"
+    "crypto/subtle"
     "encoding/base64"
     "fmt"
+    "strings"
+    "golang.org/x/crypto/argon2"
     "golang.org/x/crypto/pbkdf2"
 )
 
 const (
-    SaltLength = 32
+    // Iterations is the PBKDF2 cost of password hashes made before passwords
+    // were hashed with Argon2id.
     Iterations = 100000
+    
+    // maxPasswordMemory bounds the memory a stored hash can ask for, in KiB.
+    maxPasswordMemory = 4 * 1024 * 1024
+    maxPasswordTime   = 100
 )
 
-func HashPassword(password string) (string, string, error) {
+// PasswordParams are the Argon2id parameters passwords are hashed with.
+type PasswordParams struct {
+    Time       uint32 // passes over memory
+    Memory     uint32 // in KiB
+    Threads    uint8
+    SaltLength uint32
+    KeyLength  uint32
+}
+
+// DefaultPasswordParams are the second recommended Argon2id parameters of
+// RFC 9106, for servers with less memory to spare than the first.
+var DefaultPasswordParams = PasswordParams{
+    Time:       3,
+    Memory:     64 * 1024,
+    Threads:    4,
+    SaltLength: 16,
+    KeyLength:  32,
+}
+
+// Validate checks that the parameters make a hash worth storing and one
+// that VerifyPassword will accept.
+func (p PasswordParams) Validate() error {
+    if p.Time == 0 || p.Time > maxPasswordTime {
+        return fmt.Errorf("argon2 time must be between 1 and %d", maxPasswordTime)
+    }
+    if p.Memory < 8*uint32(p.Threads) || p.Memory > maxPasswordMemory {
+        return fmt.Errorf("argon2 memory must be between 8 KiB per thread and %d KiB", maxPasswordMemory)
+    }
+    if p.Threads == 0 {
+        return fmt.Errorf("argon2 threads must be at least 1")
+    }
+    if p.SaltLength < 16 || p.KeyLength < 16 {
+        return fmt.Errorf("argon2 salt and key must be at least 16 bytes")
+    }
+    return nil
+}
+
+// HashPassword hashes a password with Argon2id into a PHC string, which
+// carries the algorithm, its parameters and the salt along with the hash:
+//
+//    $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func HashPassword(password string, params PasswordParams) (string, error) {
+    if err := params.Validate(); err != nil {
+        return "", err
+    }
+    
     // Generate random salt
-    salt := make([]byte, SaltLength)
+    salt := make([]byte, params.SaltLength)
     if _, err := rand.Read(salt); err != nil {
-        return "", "", err
+        return "", err
     }
     
-    // Hash password with salt
-    hash := pbkdf2.Key([]byte(password), salt, Iterations, 32, sha256.New)
-    
-    // Encode salt and hash
-    saltStr := base64.StdEncoding.EncodeToString(salt)
-    hashStr := base64.StdEncoding.EncodeToString(hash)
-    
-    return hashStr, saltStr, nil
+    hash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+        params.Memory, params.Time, params.Threads,
+        base64.RawStdEncoding.EncodeToString(salt),
+        base64.RawStdEncoding.EncodeToString(hash)), nil
 }
 
-func VerifyPassword(password, hash, salt string) bool {
-    // Decode salt
-    saltBytes, err := base64.StdEncoding.DecodeString(salt)
+// VerifyPassword checks a password against a hash made by HashPassword, or
+// against an older PBKDF2-SHA256 hash in the same form:
+//
+//    $pbkdf2-sha256$i=100000$<salt>$<hash>
+//
+// The hashes are compared in constant time.
+func VerifyPassword(password, encoded string) bool {
+    stored, err := parsePasswordHash(encoded)
     if err != nil {
         return false
     }
     
-    // Decode hash
-    hashBytes, err := base64.StdEncoding.DecodeString(hash)
-    if err != nil {
+    var hash []byte
+    switch stored.algorithm {
+    case "argon2id":
+        p := stored.params
+        hash = argon2.IDKey([]byte(password), stored.salt, p.Time, p.Memory, p.Threads, uint32(len(stored.hash)))
+    case "pbkdf2-sha256":
+        hash = pbkdf2.Key([]byte(password), stored.salt, stored.iterations, len(stored.hash), sha256.New)
+    default:
         return false
     }
     
-    // Hash password with same salt
-    testHash := pbkdf2.Key([]byte(password), saltBytes, Iterations, 32, sha256.New)
+    return subtle.ConstantTimeCompare(hash, stored.hash) == 1
+}
+
+// PasswordNeedsRehash reports whether a stored hash was made with another
+// algorithm or other parameters than the given ones, so the password should
+// be hashed again the next time it is known.
+func PasswordNeedsRehash(encoded string, params PasswordParams) bool {
+    stored, err := parsePasswordHash(encoded)
+    if err != nil || stored.algorithm != "argon2id" {
+        return true
+    }
+    
+    p := stored.params
+    return p.Time != params.Time || p.Memory != params.Memory || p.Threads != params.Threads ||
+        uint32(len(stored.salt)) != params.SaltLength || uint32(len(stored.hash)) != params.KeyLength
+}
+
+// passwordHash is a parsed PHC string.
+type passwordHash struct {
+    algorithm  string
+    params     PasswordParams // for argon2id
+    iterations int            // for pbkdf2-sha256
+    salt       []byte
+    hash       []byte
+}
+
+// parsePasswordHash parses a PHC string, refusing parameters that would make
+// checking a password against it unreasonably expensive.
+func parsePasswordHash(encoded string) (*passwordHash, error) {
+    fields := strings.Split(encoded, "$")
+    if len(fields) < 5 || fields[0] != "" {
+        return nil, fmt.Errorf("invalid password hash")
+    }
+    
+    stored := &passwordHash{algorithm: fields[1]}
+    var salt, hash string
+    switch stored.algorithm {
+    case "argon2id":
+        if len(fields) != 6 {
+            return nil, fmt.Errorf("invalid password hash")
+        }
+        var version int
+        if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+            return nil, fmt.Errorf("unsupported argon2 version")
+        }
+        p := &stored.params
+        if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+            return nil, fmt.Errorf("invalid argon2 parameters")
+        }
+        if p.Time == 0 || p.Time > maxPasswordTime || p.Threads == 0 || p.Memory > maxPasswordMemory {
+            return nil, fmt.Errorf("invalid argon2 parameters")
+        }
+        salt, hash = fields[4], fields[5]
+    case "pbkdf2-sha256":
+        if len(fields) != 5 {
+            return nil, fmt.Errorf("invalid password hash")
+        }
+        if _, err := fmt.Sscanf(fields[2], "i=%d", &stored.iterations); err != nil || stored.iterations <= 0 || stored.iterations > 10*Iterations {
+            return nil, fmt.Errorf("invalid pbkdf2 parameters")
+        }
+        salt, hash = fields[3], fields[4]
+    default:
+        return nil, fmt.Errorf("unsupported password hash %q", stored.algorithm)
+    }
     
-    // Compare hashes
-    return fmt.Sprintf("%x", testHash) == fmt.Sprintf("%x", hashBytes)
+    var err error
+    if stored.salt, err = base64.RawStdEncoding.DecodeString(salt); err != nil {
+        return nil, fmt.Errorf("invalid password salt")
+    }
+    if stored.hash, err = base64.RawStdEncoding.DecodeString(hash); err != nil || len(stored.hash) == 0 {
+        return nil, fmt.Errorf("invalid password hash")
+    }
+    return stored, nil
 }
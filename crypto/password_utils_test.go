@@ -0,0 +1,118 @@
+package crypto
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "fmt"
+    "testing"
+    
+    "golang.org/x/crypto/pbkdf2"
+)
+
+// testPasswordParams are cheap, so the tests run quickly.
+var testPasswordParams = PasswordParams{Time: 1, Memory: 64, Threads: 1, SaltLength: 16, KeyLength: 32}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+    encoded, err := HashPassword("correct horse", testPasswordParams)
+    if err != nil {
+        t.Fatalf("HashPassword: %v", err)
+    }
+    
+    if !VerifyPassword("correct horse", encoded) {
+        t.Fatal("refused the right password")
+    }
+    if VerifyPassword("correct horse!", encoded) {
+        t.Fatal("accepted a wrong password")
+    }
+    
+    again, err := HashPassword("correct horse", testPasswordParams)
+    if err != nil {
+        t.Fatalf("HashPassword: %v", err)
+    }
+    if again == encoded {
+        t.Fatal("two hashes of the same password share a salt")
+    }
+    
+    if _, err := HashPassword("correct horse", PasswordParams{Time: 1, Memory: 64, Threads: 1, SaltLength: 8, KeyLength: 32}); err == nil {
+        t.Fatal("hashed with a short salt")
+    }
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+    encoded, err := HashPassword("correct horse", testPasswordParams)
+    if err != nil {
+        t.Fatalf("HashPassword: %v", err)
+    }
+    if PasswordNeedsRehash(encoded, testPasswordParams) {
+        t.Fatal("a hash with the current parameters needs rehashing")
+    }
+    
+    stronger := testPasswordParams
+    stronger.Time++
+    if !PasswordNeedsRehash(encoded, stronger) {
+        t.Fatal("a hash with other parameters does not need rehashing")
+    }
+    if !PasswordNeedsRehash(pbkdf2Hash("correct horse", 1000), testPasswordParams) {
+        t.Fatal("a PBKDF2 hash does not need rehashing")
+    }
+}
+
+// pbkdf2Hash makes a hash in the form earlier versions were migrated to.
+func pbkdf2Hash(password string, iterations int) string {
+    salt := []byte("0123456789abcdef")
+    hash := pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
+    return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", iterations,
+        base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func TestVerifyLegacyPassword(t *testing.T) {
+    encoded := pbkdf2Hash("correct horse", 1000)
+    if !VerifyPassword("correct horse", encoded) {
+        t.Fatal("refused the right password")
+    }
+    if VerifyPassword("wrong horse", encoded) {
+        t.Fatal("accepted a wrong password")
+    }
+}
+
+func TestParsePasswordHash(t *testing.T) {
+    salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+    hash := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+    
+    stored, err := parsePasswordHash("$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + hash)
+    if err != nil {
+        t.Fatalf("parsePasswordHash: %v", err)
+    }
+    if stored.algorithm != "argon2id" || stored.params.Memory != 65536 || stored.params.Time != 3 || stored.params.Threads != 4 ||
+        len(stored.salt) != 16 || len(stored.hash) != 32 {
+        t.Fatalf("parsed %+v", stored)
+    }
+    
+    invalid := []string{
+        "",
+        "argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + hash,
+        "$argon2id$v=19$m=65536,t=3,p=4$" + salt,
+        "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + hash + "$",
+        "$argon2i$v=19$m=65536,t=3,p=4$" + salt + "$" + hash,
+        "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + hash,
+        "$argon2id$v=19$m=65536,t=three,p=4$" + salt + "$" + hash,
+        "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + hash,
+        fmt.Sprintf("$argon2id$v=19$m=65536,t=%d,p=4$%s$%s", maxPasswordTime+1, salt, hash),
+        fmt.Sprintf("$argon2id$v=19$m=%d,t=3,p=4$%s$%s", maxPasswordMemory+1, salt, hash),
+        "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + hash,
+        "$argon2id$v=19$m=65536,t=3,p=4$not base64!$" + hash,
+        "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$",
+        "$pbkdf2-sha256$i=0$" + salt + "$" + hash,
+        fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", 10*Iterations+1, salt, hash),
+        "$pbkdf2-sha256$i=100000$m=1$" + salt + "$" + hash,
+        "$bcrypt$i=100000$" + salt + "$" + hash,
+    }
+    for _, encoded := range invalid {
+        if _, err := parsePasswordHash(encoded); err == nil {
+            t.Errorf("parsed %q", encoded)
+        }
+        if VerifyPassword("", encoded) {
+            t.Errorf("verified against %q", encoded)
+        }
+    }
+}
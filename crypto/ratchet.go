@@ -0,0 +1,310 @@
+package crypto
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdh"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    
+    "golang.org/x/crypto/hkdf"
+)
+
+// maxSkippedKeys bounds how many message keys a session keeps for messages
+// that have not arrived yet, so a malicious header cannot make it derive
+// keys without end.
+const maxSkippedKeys = 1000
+
+// RatchetSession is one side of a double ratchet session with a contact.
+// Every message is encrypted under its own key, and keys are deleted once
+// used, so a later compromise does not expose earlier messages. It is
+// persisted by the client between messages.
+type RatchetSession struct {
+    ID        string            `json:"id"`
+    AD        []byte            `json:"ad"` // both identity keys, initiator first
+    RootKey   []byte            `json:"root_key"`
+    DHSelf    []byte            `json:"dh_self"` // private ratchet key
+    DHRemote  []byte            `json:"dh_remote,omitempty"`
+    SendChain []byte            `json:"send_chain,omitempty"`
+    RecvChain []byte            `json:"recv_chain,omitempty"`
+    Ns        uint32            `json:"ns"`
+    Nr        uint32            `json:"nr"`
+    PN        uint32            `json:"pn"`
+    Skipped   map[string][]byte `json:"skipped,omitempty"`
+    
+    // Initial is set on the initiator's side until the contact first replies
+    Initial *InitialHeader `json:"initial,omitempty"`
+}
+
+// RatchetHeader tells the recipient which ratchet key and chain position a
+// message was encrypted at.
+type RatchetHeader struct {
+    DH []byte `json:"dh"`
+    PN uint32 `json:"pn"`
+    N  uint32 `json:"n"`
+}
+
+// RatchetMessage is a message encrypted by a RatchetSession.
+type RatchetMessage struct {
+    SessionID  string         `json:"session_id"`
+    Initial    *InitialHeader `json:"initial,omitempty"`
+    Header     RatchetHeader  `json:"header"`
+    Ciphertext []byte         `json:"ciphertext"`
+}
+
+func newInitiatorSession(id string, ad, sharedKey, theirRatchetKey []byte) (*RatchetSession, error) {
+    rs := &RatchetSession{
+        ID:       id,
+        AD:       ad,
+        RootKey:  sharedKey,
+        DHRemote: theirRatchetKey,
+        Skipped:  make(map[string][]byte),
+    }
+    
+    dhSelf, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    rs.DHSelf = dhSelf.Bytes()
+    
+    if rs.RootKey, rs.SendChain, err = rs.ratchetRoot(); err != nil {
+        return nil, err
+    }
+    return rs, nil
+}
+
+func newRecipientSession(id string, ad, sharedKey, ownRatchetKey []byte) *RatchetSession {
+    return &RatchetSession{
+        ID:      id,
+        AD:      ad,
+        RootKey: sharedKey,
+        DHSelf:  ownRatchetKey,
+        Skipped: make(map[string][]byte),
+    }
+}
+
+// Encrypt encrypts a message under the next key of the sending chain.
+func (rs *RatchetSession) Encrypt(plaintext []byte) (*RatchetMessage, error) {
+    if rs.SendChain == nil {
+        return nil, fmt.Errorf("session cannot send before receiving")
+    }
+    
+    dhSelf, err := ecdh.X25519().NewPrivateKey(rs.DHSelf)
+    if err != nil {
+        return nil, err
+    }
+    
+    messageKey, nextChain := chainStep(rs.SendChain)
+    header := RatchetHeader{DH: dhSelf.PublicKey().Bytes(), PN: rs.PN, N: rs.Ns}
+    
+    ciphertext, err := sealRatchet(messageKey, plaintext, rs.AD, &header)
+    if err != nil {
+        return nil, err
+    }
+    
+    rs.SendChain = nextChain
+    rs.Ns++
+    
+    return &RatchetMessage{
+        SessionID:  rs.ID,
+        Initial:    rs.Initial,
+        Header:     header,
+        Ciphertext: ciphertext,
+    }, nil
+}
+
+// Decrypt decrypts a message of this session, which may arrive out of
+// order. The session is only changed when decryption succeeds, so a forged
+// message cannot break it.
+func (rs *RatchetSession) Decrypt(msg *RatchetMessage) ([]byte, error) {
+    state, err := rs.clone()
+    if err != nil {
+        return nil, err
+    }
+    
+    plaintext, err := state.decrypt(msg)
+    if err != nil {
+        return nil, err
+    }
+    
+    // Whatever the contact sent, they have the session by now
+    state.Initial = nil
+    *rs = *state
+    return plaintext, nil
+}
+
+func (rs *RatchetSession) decrypt(msg *RatchetMessage) ([]byte, error) {
+    header := &msg.Header
+    
+    skipped := skippedKeyID(header.DH, header.N)
+    if messageKey, ok := rs.Skipped[skipped]; ok {
+        delete(rs.Skipped, skipped)
+        return openRatchet(messageKey, msg.Ciphertext, rs.AD, header)
+    }
+    
+    if !bytes.Equal(header.DH, rs.DHRemote) {
+        if err := rs.skipUntil(header.PN); err != nil {
+            return nil, err
+        }
+        if err := rs.ratchetStep(header.DH); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := rs.skipUntil(header.N); err != nil {
+        return nil, err
+    }
+    
+    messageKey, nextChain := chainStep(rs.RecvChain)
+    rs.RecvChain = nextChain
+    rs.Nr++
+    
+    return openRatchet(messageKey, msg.Ciphertext, rs.AD, header)
+}
+
+// skipUntil stores the keys of messages of the receiving chain that have not
+// arrived yet, up to position n.
+func (rs *RatchetSession) skipUntil(n uint32) error {
+    if rs.RecvChain == nil {
+        return nil
+    }
+    if n > rs.Nr && (n-rs.Nr > maxSkippedKeys || len(rs.Skipped)+int(n-rs.Nr) > maxSkippedKeys) {
+        return fmt.Errorf("too many skipped messages")
+    }
+    
+    for rs.Nr < n {
+        messageKey, nextChain := chainStep(rs.RecvChain)
+        rs.Skipped[skippedKeyID(rs.DHRemote, rs.Nr)] = messageKey
+        rs.RecvChain = nextChain
+        rs.Nr++
+    }
+    return nil
+}
+
+// ratchetStep moves to the contact's new ratchet key and a new one of our
+// own, deriving fresh receiving and sending chains.
+func (rs *RatchetSession) ratchetStep(theirRatchetKey []byte) error {
+    rs.PN = rs.Ns
+    rs.Ns = 0
+    rs.Nr = 0
+    rs.DHRemote = theirRatchetKey
+    
+    var err error
+    if rs.RootKey, rs.RecvChain, err = rs.ratchetRoot(); err != nil {
+        return err
+    }
+    
+    dhSelf, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return err
+    }
+    rs.DHSelf = dhSelf.Bytes()
+    
+    rs.RootKey, rs.SendChain, err = rs.ratchetRoot()
+    return err
+}
+
+// ratchetRoot mixes the DH output of the current ratchet keys into the root
+// key, returning the next root key and a new chain key.
+func (rs *RatchetSession) ratchetRoot() ([]byte, []byte, error) {
+    dhSelf, err := ecdh.X25519().NewPrivateKey(rs.DHSelf)
+    if err != nil {
+        return nil, nil, err
+    }
+    dhRemote, err := ecdh.X25519().NewPublicKey(rs.DHRemote)
+    if err != nil {
+        return nil, nil, fmt.Errorf("invalid ratchet key: %v", err)
+    }
+    
+    secret, err := dhSelf.ECDH(dhRemote)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    out := make([]byte, 64)
+    kdf := hkdf.New(sha256.New, secret, rs.RootKey, []byte("secure-messenger ratchet"))
+    if _, err := io.ReadFull(kdf, out); err != nil {
+        return nil, nil, err
+    }
+    return out[:32], out[32:], nil
+}
+
+func (rs *RatchetSession) clone() (*RatchetSession, error) {
+    data, err := json.Marshal(rs)
+    if err != nil {
+        return nil, err
+    }
+    
+    var copied RatchetSession
+    if err := json.Unmarshal(data, &copied); err != nil {
+        return nil, err
+    }
+    if copied.Skipped == nil {
+        copied.Skipped = make(map[string][]byte)
+    }
+    return &copied, nil
+}
+
+// chainStep returns the message key at a chain key and the chain key after it.
+func chainStep(chainKey []byte) ([]byte, []byte) {
+    mac := hmac.New(sha256.New, chainKey)
+    mac.Write([]byte{0x01})
+    messageKey := mac.Sum(nil)
+    
+    mac = hmac.New(sha256.New, chainKey)
+    mac.Write([]byte{0x02})
+    return messageKey, mac.Sum(nil)
+}
+
+func skippedKeyID(ratchetKey []byte, n uint32) string {
+    return fmt.Sprintf("%s:%d", hex.EncodeToString(ratchetKey), n)
+}
+
+// sealRatchet encrypts with AES-GCM under a key and nonce derived from the
+// message key, authenticating the session and header along with it.
+func sealRatchet(messageKey, plaintext, ad []byte, header *RatchetHeader) ([]byte, error) {
+    gcm, nonce, err := ratchetCipher(messageKey)
+    if err != nil {
+        return nil, err
+    }
+    return gcm.Seal(nil, nonce, plaintext, headerAD(ad, header)), nil
+}
+
+func openRatchet(messageKey, ciphertext, ad []byte, header *RatchetHeader) ([]byte, error) {
+    gcm, nonce, err := ratchetCipher(messageKey)
+    if err != nil {
+        return nil, err
+    }
+    return gcm.Open(nil, nonce, ciphertext, headerAD(ad, header))
+}
+
+func ratchetCipher(messageKey []byte) (cipher.AEAD, []byte, error) {
+    out := make([]byte, 32+12)
+    kdf := hkdf.New(sha256.New, messageKey, make([]byte, 32), []byte("secure-messenger message keys"))
+    if _, err := io.ReadFull(kdf, out); err != nil {
+        return nil, nil, err
+    }
+    
+    block, err := aes.NewCipher(out[:32])
+    if err != nil {
+        return nil, nil, err
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, nil, err
+    }
+    return gcm, out[32:], nil
+}
+
+func headerAD(ad []byte, header *RatchetHeader) []byte {
+    data := append(append([]byte{}, ad...), header.DH...)
+    data = binary.BigEndian.AppendUint32(data, header.PN)
+    return binary.BigEndian.AppendUint32(data, header.N)
+}
@@ -0,0 +1,175 @@
+package crypto
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+)
+
+// newSessionPair starts a session from alice to bob, with bob having
+// received alice's first message.
+func newSessionPair(t *testing.T) (*RatchetSession, *RatchetSession) {
+    t.Helper()
+    
+    bobPrekeys, bundle := newBundle(t, true)
+    alicePrekeys, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    
+    alice, err := InitiateSession(alicePrekeys, bundle)
+    if err != nil {
+        t.Fatalf("InitiateSession: %v", err)
+    }
+    msg := encrypt(t, alice, "first")
+    
+    bob, err := AcceptSession(bobPrekeys, msg.Initial)
+    if err != nil {
+        t.Fatalf("AcceptSession: %v", err)
+    }
+    expectPlaintext(t, bob, msg, "first")
+    return alice, bob
+}
+
+func encrypt(t *testing.T, rs *RatchetSession, plaintext string) *RatchetMessage {
+    t.Helper()
+    
+    msg, err := rs.Encrypt([]byte(plaintext))
+    if err != nil {
+        t.Fatalf("Encrypt: %v", err)
+    }
+    return msg
+}
+
+func expectPlaintext(t *testing.T, rs *RatchetSession, msg *RatchetMessage, want string) {
+    t.Helper()
+    
+    plaintext, err := rs.Decrypt(msg)
+    if err != nil {
+        t.Fatalf("Decrypt %q: %v", want, err)
+    }
+    if string(plaintext) != want {
+        t.Fatalf("got %q, want %q", plaintext, want)
+    }
+}
+
+func TestRatchetRoundTrip(t *testing.T) {
+    alice, bob := newSessionPair(t)
+    
+    if _, err := newRecipientSession("id", nil, make([]byte, 32), make([]byte, 32)).Encrypt([]byte("x")); err == nil {
+        t.Fatal("a recipient session sent before receiving")
+    }
+    
+    // Several turns, with more than one message per turn
+    for turn := 0; turn < 4; turn++ {
+        for i := 0; i < 3; i++ {
+            text := fmt.Sprintf("bob %d.%d", turn, i)
+            expectPlaintext(t, alice, encrypt(t, bob, text), text)
+        }
+        if alice.Initial != nil {
+            t.Fatal("initial header still sent after bob replied")
+        }
+        for i := 0; i < 2; i++ {
+            text := fmt.Sprintf("alice %d.%d", turn, i)
+            expectPlaintext(t, bob, encrypt(t, alice, text), text)
+        }
+    }
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+    alice, bob := newSessionPair(t)
+    
+    var sent []*RatchetMessage
+    for i := 0; i < 5; i++ {
+        sent = append(sent, encrypt(t, alice, fmt.Sprintf("m%d", i)))
+    }
+    
+    for _, i := range []int{3, 0, 4} {
+        expectPlaintext(t, bob, sent[i], fmt.Sprintf("m%d", i))
+    }
+    
+    // A ratchet step while m1 and m2 are still on their way
+    expectPlaintext(t, alice, encrypt(t, bob, "reply"), "reply")
+    next := encrypt(t, alice, "after reply")
+    expectPlaintext(t, bob, next, "after reply")
+    
+    expectPlaintext(t, bob, sent[2], "m2")
+    expectPlaintext(t, bob, sent[1], "m1")
+    if len(bob.Skipped) != 0 {
+        t.Fatalf("%d skipped keys kept after every message arrived", len(bob.Skipped))
+    }
+}
+
+func TestRatchetRejectsReplay(t *testing.T) {
+    alice, bob := newSessionPair(t)
+    
+    msg := encrypt(t, alice, "once")
+    expectPlaintext(t, bob, msg, "once")
+    if _, err := bob.Decrypt(msg); err == nil {
+        t.Fatal("decrypted the same message twice")
+    }
+    
+    // The same goes for a message whose key was skipped and then used
+    first := encrypt(t, alice, "first")
+    expectPlaintext(t, bob, encrypt(t, alice, "second"), "second")
+    expectPlaintext(t, bob, first, "first")
+    if _, err := bob.Decrypt(first); err == nil {
+        t.Fatal("decrypted a skipped message twice")
+    }
+}
+
+func TestRatchetRejectsTampering(t *testing.T) {
+    alice, bob := newSessionPair(t)
+    msg := encrypt(t, alice, "untouched")
+    
+    tamper := []func(m *RatchetMessage){
+        func(m *RatchetMessage) { m.Ciphertext[0] ^= 1 },
+        func(m *RatchetMessage) { m.Ciphertext[len(m.Ciphertext)-1] ^= 1 },
+        func(m *RatchetMessage) { m.Header.PN++ },
+        func(m *RatchetMessage) { m.Header.N++ },
+        func(m *RatchetMessage) { m.Header.DH = append([]byte{}, m.Header.DH...); m.Header.DH[0] ^= 1 },
+    }
+    for i, change := range tamper {
+        tampered := *msg
+        tampered.Ciphertext = append([]byte{}, msg.Ciphertext...)
+        change(&tampered)
+        
+        if _, err := bob.Decrypt(&tampered); err == nil {
+            t.Fatalf("tampered message %d decrypted", i)
+        }
+    }
+    
+    // Failed attempts leave the session as it was
+    expectPlaintext(t, bob, msg, "untouched")
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+    alice, bob := newSessionPair(t)
+    
+    msg := encrypt(t, alice, "far ahead")
+    msg.Header.N = maxSkippedKeys + 1
+    if _, err := bob.Decrypt(msg); err == nil {
+        t.Fatal("derived more skipped keys than allowed")
+    }
+    if len(bob.Skipped) != 0 {
+        t.Fatalf("rejected message left %d skipped keys", len(bob.Skipped))
+    }
+}
+
+func TestRatchetPersistence(t *testing.T) {
+    alice, bob := newSessionPair(t)
+    pending := encrypt(t, alice, "pending")
+    expectPlaintext(t, bob, encrypt(t, alice, "later"), "later")
+    
+    data, err := json.Marshal(bob)
+    if err != nil {
+        t.Fatalf("Marshal: %v", err)
+    }
+    var restored RatchetSession
+    if err := json.Unmarshal(data, &restored); err != nil {
+        t.Fatalf("Unmarshal: %v", err)
+    }
+    
+    expectPlaintext(t, &restored, pending, "pending")
+    expectPlaintext(t, alice, encrypt(t, &restored, "restored"), "restored")
+}
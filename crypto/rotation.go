@@ -0,0 +1,160 @@
+package crypto
+
+import (
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "fmt"
+    "time"
+)
+
+// keyRotationContext is prepended to a new public key before the old one
+// signs it.
+const keyRotationContext = "secure-messenger key rotation"
+
+// retiredKey is a private key replaced by a rotation, kept to decrypt what
+// was encrypted to it.
+type retiredKey struct {
+    privateKey *rsa.PrivateKey
+    id         string
+    createdAt  time.Time
+    retiredAt  time.Time
+}
+
+// KeyInfo describes one of the user's keypairs.
+type KeyInfo struct {
+    ID        string
+    CreatedAt time.Time // zero for keys made before creation dates were kept
+    RetiredAt time.Time // zero for the current key
+}
+
+// KeyID identifies a public key in the ciphertexts encrypted to it: the
+// first 8 bytes of its SHA-256 digest, in hex.
+func KeyID(publicKey *rsa.PublicKey) (string, error) {
+    der, err := x509.MarshalPKIXPublicKey(publicKey)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(der)
+    return hex.EncodeToString(sum[:8]), nil
+}
+
+// Keys lists the user's keypairs, the current one first and then the
+// retired ones from the most recently retired.
+func (km *KeyManager) Keys() []KeyInfo {
+    if km.privateKey == nil {
+        return nil
+    }
+    
+    keys := []KeyInfo{{ID: km.keyID, CreatedAt: km.createdAt}}
+    for i := len(km.retired) - 1; i >= 0; i-- {
+        retired := km.retired[i]
+        keys = append(keys, KeyInfo{ID: retired.id, CreatedAt: retired.createdAt, RetiredAt: retired.retiredAt})
+    }
+    return keys
+}
+
+// KeyID returns the ID of the current public key.
+func (km *KeyManager) KeyID() string {
+    return km.keyID
+}
+
+// privateKeyFor returns the current or retired private key with the ID, or
+// nil if there is none.
+func (km *KeyManager) privateKeyFor(keyID string) *rsa.PrivateKey {
+    if keyID == km.keyID {
+        return km.privateKey
+    }
+    for _, retired := range km.retired {
+        if retired.id == keyID {
+            return retired.privateKey
+        }
+    }
+    return nil
+}
+
+// privateKeys returns every private key, the current one first, for
+// ciphertexts made before they named their key.
+func (km *KeyManager) privateKeys() []*rsa.PrivateKey {
+    keys := []*rsa.PrivateKey{km.privateKey}
+    for i := len(km.retired) - 1; i >= 0; i-- {
+        keys = append(keys, km.retired[i].privateKey)
+    }
+    return keys
+}
+
+// setPrivateKey makes the private key the current one.
+func (km *KeyManager) setPrivateKey(privateKey *rsa.PrivateKey, createdAt time.Time) error {
+    keyID, err := KeyID(&privateKey.PublicKey)
+    if err != nil {
+        return err
+    }
+    
+    km.privateKey = privateKey
+    km.publicKey = &privateKey.PublicKey
+    km.keyID = keyID
+    km.createdAt = createdAt
+    return nil
+}
+
+// RotateKeys replaces the RSA keypair with a new one and saves it in the
+// keystore in keyPath, which the passphrase must open. The old private key
+// is kept to decrypt messages encrypted to it. It returns the old key's
+// signature over the new public key, which lets contacts who trust the old
+// key accept the new one. The signing key stays the same, so signatures on
+// earlier messages still verify.
+func (km *KeyManager) RotateKeys(keyPath, passphrase string) ([]byte, error) {
+    if km.privateKey == nil {
+        return nil, fmt.Errorf("no private key loaded")
+    }
+    if err := NewKeyManager().openKeystore(keyPath, passphrase); err != nil {
+        return nil, err
+    }
+    
+    privateKey, err := rsa.GenerateKey(rand.Reader, KeySize)
+    if err != nil {
+        return nil, err
+    }
+    signature, err := rsa.SignPSS(rand.Reader, km.privateKey, crypto.SHA256, keyRotationDigest(&privateKey.PublicKey), nil)
+    if err != nil {
+        return nil, err
+    }
+    
+    previous := *km
+    now := time.Now()
+    km.retired = append(km.retired[:len(km.retired):len(km.retired)], &retiredKey{
+        privateKey: km.privateKey,
+        id:         km.keyID,
+        createdAt:  km.createdAt,
+        retiredAt:  now,
+    })
+    if err := km.setPrivateKey(privateKey, now); err != nil {
+        *km = previous
+        return nil, err
+    }
+    
+    if err := km.SaveKeys(keyPath, passphrase); err != nil {
+        *km = previous
+        return nil, fmt.Errorf("failed to save keys: %v", err)
+    }
+    return signature, nil
+}
+
+// VerifyKeyRotation checks that the old public key signed the new one, as
+// RotateKeys does.
+func VerifyKeyRotation(oldPublicKey, newPublicKey *rsa.PublicKey, signature []byte) error {
+    if err := rsa.VerifyPSS(oldPublicKey, crypto.SHA256, keyRotationDigest(newPublicKey), signature, nil); err != nil {
+        return fmt.Errorf("invalid key rotation signature")
+    }
+    return nil
+}
+
+func keyRotationDigest(publicKey *rsa.PublicKey) []byte {
+    hash := sha256.New()
+    hash.Write([]byte(keyRotationContext))
+    hash.Write(x509.MarshalPKCS1PublicKey(publicKey))
+    return hash.Sum(nil)
+}
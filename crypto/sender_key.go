@@ -0,0 +1,153 @@
+package crypto
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+)
+
+// SenderKey is a member's chain for encrypting their messages to a channel.
+// Each message is encrypted once under the next key of the chain, and every
+// other member holds a copy of the chain to decrypt it. The chain only moves
+// forward, so a copy taken later cannot decrypt earlier messages.
+type SenderKey struct {
+    ID        string            `json:"id"`
+    ChainKey  []byte            `json:"chain_key"`
+    Iteration uint32            `json:"iteration"`
+    Skipped   map[uint32][]byte `json:"skipped,omitempty"` // keys of messages not yet received
+}
+
+// SenderKeyMessage is a channel message encrypted with a SenderKey.
+type SenderKeyMessage struct {
+    KeyID      string `json:"key_id"`
+    Iteration  uint32 `json:"iteration"`
+    Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewSenderKey generates a sender key with a fresh random chain.
+func NewSenderKey() (*SenderKey, error) {
+    id := make([]byte, 16)
+    chainKey := make([]byte, 32)
+    if _, err := rand.Read(id); err != nil {
+        return nil, err
+    }
+    if _, err := rand.Read(chainKey); err != nil {
+        return nil, err
+    }
+    
+    return &SenderKey{
+        ID:       hex.EncodeToString(id),
+        ChainKey: chainKey,
+        Skipped:  make(map[uint32][]byte),
+    }, nil
+}
+
+// Distribution returns the copy of the key to hand to another member, from
+// the current position of the chain on.
+func (sk *SenderKey) Distribution() *SenderKey {
+    return &SenderKey{
+        ID:        sk.ID,
+        ChainKey:  append([]byte{}, sk.ChainKey...),
+        Iteration: sk.Iteration,
+    }
+}
+
+// Encrypt encrypts a message under the next key of the chain. The associated
+// data should name the channel and sender, so a message cannot be replayed
+// into another channel or passed off as someone else's.
+func (sk *SenderKey) Encrypt(plaintext, ad []byte) (*SenderKeyMessage, error) {
+    messageKey, nextChain := chainStep(sk.ChainKey)
+    
+    ciphertext, err := sealSenderKey(messageKey, plaintext, ad, sk.ID, sk.Iteration)
+    if err != nil {
+        return nil, err
+    }
+    
+    msg := &SenderKeyMessage{KeyID: sk.ID, Iteration: sk.Iteration, Ciphertext: ciphertext}
+    sk.ChainKey = nextChain
+    sk.Iteration++
+    return msg, nil
+}
+
+// Decrypt decrypts a message encrypted with this key, which may arrive out
+// of order. The key is only changed when decryption succeeds.
+func (sk *SenderKey) Decrypt(msg *SenderKeyMessage, ad []byte) ([]byte, error) {
+    if msg.KeyID != sk.ID {
+        return nil, fmt.Errorf("message was encrypted with another sender key")
+    }
+    
+    state, err := sk.clone()
+    if err != nil {
+        return nil, err
+    }
+    
+    var messageKey []byte
+    if key, ok := state.Skipped[msg.Iteration]; ok {
+        messageKey = key
+        delete(state.Skipped, msg.Iteration)
+    } else {
+        if msg.Iteration < state.Iteration {
+            return nil, fmt.Errorf("message key is no longer available")
+        }
+        if msg.Iteration-state.Iteration > maxSkippedKeys || len(state.Skipped)+int(msg.Iteration-state.Iteration) > maxSkippedKeys {
+            return nil, fmt.Errorf("too many skipped messages")
+        }
+        
+        for state.Iteration < msg.Iteration {
+            key, nextChain := chainStep(state.ChainKey)
+            state.Skipped[state.Iteration] = key
+            state.ChainKey = nextChain
+            state.Iteration++
+        }
+        
+        messageKey, state.ChainKey = chainStep(state.ChainKey)
+        state.Iteration++
+    }
+    
+    plaintext, err := openSenderKey(messageKey, msg.Ciphertext, ad, msg.KeyID, msg.Iteration)
+    if err != nil {
+        return nil, err
+    }
+    
+    *sk = *state
+    return plaintext, nil
+}
+
+func (sk *SenderKey) clone() (*SenderKey, error) {
+    data, err := json.Marshal(sk)
+    if err != nil {
+        return nil, err
+    }
+    
+    var copied SenderKey
+    if err := json.Unmarshal(data, &copied); err != nil {
+        return nil, err
+    }
+    if copied.Skipped == nil {
+        copied.Skipped = make(map[uint32][]byte)
+    }
+    return &copied, nil
+}
+
+func sealSenderKey(messageKey, plaintext, ad []byte, keyID string, iteration uint32) ([]byte, error) {
+    gcm, nonce, err := ratchetCipher(messageKey)
+    if err != nil {
+        return nil, err
+    }
+    return gcm.Seal(nil, nonce, plaintext, senderKeyAD(ad, keyID, iteration)), nil
+}
+
+func openSenderKey(messageKey, ciphertext, ad []byte, keyID string, iteration uint32) ([]byte, error) {
+    gcm, nonce, err := ratchetCipher(messageKey)
+    if err != nil {
+        return nil, err
+    }
+    return gcm.Open(nil, nonce, ciphertext, senderKeyAD(ad, keyID, iteration))
+}
+
+func senderKeyAD(ad []byte, keyID string, iteration uint32) []byte {
+    data := append(append([]byte{}, ad...), keyID...)
+    return binary.BigEndian.AppendUint32(data, iteration)
+}
@@ -0,0 +1,132 @@
+package crypto
+
+import (
+    "fmt"
+    "testing"
+)
+
+var channelAD = []byte("ch_1 alice")
+
+func newSenderKey(t *testing.T) *SenderKey {
+    t.Helper()
+    
+    sk, err := NewSenderKey()
+    if err != nil {
+        t.Fatalf("NewSenderKey: %v", err)
+    }
+    return sk
+}
+
+func encryptSenderKey(t *testing.T, sk *SenderKey, plaintext string) *SenderKeyMessage {
+    t.Helper()
+    
+    msg, err := sk.Encrypt([]byte(plaintext), channelAD)
+    if err != nil {
+        t.Fatalf("Encrypt: %v", err)
+    }
+    return msg
+}
+
+func expectSenderKeyPlaintext(t *testing.T, sk *SenderKey, msg *SenderKeyMessage, want string) {
+    t.Helper()
+    
+    plaintext, err := sk.Decrypt(msg, channelAD)
+    if err != nil {
+        t.Fatalf("Decrypt %q: %v", want, err)
+    }
+    if string(plaintext) != want {
+        t.Fatalf("got %q, want %q", plaintext, want)
+    }
+}
+
+func TestSenderKeyRoundTrip(t *testing.T) {
+    sender := newSenderKey(t)
+    receiver := sender.Distribution()
+    
+    for i := 0; i < 5; i++ {
+        text := fmt.Sprintf("m%d", i)
+        expectSenderKeyPlaintext(t, receiver, encryptSenderKey(t, sender, text), text)
+    }
+}
+
+func TestSenderKeyOutOfOrder(t *testing.T) {
+    sender := newSenderKey(t)
+    receiver := sender.Distribution()
+    
+    var sent []*SenderKeyMessage
+    for i := 0; i < 5; i++ {
+        sent = append(sent, encryptSenderKey(t, sender, fmt.Sprintf("m%d", i)))
+    }
+    
+    for _, i := range []int{4, 1, 0, 3, 2} {
+        expectSenderKeyPlaintext(t, receiver, sent[i], fmt.Sprintf("m%d", i))
+    }
+    if len(receiver.Skipped) != 0 {
+        t.Fatalf("%d skipped keys kept after every message arrived", len(receiver.Skipped))
+    }
+    
+    if _, err := receiver.Decrypt(sent[2], channelAD); err == nil {
+        t.Fatal("decrypted the same message twice")
+    }
+}
+
+func TestSenderKeyRejectsTampering(t *testing.T) {
+    sender := newSenderKey(t)
+    receiver := sender.Distribution()
+    msg := encryptSenderKey(t, sender, "untouched")
+    
+    flipped := *msg
+    flipped.Ciphertext = append([]byte{}, msg.Ciphertext...)
+    flipped.Ciphertext[0] ^= 1
+    if _, err := receiver.Decrypt(&flipped, channelAD); err == nil {
+        t.Fatal("decrypted a tampered ciphertext")
+    }
+    
+    moved := *msg
+    moved.Iteration = 1
+    if _, err := receiver.Decrypt(&moved, channelAD); err == nil {
+        t.Fatal("decrypted a message at another iteration")
+    }
+    
+    // Replayed into another channel, or passed off as another sender's
+    if _, err := receiver.Decrypt(msg, []byte("ch_2 alice")); err == nil {
+        t.Fatal("decrypted a message with other associated data")
+    }
+    
+    wrongKey := *msg
+    wrongKey.KeyID = newSenderKey(t).ID
+    if _, err := receiver.Decrypt(&wrongKey, channelAD); err == nil {
+        t.Fatal("decrypted a message naming another sender key")
+    }
+    
+    // Failed attempts leave the key as it was
+    if receiver.Iteration != 0 || len(receiver.Skipped) != 0 {
+        t.Fatalf("failed decryption moved the chain to %d with %d skipped keys", receiver.Iteration, len(receiver.Skipped))
+    }
+    expectSenderKeyPlaintext(t, receiver, msg, "untouched")
+}
+
+func TestSenderKeyLaterCopyCannotReadEarlier(t *testing.T) {
+    sender := newSenderKey(t)
+    early := encryptSenderKey(t, sender, "before joining")
+    
+    late := sender.Distribution()
+    if _, err := late.Decrypt(early, channelAD); err == nil {
+        t.Fatal("a copy taken later decrypted an earlier message")
+    }
+    expectSenderKeyPlaintext(t, late, encryptSenderKey(t, sender, "after joining"), "after joining")
+}
+
+func TestSenderKeyTooManySkipped(t *testing.T) {
+    sender := newSenderKey(t)
+    receiver := sender.Distribution()
+    
+    msg := encryptSenderKey(t, sender, "far ahead")
+    msg.Iteration = maxSkippedKeys + 1
+    if _, err := receiver.Decrypt(msg, channelAD); err == nil {
+        t.Fatal("derived more skipped keys than allowed")
+    }
+    if len(receiver.Skipped) != 0 {
+        t.Fatalf("rejected message left %d skipped keys", len(receiver.Skipped))
+    }
+}
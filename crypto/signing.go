@@ -0,0 +1,144 @@
+package crypto
+
+import (
+    "crypto"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/pem"
+    "fmt"
+    "os"
+    "path/filepath"
+    "secure-messenger/shared"
+    "time"
+)
+
+const (
+    // signingKeySignatureContext is prepended to a signing key before the
+    // RSA key signs it.
+    signingKeySignatureContext = "secure-messenger signing key"
+    
+    // messageSignatureContext is prepended to the signed fields of a message.
+    messageSignatureContext = "secure-messenger message"
+)
+
+// loadSigningKey loads the Ed25519 signing key kept unencrypted next to the
+// RSA key before keys were moved into a keystore, generating one for keys
+// made before messages were signed.
+func (km *KeyManager) loadSigningKey(keyPath string) error {
+    path := filepath.Join(keyPath, "signing.pem")
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        _, km.signingKey, err = ed25519.GenerateKey(rand.Reader)
+        return err
+    }
+    if err != nil {
+        return err
+    }
+    
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return fmt.Errorf("failed to decode signing key PEM")
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return err
+    }
+    signingKey, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return fmt.Errorf("signing key is not an Ed25519 key")
+    }
+    
+    km.signingKey = signingKey
+    return nil
+}
+
+// SigningPublicKey returns the key contacts verify the user's messages with.
+func (km *KeyManager) SigningPublicKey() ed25519.PublicKey {
+    if km.signingKey == nil {
+        return nil
+    }
+    return km.signingKey.Public().(ed25519.PublicKey)
+}
+
+// SignSigningKey signs the user's signing key with their RSA key, so the key
+// contacts pinned and verified also vouches for it.
+func (km *KeyManager) SignSigningKey() ([]byte, error) {
+    if km.privateKey == nil || km.signingKey == nil {
+        return nil, fmt.Errorf("no private key loaded")
+    }
+    digest := signingKeyDigest(km.SigningPublicKey())
+    return rsa.SignPSS(rand.Reader, km.privateKey, crypto.SHA256, digest, nil)
+}
+
+// VerifySigningKey checks a signature made by SignSigningKey.
+func VerifySigningKey(publicKey *rsa.PublicKey, signingKey, signature []byte) error {
+    if len(signingKey) != ed25519.PublicKeySize {
+        return fmt.Errorf("invalid signing key")
+    }
+    if err := rsa.VerifyPSS(publicKey, crypto.SHA256, signingKeyDigest(signingKey), signature, nil); err != nil {
+        return fmt.Errorf("invalid signing key signature")
+    }
+    return nil
+}
+
+func signingKeyDigest(signingKey []byte) []byte {
+    hash := sha256.New()
+    hash.Write([]byte(signingKeySignatureContext))
+    hash.Write(signingKey)
+    return hash.Sum(nil)
+}
+
+// SignMessage signs a message as sent: its content and attachments, the user
+// or channel it was sent to, the sender's client message ID and when it was
+// signed.
+func (km *KeyManager) SignMessage(from, to, clientMessageID, content string, attachments []*shared.Attachment, signedAt time.Time) ([]byte, error) {
+    if km.signingKey == nil {
+        return nil, fmt.Errorf("no signing key loaded")
+    }
+    return ed25519.Sign(km.signingKey, messageSignatureData(from, to, clientMessageID, content, attachments, signedAt)), nil
+}
+
+// VerifyMessage checks a signature made by SignMessage.
+func VerifyMessage(signingKey []byte, from, to, clientMessageID, content string, attachments []*shared.Attachment, signedAt time.Time, signature []byte) bool {
+    if len(signingKey) != ed25519.PublicKeySize {
+        return false
+    }
+    data := messageSignatureData(from, to, clientMessageID, content, attachments, signedAt)
+    return ed25519.Verify(ed25519.PublicKey(signingKey), data, signature)
+}
+
+// messageSignatureData encodes the signed fields with their lengths, so no
+// two messages encode the same. Attachments are encoded in order, without
+// the ID the server gives them, and only when there are any, so messages
+// signed before attachments were covered still verify.
+func messageSignatureData(from, to, clientMessageID, content string, attachments []*shared.Attachment, signedAt time.Time) []byte {
+    data := []byte(messageSignatureContext)
+    data = appendFields(data, from, to, clientMessageID, content)
+    
+    if len(attachments) > 0 {
+        data = binary.BigEndian.AppendUint32(data, uint32(len(attachments)))
+        for _, attachment := range attachments {
+            // The server fills in a missing MIME type
+            mimeType := attachment.MimeType
+            if mimeType == "" {
+                mimeType = shared.DefaultMimeType
+            }
+            data = appendFields(data, attachment.BlobHash, attachment.Name, mimeType, attachment.Key, attachment.PreviewHash)
+            data = binary.BigEndian.AppendUint64(data, uint64(attachment.Size))
+            data = binary.BigEndian.AppendUint64(data, uint64(attachment.PreviewSize))
+        }
+    }
+    return binary.BigEndian.AppendUint64(data, uint64(signedAt.UnixMilli()))
+}
+
+func appendFields(data []byte, fields ...string) []byte {
+    for _, field := range fields {
+        data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+        data = append(data, field...)
+    }
+    return data
+}
@@ -0,0 +1,53 @@
+package crypto
+
+import (
+    "testing"
+    "time"
+    
+    "secure-messenger/shared"
+)
+
+func TestMessageSignatureCoversAttachments(t *testing.T) {
+    km := testKeyManager(t)
+    signedAt := time.Now()
+    attachment := func() *shared.Attachment {
+        return &shared.Attachment{BlobHash: "aa", Name: "report.pdf", Size: 100, Key: "wrapped", PreviewHash: "bb", PreviewSize: 10}
+    }
+    sent := []*shared.Attachment{attachment(), attachment()}
+    sent[1].Name = "notes.txt"
+    
+    signature, err := km.SignMessage("alice", "bob", "cm_1", "content", sent, signedAt)
+    if err != nil {
+        t.Fatalf("SignMessage: %v", err)
+    }
+    verify := func(attachments []*shared.Attachment) bool {
+        return VerifyMessage(km.SigningPublicKey(), "alice", "bob", "cm_1", "content", attachments, signedAt, signature)
+    }
+    
+    // The server gives attachments an ID and fills in a missing MIME type
+    received := []*shared.Attachment{attachment(), attachment()}
+    received[1].Name = "notes.txt"
+    received[0].ID, received[0].MimeType = "att_1", shared.DefaultMimeType
+    if !verify(received) {
+        t.Fatal("attachments as stored by the server did not verify")
+    }
+    
+    tamper := []func(a []*shared.Attachment) []*shared.Attachment{
+        func(a []*shared.Attachment) []*shared.Attachment { return nil },
+        func(a []*shared.Attachment) []*shared.Attachment { return a[:1] },
+        func(a []*shared.Attachment) []*shared.Attachment { return []*shared.Attachment{a[1], a[0]} },
+        func(a []*shared.Attachment) []*shared.Attachment { a[0].BlobHash = "cc"; return a },
+        func(a []*shared.Attachment) []*shared.Attachment { a[0].Size++; return a },
+        func(a []*shared.Attachment) []*shared.Attachment { a[0].Name = "invoice.pdf"; return a },
+        func(a []*shared.Attachment) []*shared.Attachment { a[0].MimeType = "text/html"; return a },
+        func(a []*shared.Attachment) []*shared.Attachment { a[0].Key = "other"; return a },
+        func(a []*shared.Attachment) []*shared.Attachment { a[0].PreviewHash = ""; a[0].PreviewSize = 0; return a },
+    }
+    for i, change := range tamper {
+        attachments := []*shared.Attachment{attachment(), attachment()}
+        attachments[1].Name = "notes.txt"
+        if verify(change(attachments)) {
+            t.Fatalf("tampered attachments %d verified", i)
+        }
+    }
+}
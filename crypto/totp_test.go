@@ -0,0 +1,103 @@
+package crypto
+
+import (
+    "encoding/base32"
+    "testing"
+    "time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, in base32.
+var rfc6238Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func totpCode(t *testing.T, step int64) string {
+    t.Helper()
+    
+    code, err := TOTPCode(rfc6238Secret, step)
+    if err != nil {
+        t.Fatalf("TOTPCode: %v", err)
+    }
+    return code
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+    // The SHA-1 vectors of RFC 6238 appendix B, which are 8 digits long;
+    // 6-digit codes are their last 6 digits
+    vectors := []struct {
+        unix int64
+        code string
+    }{
+        {59, "94287082"},
+        {1111111109, "07081804"},
+        {1111111111, "14050471"},
+        {1234567890, "89005924"},
+        {2000000000, "69279037"},
+        {20000000000, "65353130"},
+    }
+    for _, v := range vectors {
+        want := v.code[len(v.code)-TOTPDigits:]
+        if got := totpCode(t, TOTPStep(time.Unix(v.unix, 0))); got != want {
+            t.Errorf("code at %d: got %s, want %s", v.unix, got, want)
+        }
+    }
+}
+
+func TestTOTPSecret(t *testing.T) {
+    secret, err := GenerateTOTPSecret()
+    if err != nil {
+        t.Fatalf("GenerateTOTPSecret: %v", err)
+    }
+    key, err := totpEncoding.DecodeString(secret)
+    if err != nil || len(key) != totpSecretSize {
+        t.Fatalf("secret %q does not decode to %d bytes: %v", secret, totpSecretSize, err)
+    }
+    
+    if _, err := TOTPCode("not base32!", 1); err == nil {
+        t.Fatal("made a code from an invalid secret")
+    }
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+    now := time.Unix(1111111111, 0)
+    step := TOTPStep(now)
+    
+    for offset := int64(-totpSkew); offset <= totpSkew; offset++ {
+        got, ok := VerifyTOTP(rfc6238Secret, totpCode(t, step+offset), now, 0)
+        if !ok || got != step+offset {
+            t.Fatalf("code %d periods off: got step %d, %v", offset, got, ok)
+        }
+    }
+    for _, offset := range []int64{-totpSkew - 1, totpSkew + 1} {
+        if _, ok := VerifyTOTP(rfc6238Secret, totpCode(t, step+offset), now, 0); ok {
+            t.Fatalf("accepted a code %d periods off", offset)
+        }
+    }
+    
+    code := totpCode(t, step)
+    if _, ok := VerifyTOTP(rfc6238Secret, " "+code[:3]+" "+code[3:]+" ", now, 0); !ok {
+        t.Fatal("refused a code typed with spaces")
+    }
+    for _, wrong := range []string{"", code[1:], code + "0", "000000"} {
+        if wrong == code {
+            continue
+        }
+        if _, ok := VerifyTOTP(rfc6238Secret, wrong, now, 0); ok {
+            t.Fatalf("accepted %q", wrong)
+        }
+    }
+}
+
+func TestVerifyTOTPLastStep(t *testing.T) {
+    now := time.Unix(1111111111, 0)
+    step := TOTPStep(now)
+    
+    // A code cannot be used again, nor one older than the last one used
+    if _, ok := VerifyTOTP(rfc6238Secret, totpCode(t, step), now, step); ok {
+        t.Fatal("accepted a code for the last step used")
+    }
+    if _, ok := VerifyTOTP(rfc6238Secret, totpCode(t, step-1), now, step); ok {
+        t.Fatal("accepted a code before the last step used")
+    }
+    if got, ok := VerifyTOTP(rfc6238Secret, totpCode(t, step+1), now, step); !ok || got != step+1 {
+        t.Fatalf("refused the code after the last step used: %d, %v", got, ok)
+    }
+}
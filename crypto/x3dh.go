@@ -0,0 +1,298 @@
+package crypto
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/ecdh"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "secure-messenger/shared"
+    
+    "golang.org/x/crypto/hkdf"
+)
+
+// prekeySignatureContext is prepended to the signed prekey data, so the
+// signature cannot be passed off as one over anything else.
+const prekeySignatureContext = "secure-messenger prekeys"
+
+// PrekeySet holds the private halves of a user's published prekeys. It
+// belongs to one device and is persisted by the client.
+type PrekeySet struct {
+    IdentityKey    []byte            `json:"identity_key"`
+    SignedPrekeyID uint32            `json:"signed_prekey_id"`
+    SignedPrekey   []byte            `json:"signed_prekey"`
+    OneTimePrekeys map[string][]byte `json:"one_time_prekeys"` // by ID
+}
+
+// GeneratePrekeySet creates a new identity key and signed prekey, without
+// any one-time prekeys yet.
+func GeneratePrekeySet() (*PrekeySet, error) {
+    identityKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    signedPrekey, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    
+    var id [4]byte
+    if _, err := rand.Read(id[:]); err != nil {
+        return nil, err
+    }
+    
+    return &PrekeySet{
+        IdentityKey:    identityKey.Bytes(),
+        SignedPrekeyID: uint32(id[0])<<24 | uint32(id[1])<<16 | uint32(id[2])<<8 | uint32(id[3]),
+        SignedPrekey:   signedPrekey.Bytes(),
+        OneTimePrekeys: make(map[string][]byte),
+    }, nil
+}
+
+// GenerateOneTimePrekeys adds count new one-time prekeys to the set and
+// returns their public halves for publishing.
+func (ps *PrekeySet) GenerateOneTimePrekeys(count int) ([]*shared.OneTimePrekey, error) {
+    var public []*shared.OneTimePrekey
+    for i := 0; i < count; i++ {
+        key, err := ecdh.X25519().GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        
+        id := make([]byte, 8)
+        if _, err := rand.Read(id); err != nil {
+            return nil, err
+        }
+        
+        ps.OneTimePrekeys[hex.EncodeToString(id)] = key.Bytes()
+        public = append(public, &shared.OneTimePrekey{
+            ID:        hex.EncodeToString(id),
+            PublicKey: key.PublicKey().Bytes(),
+        })
+    }
+    return public, nil
+}
+
+// Upload returns the set's public keys signed with the user's RSA key, along
+// with the given one-time prekeys.
+func (ps *PrekeySet) Upload(km *KeyManager, oneTimePrekeys []*shared.OneTimePrekey) (*shared.PrekeyUpload, error) {
+    identityKey, err := ecdh.X25519().NewPrivateKey(ps.IdentityKey)
+    if err != nil {
+        return nil, err
+    }
+    signedPrekey, err := ecdh.X25519().NewPrivateKey(ps.SignedPrekey)
+    if err != nil {
+        return nil, err
+    }
+    
+    upload := &shared.PrekeyUpload{
+        IdentityKey:    identityKey.PublicKey().Bytes(),
+        SignedPrekeyID: ps.SignedPrekeyID,
+        SignedPrekey:   signedPrekey.PublicKey().Bytes(),
+        OneTimePrekeys: oneTimePrekeys,
+    }
+    
+    upload.Signature, err = km.SignPrekeys(upload.IdentityKey, upload.SignedPrekey)
+    if err != nil {
+        return nil, err
+    }
+    return upload, nil
+}
+
+// SignPrekeys signs a user's X25519 identity key and signed prekey with their
+// RSA key, tying both to the key contacts already pinned and verified.
+func (km *KeyManager) SignPrekeys(identityKey, signedPrekey []byte) ([]byte, error) {
+    if km.privateKey == nil {
+        return nil, fmt.Errorf("no private key loaded")
+    }
+    
+    digest := prekeyDigest(identityKey, signedPrekey)
+    return rsa.SignPSS(rand.Reader, km.privateKey, crypto.SHA256, digest, nil)
+}
+
+// VerifyPrekeys checks a signature made by SignPrekeys.
+func VerifyPrekeys(publicKey *rsa.PublicKey, identityKey, signedPrekey, signature []byte) error {
+    digest := prekeyDigest(identityKey, signedPrekey)
+    if err := rsa.VerifyPSS(publicKey, crypto.SHA256, digest, signature, nil); err != nil {
+        return fmt.Errorf("invalid prekey signature")
+    }
+    return nil
+}
+
+func prekeyDigest(identityKey, signedPrekey []byte) []byte {
+    hash := sha256.New()
+    hash.Write([]byte(prekeySignatureContext))
+    hash.Write(identityKey)
+    hash.Write(signedPrekey)
+    return hash.Sum(nil)
+}
+
+// InitialHeader travels with an initiator's messages until the recipient
+// replies, so the recipient can derive the same session from any of them.
+type InitialHeader struct {
+    IdentityKey     []byte `json:"identity_key"`
+    EphemeralKey    []byte `json:"ephemeral_key"`
+    SignedPrekeyID  uint32 `json:"signed_prekey_id"`
+    OneTimePrekeyID string `json:"one_time_prekey_id,omitempty"`
+}
+
+// InitiateSession runs the initiator's side of an X3DH key agreement with a
+// contact's prekey bundle, whose signature the caller must have checked with
+// VerifyPrekeys against the contact's pinned key.
+func InitiateSession(ps *PrekeySet, bundle *shared.PrekeyBundle) (*RatchetSession, error) {
+    identityKey, err := ecdh.X25519().NewPrivateKey(ps.IdentityKey)
+    if err != nil {
+        return nil, err
+    }
+    theirIdentityKey, err := ecdh.X25519().NewPublicKey(bundle.IdentityKey)
+    if err != nil {
+        return nil, fmt.Errorf("invalid identity key: %v", err)
+    }
+    theirSignedPrekey, err := ecdh.X25519().NewPublicKey(bundle.SignedPrekey)
+    if err != nil {
+        return nil, fmt.Errorf("invalid signed prekey: %v", err)
+    }
+    
+    ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    
+    dh1, err := identityKey.ECDH(theirSignedPrekey)
+    if err != nil {
+        return nil, err
+    }
+    dh2, err := ephemeralKey.ECDH(theirIdentityKey)
+    if err != nil {
+        return nil, err
+    }
+    dh3, err := ephemeralKey.ECDH(theirSignedPrekey)
+    if err != nil {
+        return nil, err
+    }
+    secrets := [][]byte{dh1, dh2, dh3}
+    
+    initial := &InitialHeader{
+        IdentityKey:    identityKey.PublicKey().Bytes(),
+        EphemeralKey:   ephemeralKey.PublicKey().Bytes(),
+        SignedPrekeyID: bundle.SignedPrekeyID,
+    }
+    
+    if bundle.OneTimePrekey != nil {
+        theirOneTimePrekey, err := ecdh.X25519().NewPublicKey(bundle.OneTimePrekey.PublicKey)
+        if err != nil {
+            return nil, fmt.Errorf("invalid one-time prekey: %v", err)
+        }
+        dh4, err := ephemeralKey.ECDH(theirOneTimePrekey)
+        if err != nil {
+            return nil, err
+        }
+        secrets = append(secrets, dh4)
+        initial.OneTimePrekeyID = bundle.OneTimePrekey.ID
+    }
+    
+    sharedKey, err := x3dhKey(secrets)
+    if err != nil {
+        return nil, err
+    }
+    
+    ad := append(append([]byte{}, initial.IdentityKey...), bundle.IdentityKey...)
+    session, err := newInitiatorSession(sessionID(ad, initial.EphemeralKey), ad, sharedKey, bundle.SignedPrekey)
+    if err != nil {
+        return nil, err
+    }
+    
+    session.Initial = initial
+    return session, nil
+}
+
+// AcceptSession runs the recipient's side of the key agreement started by an
+// initiator's header. The one-time prekey it used is removed from the set,
+// which the caller must then save.
+func AcceptSession(ps *PrekeySet, initial *InitialHeader) (*RatchetSession, error) {
+    if initial.SignedPrekeyID != ps.SignedPrekeyID {
+        return nil, fmt.Errorf("unknown signed prekey")
+    }
+    
+    identityKey, err := ecdh.X25519().NewPrivateKey(ps.IdentityKey)
+    if err != nil {
+        return nil, err
+    }
+    signedPrekey, err := ecdh.X25519().NewPrivateKey(ps.SignedPrekey)
+    if err != nil {
+        return nil, err
+    }
+    theirIdentityKey, err := ecdh.X25519().NewPublicKey(initial.IdentityKey)
+    if err != nil {
+        return nil, fmt.Errorf("invalid identity key: %v", err)
+    }
+    theirEphemeralKey, err := ecdh.X25519().NewPublicKey(initial.EphemeralKey)
+    if err != nil {
+        return nil, fmt.Errorf("invalid ephemeral key: %v", err)
+    }
+    
+    dh1, err := signedPrekey.ECDH(theirIdentityKey)
+    if err != nil {
+        return nil, err
+    }
+    dh2, err := identityKey.ECDH(theirEphemeralKey)
+    if err != nil {
+        return nil, err
+    }
+    dh3, err := signedPrekey.ECDH(theirEphemeralKey)
+    if err != nil {
+        return nil, err
+    }
+    secrets := [][]byte{dh1, dh2, dh3}
+    
+    if initial.OneTimePrekeyID != "" {
+        oneTimePrekeyBytes, ok := ps.OneTimePrekeys[initial.OneTimePrekeyID]
+        if !ok {
+            return nil, fmt.Errorf("one-time prekey already used")
+        }
+        oneTimePrekey, err := ecdh.X25519().NewPrivateKey(oneTimePrekeyBytes)
+        if err != nil {
+            return nil, err
+        }
+        dh4, err := oneTimePrekey.ECDH(theirEphemeralKey)
+        if err != nil {
+            return nil, err
+        }
+        secrets = append(secrets, dh4)
+    }
+    
+    sharedKey, err := x3dhKey(secrets)
+    if err != nil {
+        return nil, err
+    }
+    
+    ad := append(append([]byte{}, initial.IdentityKey...), identityKey.PublicKey().Bytes()...)
+    session := newRecipientSession(sessionID(ad, initial.EphemeralKey), ad, sharedKey, ps.SignedPrekey)
+    
+    delete(ps.OneTimePrekeys, initial.OneTimePrekeyID)
+    return session, nil
+}
+
+func x3dhKey(secrets [][]byte) ([]byte, error) {
+    // A block of 0xFF keeps the input distinct from any single DH output
+    ikm := bytes.Repeat([]byte{0xFF}, 32)
+    for _, secret := range secrets {
+        ikm = append(ikm, secret...)
+    }
+    
+    key := make([]byte, 32)
+    kdf := hkdf.New(sha256.New, ikm, make([]byte, 32), []byte("secure-messenger X3DH"))
+    if _, err := io.ReadFull(kdf, key); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+func sessionID(ad, ephemeralKey []byte) string {
+    sum := sha256.Sum256(append(append([]byte{}, ad...), ephemeralKey...))
+    return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,200 @@
+package crypto
+
+import (
+    "bytes"
+    "testing"
+    
+    "secure-messenger/shared"
+)
+
+// newBundle publishes a prekey bundle for a fresh prekey set, with a
+// one-time prekey if oneTime is set.
+func newBundle(t *testing.T, oneTime bool) (*PrekeySet, *shared.PrekeyBundle) {
+    t.Helper()
+    
+    ps, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    oneTimePrekeys, err := ps.GenerateOneTimePrekeys(3)
+    if err != nil {
+        t.Fatalf("GenerateOneTimePrekeys: %v", err)
+    }
+    
+    upload, err := ps.Upload(testKeyManager(t), oneTimePrekeys)
+    if err != nil {
+        t.Fatalf("Upload: %v", err)
+    }
+    
+    bundle := &shared.PrekeyBundle{
+        IdentityKey:    upload.IdentityKey,
+        SignedPrekeyID: upload.SignedPrekeyID,
+        SignedPrekey:   upload.SignedPrekey,
+        Signature:      upload.Signature,
+    }
+    if oneTime {
+        bundle.OneTimePrekey = oneTimePrekeys[0]
+    }
+    return ps, bundle
+}
+
+var sharedTestKeys *KeyManager
+
+// testKeyManager returns an RSA keypair shared by the tests, as generating
+// one takes a while.
+func testKeyManager(t *testing.T) *KeyManager {
+    t.Helper()
+    
+    if sharedTestKeys == nil {
+        km := NewKeyManager()
+        if err := km.GenerateKeys(); err != nil {
+            t.Fatalf("GenerateKeys: %v", err)
+        }
+        sharedTestKeys = km
+    }
+    return sharedTestKeys
+}
+
+func TestX3DH(t *testing.T) {
+    for _, oneTime := range []bool{true, false} {
+        bobPrekeys, bundle := newBundle(t, oneTime)
+        alicePrekeys, err := GeneratePrekeySet()
+        if err != nil {
+            t.Fatalf("GeneratePrekeySet: %v", err)
+        }
+        
+        alice, err := InitiateSession(alicePrekeys, bundle)
+        if err != nil {
+            t.Fatalf("one-time prekey %v: InitiateSession: %v", oneTime, err)
+        }
+        if got := alice.Initial.OneTimePrekeyID != ""; got != oneTime {
+            t.Fatalf("one-time prekey %v: initial header names a one-time prekey: %v", oneTime, got)
+        }
+        
+        msg, err := alice.Encrypt([]byte("hello bob"))
+        if err != nil {
+            t.Fatalf("one-time prekey %v: Encrypt: %v", oneTime, err)
+        }
+        
+        bob, err := AcceptSession(bobPrekeys, msg.Initial)
+        if err != nil {
+            t.Fatalf("one-time prekey %v: AcceptSession: %v", oneTime, err)
+        }
+        if bob.ID != alice.ID || !bytes.Equal(bob.AD, alice.AD) {
+            t.Fatalf("one-time prekey %v: sessions disagree on ID or associated data", oneTime)
+        }
+        
+        plaintext, err := bob.Decrypt(msg)
+        if err != nil {
+            t.Fatalf("one-time prekey %v: Decrypt: %v", oneTime, err)
+        }
+        if string(plaintext) != "hello bob" {
+            t.Fatalf("one-time prekey %v: got %q", oneTime, plaintext)
+        }
+        
+        want := 3
+        if oneTime {
+            want = 2
+        }
+        if left := len(bobPrekeys.OneTimePrekeys); left != want {
+            t.Fatalf("one-time prekey %v: %d one-time prekeys left, want %d", oneTime, left, want)
+        }
+    }
+}
+
+func TestX3DHOneTimePrekeyUsedOnce(t *testing.T) {
+    bobPrekeys, bundle := newBundle(t, true)
+    alicePrekeys, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    
+    alice, err := InitiateSession(alicePrekeys, bundle)
+    if err != nil {
+        t.Fatalf("InitiateSession: %v", err)
+    }
+    if _, err := AcceptSession(bobPrekeys, alice.Initial); err != nil {
+        t.Fatalf("AcceptSession: %v", err)
+    }
+    
+    if _, err := AcceptSession(bobPrekeys, alice.Initial); err == nil {
+        t.Fatal("accepted a session with a one-time prekey already used")
+    }
+}
+
+func TestX3DHUnknownSignedPrekey(t *testing.T) {
+    bobPrekeys, bundle := newBundle(t, false)
+    alicePrekeys, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    
+    alice, err := InitiateSession(alicePrekeys, bundle)
+    if err != nil {
+        t.Fatalf("InitiateSession: %v", err)
+    }
+    
+    initial := *alice.Initial
+    initial.SignedPrekeyID++
+    if _, err := AcceptSession(bobPrekeys, &initial); err == nil {
+        t.Fatal("accepted a session for an unknown signed prekey")
+    }
+}
+
+func TestX3DHWrongIdentityKey(t *testing.T) {
+    bobPrekeys, bundle := newBundle(t, true)
+    alicePrekeys, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    mallory, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    
+    alice, err := InitiateSession(alicePrekeys, bundle)
+    if err != nil {
+        t.Fatalf("InitiateSession: %v", err)
+    }
+    msg, err := alice.Encrypt([]byte("hello bob"))
+    if err != nil {
+        t.Fatalf("Encrypt: %v", err)
+    }
+    
+    // Claiming to be someone else derives another key
+    forged := *msg.Initial
+    malloryUpload, err := mallory.Upload(testKeyManager(t), nil)
+    if err != nil {
+        t.Fatalf("Upload: %v", err)
+    }
+    forged.IdentityKey = malloryUpload.IdentityKey
+    
+    bob, err := AcceptSession(bobPrekeys, &forged)
+    if err != nil {
+        t.Fatalf("AcceptSession: %v", err)
+    }
+    if _, err := bob.Decrypt(msg); err == nil {
+        t.Fatal("decrypted a message under a forged identity key")
+    }
+}
+
+func TestVerifyPrekeys(t *testing.T) {
+    km := testKeyManager(t)
+    _, bundle := newBundle(t, false)
+    
+    if err := VerifyPrekeys(km.GetPublicKey(), bundle.IdentityKey, bundle.SignedPrekey, bundle.Signature); err != nil {
+        t.Fatalf("VerifyPrekeys: %v", err)
+    }
+    
+    other, err := GeneratePrekeySet()
+    if err != nil {
+        t.Fatalf("GeneratePrekeySet: %v", err)
+    }
+    otherUpload, err := other.Upload(km, nil)
+    if err != nil {
+        t.Fatalf("Upload: %v", err)
+    }
+    if err := VerifyPrekeys(km.GetPublicKey(), bundle.IdentityKey, otherUpload.SignedPrekey, bundle.Signature); err == nil {
+        t.Fatal("verified a bundle with a substituted signed prekey")
+    }
+}
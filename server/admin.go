@@ -0,0 +1,243 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "secure-messenger/storage"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+// runAdminCommand runs an administrative command against the server's
+// database instead of starting the server, for example
+//
+//     messenger-server retention set -channel ch_01H... -max-age 90d
+func runAdminCommand(srv *Server, args []string) error {
+    switch args[0] {
+    case "retention":
+        return runRetentionCommand(srv, args[1:])
+    case "twofactor":
+        return runTwoFactorCommand(srv, args[1:])
+    default:
+        return fmt.Errorf("unknown command %q", args[0])
+    }
+}
+
+const retentionUsage = `usage: messenger-server retention <command> [flags]
+
+commands:
+  list                        show the configured policies
+  set [-channel ID] [-max-age AGE] [-max-count N]
+                              set the policy of a channel, or the default
+  clear [-channel ID]         remove the policy of a channel, or the default
+  report                      show what would be purged, without deleting
+  purge                       enforce the policies now
+
+AGE is a duration such as 90d or 12h; 0 means no limit.`
+
+func runRetentionCommand(srv *Server, args []string) error {
+    if len(args) == 0 {
+        return fmt.Errorf("%s", retentionUsage)
+    }
+    
+    flags := flag.NewFlagSet("retention "+args[0], flag.ContinueOnError)
+    channelID := flags.String("channel", "", "channel ID, or empty for the default policy")
+    maxAge := flags.String("max-age", "0", "delete messages older than this")
+    maxCount := flags.Int("max-count", 0, "keep at most this many messages")
+    if err := flags.Parse(args[1:]); err != nil {
+        return err
+    }
+    
+    store := srv.retention.retentionStore
+    
+    switch args[0] {
+    case "list":
+        policies, err := store.GetPolicies()
+        if err != nil {
+            return err
+        }
+        
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(w, "CHANNEL\tMAX AGE\tMAX COUNT\tUPDATED")
+        for _, policy := range policies {
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", policyTarget(policy.ChannelID), formatRetentionAge(policy.MaxAge), formatRetentionCount(policy.MaxCount), policy.UpdatedAt.Format(time.RFC3339))
+        }
+        return w.Flush()
+    
+    case "set":
+        age, err := parseRetentionAge(*maxAge)
+        if err != nil {
+            return err
+        }
+        if *maxCount < 0 {
+            return fmt.Errorf("max count cannot be negative")
+        }
+        if *channelID != "" {
+            if _, err := srv.messageStore.GetChannel(*channelID); err != nil {
+                return err
+            }
+        }
+        
+        policy := &storage.RetentionPolicy{ChannelID: *channelID, MaxAge: age, MaxCount: *maxCount}
+        if err := store.SetPolicy(policy); err != nil {
+            return fmt.Errorf("failed to save policy: %v", err)
+        }
+        
+        fmt.Printf("Retention for %s: max age %s, max count %s\n", policyTarget(*channelID), formatRetentionAge(age), formatRetentionCount(*maxCount))
+        return nil
+    
+    case "clear":
+        removed, err := store.DeletePolicy(*channelID)
+        if err != nil {
+            return fmt.Errorf("failed to remove policy: %v", err)
+        }
+        if !removed {
+            return fmt.Errorf("no policy set for %s", policyTarget(*channelID))
+        }
+        
+        fmt.Printf("Removed retention policy for %s\n", policyTarget(*channelID))
+        return nil
+    
+    case "report":
+        reports, err := srv.retention.Report(time.Now())
+        if err != nil {
+            return err
+        }
+        
+        w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(w, "CHANNEL\tNAME\tMAX AGE\tMAX COUNT\tTO PURGE\tSYNC UPDATES\tOLDEST")
+        total, totalUpdates := 0, 0
+        for _, report := range reports {
+            oldest := "-"
+            if report.Oldest != nil {
+                oldest = report.Oldest.Format(time.RFC3339)
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", report.ChannelID, report.ChannelName, formatRetentionAge(report.Policy.MaxAge), formatRetentionCount(report.Policy.MaxCount), report.Messages, report.Updates, oldest)
+            total += report.Messages
+            totalUpdates += report.Updates
+        }
+        if err := w.Flush(); err != nil {
+            return err
+        }
+        
+        fmt.Printf("\n%d messages would be purged and %d sync updates redacted (dry run, nothing was deleted)\n", total, totalUpdates)
+        return nil
+    
+    case "purge":
+        removed, err := srv.retention.Enforce(time.Now())
+        if err != nil {
+            return err
+        }
+        
+        fmt.Printf("Purged %d messages\n", removed)
+        return nil
+    
+    default:
+        return fmt.Errorf("%s", retentionUsage)
+    }
+}
+
+const twoFactorUsage = `usage: messenger-server twofactor <command> [flags]
+
+commands:
+  status -user NAME           show whether a user has two-factor authentication
+  disable -user NAME          turn it off, for a user who lost their device
+                              and recovery codes`
+
+func runTwoFactorCommand(srv *Server, args []string) error {
+    if len(args) == 0 {
+        return fmt.Errorf("%s", twoFactorUsage)
+    }
+    
+    flags := flag.NewFlagSet("twofactor "+args[0], flag.ContinueOnError)
+    username := flags.String("user", "", "username")
+    if err := flags.Parse(args[1:]); err != nil {
+        return err
+    }
+    if *username == "" {
+        return fmt.Errorf("%s", twoFactorUsage)
+    }
+    
+    user, _, err := srv.userStore.GetUserByUsername(*username)
+    if err != nil {
+        return fmt.Errorf("user %q not found", *username)
+    }
+    
+    switch args[0] {
+    case "status":
+        status, err := srv.authManager.TwoFactorStatus(user.ID)
+        if err != nil {
+            return err
+        }
+        
+        if !status.Enabled {
+            fmt.Printf("Two-factor authentication is off for %s\n", user.Username)
+            return nil
+        }
+        fmt.Printf("Two-factor authentication is on for %s, %d recovery codes left\n", user.Username, status.RecoveryCodes)
+        return nil
+    
+    case "disable":
+        if err := srv.authManager.twoFactor.DisableTwoFactor(user.ID); err != nil {
+            return fmt.Errorf("failed to disable two-factor authentication: %v", err)
+        }
+        
+        fmt.Printf("Disabled two-factor authentication for %s\n", user.Username)
+        return nil
+    
+    default:
+        return fmt.Errorf("%s", twoFactorUsage)
+    }
+}
+
+// parseRetentionAge parses a duration, also accepting whole days such as
+// "90d".
+func parseRetentionAge(value string) (time.Duration, error) {
+    var age time.Duration
+    if days, ok := strings.CutSuffix(value, "d"); ok {
+        n, err := strconv.Atoi(days)
+        if err != nil {
+            return 0, fmt.Errorf("invalid max age %q", value)
+        }
+        age = time.Duration(n) * 24 * time.Hour
+    } else if value == "0" {
+        return 0, nil
+    } else {
+        var err error
+        if age, err = time.ParseDuration(value); err != nil {
+            return 0, fmt.Errorf("invalid max age %q", value)
+        }
+    }
+    
+    if age < 0 {
+        return 0, fmt.Errorf("max age cannot be negative")
+    }
+    return age, nil
+}
+
+func formatRetentionAge(age time.Duration) string {
+    if age <= 0 {
+        return "none"
+    }
+    if age%(24*time.Hour) == 0 {
+        return fmt.Sprintf("%dd", age/(24*time.Hour))
+    }
+    return age.String()
+}
+
+func formatRetentionCount(count int) string {
+    if count <= 0 {
+        return "none"
+    }
+    return strconv.Itoa(count)
+}
+
+func policyTarget(channelID string) string {
+    if channelID == "" {
+        return "default"
+    }
+    return channelID
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+    "time"
+)
+
+const (
+    // MaxAttachmentSize is the largest encrypted file a user can upload.
+    MaxAttachmentSize = 100 * 1024 * 1024
+    
+    // UserStorageQuota bounds the total size of the blobs a user has stored.
+    UserStorageQuota = 1024 * 1024 * 1024
+    
+    // MaxPreviewSize bounds the encrypted thumbnail of an attachment.
+    MaxPreviewSize = 512 * 1024
+    
+    // MaxAttachmentsPerMessage bounds how many files one message can carry.
+    MaxAttachmentsPerMessage = 10
+    
+    // blobGracePeriod is how long an unreferenced blob or abandoned upload
+    // is kept, giving clients time to send the message that uses it.
+    blobGracePeriod = 24 * time.Hour
+)
+
+// AttachmentManager handles chunked uploads and downloads of encrypted
+// attachment blobs. The server never sees the file keys.
+type AttachmentManager struct {
+    blobStore      *storage.BlobStore
+    messageStore   *storage.MessageStore
+    messageHandler *MessageHandler
+}
+
+func NewAttachmentManager(blobStore *storage.BlobStore, messageStore *storage.MessageStore, messageHandler *MessageHandler) *AttachmentManager {
+    return &AttachmentManager{
+        blobStore:      blobStore,
+        messageStore:   messageStore,
+        messageHandler: messageHandler,
+    }
+}
+
+// BeginUpload starts or resumes the upload of a blob. If the blob is already
+// stored the upload is reported complete right away.
+func (am *AttachmentManager) BeginUpload(userID, hash string, size int64) (*shared.UploadStatus, error) {
+    if !storage.ValidBlobHash(hash) {
+        return nil, fmt.Errorf("invalid blob hash")
+    }
+    if size <= 0 || size > MaxAttachmentSize {
+        return nil, fmt.Errorf("attachment size must be between 1 and %d bytes", MaxAttachmentSize)
+    }
+    
+    exists, err := am.blobStore.BlobExists(hash)
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up blob: %v", err)
+    }
+    if exists {
+        // Claiming a blob someone else uploaded is what lets it be attached,
+        // so it counts against the quota like uploading it would
+        if _, err := am.blobStore.GetUserBlobSize(userID, hash); err != nil {
+            stored, err := am.blobStore.GetBlobSize(hash)
+            if err != nil {
+                return nil, fmt.Errorf("failed to look up blob: %v", err)
+            }
+            used, err := am.blobStore.UsedBytes(userID)
+            if err != nil {
+                return nil, fmt.Errorf("failed to check storage quota: %v", err)
+            }
+            if used+stored > UserStorageQuota {
+                return nil, fmt.Errorf("storage quota exceeded")
+            }
+            
+            if err := am.blobStore.AddUserBlob(userID, hash); err != nil {
+                return nil, fmt.Errorf("failed to record blob: %v", err)
+            }
+        }
+        return &shared.UploadStatus{BlobHash: hash, Size: size, Received: size, Complete: true}, nil
+    }
+    
+    // Resume an interrupted upload of the same data
+    status, err := am.blobStore.FindUpload(userID, hash)
+    if err != nil {
+        return nil, fmt.Errorf("failed to look up upload: %v", err)
+    }
+    if status != nil {
+        return status, nil
+    }
+    
+    used, err := am.blobStore.UsedBytes(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to check storage quota: %v", err)
+    }
+    if used+size > UserStorageQuota {
+        return nil, fmt.Errorf("storage quota exceeded")
+    }
+    
+    status, err = am.blobStore.CreateUpload(generateUploadID(), userID, hash, size)
+    if err != nil {
+        return nil, fmt.Errorf("failed to start upload: %v", err)
+    }
+    
+    return status, nil
+}
+
+func (am *AttachmentManager) UploadChunk(userID, uploadID string, offset int64, chunk []byte) (*shared.UploadStatus, error) {
+    if len(chunk) == 0 || len(chunk) > shared.MaxChunkSize {
+        return nil, fmt.Errorf("chunk size must be between 1 and %d bytes", shared.MaxChunkSize)
+    }
+    
+    status, err := am.blobStore.GetUpload(uploadID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    status.Received, err = am.blobStore.AppendChunk(status, offset, chunk)
+    if err != nil {
+        return status, err
+    }
+    
+    return status, nil
+}
+
+func (am *AttachmentManager) FinishUpload(userID, uploadID string) (*shared.UploadStatus, error) {
+    status, err := am.blobStore.GetUpload(uploadID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := am.blobStore.CompleteUpload(status, userID); err != nil {
+        return nil, err
+    }
+    
+    status.Complete = true
+    return status, nil
+}
+
+// DownloadChunk reads part of an attachment the user can see, or of its
+// preview. The returned flag is set once the end of the blob has been
+// reached.
+func (am *AttachmentManager) DownloadChunk(userID, attachmentID string, preview bool, offset int64, length int) ([]byte, bool, error) {
+    attachment, messageID, err := am.messageStore.GetAttachment(attachmentID)
+    if err != nil {
+        return nil, false, err
+    }
+    
+    if _, err := am.messageHandler.getAccessibleMessage(messageID, userID); err != nil {
+        return nil, false, err
+    }
+    
+    hash, size := attachment.BlobHash, attachment.Size
+    if preview {
+        if attachment.PreviewHash == "" {
+            return nil, false, fmt.Errorf("attachment has no preview")
+        }
+        hash, size = attachment.PreviewHash, attachment.PreviewSize
+    }
+    
+    if length <= 0 || length > shared.MaxChunkSize {
+        length = shared.MaxChunkSize
+    }
+    if offset < 0 || offset > size {
+        return nil, false, fmt.Errorf("offset out of range")
+    }
+    
+    chunk, err := am.blobStore.ReadBlob(hash, offset, length)
+    if err != nil {
+        return nil, false, fmt.Errorf("failed to read attachment: %v", err)
+    }
+    
+    return chunk, offset+int64(len(chunk)) >= size, nil
+}
+
+// CollectGarbage periodically removes blobs no message refers to anymore
+// and uploads that were abandoned.
+func (am *AttachmentManager) CollectGarbage(interval time.Duration) {
+    for {
+        removed, err := am.blobStore.CollectGarbage(time.Now().Add(-blobGracePeriod))
+        if err != nil {
+            log.Printf("Failed to collect unused blobs: %v", err)
+        } else if removed > 0 {
+            log.Printf("Removed %d unused blobs and uploads", removed)
+        }
+        
+        time.Sleep(interval)
+    }
+}
+
+func generateUploadID() string {
+    return "upl_" + shared.NewSortableID()
+}
+
+func generateAttachmentID() string {
+    return "att_" + shared.NewSortableID()
+}
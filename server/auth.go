@@ -1,25 +1,99 @@
 package main
 
 import (
+    "bytes"
     "crypto/rand"
+    "crypto/sha256"
     "encoding/hex"
+    "fmt"
+    "log"
     "secure-messenger/crypto"
     "secure-messenger/shared"
     "secure-messenger/storage"
+    "sync"
     "time"
 )
 
+const (
+    // passwordResetTTL is how long a reset token can be used.
+    passwordResetTTL = time.Hour
+    
+    // passwordResetInterval is the least time between reset emails to the
+    // same user, so the reset form cannot be used to flood their inbox.
+    passwordResetInterval = time.Minute
+)
+
 type AuthManager struct {
-    userStore *storage.UserStore
+    userStore        *storage.UserStore
+    twoFactor        *storage.TwoFactorStore
+    passwordParams   crypto.PasswordParams
+    policy           *PasswordPolicy
+    mailer           Mailer
+    requireTwoFactor bool
+    
+    // Logins waiting for a two-factor code, by challenge, and recent failed
+    // codes by user
+    mu         sync.Mutex
+    challenges map[string]*loginChallenge
+    failures   map[string]*twoFactorFailures
+    dummyHash  string // see dummyPasswordHash
+}
+
+func NewAuthManager(userStore *storage.UserStore, twoFactor *storage.TwoFactorStore) *AuthManager {
+    return &AuthManager{
+        userStore:      userStore,
+        twoFactor:      twoFactor,
+        passwordParams: crypto.DefaultPasswordParams,
+        policy:         NewPasswordPolicy(),
+        mailer:         LogMailer{},
+        challenges:     make(map[string]*loginChallenge),
+        failures:       make(map[string]*twoFactorFailures),
+    }
 }
 
-func NewAuthManager(userStore *storage.UserStore) *AuthManager {
-    return &AuthManager{userStore: userStore}
+// SetMailer changes how password reset tokens are delivered. Until it is
+// called they are written to the server log.
+func (am *AuthManager) SetMailer(mailer Mailer) {
+    am.mailer = mailer
+}
+
+// SetPasswordParams changes the Argon2id parameters new password hashes are
+// made with. Stored hashes made with other parameters are upgraded as their
+// users log in.
+func (am *AuthManager) SetPasswordParams(params crypto.PasswordParams) error {
+    if err := params.Validate(); err != nil {
+        return err
+    }
+    am.passwordParams = params
+    
+    am.mu.Lock()
+    am.dummyHash = ""
+    am.mu.Unlock()
+    return nil
+}
+
+// dummyPasswordHash returns the hash of a random password made with the
+// current parameters. Logins for unknown usernames are checked against it,
+// so they take as long as those for real users and do not reveal which
+// usernames exist.
+func (am *AuthManager) dummyPasswordHash() string {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    
+    if am.dummyHash == "" {
+        hash, err := crypto.HashPassword(generateSessionToken(), am.passwordParams)
+        if err != nil {
+            log.Printf("Failed to make dummy password hash: %v", err)
+            return ""
+        }
+        am.dummyHash = hash
+    }
+    return am.dummyHash
 }
 
 func (am *AuthManager) Register(req *shared.RegisterRequest) (*shared.AuthResponse, error) {
     // Check if user already exists
-    _, _, _, err := am.userStore.GetUserByUsername(req.Username)
+    _, _, err := am.userStore.GetUserByUsername(req.Username)
     if err == nil {
         return &shared.AuthResponse{
             Success: false,
@@ -36,8 +110,15 @@ func (am *AuthManager) Register(req *shared.RegisterRequest) (*shared.AuthRespon
         }, nil
     }
     
+    if err := am.policy.Check(req.Password, req.Username, req.Email); err != nil {
+        return &shared.AuthResponse{
+            Success: false,
+            Error:   err.Error(),
+        }, nil
+    }
+    
     // Hash password
-    passwordHash, passwordSalt, err := crypto.HashPassword(req.Password)
+    passwordHash, err := crypto.HashPassword(req.Password, am.passwordParams)
     if err != nil {
         return &shared.AuthResponse{
             Success: false,
@@ -54,35 +135,23 @@ func (am *AuthManager) Register(req *shared.RegisterRequest) (*shared.AuthRespon
     }
     
     // Save user to database
-    if err := am.userStore.CreateUser(user, passwordHash, passwordSalt); err != nil {
+    if err := am.userStore.CreateUser(user, passwordHash); err != nil {
         return &shared.AuthResponse{
             Success: false,
             Error:   "Failed to create user",
         }, nil
     }
     
-    // Generate session token
-    token := generateSessionToken()
-    
-    // Create session
-    if err := am.userStore.CreateSession(token, user.ID); err != nil {
-        return &shared.AuthResponse{
-            Success: false,
-            Error:   "Failed to create session",
-        }, nil
-    }
-    
-    return &shared.AuthResponse{
-        Success: true,
-        Token:   token,
-        User:    user,
-    }, nil
+    // Where two-factor authentication is required, new users enroll before
+    // their first session
+    return am.startSession(user), nil
 }
 
 func (am *AuthManager) Login(req *shared.LoginRequest) (*shared.AuthResponse, error) {
     // Get user from database
-    user, passwordHash, passwordSalt, err := am.userStore.GetUserByUsername(req.Username)
+    user, passwordHash, err := am.userStore.GetUserByUsername(req.Username)
     if err != nil {
+        crypto.VerifyPassword(req.Password, am.dummyPasswordHash())
         return &shared.AuthResponse{
             Success: false,
             Error:   "Invalid username or password",
@@ -90,13 +159,28 @@ func (am *AuthManager) Login(req *shared.LoginRequest) (*shared.AuthResponse, er
     }
     
     // Verify password
-    if !crypto.VerifyPassword(req.Password, passwordHash, passwordSalt) {
+    if !crypto.VerifyPassword(req.Password, passwordHash) {
         return &shared.AuthResponse{
             Success: false,
             Error:   "Invalid username or password",
         }, nil
     }
     
+    // The password is only known now, so this is when a hash made with an
+    // older algorithm or parameters can be replaced
+    if crypto.PasswordNeedsRehash(passwordHash, am.passwordParams) {
+        if rehashed, err := crypto.HashPassword(req.Password, am.passwordParams); err != nil {
+            log.Printf("Failed to rehash password of %s: %v", user.ID, err)
+        } else if err := am.userStore.UpdatePasswordHash(user.ID, rehashed); err != nil {
+            log.Printf("Failed to save rehashed password of %s: %v", user.ID, err)
+        }
+    }
+    
+    return am.startSession(user), nil
+}
+
+// createSession logs the user in with a new session token.
+func (am *AuthManager) createSession(user *shared.User) *shared.AuthResponse {
     // Generate session token
     token := generateSessionToken()
     
@@ -105,14 +189,132 @@ func (am *AuthManager) Login(req *shared.LoginRequest) (*shared.AuthResponse, er
         return &shared.AuthResponse{
             Success: false,
             Error:   "Failed to create session",
-        }, nil
+        }
     }
     
     return &shared.AuthResponse{
         Success: true,
         Token:   token,
         User:    user,
-    }, nil
+    }
+}
+
+// ChangePassword sets a new password for the user, who must know the
+// current one, and logs them out everywhere but the session with the token.
+func (am *AuthManager) ChangePassword(user *shared.User, token string, req *shared.ChangePasswordRequest) error {
+    _, passwordHash, err := am.userStore.GetUserByUsername(user.Username)
+    if err != nil {
+        return fmt.Errorf("failed to load user: %v", err)
+    }
+    if !crypto.VerifyPassword(req.CurrentPassword, passwordHash) {
+        return fmt.Errorf("Current password is incorrect")
+    }
+    
+    if err := am.setPassword(user.ID, user.Username, user.Email, req.NewPassword); err != nil {
+        return err
+    }
+    if err := am.userStore.DeleteUserSessions(user.ID, token); err != nil {
+        return fmt.Errorf("failed to end other sessions: %v", err)
+    }
+    return nil
+}
+
+// RequestPasswordReset mails a single-use reset token to the account with
+// the email. Nothing tells the caller whether such an account exists: an
+// unknown email, like a repeated request, is silently ignored, and the mail
+// is sent in the background so the response takes as long either way.
+func (am *AuthManager) RequestPasswordReset(email string) error {
+    user, err := am.userStore.GetUserByEmail(email)
+    if err != nil {
+        return nil
+    }
+    
+    now := time.Now()
+    last, err := am.userStore.LastPasswordReset(user.ID)
+    if err != nil {
+        return fmt.Errorf("failed to load password resets: %v", err)
+    }
+    if now.Sub(last) < passwordResetInterval {
+        return nil
+    }
+    
+    // Only a hash is stored, so the database alone cannot reset passwords
+    token := generateSessionToken()
+    if err := am.userStore.CreatePasswordReset(hashResetToken(token), user.ID, now, now.Add(passwordResetTTL)); err != nil {
+        return fmt.Errorf("failed to save reset token: %v", err)
+    }
+    
+    body := fmt.Sprintf("Hello %s,\n\n"+
+        "Someone asked to reset the password of your Secure Messenger account. "+
+        "To choose a new password, enter this reset token in the client within %d minutes:\n\n"+
+        "%s\n\n"+
+        "If it was not you, ignore this email and your password stays the same.\n",
+        user.Username, int(passwordResetTTL.Minutes()), token)
+    go func() {
+        if err := am.mailer.Send(user.Email, "Reset your Secure Messenger password", body); err != nil {
+            log.Printf("Failed to mail password reset to %s: %v", user.ID, err)
+        }
+    }()
+    return nil
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset,
+// using the token up, and logs the user out everywhere. It returns the ID of
+// the user whose password was reset.
+func (am *AuthManager) ResetPassword(req *shared.ResetPasswordRequest) (string, error) {
+    tokenHash := hashResetToken(req.Token)
+    now := time.Now()
+    
+    // The token is only used up once the new password is known to be
+    // acceptable, so a refused password can be retried
+    userID, err := am.userStore.GetPasswordResetUser(tokenHash, now)
+    if err != nil {
+        return "", fmt.Errorf("Invalid or expired reset token")
+    }
+    user, err := am.userStore.GetUserByID(userID)
+    if err != nil {
+        return "", fmt.Errorf("failed to load user: %v", err)
+    }
+    if err := am.policy.Check(req.NewPassword, user.Username, user.Email); err != nil {
+        return "", err
+    }
+    
+    if _, err := am.userStore.ConsumePasswordReset(tokenHash, now); err != nil {
+        return "", fmt.Errorf("Invalid or expired reset token")
+    }
+    if err := am.setPassword(user.ID, user.Username, user.Email, req.NewPassword); err != nil {
+        return "", err
+    }
+    if err := am.userStore.DeleteUserSessions(user.ID, ""); err != nil {
+        return "", fmt.Errorf("failed to end sessions: %v", err)
+    }
+    return user.ID, nil
+}
+
+// setPassword checks a new password against the policy and saves its hash,
+// invalidating any reset tokens still out.
+func (am *AuthManager) setPassword(userID, username, email, password string) error {
+    if err := am.policy.Check(password, username, email); err != nil {
+        return err
+    }
+    
+    passwordHash, err := crypto.HashPassword(password, am.passwordParams)
+    if err != nil {
+        return fmt.Errorf("failed to hash password: %v", err)
+    }
+    if err := am.userStore.UpdatePasswordHash(userID, passwordHash); err != nil {
+        return fmt.Errorf("failed to save password: %v", err)
+    }
+    if err := am.userStore.DeletePasswordResets(userID); err != nil {
+        return fmt.Errorf("failed to invalidate reset tokens: %v", err)
+    }
+    return nil
+}
+
+// hashResetToken returns the form a reset token is stored in.
+func hashResetToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
 }
 
 func (am *AuthManager) ValidateSession(token string) (*shared.User, error) {
@@ -127,6 +329,172 @@ func (am *AuthManager) ValidateSession(token string) (*shared.User, error) {
     return user, nil
 }
 
+// maxPublicKeyLength bounds an uploaded public key PEM.
+const maxPublicKeyLength = 8 * 1024
+
+// SetPublicKey publishes the user's public key so others can encrypt
+// messages to them, and the signing key their messages are signed with,
+// which the public key must have signed. It reports whether a different
+// public key was replaced, and whether only the signing key was. A different public key is only replaced when
+// replace is set, so a device that does not hold the user's keys cannot make
+// all their contacts see a key change by logging in, and a published signing
+// key is only replaced by one the public key signed, so it cannot be cleared
+// to make the user's messages show as unverified.
+func (am *AuthManager) SetPublicKey(userID, publicKeyPEM string, signingKey, signingKeySignature []byte, replace bool) (keyChanged, signingKeyChanged bool, err error) {
+    if len(publicKeyPEM) > maxPublicKeyLength {
+        return false, false, fmt.Errorf("public key is too large")
+    }
+    
+    publicKey, err := crypto.ParsePublicKey(publicKeyPEM)
+    if err != nil {
+        return false, false, fmt.Errorf("invalid public key: %v", err)
+    }
+    if publicKey.N.BitLen() < crypto.KeySize {
+        return false, false, fmt.Errorf("public key must be at least %d bits", crypto.KeySize)
+    }
+    
+    if len(signingKey) > 0 || len(signingKeySignature) > 0 {
+        if err := crypto.VerifySigningKey(publicKey, signingKey, signingKeySignature); err != nil {
+            return false, false, err
+        }
+    }
+    
+    previous, err := am.userStore.GetUserPublicKey(userID)
+    if err != nil {
+        return false, false, fmt.Errorf("failed to load public key: %v", err)
+    }
+    previousSigningKey, _, err := am.userStore.GetUserSigningKey(userID)
+    if err != nil {
+        return false, false, fmt.Errorf("failed to load signing key: %v", err)
+    }
+    if previous == publicKeyPEM && bytes.Equal(previousSigningKey, signingKey) {
+        return false, false, nil
+    }
+    if len(signingKey) == 0 && len(previousSigningKey) > 0 {
+        return false, false, fmt.Errorf("a signing key is already published")
+    }
+    if previous != "" && previous != publicKeyPEM && !replace {
+        return false, false, fmt.Errorf("a different public key is already published")
+    }
+    
+    if err := am.userStore.UpdateUserPublicKey(userID, publicKeyPEM, signingKey, signingKeySignature); err != nil {
+        return false, false, fmt.Errorf("failed to save public key: %v", err)
+    }
+    if previous != "" && previous != publicKeyPEM {
+        return true, false, nil
+    }
+    return false, len(previousSigningKey) > 0, nil
+}
+
+// RotatePublicKey replaces the user's public key with a new one that the
+// current key signed, so contacts who trust the current key can trust the
+// new one too. The signing key is published with it as in SetPublicKey.
+func (am *AuthManager) RotatePublicKey(userID, publicKeyPEM string, signingKey, signingKeySignature, rotationSignature []byte) error {
+    if len(publicKeyPEM) > maxPublicKeyLength {
+        return fmt.Errorf("public key is too large")
+    }
+    
+    publicKey, err := crypto.ParsePublicKey(publicKeyPEM)
+    if err != nil {
+        return fmt.Errorf("invalid public key: %v", err)
+    }
+    if publicKey.N.BitLen() < crypto.KeySize {
+        return fmt.Errorf("public key must be at least %d bits", crypto.KeySize)
+    }
+    if err := crypto.VerifySigningKey(publicKey, signingKey, signingKeySignature); err != nil {
+        return err
+    }
+    
+    previous, err := am.userStore.GetUserPublicKey(userID)
+    if err != nil {
+        return fmt.Errorf("failed to load public key: %v", err)
+    }
+    if previous == "" {
+        return fmt.Errorf("no public key to rotate")
+    }
+    if previous == publicKeyPEM {
+        return fmt.Errorf("new public key is the current one")
+    }
+    previousKey, err := crypto.ParsePublicKey(previous)
+    if err != nil {
+        return fmt.Errorf("failed to load public key: %v", err)
+    }
+    if err := crypto.VerifyKeyRotation(previousKey, publicKey, rotationSignature); err != nil {
+        return err
+    }
+    
+    if err := am.userStore.RotateUserPublicKey(userID, publicKeyPEM, signingKey, signingKeySignature, previous, rotationSignature); err != nil {
+        return fmt.Errorf("failed to save public key: %v", err)
+    }
+    return nil
+}
+
+// GetKeyRotation returns the public key a user's current one replaced and
+// its signature over the current one, both empty unless the user rotated to
+// the current key.
+func (am *AuthManager) GetKeyRotation(userID string) (string, []byte, error) {
+    return am.userStore.GetUserKeyRotation(userID)
+}
+
+// GetPublicKey returns a user's public key, or an error if they have not
+// published one yet.
+func (am *AuthManager) GetPublicKey(userID string) (string, error) {
+    publicKey, err := am.userStore.GetUserPublicKey(userID)
+    if err != nil {
+        return "", err
+    }
+    if publicKey == "" {
+        return "", fmt.Errorf("user has not published a public key")
+    }
+    return publicKey, nil
+}
+
+// GetSigningKey returns a user's signing key and their public key's
+// signature over it, both empty if they have not published one.
+func (am *AuthManager) GetSigningKey(userID string) ([]byte, []byte, error) {
+    return am.userStore.GetUserSigningKey(userID)
+}
+
+// maxKeyBackupSize bounds an uploaded key backup, which only holds the
+// user's identity keys and the keys they rotated away from.
+const maxKeyBackupSize = 64 * 1024
+
+// SetKeyBackup stores the user's key backup. It is encrypted by the client
+// under a recovery phrase the server never sees.
+func (am *AuthManager) SetKeyBackup(userID string, backup []byte) error {
+    if len(backup) == 0 {
+        return fmt.Errorf("key backup is empty")
+    }
+    if len(backup) > maxKeyBackupSize {
+        return fmt.Errorf("key backup is too large")
+    }
+    
+    if err := am.userStore.SetKeyBackup(userID, backup); err != nil {
+        return fmt.Errorf("failed to save key backup: %v", err)
+    }
+    return nil
+}
+
+// GetKeyBackup returns the user's key backup, or an error if they have not
+// stored one.
+func (am *AuthManager) GetKeyBackup(userID string) ([]byte, error) {
+    backup, err := am.userStore.GetKeyBackup(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load key backup: %v", err)
+    }
+    if len(backup) == 0 {
+        return nil, fmt.Errorf("no key backup stored")
+    }
+    return backup, nil
+}
+
+func (am *AuthManager) DeleteKeyBackup(userID string) error {
+    if err := am.userStore.SetKeyBackup(userID, nil); err != nil {
+        return fmt.Errorf("failed to delete key backup: %v", err)
+    }
+    return nil
+}
+
 func (am *AuthManager) Logout(token string) error {
     return am.userStore.DeleteSession(token)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "log"
+    "secure-messenger/shared"
+    "sync"
+)
+
+// ConnectionManager tracks which connections belong to which user so the
+// server can push events to everyone taking part in a conversation.
+type ConnectionManager struct {
+    mu          sync.RWMutex
+    connections map[string]map[*shared.Protocol]bool
+    owners      map[*shared.Protocol]string
+    tokens      map[*shared.Protocol]string // session token last used on each connection
+}
+
+func NewConnectionManager() *ConnectionManager {
+    return &ConnectionManager{
+        connections: make(map[string]map[*shared.Protocol]bool),
+        owners:      make(map[*shared.Protocol]string),
+        tokens:      make(map[*shared.Protocol]string),
+    }
+}
+
+// Register associates a connection with a user's session and reports
+// whether the association with the user is new.
+func (cm *ConnectionManager) Register(userID, token string, protocol *shared.Protocol) bool {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    // A connection can only belong to one user at a time
+    if previous, ok := cm.owners[protocol]; ok {
+        if previous == userID {
+            cm.tokens[protocol] = token
+            return false
+        }
+        cm.removeLocked(previous, protocol)
+    }
+    
+    if cm.connections[userID] == nil {
+        cm.connections[userID] = make(map[*shared.Protocol]bool)
+    }
+    cm.connections[userID][protocol] = true
+    cm.owners[protocol] = userID
+    cm.tokens[protocol] = token
+    return true
+}
+
+func (cm *ConnectionManager) Unregister(protocol *shared.Protocol) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    if userID, ok := cm.owners[protocol]; ok {
+        cm.removeLocked(userID, protocol)
+    }
+}
+
+func (cm *ConnectionManager) removeLocked(userID string, protocol *shared.Protocol) {
+    delete(cm.owners, protocol)
+    delete(cm.tokens, protocol)
+    delete(cm.connections[userID], protocol)
+    if len(cm.connections[userID]) == 0 {
+        delete(cm.connections, userID)
+    }
+}
+
+// RevokeSessions stops pushing events to a user's connections of sessions
+// other than the one with keepToken, which may be empty to stop them all,
+// and tells them their session ended with a session_revoked event.
+func (cm *ConnectionManager) RevokeSessions(userID, keepToken string) {
+    cm.mu.Lock()
+    var revoked []*shared.Protocol
+    for protocol := range cm.connections[userID] {
+        if keepToken == "" || cm.tokens[protocol] != keepToken {
+            revoked = append(revoked, protocol)
+        }
+    }
+    for _, protocol := range revoked {
+        cm.removeLocked(userID, protocol)
+    }
+    cm.mu.Unlock()
+    
+    for _, protocol := range revoked {
+        if err := protocol.SendMessage(map[string]interface{}{"event": "session_revoked"}); err != nil {
+            log.Printf("Failed to push event to user %s: %v", userID, err)
+        }
+    }
+}
+
+func (cm *ConnectionManager) IsOnline(userID string) bool {
+    cm.mu.RLock()
+    defer cm.mu.RUnlock()
+    
+    return len(cm.connections[userID]) > 0
+}
+
+// SendToUser pushes an event to every connection the user currently has open.
+func (cm *ConnectionManager) SendToUser(userID string, event map[string]interface{}) {
+    cm.mu.RLock()
+    protocols := make([]*shared.Protocol, 0, len(cm.connections[userID]))
+    for protocol := range cm.connections[userID] {
+        protocols = append(protocols, protocol)
+    }
+    cm.mu.RUnlock()
+    
+    for _, protocol := range protocols {
+        if err := protocol.SendMessage(event); err != nil {
+            log.Printf("Failed to push event to user %s: %v", userID, err)
+        }
+    }
+}
+
+func (cm *ConnectionManager) SendToUsers(userIDs []string, event map[string]interface{}) {
+    for _, userID := range userIDs {
+        cm.SendToUser(userID, event)
+    }
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+)
+
+// deliveryBatchSize is how many queued messages are read at a time when a
+// user comes online.
+const deliveryBatchSize = 200
+
+// DeliveryManager queues messages for their recipients and keeps them queued
+// until each recipient acknowledges receipt, so messages sent while a user
+// is offline are pushed as soon as they connect.
+type DeliveryManager struct {
+    messageStore *storage.MessageStore
+    connections  *ConnectionManager
+}
+
+func NewDeliveryManager(messageStore *storage.MessageStore, connections *ConnectionManager) *DeliveryManager {
+    return &DeliveryManager{
+        messageStore: messageStore,
+        connections:  connections,
+    }
+}
+
+// Deliver queues the message for every recipient except the sender and
+// pushes it to those who are online.
+func (dm *DeliveryManager) Deliver(message *shared.Message, participants []string) {
+    var recipients []string
+    for _, userID := range participants {
+        if userID != message.From {
+            recipients = append(recipients, userID)
+        }
+    }
+    
+    if len(recipients) == 0 {
+        return
+    }
+    
+    if err := dm.messageStore.EnqueueDelivery(message.ID, recipients); err != nil {
+        log.Printf("Failed to queue message %s for delivery: %v", message.ID, err)
+    }
+    
+    dm.connections.SendToUsers(recipients, messageEvent(message))
+}
+
+// DeliverPending pushes everything still queued for the user to a
+// connection that has just been associated with them.
+func (dm *DeliveryManager) DeliverPending(userID string, protocol *shared.Protocol) {
+    after := ""
+    for {
+        messages, err := dm.messageStore.GetPendingDeliveries(userID, after, deliveryBatchSize)
+        if err != nil {
+            log.Printf("Failed to load pending deliveries for user %s: %v", userID, err)
+            return
+        }
+        
+        for _, message := range messages {
+            if err := protocol.SendMessage(messageEvent(message)); err != nil {
+                log.Printf("Failed to deliver message %s to user %s: %v", message.ID, userID, err)
+                return
+            }
+        }
+        
+        if len(messages) < deliveryBatchSize {
+            return
+        }
+        after = messages[len(messages)-1].ID
+    }
+}
+
+// Acknowledge removes messages the user has received from their queue.
+func (dm *DeliveryManager) Acknowledge(userID string, messageIDs []string) (int64, error) {
+    removed, err := dm.messageStore.AcknowledgeDeliveries(userID, messageIDs)
+    if err != nil {
+        return 0, fmt.Errorf("failed to acknowledge messages: %v", err)
+    }
+    return removed, nil
+}
+
+func messageEvent(message *shared.Message) map[string]interface{} {
+    return map[string]interface{}{
+        "event":   "message",
+        "message": message,
+    }
+}
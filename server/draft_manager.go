@@ -0,0 +1,64 @@
+package main
+
+import (
+    "fmt"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+    "time"
+)
+
+// DraftManager saves unsent messages so they follow a user across devices.
+// Every save is pushed to the user's other connections, so a conversation
+// already open elsewhere picks it up too.
+type DraftManager struct {
+    draftStore   *storage.DraftStore
+    messageStore *storage.MessageStore
+    userStore    *storage.UserStore
+    connections  *ConnectionManager
+}
+
+func NewDraftManager(draftStore *storage.DraftStore, messageStore *storage.MessageStore, userStore *storage.UserStore, connections *ConnectionManager) *DraftManager {
+    return &DraftManager{
+        draftStore:   draftStore,
+        messageStore: messageStore,
+        userStore:    userStore,
+        connections:  connections,
+    }
+}
+
+func (dm *DraftManager) SaveDraft(draft *shared.Draft, userID string) (*shared.Draft, error) {
+    if (draft.ChannelID == "") == (draft.OtherUserID == "") {
+        return nil, fmt.Errorf("either a channel or another user is required")
+    }
+    if len(draft.Content) > shared.MaxDraftSize {
+        return nil, fmt.Errorf("draft is too large")
+    }
+    
+    if draft.ChannelID != "" {
+        if _, err := dm.messageStore.GetChannelRole(draft.ChannelID, userID); err != nil {
+            return nil, err
+        }
+    } else if _, err := dm.userStore.GetUserByID(draft.OtherUserID); err != nil {
+        return nil, fmt.Errorf("user not found")
+    }
+    
+    draft.UpdatedAt = time.Now()
+    if err := dm.draftStore.SaveDraft(userID, draft); err != nil {
+        return nil, fmt.Errorf("failed to save draft: %v", err)
+    }
+    
+    dm.connections.SendToUser(userID, map[string]interface{}{
+        "event": "draft_updated",
+        "draft": draft,
+    })
+    
+    return draft, nil
+}
+
+func (dm *DraftManager) GetDrafts(userID string) ([]*shared.Draft, error) {
+    drafts, err := dm.draftStore.GetDrafts(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load drafts: %v", err)
+    }
+    return drafts, nil
+}
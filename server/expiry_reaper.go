@@ -0,0 +1,135 @@
+package main
+
+import (
+    "log"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+    "time"
+)
+
+// expiryBatchSize bounds how many expired messages are deleted per
+// transaction, so a large backlog never holds the database lock for long.
+const expiryBatchSize = 200
+
+// ExpiryReaper permanently deletes disappearing messages once they expire,
+// together with the attachment blobs only they referred to, and tells the
+// participants so their clients drop their copies too.
+type ExpiryReaper struct {
+    messageStore   *storage.MessageStore
+    blobStore      *storage.BlobStore
+    messageHandler *MessageHandler
+    syncManager    *SyncManager
+    connections    *ConnectionManager
+}
+
+func NewExpiryReaper(messageStore *storage.MessageStore, blobStore *storage.BlobStore, messageHandler *MessageHandler, syncManager *SyncManager, connections *ConnectionManager) *ExpiryReaper {
+    return &ExpiryReaper{
+        messageStore:   messageStore,
+        blobStore:      blobStore,
+        messageHandler: messageHandler,
+        syncManager:    syncManager,
+        connections:    connections,
+    }
+}
+
+// Run reaps expired messages every interval.
+func (er *ExpiryReaper) Run(interval time.Duration) {
+    for {
+        removed, err := er.ReapExpired(time.Now())
+        if err != nil {
+            log.Printf("Failed to delete expired messages: %v", err)
+        } else if removed > 0 {
+            log.Printf("Deleted %d expired messages", removed)
+        }
+        
+        time.Sleep(interval)
+    }
+}
+
+// ReapExpired deletes every message that expired before now, in batches,
+// and returns how many were deleted.
+func (er *ExpiryReaper) ReapExpired(now time.Time) (int, error) {
+    removed := 0
+    for {
+        messages, err := er.messageStore.DeleteExpiredMessages(now, expiryBatchSize)
+        if err != nil {
+            return removed, err
+        }
+        removed += len(messages)
+        
+        er.discard(messages, "expired")
+        
+        if len(messages) < expiryBatchSize {
+            return removed, nil
+        }
+    }
+}
+
+// discard cleans up after messages that were deleted from the database:
+// it removes the blobs only they used and tells the participants, giving
+// reason as why the messages are gone.
+func (er *ExpiryReaper) discard(messages []*shared.Message, reason string) {
+    er.removeBlobs(messages)
+    er.notify(messages, reason)
+}
+
+func (er *ExpiryReaper) removeBlobs(messages []*shared.Message) {
+    var hashes []string
+    for _, message := range messages {
+        for _, attachment := range message.Attachments {
+            hashes = append(hashes, attachment.BlobHash)
+            if attachment.PreviewHash != "" {
+                hashes = append(hashes, attachment.PreviewHash)
+            }
+        }
+    }
+    
+    if len(hashes) == 0 {
+        return
+    }
+    
+    if _, err := er.blobStore.RemoveUnreferenced(hashes); err != nil {
+        log.Printf("Failed to remove blobs of deleted messages: %v", err)
+    }
+}
+
+// notify records one deletion update per conversation and pushes it to the
+// participants who are online.
+func (er *ExpiryReaper) notify(messages []*shared.Message, reason string) {
+    byConversation := make(map[string][]*shared.Message)
+    var order []string
+    for _, message := range messages {
+        id := conversationID(message)
+        if _, ok := byConversation[id]; !ok {
+            order = append(order, id)
+        }
+        byConversation[id] = append(byConversation[id], message)
+    }
+    
+    for _, id := range order {
+        conversation := byConversation[id]
+        participants, err := er.messageHandler.GetParticipants(conversation[0])
+        if err != nil {
+            log.Printf("Failed to load participants for conversation %s: %v", id, err)
+            continue
+        }
+        
+        messageIDs := make([]string, len(conversation))
+        for i, message := range conversation {
+            messageIDs[i] = message.ID
+        }
+        
+        payload := map[string]interface{}{
+            "message_ids": messageIDs,
+            "channel_id":  conversation[0].ChannelID,
+            "reason":      reason,
+        }
+        er.syncManager.Record(participants, shared.UpdateMessagesDeleted, payload)
+        
+        pushed := map[string]interface{}{"event": "messages_deleted"}
+        for key, value := range payload {
+            pushed[key] = value
+        }
+        er.connections.SendToUsers(participants, pushed)
+    }
+}
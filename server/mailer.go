@@ -0,0 +1,93 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/smtp"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Mailer delivers email to users, such as password reset tokens.
+type Mailer interface {
+    Send(to, subject, body string) error
+}
+
+// SMTPMailer sends email through an SMTP server, authenticating with PLAIN
+// when a username is set. The server must offer STARTTLS for credentials to
+// be sent, unless it runs on localhost.
+type SMTPMailer struct {
+    Addr     string // host:port
+    From     string
+    Username string
+    Password string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+    var auth smtp.Auth
+    if m.Username != "" {
+        host, _, err := net.SplitHostPort(m.Addr)
+        if err != nil {
+            return fmt.Errorf("invalid SMTP address: %v", err)
+        }
+        auth = smtp.PlainAuth("", m.Username, m.Password, host)
+    }
+    
+    if err := smtp.SendMail(m.Addr, auth, m.From, []string{to}, formatMail(m.From, to, subject, body)); err != nil {
+        return fmt.Errorf("failed to send mail: %v", err)
+    }
+    return nil
+}
+
+// FileMailer appends each email to a file instead of sending it, for
+// servers without a mail server and for development.
+type FileMailer struct {
+    Path string
+    mu   sync.Mutex
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    
+    file, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open mail file: %v", err)
+    }
+    defer file.Close()
+    
+    if _, err := file.Write(append(formatMail("", to, subject, body), "\r\n"...)); err != nil {
+        return fmt.Errorf("failed to write mail: %v", err)
+    }
+    return nil
+}
+
+// LogMailer writes each email to the server log. It is used when no other
+// mailer is configured, so anyone who can read the log can read the mail.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+    log.Printf("Mail to %s: %s\n%s", to, subject, body)
+    return nil
+}
+
+// formatMail builds an RFC 5322 message. Header values come from the server
+// and user email addresses, and line breaks are stripped so none can add
+// headers.
+func formatMail(from, to, subject, body string) []byte {
+    clean := strings.NewReplacer("\r", "", "\n", "")
+    
+    var message strings.Builder
+    if from != "" {
+        fmt.Fprintf(&message, "From: %s\r\n", clean.Replace(from))
+    }
+    fmt.Fprintf(&message, "To: %s\r\n", clean.Replace(to))
+    fmt.Fprintf(&message, "Subject: %s\r\n", clean.Replace(subject))
+    fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+    return []byte(message.String())
+}
@@ -6,7 +6,10 @@ import (
     "log"
     "os"
     "os/signal"
+    "strconv"
     "syscall"
+    "time"
+    "secure-messenger/crypto"
     "secure-messenger/storage"
 )
 
@@ -19,7 +22,54 @@ func main() {
     defer db.Close()
     
     // Initialize server
-    srv := NewServer(db)
+    srv, err := NewServer(db)
+    if err != nil {
+        log.Fatal("Failed to initialize server:", err)
+    }
+    
+    // Password hashing cost can be tuned without forcing password resets,
+    // hashes made with other parameters are replaced at login
+    params, err := passwordParamsFromEnv()
+    if err != nil {
+        log.Fatal("Invalid password hashing parameters:", err)
+    }
+    if err := srv.authManager.SetPasswordParams(params); err != nil {
+        log.Fatal("Invalid password hashing parameters:", err)
+    }
+    
+    // Password reset tokens are mailed through SMTP, or to a file or the log
+    // when there is no mail server
+    srv.authManager.SetMailer(mailerFromEnv())
+    
+    // The administrator can have every user log in with a second factor
+    if value := os.Getenv("REQUIRE_2FA"); value != "" {
+        required, err := strconv.ParseBool(value)
+        if err != nil {
+            log.Fatal("Invalid REQUIRE_2FA:", err)
+        }
+        srv.authManager.SetRequireTwoFactor(required)
+    }
+    
+    // Administrative commands run against the database and exit
+    if len(os.Args) > 1 {
+        if err := runAdminCommand(srv, os.Args[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+    
+    // Remove attachment blobs that are no longer referenced
+    go srv.attachments.CollectGarbage(time.Hour)
+    
+    // Delete disappearing messages once they expire
+    go srv.expiry.Run(time.Minute)
+    
+    // Enforce the administrator's channel retention policies
+    go srv.retention.Run(time.Hour)
+    
+    // Send scheduled messages as they come due, including any that came due
+    // while the server was down
+    go srv.scheduler.Run()
     
     // Load TLS certificate
     cert, err := tls.LoadX509KeyPair("../certs/server.crt", "../certs/server.key")
@@ -61,3 +111,47 @@ func main() {
         go srv.HandleConnection(conn)
     }
 }
+
+// passwordParamsFromEnv returns the default Argon2id parameters, overridden
+// by ARGON2_TIME, ARGON2_MEMORY_KIB and ARGON2_THREADS when set.
+func passwordParamsFromEnv() (crypto.PasswordParams, error) {
+    params := crypto.DefaultPasswordParams
+    for _, setting := range []struct {
+        name string
+        bits int
+        set  func(uint64)
+    }{
+        {"ARGON2_TIME", 32, func(v uint64) { params.Time = uint32(v) }},
+        {"ARGON2_MEMORY_KIB", 32, func(v uint64) { params.Memory = uint32(v) }},
+        {"ARGON2_THREADS", 8, func(v uint64) { params.Threads = uint8(v) }},
+    } {
+        value := os.Getenv(setting.name)
+        if value == "" {
+            continue
+        }
+        parsed, err := strconv.ParseUint(value, 10, setting.bits)
+        if err != nil {
+            return params, fmt.Errorf("%s: %v", setting.name, err)
+        }
+        setting.set(parsed)
+    }
+    return params, nil
+}
+
+// mailerFromEnv returns an SMTPMailer when SMTP_ADDR is set, configured by
+// SMTP_FROM, SMTP_USERNAME and SMTP_PASSWORD, otherwise a FileMailer when
+// MAIL_FILE is set, and otherwise a LogMailer.
+func mailerFromEnv() Mailer {
+    if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+        return &SMTPMailer{
+            Addr:     addr,
+            From:     os.Getenv("SMTP_FROM"),
+            Username: os.Getenv("SMTP_USERNAME"),
+            Password: os.Getenv("SMTP_PASSWORD"),
+        }
+    }
+    if path := os.Getenv("MAIL_FILE"); path != "" {
+        return &FileMailer{Path: path}
+    }
+    return LogMailer{}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "secure-messenger/shared"
+    "strings"
+)
+
+// channelMention notifies every member of the channel.
+const channelMention = "channel"
+
+type MentionResult struct {
+    UserIDs    []string       // members who were mentioned and should be notified
+    NonMembers []*shared.User // mentioned users who cannot see the channel
+}
+
+// resolveMentions maps mentioned usernames to channel members, skipping the
+// sender and unknown usernames.
+func (mh *MessageHandler) resolveMentions(channel *shared.Channel, names []string, fromUserID string) *MentionResult {
+    result := &MentionResult{}
+    
+    members := make(map[string]bool)
+    for _, memberID := range channel.Members {
+        members[memberID] = true
+    }
+    
+    notified := make(map[string]bool)
+    notify := func(userID string) {
+        if userID != fromUserID && !notified[userID] {
+            notified[userID] = true
+            result.UserIDs = append(result.UserIDs, userID)
+        }
+    }
+    
+    seen := make(map[string]bool)
+    for _, name := range names {
+        name = strings.TrimPrefix(name, "@")
+        if seen[name] {
+            continue
+        }
+        seen[name] = true
+        
+        if name == channelMention {
+            for _, memberID := range channel.Members {
+                notify(memberID)
+            }
+            continue
+        }
+        
+        user, _, err := mh.userStore.GetUserByUsername(name)
+        if err != nil {
+            continue
+        }
+        
+        if members[user.ID] {
+            notify(user.ID)
+        } else {
+            result.NonMembers = append(result.NonMembers, &shared.User{
+                ID:       user.ID,
+                Username: user.Username,
+            })
+        }
+    }
+    
+    return result
+}
@@ -1,33 +1,81 @@
 package main
 
 import (
+    "crypto/ed25519"
     "fmt"
     "secure-messenger/shared"
     "secure-messenger/storage"
+    "strings"
+    "sync"
     "time"
 )
 
 type MessageHandler struct {
     messageStore *storage.MessageStore
     userStore    *storage.UserStore
+    blobStore    *storage.BlobStore
+    sendMu       sync.Mutex
 }
 
-func NewMessageHandler(messageStore *storage.MessageStore, userStore *storage.UserStore) *MessageHandler {
+func NewMessageHandler(messageStore *storage.MessageStore, userStore *storage.UserStore, blobStore *storage.BlobStore) *MessageHandler {
     return &MessageHandler{
         messageStore: messageStore,
         userStore:    userStore,
+        blobStore:    blobStore,
     }
 }
 
-func (mh *MessageHandler) SendMessage(req *shared.MessageRequest, fromUserID string) (*shared.Message, error) {
+// DedupWindow is how long a client message ID is remembered. A send retried
+// within it returns the original message instead of creating a duplicate.
+const DedupWindow = 24 * time.Hour
+
+// maxClientMessageIDLength bounds client message IDs, which only need to
+// hold a UUID or similar.
+const maxClientMessageIDLength = 64
+
+// SendResult describes the outcome of sending a message.
+type SendResult struct {
+    Message   *shared.Message
+    Mentions  *MentionResult // channel messages only
+    Duplicate bool           // the client message ID was already sent, nothing new was stored
+}
+
+func (mh *MessageHandler) SendMessage(req *shared.MessageRequest, fromUserID string) (*SendResult, error) {
+    if len(req.ClientMessageID) > maxClientMessageIDLength {
+        return nil, fmt.Errorf("client message ID is too long")
+    }
+    if err := checkSignature(req.Signature); err != nil {
+        return nil, err
+    }
+    
+    // Serialize sends so two retries of the same message cannot both pass
+    // the duplicate check
+    mh.sendMu.Lock()
+    defer mh.sendMu.Unlock()
+    
+    if result, err := mh.findDuplicate(fromUserID, req.ClientMessageID); result != nil || err != nil {
+        return result, err
+    }
+    
+    if err := mh.prepareAttachments(fromUserID, req.Attachments); err != nil {
+        return nil, err
+    }
+    
     // Create message
     message := &shared.Message{
-        ID:        generateMessageID(),
-        From:      fromUserID,
-        To:        req.To,
-        Content:   req.Content,
-        Encrypted: true,
-        Timestamp: time.Now(),
+        ID:              generateMessageID(),
+        From:            fromUserID,
+        To:              req.To,
+        Content:         req.Content,
+        Encrypted:       req.Encrypted,
+        Timestamp:       time.Now(),
+        ClientMessageID: req.ClientMessageID,
+        Attachments:     req.Attachments,
+        Signature:       req.Signature,
+    }
+    
+    if err := mh.stampExpiry(message); err != nil {
+        return nil, err
     }
     
     // Save message to database
@@ -35,36 +83,69 @@ func (mh *MessageHandler) SendMessage(req *shared.MessageRequest, fromUserID str
         return nil, fmt.Errorf("failed to save message: %v", err)
     }
     
-    return message, nil
+    return &SendResult{Message: message}, nil
 }
 
-func (mh *MessageHandler) SendChannelMessage(req *shared.ChannelMessageRequest, fromUserID string) (*shared.Message, error) {
+func (mh *MessageHandler) SendChannelMessage(req *shared.ChannelMessageRequest, fromUserID string) (*SendResult, error) {
+    if len(req.ClientMessageID) > maxClientMessageIDLength {
+        return nil, fmt.Errorf("client message ID is too long")
+    }
+    if err := checkSignature(req.Signature); err != nil {
+        return nil, err
+    }
+    
     // Verify user is member of channel
     channels, err := mh.messageStore.GetUserChannels(fromUserID)
     if err != nil {
         return nil, fmt.Errorf("failed to get user channels: %v", err)
     }
     
-    isMember := false
-    for _, channel := range channels {
-        if channel.ID == req.ChannelID {
-            isMember = true
+    var channel *shared.Channel
+    for _, c := range channels {
+        if c.ID == req.ChannelID {
+            channel = c
             break
         }
     }
     
-    if !isMember {
+    if channel == nil {
         return nil, fmt.Errorf("user is not a member of this channel")
     }
     
+    mh.sendMu.Lock()
+    defer mh.sendMu.Unlock()
+    
+    // A retry of a message that was already stored gets the original back,
+    // even if the members changed since it was encrypted
+    if result, err := mh.findDuplicate(fromUserID, req.ClientMessageID); result != nil || err != nil {
+        return result, err
+    }
+    
+    // A sender key made before the members last changed may be held by
+    // someone who left or missing for someone who joined
+    if req.Encrypted && req.KeyEpoch != channel.KeyEpoch {
+        return nil, fmt.Errorf("%s", errSenderKeyOutdated)
+    }
+    
+    if err := mh.prepareAttachments(fromUserID, req.Attachments); err != nil {
+        return nil, err
+    }
+    
     // Create message
     message := &shared.Message{
-        ID:        generateMessageID(),
-        From:      fromUserID,
-        ChannelID: req.ChannelID,
-        Content:   req.Content,
-        Encrypted: true,
-        Timestamp: time.Now(),
+        ID:              generateMessageID(),
+        From:            fromUserID,
+        ChannelID:       req.ChannelID,
+        Content:         req.Content,
+        Encrypted:       req.Encrypted,
+        Timestamp:       time.Now(),
+        ClientMessageID: req.ClientMessageID,
+        Attachments:     req.Attachments,
+        Signature:       req.Signature,
+    }
+    
+    if err := mh.stampExpiry(message); err != nil {
+        return nil, err
     }
     
     // Save message to database
@@ -72,15 +153,106 @@ func (mh *MessageHandler) SendChannelMessage(req *shared.ChannelMessageRequest,
         return nil, fmt.Errorf("failed to save message: %v", err)
     }
     
-    return message, nil
+    // Record mentions parsed from the content plus any the client listed
+    names := append(shared.ParseMentions(req.Content), req.Mentions...)
+    mentions := mh.resolveMentions(channel, names, fromUserID)
+    if len(mentions.UserIDs) > 0 {
+        if err := mh.messageStore.CreateMentions(message.ID, channel.ID, mentions.UserIDs); err != nil {
+            return nil, fmt.Errorf("failed to save mentions: %v", err)
+        }
+    }
+    
+    return &SendResult{Message: message, Mentions: mentions}, nil
 }
 
-func (mh *MessageHandler) GetMessages(userID, otherUserID string, limit int) ([]*shared.Message, error) {
-    return mh.messageStore.GetMessagesBetweenUsers(userID, otherUserID, limit)
+// checkSignature rejects a sender signature that is malformed. Whether it is
+// genuine is for recipients to check, only they can trust the sender's key.
+func checkSignature(signature *shared.MessageSignature) error {
+    if signature != nil && len(signature.Signature) != ed25519.SignatureSize {
+        return fmt.Errorf("invalid message signature")
+    }
+    return nil
 }
 
-func (mh *MessageHandler) GetChannelMessages(channelID string, limit int) ([]*shared.Message, error) {
-    return mh.messageStore.GetChannelMessages(channelID, limit)
+// prepareAttachments checks that every attachment refers to a blob of the
+// stated size that the sender uploaded, so it counts against their quota,
+// and assigns attachment IDs. Knowing a blob's hash is not enough to attach
+// it.
+func (mh *MessageHandler) prepareAttachments(fromUserID string, attachments []*shared.Attachment) error {
+    if len(attachments) > MaxAttachmentsPerMessage {
+        return fmt.Errorf("a message can carry at most %d attachments", MaxAttachmentsPerMessage)
+    }
+    
+    for _, attachment := range attachments {
+        if attachment == nil || !storage.ValidBlobHash(attachment.BlobHash) {
+            return fmt.Errorf("invalid attachment")
+        }
+        if attachment.Name == "" || len(attachment.Name) > 255 {
+            return fmt.Errorf("attachment name must be between 1 and 255 characters")
+        }
+        if attachment.Key == "" {
+            return fmt.Errorf("attachment key is required")
+        }
+        if attachment.MimeType == "" {
+            attachment.MimeType = shared.DefaultMimeType
+        }
+        
+        size, err := mh.blobStore.GetUserBlobSize(fromUserID, attachment.BlobHash)
+        if err != nil {
+            return fmt.Errorf("attachment %s has not been uploaded", attachment.Name)
+        }
+        if size != attachment.Size {
+            return fmt.Errorf("attachment %s does not match the uploaded size", attachment.Name)
+        }
+        
+        if attachment.PreviewHash != "" {
+            if !storage.ValidBlobHash(attachment.PreviewHash) || attachment.PreviewSize > MaxPreviewSize {
+                return fmt.Errorf("invalid preview for attachment %s", attachment.Name)
+            }
+            size, err := mh.blobStore.GetUserBlobSize(fromUserID, attachment.PreviewHash)
+            if err != nil || size != attachment.PreviewSize {
+                return fmt.Errorf("preview for attachment %s has not been uploaded", attachment.Name)
+            }
+        }
+        
+        attachment.ID = generateAttachmentID()
+    }
+    
+    return nil
+}
+
+// findDuplicate returns the earlier send of a retried message, or nil when
+// the client message ID is new or was not given.
+func (mh *MessageHandler) findDuplicate(fromUserID, clientMessageID string) (*SendResult, error) {
+    if clientMessageID == "" {
+        return nil, nil
+    }
+    
+    message, err := mh.messageStore.FindMessageByClientID(fromUserID, clientMessageID, time.Now().Add(-DedupWindow))
+    if err != nil {
+        return nil, fmt.Errorf("failed to check for duplicate message: %v", err)
+    }
+    if message == nil {
+        return nil, nil
+    }
+    
+    return &SendResult{
+        Message:   message,
+        Mentions:  &MentionResult{},
+        Duplicate: true,
+    }, nil
+}
+
+func (mh *MessageHandler) GetMessages(userID, otherUserID string, page shared.Page) (*shared.MessagePage, error) {
+    return mh.messageStore.GetMessagesBetweenUsers(userID, otherUserID, page)
+}
+
+func (mh *MessageHandler) GetChannelMessages(userID, channelID string, page shared.Page) (*shared.MessagePage, error) {
+    return mh.messageStore.GetChannelMessages(userID, channelID, page)
+}
+
+func (mh *MessageHandler) GetMentions(userID string, page shared.Page) (*shared.MessagePage, error) {
+    return mh.messageStore.GetMentions(userID, page)
 }
 
 func (mh *MessageHandler) CreateChannel(req *shared.ChannelRequest, creatorID string) (*shared.Channel, error) {
@@ -114,14 +286,362 @@ func (mh *MessageHandler) RemoveUserFromChannel(channelID, userID string) error
     return mh.messageStore.RemoveUserFromChannel(channelID, userID)
 }
 
-func (mh *MessageHandler) GetRecentMessages(userID string, limit int) ([]*shared.Message, error) {
-    return mh.messageStore.GetRecentMessages(userID, limit)
+// SetChannelRole lets the owner of a channel make a member an admin, who can
+// pin messages and set the disappearing timer, or a plain member again. The
+// change is recorded in the history.
+func (mh *MessageHandler) SetChannelRole(req *shared.ChannelRoleRequest, userID string) (*shared.Message, error) {
+    if req.Role != shared.ChannelRoleAdmin && req.Role != shared.ChannelRoleMember {
+        return nil, fmt.Errorf("role must be admin or member")
+    }
+    
+    role, err := mh.messageStore.GetChannelRole(req.ChannelID, userID)
+    if err != nil {
+        return nil, err
+    }
+    if role != shared.ChannelRoleOwner {
+        return nil, fmt.Errorf("only the channel owner can change roles")
+    }
+    
+    current, err := mh.messageStore.GetChannelRole(req.ChannelID, req.UserID)
+    if err != nil {
+        return nil, err
+    }
+    if current == shared.ChannelRoleOwner {
+        return nil, fmt.Errorf("the owner's role cannot be changed")
+    }
+    if current == req.Role {
+        return nil, fmt.Errorf("user is already %s", shared.ChannelRoleName(req.Role))
+    }
+    
+    target, err := mh.userStore.GetUserByID(req.UserID)
+    if err != nil {
+        return nil, fmt.Errorf("user not found")
+    }
+    if err := mh.messageStore.SetChannelRole(req.ChannelID, req.UserID, req.Role); err != nil {
+        return nil, err
+    }
+    
+    action := shared.SystemActionRole(target.Username, req.Role)
+    return mh.saveSystemMessage(&shared.Message{ChannelID: req.ChannelID}, userID, action, false)
+}
+
+func (mh *MessageHandler) GetRecentMessages(userID string, page shared.Page) (*shared.MessagePage, error) {
+    return mh.messageStore.GetRecentMessages(userID, page)
+}
+
+func (mh *MessageHandler) AddReaction(req *shared.ReactionRequest, userID string) (*shared.Message, error) {
+    if err := validateEmoji(req.Emoji); err != nil {
+        return nil, err
+    }
+    
+    message, err := mh.getAccessibleMessage(req.MessageID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := mh.messageStore.AddReaction(message.ID, userID, req.Emoji); err != nil {
+        return nil, fmt.Errorf("failed to add reaction: %v", err)
+    }
+    
+    message.Reactions, err = mh.messageStore.GetReactions(message.ID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load reactions: %v", err)
+    }
+    
+    return message, nil
+}
+
+func (mh *MessageHandler) RemoveReaction(req *shared.ReactionRequest, userID string) (*shared.Message, error) {
+    message, err := mh.getAccessibleMessage(req.MessageID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := mh.messageStore.RemoveReaction(message.ID, userID, req.Emoji); err != nil {
+        return nil, fmt.Errorf("failed to remove reaction: %v", err)
+    }
+    
+    message.Reactions, err = mh.messageStore.GetReactions(message.ID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load reactions: %v", err)
+    }
+    
+    return message, nil
+}
+
+func (mh *MessageHandler) PinMessage(req *shared.PinRequest, userID string) (*shared.Message, error) {
+    message, err := mh.getPinnableMessage(req.MessageID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    pinned, err := mh.messageStore.PinMessage(conversationID(message), message.ID, userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to pin message: %v", err)
+    }
+    if !pinned {
+        return nil, fmt.Errorf("message is already pinned")
+    }
+    
+    return mh.createSystemMessage(message, userID, shared.SystemActionPinned)
+}
+
+func (mh *MessageHandler) UnpinMessage(req *shared.PinRequest, userID string) (*shared.Message, error) {
+    message, err := mh.getPinnableMessage(req.MessageID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    unpinned, err := mh.messageStore.UnpinMessage(conversationID(message), message.ID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to unpin message: %v", err)
+    }
+    if !unpinned {
+        return nil, fmt.Errorf("message is not pinned")
+    }
+    
+    return mh.createSystemMessage(message, userID, shared.SystemActionUnpinned)
+}
+
+// GetPinned lists pinned messages of a channel, or of the direct conversation
+// with otherUserID when channelID is empty.
+func (mh *MessageHandler) GetPinned(userID, channelID, otherUserID string) ([]*shared.Message, error) {
+    if channelID != "" {
+        if _, err := mh.messageStore.GetChannelRole(channelID, userID); err != nil {
+            return nil, err
+        }
+        return mh.messageStore.GetPinnedMessages(channelID)
+    }
+    
+    return mh.messageStore.GetPinnedMessages(directConversationID(userID, otherUserID))
+}
+
+// getPinnableMessage loads a message the user may pin: any message of their
+// direct conversations, or channel messages when they own or administer the
+// channel.
+func (mh *MessageHandler) getPinnableMessage(messageID, userID string) (*shared.Message, error) {
+    message, err := mh.getAccessibleMessage(messageID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    if message.Type == shared.MessageTypeSystem {
+        return nil, fmt.Errorf("system messages cannot be pinned")
+    }
+    
+    if message.ChannelID != "" {
+        role, err := mh.messageStore.GetChannelRole(message.ChannelID, userID)
+        if err != nil {
+            return nil, err
+        }
+        if role != shared.ChannelRoleOwner && role != shared.ChannelRoleAdmin {
+            return nil, fmt.Errorf("only channel owners and admins can pin messages")
+        }
+    }
+    
+    return message, nil
+}
+
+// createSystemMessage records an entry in the conversation of reference,
+// attributed to the acting user, so the action shows up in the history.
+// The entry disappears along with the conversation's other messages.
+func (mh *MessageHandler) createSystemMessage(reference *shared.Message, actorID, action string) (*shared.Message, error) {
+    message := &shared.Message{
+        ChannelID:   reference.ChannelID,
+        ReferenceID: reference.ID,
+    }
+    
+    if reference.ChannelID == "" {
+        message.To = reference.To
+        if reference.To == actorID {
+            message.To = reference.From
+        }
+    }
+    
+    return mh.saveSystemMessage(message, actorID, action, true)
+}
+
+// saveSystemMessage fills in and stores a system entry whose conversation is
+// already set on message.
+func (mh *MessageHandler) saveSystemMessage(message *shared.Message, actorID, action string, disappearing bool) (*shared.Message, error) {
+    actor, err := mh.userStore.GetUserByID(actorID)
+    if err != nil {
+        return nil, err
+    }
+    
+    message.ID = generateMessageID()
+    message.From = actorID
+    message.Content = fmt.Sprintf("%s %s", actor.Username, action)
+    message.Timestamp = time.Now()
+    message.Type = shared.MessageTypeSystem
+    
+    if disappearing {
+        if err := mh.stampExpiry(message); err != nil {
+            return nil, err
+        }
+    }
+    
+    if err := mh.messageStore.CreateMessage(message); err != nil {
+        return nil, fmt.Errorf("failed to save message: %v", err)
+    }
+    
+    return message, nil
+}
+
+// stampExpiry sets when a new message disappears according to the timer of
+// its conversation.
+func (mh *MessageHandler) stampExpiry(message *shared.Message) error {
+    timer, err := mh.messageStore.GetDisappearingTimer(conversationID(message))
+    if err != nil {
+        return fmt.Errorf("failed to load disappearing timer: %v", err)
+    }
+    
+    if timer > 0 {
+        expiresAt := message.Timestamp.Add(timer)
+        message.ExpiresAt = &expiresAt
+    }
+    return nil
+}
+
+// SetDisappearingTimer changes how long new messages of a channel or direct
+// conversation are kept and records the change in its history. Any member
+// of a direct conversation can change it; channels need an owner or admin.
+// The system entry itself does not disappear so the change stays visible.
+func (mh *MessageHandler) SetDisappearingTimer(req *shared.DisappearingTimerRequest, userID string) (*shared.Message, error) {
+    timer := time.Duration(req.Seconds) * time.Second
+    if !validDisappearingTimer(timer) {
+        return nil, fmt.Errorf("unsupported disappearing timer")
+    }
+    
+    message := &shared.Message{}
+    var conversation string
+    if req.ChannelID != "" {
+        role, err := mh.messageStore.GetChannelRole(req.ChannelID, userID)
+        if err != nil {
+            return nil, err
+        }
+        if role != shared.ChannelRoleOwner && role != shared.ChannelRoleAdmin {
+            return nil, fmt.Errorf("only channel owners and admins can change the disappearing timer")
+        }
+        message.ChannelID = req.ChannelID
+        conversation = req.ChannelID
+    } else {
+        if req.OtherUserID == "" {
+            return nil, fmt.Errorf("channel ID or other user ID required")
+        }
+        if _, err := mh.userStore.GetUserByID(req.OtherUserID); err != nil {
+            return nil, fmt.Errorf("user not found")
+        }
+        message.To = req.OtherUserID
+        conversation = directConversationID(userID, req.OtherUserID)
+    }
+    
+    current, err := mh.messageStore.GetDisappearingTimer(conversation)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load disappearing timer: %v", err)
+    }
+    if current == timer {
+        return nil, fmt.Errorf("disappearing timer is already %s", shared.DisappearingTimerLabel(timer))
+    }
+    
+    if err := mh.messageStore.SetDisappearingTimer(conversation, timer, userID); err != nil {
+        return nil, fmt.Errorf("failed to save disappearing timer: %v", err)
+    }
+    
+    return mh.saveSystemMessage(message, userID, shared.SystemActionTimer(timer), false)
+}
+
+// GetDisappearingTimer returns the timer of a channel, or of the direct
+// conversation with otherUserID when channelID is empty.
+func (mh *MessageHandler) GetDisappearingTimer(userID, channelID, otherUserID string) (time.Duration, error) {
+    if channelID != "" {
+        if _, err := mh.messageStore.GetChannelRole(channelID, userID); err != nil {
+            return 0, err
+        }
+        return mh.messageStore.GetDisappearingTimer(channelID)
+    }
+    
+    return mh.messageStore.GetDisappearingTimer(directConversationID(userID, otherUserID))
+}
+
+func validDisappearingTimer(timer time.Duration) bool {
+    if timer == 0 {
+        return true
+    }
+    for _, allowed := range shared.DisappearingTimers {
+        if timer == allowed {
+            return true
+        }
+    }
+    return false
+}
+
+// GetParticipants returns the users who can see a message: both sides of a
+// direct conversation, or every member of the channel it was posted to.
+func (mh *MessageHandler) GetParticipants(message *shared.Message) ([]string, error) {
+    if message.ChannelID != "" {
+        channel, err := mh.messageStore.GetChannel(message.ChannelID)
+        if err != nil {
+            return nil, err
+        }
+        return channel.Members, nil
+    }
+    
+    if message.From == message.To {
+        return []string{message.From}, nil
+    }
+    return []string{message.From, message.To}, nil
+}
+
+func (mh *MessageHandler) getAccessibleMessage(messageID, userID string) (*shared.Message, error) {
+    message, err := mh.messageStore.GetMessage(messageID)
+    if err != nil {
+        return nil, err
+    }
+    
+    participants, err := mh.GetParticipants(message)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load participants: %v", err)
+    }
+    
+    for _, participant := range participants {
+        if participant == userID {
+            return message, nil
+        }
+    }
+    
+    return nil, fmt.Errorf("message not found")
+}
+
+// conversationID identifies the conversation a message belongs to.
+func conversationID(message *shared.Message) string {
+    if message.ChannelID != "" {
+        return message.ChannelID
+    }
+    return directConversationID(message.From, message.To)
+}
+
+func directConversationID(user1ID, user2ID string) string {
+    if user1ID > user2ID {
+        user1ID, user2ID = user2ID, user1ID
+    }
+    return "dm_" + user1ID + "_" + user2ID
+}
+
+func validateEmoji(emoji string) error {
+    if emoji == "" {
+        return fmt.Errorf("emoji required")
+    }
+    if len(emoji) > 32 || strings.ContainsAny(emoji, " \t\r\n") {
+        return fmt.Errorf("invalid emoji")
+    }
+    return nil
 }
 
 func generateMessageID() string {
-    return fmt.Sprintf("msg_%d", time.Now().UnixNano())
+    return "msg_" + shared.NewSortableID()
 }
 
 func generateChannelID() string {
-    return fmt.Sprintf("ch_%d", time.Now().UnixNano())
+    return "ch_" + shared.NewSortableID()
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+    _ "embed"
+    "fmt"
+    "strings"
+    "unicode/utf8"
+)
+
+// commonPasswords lists passwords that top breach corpora, one per line.
+//
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// PasswordPolicy decides which passwords users may choose. It applies when
+// a password is set, so existing passwords keep working until changed.
+type PasswordPolicy struct {
+    MinLength int // in characters
+    MaxLength int
+    common    map[string]bool
+}
+
+// NewPasswordPolicy returns the default policy: 10 to 1024 characters, and
+// none of the common passwords.
+func NewPasswordPolicy() *PasswordPolicy {
+    common := make(map[string]bool)
+    for _, password := range strings.Fields(commonPasswords) {
+        common[password] = true
+    }
+    return &PasswordPolicy{MinLength: 10, MaxLength: 1024, common: common}
+}
+
+// Check reports why a password may not be used by the user, or nil if it
+// may. A password is refused if it is too short or too long, is a common
+// password, possibly with digits or symbols appended, or is the user's
+// username or email.
+func (pp *PasswordPolicy) Check(password, username, email string) error {
+    length := utf8.RuneCountInString(password)
+    if length < pp.MinLength {
+        return fmt.Errorf("Password must be at least %d characters", pp.MinLength)
+    }
+    if length > pp.MaxLength {
+        return fmt.Errorf("Password must be at most %d characters", pp.MaxLength)
+    }
+    
+    lowered := strings.ToLower(password)
+    if lowered == strings.ToLower(username) || lowered == strings.ToLower(email) {
+        return fmt.Errorf("Password must not be your username or email")
+    }
+    
+    // Appending digits or punctuation is the usual way around a length rule
+    stem := strings.TrimRight(lowered, "0123456789!@#$%^&*()-_=+.?")
+    if pp.common[lowered] || pp.common[stem] {
+        return fmt.Errorf("Password is too common, choose another")
+    }
+    return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "crypto/ecdh"
+    "fmt"
+    "secure-messenger/crypto"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+)
+
+// errNoPrekeys is returned for a user whose client has not published prekeys
+// yet. Clients fall back to encrypting with the user's RSA key.
+const errNoPrekeys = "user has not published prekeys"
+
+// PrekeyManager publishes the prekeys clients use to start forward secret
+// sessions with each other. The server only stores and hands them out; the
+// sessions themselves never reach it.
+type PrekeyManager struct {
+    prekeyStore *storage.PrekeyStore
+    authManager *AuthManager
+}
+
+func NewPrekeyManager(prekeyStore *storage.PrekeyStore, authManager *AuthManager) *PrekeyManager {
+    return &PrekeyManager{
+        prekeyStore: prekeyStore,
+        authManager: authManager,
+    }
+}
+
+// UploadPrekeys checks that the prekeys are well formed and signed by the
+// user's published RSA key, then saves them.
+func (pm *PrekeyManager) UploadPrekeys(upload *shared.PrekeyUpload, userID string) error {
+    if _, err := ecdh.X25519().NewPublicKey(upload.IdentityKey); err != nil {
+        return fmt.Errorf("invalid identity key: %v", err)
+    }
+    if _, err := ecdh.X25519().NewPublicKey(upload.SignedPrekey); err != nil {
+        return fmt.Errorf("invalid signed prekey: %v", err)
+    }
+    for _, prekey := range upload.OneTimePrekeys {
+        if prekey.ID == "" || len(prekey.ID) > 64 {
+            return fmt.Errorf("invalid one-time prekey ID")
+        }
+        if _, err := ecdh.X25519().NewPublicKey(prekey.PublicKey); err != nil {
+            return fmt.Errorf("invalid one-time prekey: %v", err)
+        }
+    }
+    
+    publicKeyPEM, err := pm.authManager.GetPublicKey(userID)
+    if err != nil {
+        return fmt.Errorf("publish a public key before prekeys")
+    }
+    publicKey, err := crypto.ParsePublicKey(publicKeyPEM)
+    if err != nil {
+        return fmt.Errorf("invalid public key: %v", err)
+    }
+    if err := crypto.VerifyPrekeys(publicKey, upload.IdentityKey, upload.SignedPrekey, upload.Signature); err != nil {
+        return err
+    }
+    
+    if err := pm.prekeyStore.SavePrekeys(userID, upload); err != nil {
+        return fmt.Errorf("failed to save prekeys: %v", err)
+    }
+    return nil
+}
+
+// GetPrekeyBundle hands out a user's prekey bundle, using up one of their
+// one-time prekeys if any are left.
+func (pm *PrekeyManager) GetPrekeyBundle(userID string) (*shared.PrekeyBundle, error) {
+    bundle, err := pm.prekeyStore.TakeBundle(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load prekeys: %v", err)
+    }
+    if bundle == nil {
+        return nil, fmt.Errorf("%s", errNoPrekeys)
+    }
+    return bundle, nil
+}
+
+// GetPrekeyStatus returns the ID of the user's published signed prekey and
+// how many one-time prekeys they have left, so their client knows when to
+// publish more.
+func (pm *PrekeyManager) GetPrekeyStatus(userID string) (uint32, int, error) {
+    signedPrekeyID, count, err := pm.prekeyStore.GetPrekeyStatus(userID)
+    if err != nil {
+        return 0, 0, fmt.Errorf("failed to load prekeys: %v", err)
+    }
+    return signedPrekeyID, count, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "sort"
+    "secure-messenger/storage"
+    "time"
+)
+
+const (
+    // retentionBatchSize bounds how many messages are deleted per
+    // transaction while enforcing retention policies.
+    retentionBatchSize = 500
+    
+    // retentionBatchPause is slept between batches so other writers are not
+    // starved of the database lock during a large purge.
+    retentionBatchPause = 100 * time.Millisecond
+)
+
+// RetentionManager enforces the retention policies set by the server
+// administrator by deleting channel messages past their channel's limits.
+// Unlike disappearing messages these apply regardless of what members chose.
+type RetentionManager struct {
+    retentionStore *storage.RetentionStore
+    messageStore   *storage.MessageStore
+    reaper         *ExpiryReaper
+}
+
+func NewRetentionManager(retentionStore *storage.RetentionStore, messageStore *storage.MessageStore, reaper *ExpiryReaper) *RetentionManager {
+    return &RetentionManager{
+        retentionStore: retentionStore,
+        messageStore:   messageStore,
+        reaper:         reaper,
+    }
+}
+
+// RetentionReport describes the messages of a channel that its policy
+// would delete, and the sync log entries that would be redacted with them.
+type RetentionReport struct {
+    ChannelID   string
+    ChannelName string
+    Policy      *storage.RetentionPolicy
+    Messages    int
+    Updates     int
+    Oldest      *time.Time
+}
+
+// channelPolicy pairs a channel with the policy that applies to it.
+type channelPolicy struct {
+    channelID string
+    name      string
+    policy    *storage.RetentionPolicy
+}
+
+// Run enforces the policies every interval.
+func (rm *RetentionManager) Run(interval time.Duration) {
+    for {
+        removed, err := rm.Enforce(time.Now())
+        if err != nil {
+            log.Printf("Failed to enforce retention policies: %v", err)
+        } else if removed > 0 {
+            log.Printf("Deleted %d messages past their retention policy", removed)
+        }
+        
+        time.Sleep(interval)
+    }
+}
+
+// Enforce deletes the messages of every channel that exceed its policy as of
+// now, in batches, and returns how many were deleted.
+func (rm *RetentionManager) Enforce(now time.Time) (int, error) {
+    channels, err := rm.channelPolicies()
+    if err != nil {
+        return 0, err
+    }
+    
+    removed := 0
+    for _, channel := range channels {
+        n, err := rm.enforceChannel(channel, now)
+        removed += n
+        if err != nil {
+            return removed, fmt.Errorf("channel %s: %v", channel.channelID, err)
+        }
+    }
+    
+    return removed, nil
+}
+
+func (rm *RetentionManager) enforceChannel(channel *channelPolicy, now time.Time) (int, error) {
+    before := retentionCutoff(channel.policy, now)
+    
+    removed := 0
+    for {
+        messages, err := rm.messageStore.GetPurgeableChannelMessages(channel.channelID, before, channel.policy.MaxCount, retentionBatchSize)
+        if err != nil {
+            return removed, err
+        }
+        if len(messages) == 0 {
+            return removed, nil
+        }
+        
+        if err := rm.messageStore.DeleteMessages(messages); err != nil {
+            return removed, err
+        }
+        removed += len(messages)
+        
+        rm.reaper.discard(messages, "retention")
+        
+        if len(messages) < retentionBatchSize {
+            return removed, nil
+        }
+        time.Sleep(retentionBatchPause)
+    }
+}
+
+// Report returns what Enforce would delete as of now, without deleting
+// anything. Channels with nothing to delete are included so every policy in
+// effect is listed.
+func (rm *RetentionManager) Report(now time.Time) ([]*RetentionReport, error) {
+    channels, err := rm.channelPolicies()
+    if err != nil {
+        return nil, err
+    }
+    
+    var reports []*RetentionReport
+    for _, channel := range channels {
+        before := retentionCutoff(channel.policy, now)
+        
+        count, oldest, err := rm.messageStore.CountPurgeableChannelMessages(channel.channelID, before, channel.policy.MaxCount)
+        if err != nil {
+            return nil, fmt.Errorf("channel %s: %v", channel.channelID, err)
+        }
+        
+        updates, err := rm.messageStore.CountPurgeableChannelUpdates(channel.channelID, before, channel.policy.MaxCount)
+        if err != nil {
+            return nil, fmt.Errorf("channel %s: %v", channel.channelID, err)
+        }
+        
+        reports = append(reports, &RetentionReport{
+            ChannelID:   channel.channelID,
+            ChannelName: channel.name,
+            Policy:      channel.policy,
+            Messages:    count,
+            Updates:     updates,
+            Oldest:      oldest,
+        })
+    }
+    
+    return reports, nil
+}
+
+// channelPolicies returns every channel that has a limit, with its own
+// policy or else the default.
+func (rm *RetentionManager) channelPolicies() ([]*channelPolicy, error) {
+    policies, err := rm.retentionStore.GetPolicies()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load retention policies: %v", err)
+    }
+    
+    byChannel := make(map[string]*storage.RetentionPolicy)
+    for _, policy := range policies {
+        byChannel[policy.ChannelID] = policy
+    }
+    defaultPolicy := byChannel[""]
+    
+    names, err := rm.retentionStore.GetChannelNames()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load channels: %v", err)
+    }
+    
+    var channels []*channelPolicy
+    for channelID, name := range names {
+        policy, ok := byChannel[channelID]
+        if !ok {
+            policy = defaultPolicy
+        }
+        if policy == nil || (policy.MaxAge <= 0 && policy.MaxCount <= 0) {
+            continue
+        }
+        
+        channels = append(channels, &channelPolicy{channelID: channelID, name: name, policy: policy})
+    }
+    
+    sort.Slice(channels, func(i, j int) bool {
+        return channels[i].channelID < channels[j].channelID
+    })
+    
+    return channels, nil
+}
+
+// retentionCutoff returns the time before which messages are too old under
+// the policy, or the zero time when it has no age limit.
+func retentionCutoff(policy *storage.RetentionPolicy, now time.Time) time.Time {
+    if policy.MaxAge <= 0 {
+        return time.Time{}
+    }
+    return now.Add(-policy.MaxAge)
+}
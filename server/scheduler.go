@@ -0,0 +1,337 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+    "sync"
+    "time"
+)
+
+const (
+    // MaxScheduleAhead is how far in the future a message can be scheduled.
+    MaxScheduleAhead = 365 * 24 * time.Hour
+    
+    // MaxScheduledPerUser bounds how many messages a user can have waiting.
+    MaxScheduledPerUser = 100
+    
+    // schedulerIdleWait is the longest the scheduler sleeps before checking
+    // for due messages again.
+    schedulerIdleWait = time.Minute
+    
+    // schedulerBatchSize is how many due messages are read at a time.
+    schedulerBatchSize = 100
+)
+
+// Scheduler holds messages until their send time and then sends them
+// through the MessageHandler like any other message. Scheduled messages are
+// stored in the database, so they survive a restart and anything that came
+// due while the server was down is sent when it starts.
+type Scheduler struct {
+    scheduleStore  *storage.ScheduleStore
+    messageStore   *storage.MessageStore
+    userStore      *storage.UserStore
+    messageHandler *MessageHandler
+    connections    *ConnectionManager
+    onSent         func(result *SendResult)
+    mu             sync.Mutex // keeps edits from racing a send
+    wake           chan struct{}
+}
+
+// NewScheduler creates a scheduler that calls onSent with every message it
+// sends, so it can be published like one sent directly.
+func NewScheduler(scheduleStore *storage.ScheduleStore, messageStore *storage.MessageStore, userStore *storage.UserStore, messageHandler *MessageHandler, connections *ConnectionManager, onSent func(result *SendResult)) *Scheduler {
+    return &Scheduler{
+        scheduleStore:  scheduleStore,
+        messageStore:   messageStore,
+        userStore:      userStore,
+        messageHandler: messageHandler,
+        connections:    connections,
+        onSent:         onSent,
+        wake:           make(chan struct{}, 1),
+    }
+}
+
+func (sc *Scheduler) Schedule(req *shared.ScheduleMessageRequest, userID string) (*shared.ScheduledMessage, error) {
+    if (req.To == "") == (req.ChannelID == "") {
+        return nil, fmt.Errorf("either a recipient or a channel is required")
+    }
+    
+    if err := sc.checkRecipient(req.To, req.ChannelID, userID); err != nil {
+        return nil, err
+    }
+    
+    if err := sc.checkKeyEpoch(req.ChannelID, req); err != nil {
+        return nil, err
+    }
+    
+    if err := sc.validate(req, userID); err != nil {
+        return nil, err
+    }
+    
+    count, err := sc.scheduleStore.CountUserScheduled(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to count scheduled messages: %v", err)
+    }
+    if count >= MaxScheduledPerUser {
+        return nil, fmt.Errorf("you can have at most %d scheduled messages", MaxScheduledPerUser)
+    }
+    
+    scheduled := &shared.ScheduledMessage{
+        ID:              generateScheduledID(),
+        From:            userID,
+        To:              req.To,
+        ChannelID:       req.ChannelID,
+        Content:         req.Content,
+        Encrypted:       req.Encrypted,
+        Mentions:        req.Mentions,
+        Attachments:     req.Attachments,
+        KeyEpoch:        req.KeyEpoch,
+        ClientMessageID: req.ClientMessageID,
+        Signature:       req.Signature,
+        SendAt:          req.SendAt,
+        Status:          shared.ScheduledStatusPending,
+        Created:         time.Now(),
+    }
+    
+    if err := sc.scheduleStore.CreateScheduled(scheduled); err != nil {
+        return nil, fmt.Errorf("failed to save scheduled message: %v", err)
+    }
+    
+    sc.notify()
+    return scheduled, nil
+}
+
+// Edit changes the content, attachments and send time of a scheduled
+// message. Editing a message that failed to send schedules it again.
+func (sc *Scheduler) Edit(req *shared.ScheduleMessageRequest, userID string) (*shared.ScheduledMessage, error) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    
+    scheduled, err := sc.scheduleStore.GetScheduled(req.ID, userID)
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := sc.checkRecipient(scheduled.To, scheduled.ChannelID, userID); err != nil {
+        return nil, err
+    }
+    
+    if err := sc.checkKeyEpoch(scheduled.ChannelID, req); err != nil {
+        return nil, err
+    }
+    
+    if err := sc.validate(req, userID); err != nil {
+        return nil, err
+    }
+    
+    scheduled.Content = req.Content
+    scheduled.Encrypted = req.Encrypted
+    scheduled.Mentions = req.Mentions
+    scheduled.Attachments = req.Attachments
+    scheduled.KeyEpoch = req.KeyEpoch
+    scheduled.Signature = req.Signature
+    scheduled.SendAt = req.SendAt
+    scheduled.Status = shared.ScheduledStatusPending
+    scheduled.Error = ""
+    
+    if err := sc.scheduleStore.UpdateScheduled(scheduled); err != nil {
+        return nil, fmt.Errorf("failed to save scheduled message: %v", err)
+    }
+    
+    sc.notify()
+    return scheduled, nil
+}
+
+func (sc *Scheduler) Cancel(id, userID string) error {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    
+    if _, err := sc.scheduleStore.GetScheduled(id, userID); err != nil {
+        return err
+    }
+    
+    if err := sc.scheduleStore.DeleteScheduled(id); err != nil {
+        return fmt.Errorf("failed to cancel scheduled message: %v", err)
+    }
+    return nil
+}
+
+func (sc *Scheduler) List(userID string) ([]*shared.ScheduledMessage, error) {
+    return sc.scheduleStore.GetUserScheduled(userID)
+}
+
+// checkRecipient makes sure the user can currently message the recipient or
+// channel.
+func (sc *Scheduler) checkRecipient(to, channelID, userID string) error {
+    if channelID != "" {
+        _, err := sc.messageStore.GetChannelRole(channelID, userID)
+        return err
+    }
+    
+    if _, err := sc.userStore.GetUserByID(to); err != nil {
+        return fmt.Errorf("user not found")
+    }
+    return nil
+}
+
+// checkKeyEpoch makes sure an encrypted channel message uses a sender key
+// made since the members last changed. A change before the send time fails
+// the message, and the user edits it to encrypt it again.
+func (sc *Scheduler) checkKeyEpoch(channelID string, req *shared.ScheduleMessageRequest) error {
+    if channelID == "" || !req.Encrypted {
+        return nil
+    }
+    
+    channel, err := sc.messageStore.GetChannel(channelID)
+    if err != nil {
+        return err
+    }
+    if req.KeyEpoch != channel.KeyEpoch {
+        return fmt.Errorf("%s", errSenderKeyOutdated)
+    }
+    return nil
+}
+
+func (sc *Scheduler) validate(req *shared.ScheduleMessageRequest, userID string) error {
+    now := time.Now()
+    if !req.SendAt.After(now) {
+        return fmt.Errorf("send time must be in the future")
+    }
+    if req.SendAt.After(now.Add(MaxScheduleAhead)) {
+        return fmt.Errorf("messages can be scheduled at most a year ahead")
+    }
+    
+    if req.Content == "" && len(req.Attachments) == 0 {
+        return fmt.Errorf("message is empty")
+    }
+    if len(req.ClientMessageID) > maxClientMessageIDLength {
+        return fmt.Errorf("client message ID is too long")
+    }
+    if err := checkSignature(req.Signature); err != nil {
+        return err
+    }
+    
+    // Attachment blobs are checked now so a missing upload is reported
+    // while the user is still around to fix it
+    return sc.messageHandler.prepareAttachments(userID, req.Attachments)
+}
+
+// notify wakes the scheduler so it sees a new or changed send time.
+func (sc *Scheduler) notify() {
+    select {
+    case sc.wake <- struct{}{}:
+    default:
+    }
+}
+
+// Run sends messages as they come due. It sleeps until the next send time,
+// waking early when messages are scheduled or edited. After a database error
+// it waits the full idle time, since the messages that were due still are.
+func (sc *Scheduler) Run() {
+    for {
+        wait := schedulerIdleWait
+        if err := sc.SendDue(time.Now()); err != nil {
+            log.Printf("Failed to send scheduled messages: %v", err)
+        } else if next, err := sc.scheduleStore.NextSendAt(); err != nil {
+            log.Printf("Failed to read next scheduled message: %v", err)
+        } else if next != nil && time.Until(*next) < wait {
+            wait = time.Until(*next)
+        }
+        
+        timer := time.NewTimer(wait)
+        select {
+        case <-timer.C:
+        case <-sc.wake:
+            timer.Stop()
+        }
+    }
+}
+
+// SendDue sends every pending message whose send time is not after now. It
+// stops at the first message that cannot be removed or marked failed, since
+// reading the next batch would return that message again.
+func (sc *Scheduler) SendDue(now time.Time) error {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    
+    for {
+        due, err := sc.scheduleStore.GetDueScheduled(now, schedulerBatchSize)
+        if err != nil {
+            return err
+        }
+        
+        for _, scheduled := range due {
+            if err := sc.send(scheduled); err != nil {
+                return err
+            }
+        }
+        
+        if len(due) < schedulerBatchSize {
+            return nil
+        }
+    }
+}
+
+// send sends a scheduled message and removes it. The client message ID the
+// sender signed with, or else the scheduled ID, is used for the message, so
+// if the server stops between sending and removing, the retry after a
+// restart is recognised as a duplicate. A
+// message that cannot be sent is kept as failed for the user to edit or
+// cancel. The error returned is only about updating the stored message.
+func (sc *Scheduler) send(scheduled *shared.ScheduledMessage) error {
+    clientMessageID := scheduled.ClientMessageID
+    if clientMessageID == "" {
+        clientMessageID = scheduled.ID
+    }
+    
+    var result *SendResult
+    var err error
+    if scheduled.ChannelID != "" {
+        result, err = sc.messageHandler.SendChannelMessage(&shared.ChannelMessageRequest{
+            ChannelID:       scheduled.ChannelID,
+            Content:         scheduled.Content,
+            Encrypted:       scheduled.Encrypted,
+            Mentions:        scheduled.Mentions,
+            ClientMessageID: clientMessageID,
+            Attachments:     scheduled.Attachments,
+            KeyEpoch:        scheduled.KeyEpoch,
+            Signature:       scheduled.Signature,
+        }, scheduled.From)
+    } else {
+        result, err = sc.messageHandler.SendMessage(&shared.MessageRequest{
+            To:              scheduled.To,
+            Content:         scheduled.Content,
+            Encrypted:       scheduled.Encrypted,
+            ClientMessageID: clientMessageID,
+            Attachments:     scheduled.Attachments,
+            Signature:       scheduled.Signature,
+        }, scheduled.From)
+    }
+    
+    if err != nil {
+        scheduled.Status = shared.ScheduledStatusFailed
+        scheduled.Error = err.Error()
+        if err := sc.scheduleStore.UpdateScheduled(scheduled); err != nil {
+            return fmt.Errorf("failed to mark scheduled message %s as failed: %v", scheduled.ID, err)
+        }
+        
+        sc.connections.SendToUser(scheduled.From, map[string]interface{}{
+            "event":     "scheduled_message_failed",
+            "scheduled": scheduled,
+        })
+        return nil
+    }
+    
+    sc.onSent(result)
+    
+    if err := sc.scheduleStore.DeleteScheduled(scheduled.ID); err != nil {
+        return fmt.Errorf("failed to remove sent scheduled message %s: %v", scheduled.ID, err)
+    }
+    return nil
+}
+
+func generateScheduledID() string {
+    return "sch_" + shared.NewSortableID()
+}
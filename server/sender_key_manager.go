@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+    "time"
+)
+
+// errSenderKeyOutdated is returned for a sender key made before the channel's
+// members last changed. Clients answer it by distributing a new one.
+const errSenderKeyOutdated = "sender key is out of date"
+
+// SenderKeyManager passes the sender keys channel members encrypt their
+// messages with between them. Keys travel encrypted for each recipient, so
+// the server can neither read them nor the channel messages.
+type SenderKeyManager struct {
+    senderKeyStore *storage.SenderKeyStore
+    messageStore   *storage.MessageStore
+}
+
+func NewSenderKeyManager(senderKeyStore *storage.SenderKeyStore, messageStore *storage.MessageStore) *SenderKeyManager {
+    return &SenderKeyManager{
+        senderKeyStore: senderKeyStore,
+        messageStore:   messageStore,
+    }
+}
+
+// DistributeSenderKey saves a member's new sender key for each of the other
+// members. It must be made for the channel's current key epoch and reach
+// every other member, so no one is left unable to read the channel.
+func (sm *SenderKeyManager) DistributeSenderKey(upload *shared.SenderKeyUpload, userID string) ([]*shared.SenderKeyDistribution, error) {
+    if _, err := sm.messageStore.GetChannelRole(upload.ChannelID, userID); err != nil {
+        return nil, fmt.Errorf("user is not a member of this channel")
+    }
+    channel, err := sm.messageStore.GetChannel(upload.ChannelID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load channel: %v", err)
+    }
+    if upload.KeyEpoch != channel.KeyEpoch {
+        return nil, fmt.Errorf("%s", errSenderKeyOutdated)
+    }
+    
+    if len(upload.Keys) != len(channel.Members)-1 {
+        return nil, fmt.Errorf("sender key must be sent to every other member")
+    }
+    
+    now := time.Now()
+    var distributions []*shared.SenderKeyDistribution
+    for _, memberID := range channel.Members {
+        if memberID == userID {
+            continue
+        }
+        content, ok := upload.Keys[memberID]
+        if !ok || content == "" {
+            return nil, fmt.Errorf("sender key must be sent to every other member")
+        }
+        
+        distributions = append(distributions, &shared.SenderKeyDistribution{
+            ID:        "sk_" + shared.NewSortableID(),
+            ChannelID: channel.ID,
+            From:      userID,
+            To:        memberID,
+            KeyEpoch:  channel.KeyEpoch,
+            Content:   content,
+            Created:   now,
+        })
+    }
+    
+    saved, err := sm.senderKeyStore.SaveDistributions(channel.ID, channel.KeyEpoch, distributions)
+    if err != nil {
+        return nil, fmt.Errorf("failed to save sender keys: %v", err)
+    }
+    if !saved {
+        return nil, fmt.Errorf("%s", errSenderKeyOutdated)
+    }
+    
+    return distributions, nil
+}
+
+// GetSenderKeys returns the sender keys held for a user, in one channel or
+// in all of their channels when channelID is empty.
+func (sm *SenderKeyManager) GetSenderKeys(userID, channelID string) ([]*shared.SenderKeyDistribution, error) {
+    distributions, err := sm.senderKeyStore.GetDistributions(userID, channelID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load sender keys: %v", err)
+    }
+    return distributions, nil
+}
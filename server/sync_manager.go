@@ -0,0 +1,59 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+)
+
+// SyncManager maintains the per-user update logs clients catch up from after
+// being offline.
+type SyncManager struct {
+    updateStore *storage.UpdateStore
+}
+
+func NewSyncManager(updateStore *storage.UpdateStore) *SyncManager {
+    return &SyncManager{updateStore: updateStore}
+}
+
+// Record appends an update to the log of each user. Failures are logged
+// rather than returned since the change itself has already been applied.
+func (sm *SyncManager) Record(userIDs []string, updateType string, payload interface{}) {
+    if len(userIDs) == 0 {
+        return
+    }
+    
+    if err := sm.updateStore.AppendUpdate(userIDs, updateType, payload); err != nil {
+        log.Printf("Failed to record %s update: %v", updateType, err)
+    }
+}
+
+// Sync returns the updates after since. When the log no longer holds every
+// update after since, or since is ahead of the log, the client is told to do
+// a full resync instead.
+func (sm *SyncManager) Sync(userID string, since int64, limit int) (*shared.SyncResult, error) {
+    oldest, latest, err := sm.updateStore.GetSequenceRange(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read update log: %v", err)
+    }
+    
+    result := &shared.SyncResult{LatestSequence: latest}
+    if since < 0 || since > latest || since < oldest-1 {
+        result.ResyncRequired = true
+        return result, nil
+    }
+    
+    updates, err := sm.updateStore.GetUpdates(userID, since, limit+1)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read update log: %v", err)
+    }
+    
+    if len(updates) > limit {
+        updates = updates[:limit]
+        result.HasMore = true
+    }
+    result.Updates = updates
+    
+    return result, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base32"
+    "encoding/hex"
+    "fmt"
+    "secure-messenger/crypto"
+    "secure-messenger/shared"
+    "strings"
+    "time"
+)
+
+const (
+    // totpIssuer names the server in authenticator apps.
+    totpIssuer = "Secure Messenger"
+    
+    // loginChallengeTTL is how long a login waits for its two-factor code,
+    // and maxChallengeAttempts how many codes it may be tried with.
+    loginChallengeTTL    = 5 * time.Minute
+    maxChallengeAttempts = 5
+    
+    // After maxTwoFactorFailures wrong codes, across logins, a user is locked
+    // out of two-factor logins until twoFactorLockout has passed since the
+    // first of them.
+    maxTwoFactorFailures = 10
+    twoFactorLockout     = 15 * time.Minute
+    
+    recoveryCodeCount = 10
+)
+
+// loginChallenge is a login whose password was correct, waiting for the
+// second factor. A user who has to enroll first gets the secret to enroll
+// with, which is only saved once a code confirms it.
+type loginChallenge struct {
+    user      *shared.User
+    secret    string
+    expiresAt time.Time
+    attempts  int
+}
+
+type twoFactorFailures struct {
+    count int
+    since time.Time
+}
+
+// SetRequireTwoFactor makes every user log in with a second factor. Users
+// who have not enabled it are asked to enroll when they next log in, and
+// cannot disable it.
+func (am *AuthManager) SetRequireTwoFactor(required bool) {
+    am.requireTwoFactor = required
+}
+
+// startSession logs in a user whose password was correct, or, if they use
+// two-factor authentication or the server requires it, answers with a
+// challenge to complete with CompleteLogin.
+func (am *AuthManager) startSession(user *shared.User) *shared.AuthResponse {
+    twoFactor, err := am.twoFactor.GetTwoFactor(user.ID)
+    if err != nil {
+        return &shared.AuthResponse{
+            Success: false,
+            Error:   "Failed to load two-factor settings",
+        }
+    }
+    if !twoFactor.Enabled && !am.requireTwoFactor {
+        return am.createSession(user)
+    }
+    
+    now := time.Now()
+    if am.lockedOut(user.ID, now) {
+        return &shared.AuthResponse{
+            Success: false,
+            Error:   "Too many incorrect codes, try again later",
+        }
+    }
+    
+    challenge := &loginChallenge{user: user, expiresAt: now.Add(loginChallengeTTL)}
+    response := &shared.AuthResponse{
+        Success: false,
+        Error:   "Two-factor code required",
+    }
+    if !twoFactor.Enabled {
+        secret, err := crypto.GenerateTOTPSecret()
+        if err != nil {
+            return &shared.AuthResponse{
+                Success: false,
+                Error:   "Failed to generate two-factor secret",
+            }
+        }
+        challenge.secret = secret
+        response.Error = "Two-factor authentication must be set up"
+        response.TwoFactorSetup = newTwoFactorSetup(user, secret)
+    }
+    
+    response.Challenge = generateSessionToken()
+    am.mu.Lock()
+    for token, c := range am.challenges {
+        if now.After(c.expiresAt) {
+            delete(am.challenges, token)
+        }
+    }
+    am.challenges[response.Challenge] = challenge
+    am.mu.Unlock()
+    
+    return response
+}
+
+// CompleteLogin finishes a login that was answered with a challenge, given
+// a code from the authenticator app or an unused recovery code. A login
+// that enrolls the user returns their recovery codes with the session.
+func (am *AuthManager) CompleteLogin(req *shared.TwoFactorLoginRequest) (*shared.AuthResponse, error) {
+    // The challenge is held while its code is checked, so it cannot be
+    // completed twice
+    am.mu.Lock()
+    challenge, ok := am.challenges[req.Challenge]
+    delete(am.challenges, req.Challenge)
+    am.mu.Unlock()
+    if !ok || time.Now().After(challenge.expiresAt) {
+        return &shared.AuthResponse{
+            Success: false,
+            Error:   "Login expired, log in again",
+        }, nil
+    }
+    challenge.attempts++
+    
+    var step int64
+    err := am.verifyCode(challenge.user.ID, func() (bool, error) {
+        if challenge.secret == "" {
+            return am.checkSecondFactor(challenge.user.ID, req.Code)
+        }
+        var valid bool
+        step, valid = crypto.VerifyTOTP(challenge.secret, req.Code, time.Now(), 0)
+        return valid, nil
+    })
+    if err != nil {
+        if challenge.attempts < maxChallengeAttempts {
+            am.mu.Lock()
+            am.challenges[req.Challenge] = challenge
+            am.mu.Unlock()
+        }
+        return &shared.AuthResponse{
+            Success: false,
+            Error:   err.Error(),
+        }, nil
+    }
+    
+    if challenge.secret == "" {
+        return am.createSession(challenge.user), nil
+    }
+    
+    codes, err := am.enableTwoFactor(challenge.user.ID, challenge.secret, step)
+    if err != nil {
+        return &shared.AuthResponse{
+            Success: false,
+            Error:   "Failed to enable two-factor authentication",
+        }, nil
+    }
+    response := am.createSession(challenge.user)
+    if response.Success {
+        response.RecoveryCodes = codes
+    }
+    return response, nil
+}
+
+// TwoFactorStatus reports whether the user has two-factor authentication
+// enabled and how many recovery codes they have left.
+func (am *AuthManager) TwoFactorStatus(userID string) (*shared.TwoFactorStatus, error) {
+    twoFactor, err := am.twoFactor.GetTwoFactor(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load two-factor settings: %v", err)
+    }
+    
+    status := &shared.TwoFactorStatus{Enabled: twoFactor.Enabled, Required: am.requireTwoFactor}
+    if twoFactor.Enabled {
+        if status.RecoveryCodes, err = am.twoFactor.CountRecoveryCodes(userID); err != nil {
+            return nil, fmt.Errorf("failed to count recovery codes: %v", err)
+        }
+    }
+    return status, nil
+}
+
+// BeginTwoFactorSetup generates a secret for the user to add to their
+// authenticator app. It takes effect once ConfirmTwoFactorSetup is given a
+// code it made.
+func (am *AuthManager) BeginTwoFactorSetup(user *shared.User) (*shared.TwoFactorSetup, error) {
+    secret, err := crypto.GenerateTOTPSecret()
+    if err != nil {
+        return nil, err
+    }
+    if err := am.twoFactor.SetPendingSecret(user.ID, secret); err != nil {
+        return nil, fmt.Errorf("Two-factor authentication is already enabled")
+    }
+    return newTwoFactorSetup(user, secret), nil
+}
+
+// ConfirmTwoFactorSetup enables two-factor authentication with the secret
+// from BeginTwoFactorSetup, once the user shows their app makes the right
+// codes, and returns their recovery codes.
+func (am *AuthManager) ConfirmTwoFactorSetup(userID, code string) ([]string, error) {
+    twoFactor, err := am.twoFactor.GetTwoFactor(userID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load two-factor settings: %v", err)
+    }
+    if twoFactor.Enabled {
+        return nil, fmt.Errorf("Two-factor authentication is already enabled")
+    }
+    if twoFactor.Secret == "" {
+        return nil, fmt.Errorf("Start two-factor setup first")
+    }
+    
+    var step int64
+    err = am.verifyCode(userID, func() (bool, error) {
+        var valid bool
+        step, valid = crypto.VerifyTOTP(twoFactor.Secret, code, time.Now(), 0)
+        return valid, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    return am.enableTwoFactor(userID, twoFactor.Secret, step)
+}
+
+// DisableTwoFactor turns two-factor authentication off for a user who gives
+// their password and a code, unless the server requires it.
+func (am *AuthManager) DisableTwoFactor(user *shared.User, req *shared.DisableTwoFactorRequest) error {
+    if am.requireTwoFactor {
+        return fmt.Errorf("Two-factor authentication is required on this server")
+    }
+    
+    _, passwordHash, err := am.userStore.GetUserByUsername(user.Username)
+    if err != nil {
+        return fmt.Errorf("failed to load user: %v", err)
+    }
+    if !crypto.VerifyPassword(req.Password, passwordHash) {
+        return fmt.Errorf("Password is incorrect")
+    }
+    if err := am.verifyCode(user.ID, func() (bool, error) { return am.checkSecondFactor(user.ID, req.Code) }); err != nil {
+        return err
+    }
+    
+    if err := am.twoFactor.DisableTwoFactor(user.ID); err != nil {
+        return fmt.Errorf("failed to disable two-factor authentication: %v", err)
+    }
+    return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with new ones,
+// given a code.
+func (am *AuthManager) RegenerateRecoveryCodes(userID, code string) ([]string, error) {
+    if err := am.verifyCode(userID, func() (bool, error) { return am.checkSecondFactor(userID, code) }); err != nil {
+        return nil, err
+    }
+    
+    codes, hashes, err := generateRecoveryCodes()
+    if err != nil {
+        return nil, err
+    }
+    if err := am.twoFactor.ReplaceRecoveryCodes(userID, hashes); err != nil {
+        return nil, fmt.Errorf("failed to save recovery codes: %v", err)
+    }
+    return codes, nil
+}
+
+func (am *AuthManager) enableTwoFactor(userID, secret string, step int64) ([]string, error) {
+    codes, hashes, err := generateRecoveryCodes()
+    if err != nil {
+        return nil, err
+    }
+    if err := am.twoFactor.EnableTwoFactor(userID, secret, step, hashes); err != nil {
+        return nil, fmt.Errorf("failed to enable two-factor authentication: %v", err)
+    }
+    return codes, nil
+}
+
+// checkSecondFactor checks a code of a user with two-factor authentication
+// enabled, using it up: a TOTP code cannot be used again, nor can any code
+// of an earlier period, and a recovery code only works once.
+func (am *AuthManager) checkSecondFactor(userID, code string) (bool, error) {
+    twoFactor, err := am.twoFactor.GetTwoFactor(userID)
+    if err != nil {
+        return false, err
+    }
+    if !twoFactor.Enabled {
+        return false, nil
+    }
+    
+    if step, valid := crypto.VerifyTOTP(twoFactor.Secret, code, time.Now(), twoFactor.LastStep); valid {
+        return am.twoFactor.UseStep(userID, step)
+    }
+    return am.twoFactor.UseRecoveryCode(userID, hashRecoveryCode(code), time.Now())
+}
+
+// verifyCode runs a check of a user's code, refusing to while they are
+// locked out and counting the codes that are wrong.
+func (am *AuthManager) verifyCode(userID string, check func() (bool, error)) error {
+    now := time.Now()
+    if am.lockedOut(userID, now) {
+        return fmt.Errorf("Too many incorrect codes, try again later")
+    }
+    
+    valid, err := check()
+    if err != nil {
+        return fmt.Errorf("failed to check code: %v", err)
+    }
+    
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    if valid {
+        delete(am.failures, userID)
+        return nil
+    }
+    failures := am.failures[userID]
+    if failures == nil || now.Sub(failures.since) > twoFactorLockout {
+        failures = &twoFactorFailures{since: now}
+        am.failures[userID] = failures
+    }
+    failures.count++
+    return fmt.Errorf("Invalid code")
+}
+
+func (am *AuthManager) lockedOut(userID string, now time.Time) bool {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    
+    failures := am.failures[userID]
+    if failures == nil {
+        return false
+    }
+    if now.Sub(failures.since) > twoFactorLockout {
+        delete(am.failures, userID)
+        return false
+    }
+    return failures.count >= maxTwoFactorFailures
+}
+
+func newTwoFactorSetup(user *shared.User, secret string) *shared.TwoFactorSetup {
+    return &shared.TwoFactorSetup{
+        Secret: secret,
+        URI:    crypto.TOTPProvisioningURI(totpIssuer, user.Username, secret),
+    }
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns new recovery codes, 80 random bits each
+// written as four groups of four, and the hashes they are stored as.
+func generateRecoveryCodes() ([]string, []string, error) {
+    codes := make([]string, recoveryCodeCount)
+    hashes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        random := make([]byte, 10)
+        if _, err := rand.Read(random); err != nil {
+            return nil, nil, fmt.Errorf("failed to generate recovery codes: %v", err)
+        }
+        
+        encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(random))
+        codes[i] = encoded[0:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:16]
+        hashes[i] = hashRecoveryCode(codes[i])
+    }
+    return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the form a recovery code is stored in, the same
+// however the user typed the code's case and separators.
+func hashRecoveryCode(code string) string {
+    normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+    sum := sha256.Sum256([]byte(normalized))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "regexp"
+    "testing"
+    "time"
+    
+    "secure-messenger/crypto"
+    "secure-messenger/shared"
+    "secure-messenger/storage"
+)
+
+// wrongCode is neither a TOTP code nor a recovery code.
+const wrongCode = "not-a-code"
+
+// newTestAuthManager returns an AuthManager on a fresh database, with one
+// user who has not set up two-factor authentication.
+func newTestAuthManager(t *testing.T) (*AuthManager, *shared.User) {
+    t.Helper()
+    
+    db, err := storage.NewDatabase(t.TempDir())
+    if err != nil {
+        t.Fatalf("NewDatabase: %v", err)
+    }
+    t.Cleanup(func() { db.Close() })
+    
+    am := NewAuthManager(storage.NewUserStore(db.GetDB()), storage.NewTwoFactorStore(db.GetDB()))
+    user := &shared.User{ID: generateID(), Username: "alice", Email: "alice@example.com", Created: time.Now()}
+    if err := am.userStore.CreateUser(user, "unused"); err != nil {
+        t.Fatalf("CreateUser: %v", err)
+    }
+    return am, user
+}
+
+// enableTestTwoFactor enables two-factor authentication for the user and
+// returns the secret and recovery codes.
+func enableTestTwoFactor(t *testing.T, am *AuthManager, user *shared.User) (string, []string) {
+    t.Helper()
+    
+    secret, err := crypto.GenerateTOTPSecret()
+    if err != nil {
+        t.Fatalf("GenerateTOTPSecret: %v", err)
+    }
+    codes, err := am.enableTwoFactor(user.ID, secret, 0)
+    if err != nil {
+        t.Fatalf("enableTwoFactor: %v", err)
+    }
+    return secret, codes
+}
+
+func currentCode(t *testing.T, secret string) string {
+    t.Helper()
+    
+    code, err := crypto.TOTPCode(secret, crypto.TOTPStep(time.Now()))
+    if err != nil {
+        t.Fatalf("TOTPCode: %v", err)
+    }
+    return code
+}
+
+// challenge starts a login that must answer a challenge and returns it.
+func challenge(t *testing.T, am *AuthManager, user *shared.User) *shared.AuthResponse {
+    t.Helper()
+    
+    response := am.startSession(user)
+    if response.Success || response.Challenge == "" {
+        t.Fatalf("startSession = %+v, want a challenge", response)
+    }
+    return response
+}
+
+func completeLogin(t *testing.T, am *AuthManager, challenge, code string) *shared.AuthResponse {
+    t.Helper()
+    
+    response, err := am.CompleteLogin(&shared.TwoFactorLoginRequest{Challenge: challenge, Code: code})
+    if err != nil {
+        t.Fatalf("CompleteLogin: %v", err)
+    }
+    return response
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+    codes, hashes, err := generateRecoveryCodes()
+    if err != nil {
+        t.Fatalf("generateRecoveryCodes: %v", err)
+    }
+    if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+        t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+    }
+    
+    format := regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`)
+    seen := make(map[string]bool)
+    for i, code := range codes {
+        if !format.MatchString(code) {
+            t.Fatalf("code %q is not four groups of four", code)
+        }
+        if seen[code] {
+            t.Fatalf("code %q given twice", code)
+        }
+        seen[code] = true
+        
+        if hashes[i] != hashRecoveryCode(code) {
+            t.Fatalf("hash of code %d does not match it", i)
+        }
+    }
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+    want := hashRecoveryCode("abcd-efgh-ijkl-mnop")
+    
+    // However the user types it
+    for _, typed := range []string{"ABCD-EFGH-IJKL-MNOP", "abcdefghijklmnop", " abcd efgh ijkl mnop ", "Abcd-Efgh ijkl-mnop"} {
+        if got := hashRecoveryCode(typed); got != want {
+            t.Errorf("%q hashed differently", typed)
+        }
+    }
+    
+    for _, other := range []string{"abcd-efgh-ijkl-mnoq", "abcd-efgh-ijkl", ""} {
+        if hashRecoveryCode(other) == want {
+            t.Errorf("%q hashed the same", other)
+        }
+    }
+}
+
+func TestStartSessionWithoutTwoFactor(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    
+    response := am.startSession(user)
+    if !response.Success || response.Token == "" || response.Challenge != "" {
+        t.Fatalf("startSession = %+v, want a session", response)
+    }
+}
+
+func TestCompleteLoginWithTOTP(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    secret, _ := enableTestTwoFactor(t, am, user)
+    
+    login := challenge(t, am, user)
+    if login.TwoFactorSetup != nil {
+        t.Fatalf("enrolled user was asked to set up two-factor authentication")
+    }
+    response := completeLogin(t, am, login.Challenge, currentCode(t, secret))
+    if !response.Success || response.Token == "" {
+        t.Fatalf("CompleteLogin = %+v, want a session", response)
+    }
+    
+    // The challenge is used up
+    if response := completeLogin(t, am, login.Challenge, currentCode(t, secret)); response.Success {
+        t.Fatalf("challenge was completed twice")
+    }
+}
+
+func TestCompleteLoginRejectsReplayedCode(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    secret, _ := enableTestTwoFactor(t, am, user)
+    code := currentCode(t, secret)
+    
+    if response := completeLogin(t, am, challenge(t, am, user).Challenge, code); !response.Success {
+        t.Fatalf("CompleteLogin = %+v, want a session", response)
+    }
+    if response := completeLogin(t, am, challenge(t, am, user).Challenge, code); response.Success {
+        t.Fatalf("TOTP code was accepted twice")
+    }
+}
+
+func TestUseStep(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    enableTestTwoFactor(t, am, user)
+    step := crypto.TOTPStep(time.Now())
+    
+    // Of two logins checking the same code at once, only one uses its step
+    if used, err := am.twoFactor.UseStep(user.ID, step); err != nil || !used {
+        t.Fatalf("UseStep = %v, %v, want true", used, err)
+    }
+    if used, err := am.twoFactor.UseStep(user.ID, step); err != nil || used {
+        t.Fatalf("UseStep of the same step = %v, %v, want false", used, err)
+    }
+    if used, err := am.twoFactor.UseStep(user.ID, step-1); err != nil || used {
+        t.Fatalf("UseStep of an earlier step = %v, %v, want false", used, err)
+    }
+}
+
+func TestCompleteLoginWithRecoveryCode(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    _, codes := enableTestTwoFactor(t, am, user)
+    
+    if response := completeLogin(t, am, challenge(t, am, user).Challenge, codes[0]); !response.Success {
+        t.Fatalf("CompleteLogin = %+v, want a session", response)
+    }
+    if response := completeLogin(t, am, challenge(t, am, user).Challenge, codes[0]); response.Success {
+        t.Fatalf("recovery code was accepted twice")
+    }
+}
+
+func TestChallengeAttemptLimit(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    secret, _ := enableTestTwoFactor(t, am, user)
+    
+    login := challenge(t, am, user)
+    for i := 0; i < maxChallengeAttempts; i++ {
+        if response := completeLogin(t, am, login.Challenge, wrongCode); response.Success || response.Error != "Invalid code" {
+            t.Fatalf("attempt %d = %+v, want an invalid code", i+1, response)
+        }
+    }
+    
+    // Even the right code no longer completes the login
+    response := completeLogin(t, am, login.Challenge, currentCode(t, secret))
+    if response.Success || response.Error != "Login expired, log in again" {
+        t.Fatalf("CompleteLogin = %+v, want the login expired", response)
+    }
+    
+    // A new login may try again
+    if response := completeLogin(t, am, challenge(t, am, user).Challenge, currentCode(t, secret)); !response.Success {
+        t.Fatalf("CompleteLogin = %+v, want a session", response)
+    }
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    secret, _ := enableTestTwoFactor(t, am, user)
+    
+    // Failures count across logins
+    login := challenge(t, am, user)
+    for i := 0; i < maxTwoFactorFailures; i++ {
+        if i > 0 && i%maxChallengeAttempts == 0 {
+            login = challenge(t, am, user)
+        }
+        completeLogin(t, am, login.Challenge, wrongCode)
+    }
+    
+    response := am.startSession(user)
+    if response.Success || response.Challenge != "" {
+        t.Fatalf("startSession = %+v, want the user locked out", response)
+    }
+    
+    // Nor does a code work on a login started before the lockout
+    am.mu.Lock()
+    failures := am.failures[user.ID]
+    delete(am.failures, user.ID)
+    am.mu.Unlock()
+    login = challenge(t, am, user)
+    am.mu.Lock()
+    am.failures[user.ID] = failures
+    am.mu.Unlock()
+    if response := completeLogin(t, am, login.Challenge, currentCode(t, secret)); response.Success {
+        t.Fatalf("CompleteLogin succeeded while locked out")
+    }
+    
+    // The lockout ends once twoFactorLockout has passed since the first failure
+    am.mu.Lock()
+    am.failures[user.ID].since = time.Now().Add(-twoFactorLockout - time.Second)
+    am.mu.Unlock()
+    if response := completeLogin(t, am, challenge(t, am, user).Challenge, currentCode(t, secret)); !response.Success {
+        t.Fatalf("CompleteLogin = %+v after the lockout, want a session", response)
+    }
+}
+
+func TestRequireTwoFactorEnrollment(t *testing.T) {
+    am, user := newTestAuthManager(t)
+    am.SetRequireTwoFactor(true)
+    
+    login := challenge(t, am, user)
+    if login.TwoFactorSetup == nil || login.TwoFactorSetup.Secret == "" {
+        t.Fatalf("startSession = %+v, want a secret to enroll", login)
+    }
+    secret := login.TwoFactorSetup.Secret
+    
+    // A wrong code does not enroll the user
+    if response := completeLogin(t, am, login.Challenge, wrongCode); response.Success {
+        t.Fatalf("CompleteLogin succeeded with a wrong code")
+    }
+    if status, err := am.TwoFactorStatus(user.ID); err != nil || status.Enabled {
+        t.Fatalf("TwoFactorStatus = %+v, %v, want disabled", status, err)
+    }
+    
+    code := currentCode(t, secret)
+    response := completeLogin(t, am, login.Challenge, code)
+    if !response.Success || len(response.RecoveryCodes) != recoveryCodeCount {
+        t.Fatalf("CompleteLogin = %+v, want a session and recovery codes", response)
+    }
+    status, err := am.TwoFactorStatus(user.ID)
+    if err != nil || !status.Enabled || !status.Required || status.RecoveryCodes != recoveryCodeCount {
+        t.Fatalf("TwoFactorStatus = %+v, %v, want enabled and required", status, err)
+    }
+    
+    // The next login asks for a code, and the one enrolled with is used up
+    login = challenge(t, am, user)
+    if login.TwoFactorSetup != nil {
+        t.Fatalf("enrolled user was asked to enroll again")
+    }
+    if response := completeLogin(t, am, login.Challenge, code); response.Success {
+        t.Fatalf("enrollment code was accepted again")
+    }
+    
+    if err := am.DisableTwoFactor(user, &shared.DisableTwoFactorRequest{Code: response.RecoveryCodes[0]}); err == nil {
+        t.Fatalf("DisableTwoFactor succeeded while two-factor authentication is required")
+    }
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+    "encoding/base64"
     "encoding/json"
+    "fmt"
     "log"
     "net"
     "secure-messenger/shared"
     "secure-messenger/storage"
+    "time"
 )
 
 type Server struct {
@@ -14,25 +17,57 @@ type Server struct {
     messageStore *storage.MessageStore
     authManager  *AuthManager
     messageHandler *MessageHandler
+    connections  *ConnectionManager
+    syncManager  *SyncManager
+    deliveries   *DeliveryManager
+    attachments  *AttachmentManager
+    expiry       *ExpiryReaper
+    retention    *RetentionManager
+    scheduler    *Scheduler
+    drafts       *DraftManager
+    prekeys      *PrekeyManager
+    senderKeys   *SenderKeyManager
 }
 
-func NewServer(db *storage.Database) *Server {
+func NewServer(db *storage.Database) (*Server, error) {
     userStore := storage.NewUserStore(db.GetDB())
     messageStore := storage.NewMessageStore(db.GetDB())
+    connections := NewConnectionManager()
     
-    return &Server{
+    blobStore, err := storage.NewBlobStore(db.GetDB(), db.DataDir())
+    if err != nil {
+        return nil, fmt.Errorf("failed to open blob store: %v", err)
+    }
+    messageHandler := NewMessageHandler(messageStore, userStore, blobStore)
+    syncManager := NewSyncManager(storage.NewUpdateStore(db.GetDB()))
+    expiry := NewExpiryReaper(messageStore, blobStore, messageHandler, syncManager, connections)
+    
+    s := &Server{
         db:            db,
         userStore:     userStore,
         messageStore:  messageStore,
-        authManager:   NewAuthManager(userStore),
-        messageHandler: NewMessageHandler(messageStore, userStore),
+        authManager:   NewAuthManager(userStore, storage.NewTwoFactorStore(db.GetDB())),
+        messageHandler: messageHandler,
+        connections:   connections,
+        syncManager:   syncManager,
+        deliveries:    NewDeliveryManager(messageStore, connections),
+        attachments:   NewAttachmentManager(blobStore, messageStore, messageHandler),
+        expiry:        expiry,
+        retention:     NewRetentionManager(storage.NewRetentionStore(db.GetDB()), messageStore, expiry),
+        drafts:        NewDraftManager(storage.NewDraftStore(db.GetDB()), messageStore, userStore, connections),
     }
+    s.scheduler = NewScheduler(storage.NewScheduleStore(db.GetDB()), messageStore, userStore, messageHandler, connections, s.publishSent)
+    s.prekeys = NewPrekeyManager(storage.NewPrekeyStore(db.GetDB()), s.authManager)
+    s.senderKeys = NewSenderKeyManager(storage.NewSenderKeyStore(db.GetDB()), messageStore)
+    
+    return s, nil
 }
 
 func (s *Server) HandleConnection(conn net.Conn) {
     defer conn.Close()
     
     protocol := shared.NewProtocol(conn)
+    defer s.connections.Unregister(protocol)
     
     for {
         // Read message from client
@@ -49,8 +84,11 @@ func (s *Server) HandleConnection(conn net.Conn) {
             continue
         }
         
-        // Send response
+        // Send response, with the request ID the client matches it by
         if response != nil {
+            if requestID, ok := msg["request_id"].(string); ok {
+                response["request_id"] = requestID
+            }
             if err := protocol.SendMessage(response); err != nil {
                 log.Printf("Failed to send response: %v", err)
                 return
@@ -68,11 +106,29 @@ func (s *Server) processMessage(msg map[string]interface{}, protocol *shared.Pro
         }, nil
     }
     
+    // Associate the connection with its user so events can be pushed to it,
+    // starting with whatever was queued while they were away
+    if token, ok := msg["token"].(string); ok {
+        if user, err := s.userStore.GetSession(token); err == nil {
+            if s.connections.Register(user.ID, token, protocol) {
+                go s.deliveries.DeliverPending(user.ID, protocol)
+            }
+        }
+    }
+    
     switch action {
     case "register":
         return s.handleRegister(msg)
     case "login":
         return s.handleLogin(msg)
+    case "login_two_factor":
+        return s.handleLoginTwoFactor(msg)
+    case "change_password":
+        return s.handleChangePassword(msg)
+    case "request_password_reset":
+        return s.handleRequestPasswordReset(msg)
+    case "reset_password":
+        return s.handleResetPassword(msg)
     case "send_message":
         return s.handleSendMessage(msg)
     case "send_channel_message":
@@ -91,6 +147,80 @@ func (s *Server) processMessage(msg map[string]interface{}, protocol *shared.Pro
         return s.handleRemoveUserFromChannel(msg)
     case "get_recent_messages":
         return s.handleGetRecentMessages(msg)
+    case "add_reaction":
+        return s.handleAddReaction(msg)
+    case "remove_reaction":
+        return s.handleRemoveReaction(msg)
+    case "get_mentions":
+        return s.handleGetMentions(msg)
+    case "pin_message":
+        return s.handlePinMessage(msg, true)
+    case "unpin_message":
+        return s.handlePinMessage(msg, false)
+    case "get_pinned":
+        return s.handleGetPinned(msg)
+    case "set_disappearing_timer":
+        return s.handleSetDisappearingTimer(msg)
+    case "set_channel_role":
+        return s.handleSetChannelRole(msg)
+    case "get_disappearing_timer":
+        return s.handleGetDisappearingTimer(msg)
+    case "schedule_message":
+        return s.handleScheduleMessage(msg, false)
+    case "edit_scheduled_message":
+        return s.handleScheduleMessage(msg, true)
+    case "cancel_scheduled_message":
+        return s.handleCancelScheduledMessage(msg)
+    case "get_scheduled_messages":
+        return s.handleGetScheduledMessages(msg)
+    case "save_draft":
+        return s.handleSaveDraft(msg)
+    case "get_drafts":
+        return s.handleGetDrafts(msg)
+    case "sync":
+        return s.handleSync(msg)
+    case "ack_messages":
+        return s.handleAckMessages(msg)
+    case "begin_upload":
+        return s.handleBeginUpload(msg)
+    case "upload_chunk":
+        return s.handleUploadChunk(msg)
+    case "finish_upload":
+        return s.handleFinishUpload(msg)
+    case "download_chunk":
+        return s.handleDownloadChunk(msg)
+    case "upload_public_key":
+        return s.handleUploadPublicKey(msg)
+    case "rotate_public_key":
+        return s.handleRotatePublicKey(msg)
+    case "get_public_key":
+        return s.handleGetPublicKey(msg)
+    case "upload_prekeys":
+        return s.handleUploadPrekeys(msg)
+    case "get_prekey_bundle":
+        return s.handleGetPrekeyBundle(msg)
+    case "get_prekey_status":
+        return s.handleGetPrekeyStatus(msg)
+    case "distribute_sender_key":
+        return s.handleDistributeSenderKey(msg)
+    case "get_sender_keys":
+        return s.handleGetSenderKeys(msg)
+    case "upload_key_backup":
+        return s.handleUploadKeyBackup(msg)
+    case "get_key_backup":
+        return s.handleGetKeyBackup(msg)
+    case "delete_key_backup":
+        return s.handleDeleteKeyBackup(msg)
+    case "get_two_factor_status":
+        return s.handleGetTwoFactorStatus(msg)
+    case "begin_two_factor_setup":
+        return s.handleBeginTwoFactorSetup(msg)
+    case "confirm_two_factor_setup":
+        return s.handleConfirmTwoFactorSetup(msg)
+    case "disable_two_factor":
+        return s.handleDisableTwoFactor(msg)
+    case "regenerate_recovery_codes":
+        return s.handleRegenerateRecoveryCodes(msg)
     default:
         return map[string]interface{}{
             "success": false,
@@ -124,12 +254,7 @@ func (s *Server) handleRegister(msg map[string]interface{}) (map[string]interfac
         }, nil
     }
     
-    return map[string]interface{}{
-        "success": response.Success,
-        "token":   response.Token,
-        "user":    response.User,
-        "error":   response.Error,
-    }, nil
+    return authResult(response), nil
 }
 
 func (s *Server) handleLogin(msg map[string]interface{}) (map[string]interface{}, error) {
@@ -157,11 +282,164 @@ func (s *Server) handleLogin(msg map[string]interface{}) (map[string]interface{}
         }, nil
     }
     
-    return map[string]interface{}{
+    return authResult(response), nil
+}
+
+func (s *Server) handleLoginTwoFactor(msg map[string]interface{}) (map[string]interface{}, error) {
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.TwoFactorLoginRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    response, err := s.authManager.CompleteLogin(&req)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return authResult(response), nil
+}
+
+// authResult is the reply to a login or registration, with the two-factor
+// challenge or recovery codes when there are any.
+func authResult(response *shared.AuthResponse) map[string]interface{} {
+    result := map[string]interface{}{
         "success": response.Success,
         "token":   response.Token,
         "user":    response.User,
         "error":   response.Error,
+    }
+    if response.Challenge != "" {
+        result["challenge"] = response.Challenge
+    }
+    if response.TwoFactorSetup != nil {
+        result["two_factor_setup"] = response.TwoFactorSetup
+    }
+    if len(response.RecoveryCodes) > 0 {
+        result["recovery_codes"] = response.RecoveryCodes
+    }
+    return result
+}
+
+func (s *Server) handleChangePassword(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.ChangePasswordRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    if err := s.authManager.ChangePassword(user, token, &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    // Other devices are logged out, whoever changed the password may have
+    // done so because one of them was lost
+    s.connections.RevokeSessions(user.ID, token)
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleRequestPasswordReset(msg map[string]interface{}) (map[string]interface{}, error) {
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.PasswordResetRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil || req.Email == "" {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Email required",
+        }, nil
+    }
+    
+    // Succeeds whether or not the email belongs to an account
+    if err := s.authManager.RequestPasswordReset(req.Email); err != nil {
+        log.Printf("Failed to issue password reset: %v", err)
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleResetPassword(msg map[string]interface{}) (map[string]interface{}, error) {
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.ResetPasswordRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    userID, err := s.authManager.ResetPassword(&req)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    s.connections.RevokeSessions(userID, "")
+    
+    return map[string]interface{}{
+        "success": true,
     }, nil
 }
 
@@ -199,7 +477,7 @@ func (s *Server) handleSendMessage(msg map[string]interface{}) (map[string]inter
         }, nil
     }
     
-    message, err := s.messageHandler.SendMessage(&req, user.ID)
+    result, err := s.messageHandler.SendMessage(&req, user.ID)
     if err != nil {
         return map[string]interface{}{
             "success": false,
@@ -207,9 +485,12 @@ func (s *Server) handleSendMessage(msg map[string]interface{}) (map[string]inter
         }, nil
     }
     
+    s.publishSent(result)
+    
     return map[string]interface{}{
-        "success": true,
-        "message": message,
+        "success":   true,
+        "message":   result.Message,
+        "duplicate": result.Duplicate,
     }, nil
 }
 
@@ -247,7 +528,7 @@ func (s *Server) handleSendChannelMessage(msg map[string]interface{}) (map[strin
         }, nil
     }
     
-    message, err := s.messageHandler.SendChannelMessage(&req, user.ID)
+    result, err := s.messageHandler.SendChannelMessage(&req, user.ID)
     if err != nil {
         return map[string]interface{}{
             "success": false,
@@ -255,9 +536,13 @@ func (s *Server) handleSendChannelMessage(msg map[string]interface{}) (map[strin
         }, nil
     }
     
+    s.publishSent(result)
+    
     return map[string]interface{}{
-        "success": true,
-        "message": message,
+        "success":             true,
+        "message":             result.Message,
+        "non_member_mentions": result.Mentions.NonMembers,
+        "duplicate":           result.Duplicate,
     }, nil
 }
 
@@ -287,12 +572,7 @@ func (s *Server) handleGetMessages(msg map[string]interface{}) (map[string]inter
         }, nil
     }
     
-    limit := 50
-    if l, ok := msg["limit"].(float64); ok {
-        limit = int(l)
-    }
-    
-    messages, err := s.messageHandler.GetMessages(user.ID, otherUserID, limit)
+    page, err := s.messageHandler.GetMessages(user.ID, otherUserID, parsePage(msg))
     if err != nil {
         return map[string]interface{}{
             "success": false,
@@ -302,7 +582,8 @@ func (s *Server) handleGetMessages(msg map[string]interface{}) (map[string]inter
     
     return map[string]interface{}{
         "success":  true,
-        "messages": messages,
+        "messages": page.Messages,
+        "has_more": page.HasMore,
     }, nil
 }
 
@@ -316,7 +597,7 @@ func (s *Server) handleGetChannelMessages(msg map[string]interface{}) (map[strin
     }
     
     // Validate session
-    _, err := s.authManager.ValidateSession(token)
+    user, err := s.authManager.ValidateSession(token)
     if err != nil {
         return map[string]interface{}{
             "success": false,
@@ -332,12 +613,7 @@ func (s *Server) handleGetChannelMessages(msg map[string]interface{}) (map[strin
         }, nil
     }
     
-    limit := 50
-    if l, ok := msg["limit"].(float64); ok {
-        limit = int(l)
-    }
-    
-    messages, err := s.messageHandler.GetChannelMessages(channelID, limit)
+    page, err := s.messageHandler.GetChannelMessages(user.ID, channelID, parsePage(msg))
     if err != nil {
         return map[string]interface{}{
             "success": false,
@@ -347,7 +623,8 @@ func (s *Server) handleGetChannelMessages(msg map[string]interface{}) (map[strin
     
     return map[string]interface{}{
         "success":  true,
-        "messages": messages,
+        "messages": page.Messages,
+        "has_more": page.HasMore,
     }, nil
 }
 
@@ -393,6 +670,12 @@ func (s *Server) handleCreateChannel(msg map[string]interface{}) (map[string]int
         }, nil
     }
     
+    s.publish(channel.Members, shared.UpdateMembership, "", map[string]interface{}{
+        "action":     "created",
+        "channel_id": channel.ID,
+        "channel":    channel,
+    })
+    
     return map[string]interface{}{
         "success": true,
         "channel": channel,
@@ -472,6 +755,8 @@ func (s *Server) handleAddUserToChannel(msg map[string]interface{}) (map[string]
         }, nil
     }
     
+    s.publishMembership(channelID, userID, "added")
+    
     return map[string]interface{}{
         "success": true,
     }, nil
@@ -518,6 +803,8 @@ func (s *Server) handleRemoveUserFromChannel(msg map[string]interface{}) (map[st
         }, nil
     }
     
+    s.publishMembership(channelID, userID, "removed")
+    
     return map[string]interface{}{
         "success": true,
     }, nil
@@ -541,12 +828,56 @@ func (s *Server) handleGetRecentMessages(msg map[string]interface{}) (map[string
         }, nil
     }
     
-    limit := 50
-    if l, ok := msg["limit"].(float64); ok {
-        limit = int(l)
+    page, err := s.messageHandler.GetRecentMessages(user.ID, parsePage(msg))
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":  true,
+        "messages": page.Messages,
+        "has_more": page.HasMore,
+    }, nil
+}
+
+func (s *Server) handleAddReaction(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
     }
     
-    messages, err := s.messageHandler.GetRecentMessages(user.ID, limit)
+    var req shared.ReactionRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    message, err := s.messageHandler.AddReaction(&req, user.ID)
     if err != nil {
         return map[string]interface{}{
             "success": false,
@@ -554,8 +885,1642 @@ func (s *Server) handleGetRecentMessages(msg map[string]interface{}) (map[string
         }, nil
     }
     
+    s.pushReactionUpdate(message)
+    
     return map[string]interface{}{
-        "success":  true,
-        "messages": messages,
+        "success":    true,
+        "message_id": message.ID,
+        "reactions":  message.Reactions,
+    }, nil
+}
+
+func (s *Server) handleRemoveReaction(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.ReactionRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    message, err := s.messageHandler.RemoveReaction(&req, user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    s.pushReactionUpdate(message)
+    
+    return map[string]interface{}{
+        "success":    true,
+        "message_id": message.ID,
+        "reactions":  message.Reactions,
     }, nil
 }
+
+func (s *Server) handleGetMentions(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    page, err := s.messageHandler.GetMentions(user.ID, parsePage(msg))
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":  true,
+        "messages": page.Messages,
+        "has_more": page.HasMore,
+    }, nil
+}
+
+func (s *Server) handlePinMessage(msg map[string]interface{}, pin bool) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.PinRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    var systemMessage *shared.Message
+    if pin {
+        systemMessage, err = s.messageHandler.PinMessage(&req, user.ID)
+    } else {
+        systemMessage, err = s.messageHandler.UnpinMessage(&req, user.ID)
+    }
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    s.publishMessage(systemMessage)
+    
+    participants, err := s.messageHandler.GetParticipants(systemMessage)
+    if err != nil {
+        log.Printf("Failed to load participants for message %s: %v", systemMessage.ID, err)
+    } else {
+        s.publish(participants, shared.UpdatePin, "pin_updated", map[string]interface{}{
+            "message_id": req.MessageID,
+            "pinned":     pin,
+            "message":    systemMessage,
+        })
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "message": systemMessage,
+    }, nil
+}
+
+func (s *Server) handleGetPinned(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    channelID, _ := msg["channel_id"].(string)
+    otherUserID, _ := msg["other_user_id"].(string)
+    if channelID == "" && otherUserID == "" {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Channel ID or other user ID required",
+        }, nil
+    }
+    
+    messages, err := s.messageHandler.GetPinned(user.ID, channelID, otherUserID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":  true,
+        "messages": messages,
+    }, nil
+}
+
+func (s *Server) handleSetDisappearingTimer(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.DisappearingTimerRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    systemMessage, err := s.messageHandler.SetDisappearingTimer(&req, user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    s.publishMessage(systemMessage)
+    
+    return map[string]interface{}{
+        "success": true,
+        "seconds": req.Seconds,
+        "message": systemMessage,
+    }, nil
+}
+
+func (s *Server) handleSetChannelRole(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.ChannelRoleRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    systemMessage, err := s.messageHandler.SetChannelRole(&req, user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    s.publishMessage(systemMessage)
+    
+    return map[string]interface{}{
+        "success": true,
+        "message": systemMessage,
+    }, nil
+}
+
+func (s *Server) handleGetDisappearingTimer(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    channelID, _ := msg["channel_id"].(string)
+    otherUserID, _ := msg["other_user_id"].(string)
+    if channelID == "" && otherUserID == "" {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Channel ID or other user ID required",
+        }, nil
+    }
+    
+    timer, err := s.messageHandler.GetDisappearingTimer(user.ID, channelID, otherUserID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "seconds": int64(timer / time.Second),
+    }, nil
+}
+
+func (s *Server) handleScheduleMessage(msg map[string]interface{}, edit bool) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.ScheduleMessageRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    var scheduled *shared.ScheduledMessage
+    if edit {
+        scheduled, err = s.scheduler.Edit(&req, user.ID)
+    } else {
+        scheduled, err = s.scheduler.Schedule(&req, user.ID)
+    }
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":   true,
+        "scheduled": scheduled,
+    }, nil
+}
+
+func (s *Server) handleCancelScheduledMessage(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    scheduledID, ok := msg["scheduled_id"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Scheduled message ID required",
+        }, nil
+    }
+    
+    if err := s.scheduler.Cancel(scheduledID, user.ID); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleGetScheduledMessages(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    scheduled, err := s.scheduler.List(user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":   true,
+        "scheduled": scheduled,
+    }, nil
+}
+
+func (s *Server) handleUploadPublicKey(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    publicKey, ok := msg["public_key"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Public key required",
+        }, nil
+    }
+    
+    // The signing key is optional for clients that do not sign messages yet
+    var signingKey, signingKeySignature []byte
+    if encoded, ok := msg["signing_key"].(string); ok {
+        signingKey, err = base64.StdEncoding.DecodeString(encoded)
+        if err != nil {
+            return map[string]interface{}{
+                "success": false,
+                "error":   "Invalid signing key",
+            }, nil
+        }
+    }
+    if encoded, ok := msg["signing_key_signature"].(string); ok {
+        signingKeySignature, err = base64.StdEncoding.DecodeString(encoded)
+        if err != nil {
+            return map[string]interface{}{
+                "success": false,
+                "error":   "Invalid signing key signature",
+            }, nil
+        }
+    }
+    
+    replace, _ := msg["replace"].(bool)
+    
+    keyChanged, signingKeyChanged, err := s.authManager.SetPublicKey(user.ID, publicKey, signingKey, signingKeySignature, replace)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    // Contacts who pinned the old key must not keep encrypting to it, nor
+    // silently switch to the new one. A new signing key alone only makes
+    // them fetch it again.
+    if keyChanged || signingKeyChanged {
+        contacts, err := s.messageStore.GetContacts(user.ID)
+        if err != nil {
+            log.Printf("Failed to load contacts of %s: %v", user.ID, err)
+        }
+        event := "key_changed"
+        if signingKeyChanged {
+            event = "signing_key_changed"
+        }
+        s.connections.SendToUsers(contacts, map[string]interface{}{
+            "event":      event,
+            "user_id":    user.ID,
+            "public_key": publicKey,
+        })
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleGetPublicKey(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    if _, err := s.authManager.ValidateSession(token); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    userID, ok := msg["user_id"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "User ID required",
+        }, nil
+    }
+    
+    publicKey, err := s.authManager.GetPublicKey(userID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    signingKey, signingKeySignature, err := s.authManager.GetSigningKey(userID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    previousPublicKey, rotationSignature, err := s.authManager.GetKeyRotation(userID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":                true,
+        "user_id":                userID,
+        "public_key":             publicKey,
+        "signing_key":            signingKey,
+        "signing_key_signature":  signingKeySignature,
+        "previous_public_key":    previousPublicKey,
+        "key_rotation_signature": rotationSignature,
+    }, nil
+}
+
+func (s *Server) handleRotatePublicKey(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    publicKey, ok := msg["public_key"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Public key required",
+        }, nil
+    }
+    
+    // Unlike uploads, a rotation always carries the signing key
+    var signingKey, signingKeySignature, rotationSignature []byte
+    for _, field := range []struct {
+        key   string
+        name  string
+        value *[]byte
+    }{
+        {"signing_key", "signing key", &signingKey},
+        {"signing_key_signature", "signing key signature", &signingKeySignature},
+        {"key_rotation_signature", "key rotation signature", &rotationSignature},
+    } {
+        encoded, _ := msg[field.key].(string)
+        if *field.value, err = base64.StdEncoding.DecodeString(encoded); err != nil || len(*field.value) == 0 {
+            return map[string]interface{}{
+                "success": false,
+                "error":   fmt.Sprintf("Invalid %s", field.name),
+            }, nil
+        }
+    }
+    
+    if err := s.authManager.RotatePublicKey(user.ID, publicKey, signingKey, signingKeySignature, rotationSignature); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    // Contacts check the old key's signature over the new one and move to
+    // it without asking, when they trusted the old key
+    contacts, err := s.messageStore.GetContacts(user.ID)
+    if err != nil {
+        log.Printf("Failed to load contacts of %s: %v", user.ID, err)
+    }
+    previousPublicKey, _, err := s.authManager.GetKeyRotation(user.ID)
+    if err != nil {
+        log.Printf("Failed to load key rotation of %s: %v", user.ID, err)
+    }
+    s.connections.SendToUsers(contacts, map[string]interface{}{
+        "event":                  "key_changed",
+        "user_id":                user.ID,
+        "public_key":             publicKey,
+        "previous_public_key":    previousPublicKey,
+        "key_rotation_signature": rotationSignature,
+    })
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleUploadPrekeys(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var upload shared.PrekeyUpload
+    if err := json.Unmarshal([]byte(data), &upload); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    if err := s.prekeys.UploadPrekeys(&upload, user.ID); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleGetPrekeyBundle(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    if _, err := s.authManager.ValidateSession(token); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    userID, ok := msg["user_id"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "User ID required",
+        }, nil
+    }
+    
+    bundle, err := s.prekeys.GetPrekeyBundle(userID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "bundle":  bundle,
+    }, nil
+}
+
+func (s *Server) handleGetPrekeyStatus(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    signedPrekeyID, count, err := s.prekeys.GetPrekeyStatus(user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":          true,
+        "signed_prekey_id": signedPrekeyID,
+        "one_time_prekeys": count,
+    }, nil
+}
+
+func (s *Server) handleDistributeSenderKey(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var upload shared.SenderKeyUpload
+    if err := json.Unmarshal([]byte(data), &upload); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    distributions, err := s.senderKeys.DistributeSenderKey(&upload, user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    // Sent before the response, so members online have the key before any
+    // message encrypted with it
+    for _, distribution := range distributions {
+        s.connections.SendToUser(distribution.To, map[string]interface{}{
+            "event":      "sender_key",
+            "sender_key": distribution,
+        })
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleGetSenderKeys(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    channelID, _ := msg["channel_id"].(string)
+    
+    distributions, err := s.senderKeys.GetSenderKeys(user.ID, channelID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":     true,
+        "sender_keys": distributions,
+    }, nil
+}
+
+func (s *Server) handleUploadKeyBackup(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    encoded, ok := msg["backup"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Key backup required",
+        }, nil
+    }
+    backup, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid key backup",
+        }, nil
+    }
+    
+    if err := s.authManager.SetKeyBackup(user.ID, backup); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleGetKeyBackup(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    backup, err := s.authManager.GetKeyBackup(user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "backup":  backup,
+    }, nil
+}
+
+func (s *Server) handleDeleteKeyBackup(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    if err := s.authManager.DeleteKeyBackup(user.ID); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleGetTwoFactorStatus(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    status, err := s.authManager.TwoFactorStatus(user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "status":  status,
+    }, nil
+}
+
+func (s *Server) handleBeginTwoFactorSetup(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    setup, err := s.authManager.BeginTwoFactorSetup(user)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "setup":   setup,
+    }, nil
+}
+
+func (s *Server) handleConfirmTwoFactorSetup(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.TwoFactorCodeRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    codes, err := s.authManager.ConfirmTwoFactorSetup(user.ID, req.Code)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":        true,
+        "recovery_codes": codes,
+    }, nil
+}
+
+func (s *Server) handleDisableTwoFactor(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.DisableTwoFactorRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    if err := s.authManager.DisableTwoFactor(user, &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+    }, nil
+}
+
+func (s *Server) handleRegenerateRecoveryCodes(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var req shared.TwoFactorCodeRequest
+    if err := json.Unmarshal([]byte(data), &req); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    codes, err := s.authManager.RegenerateRecoveryCodes(user.ID, req.Code)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":        true,
+        "recovery_codes": codes,
+    }, nil
+}
+
+func (s *Server) handleSaveDraft(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    data, ok := msg["data"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request data",
+        }, nil
+    }
+    
+    var draft shared.Draft
+    if err := json.Unmarshal([]byte(data), &draft); err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid request format",
+        }, nil
+    }
+    
+    saved, err := s.drafts.SaveDraft(&draft, user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "draft":   saved,
+    }, nil
+}
+
+func (s *Server) handleGetDrafts(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    drafts, err := s.drafts.GetDrafts(user.ID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "drafts":  drafts,
+    }, nil
+}
+
+const (
+    defaultPageSize = 50
+    maxPageSize     = 200
+)
+
+// parsePage reads the history cursors and limit of a request.
+func parsePage(msg map[string]interface{}) shared.Page {
+    page := shared.Page{Limit: defaultPageSize}
+    
+    if l, ok := msg["limit"].(float64); ok && l > 0 {
+        page.Limit = int(l)
+    }
+    if page.Limit > maxPageSize {
+        page.Limit = maxPageSize
+    }
+    
+    page.Before = pageCursor(msg["before"])
+    page.After = pageCursor(msg["after"])
+    
+    return page
+}
+
+// pageCursor reads a cursor given as a message ID or as a sync sequence,
+// which may be sent as a number.
+func pageCursor(value interface{}) string {
+    switch cursor := value.(type) {
+    case string:
+        return cursor
+    case float64:
+        return fmt.Sprintf("%d", int64(cursor))
+    default:
+        return ""
+    }
+}
+
+func (s *Server) handleSync(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    var since int64
+    if seq, ok := msg["since"].(float64); ok {
+        since = int64(seq)
+    }
+    
+    limit := 500
+    if l, ok := msg["limit"].(float64); ok && l > 0 && int(l) < limit {
+        limit = int(l)
+    }
+    
+    result, err := s.syncManager.Sync(user.ID, since, limit)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":         true,
+        "updates":         result.Updates,
+        "latest_seq":      result.LatestSequence,
+        "has_more":        result.HasMore,
+        "resync_required": result.ResyncRequired,
+    }, nil
+}
+
+func (s *Server) handleAckMessages(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    rawIDs, ok := msg["message_ids"].([]interface{})
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Message IDs required",
+        }, nil
+    }
+    
+    messageIDs := make([]string, 0, len(rawIDs))
+    for _, rawID := range rawIDs {
+        if messageID, ok := rawID.(string); ok {
+            messageIDs = append(messageIDs, messageID)
+        }
+    }
+    
+    acknowledged, err := s.deliveries.Acknowledge(user.ID, messageIDs)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success":      true,
+        "acknowledged": acknowledged,
+    }, nil
+}
+
+func (s *Server) handleBeginUpload(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    hash, _ := msg["blob_hash"].(string)
+    size, _ := msg["size"].(float64)
+    
+    status, err := s.attachments.BeginUpload(user.ID, hash, int64(size))
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "upload":  status,
+    }, nil
+}
+
+func (s *Server) handleUploadChunk(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    uploadID, _ := msg["upload_id"].(string)
+    offset, _ := msg["offset"].(float64)
+    encoded, _ := msg["chunk"].(string)
+    
+    chunk, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid chunk encoding",
+        }, nil
+    }
+    
+    status, err := s.attachments.UploadChunk(user.ID, uploadID, int64(offset), chunk)
+    if err != nil {
+        // The status tells the client where to resume
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+            "upload":  status,
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "upload":  status,
+    }, nil
+}
+
+func (s *Server) handleFinishUpload(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    uploadID, _ := msg["upload_id"].(string)
+    
+    status, err := s.attachments.FinishUpload(user.ID, uploadID)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "upload":  status,
+    }, nil
+}
+
+func (s *Server) handleDownloadChunk(msg map[string]interface{}) (map[string]interface{}, error) {
+    token, ok := msg["token"].(string)
+    if !ok {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Authentication required",
+        }, nil
+    }
+    
+    // Validate session
+    user, err := s.authManager.ValidateSession(token)
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   "Invalid session",
+        }, nil
+    }
+    
+    attachmentID, _ := msg["attachment_id"].(string)
+    offset, _ := msg["offset"].(float64)
+    length, _ := msg["length"].(float64)
+    preview, _ := msg["preview"].(bool)
+    
+    chunk, eof, err := s.attachments.DownloadChunk(user.ID, attachmentID, preview, int64(offset), int(length))
+    if err != nil {
+        return map[string]interface{}{
+            "success": false,
+            "error":   err.Error(),
+        }, nil
+    }
+    
+    return map[string]interface{}{
+        "success": true,
+        "chunk":   base64.StdEncoding.EncodeToString(chunk),
+        "eof":     eof,
+    }, nil
+}
+
+// publish records an update in the log of each user and, when event is set,
+// also pushes the payload as that event to the users who are online.
+func (s *Server) publish(userIDs []string, updateType, event string, payload map[string]interface{}) {
+    s.syncManager.Record(userIDs, updateType, payload)
+    
+    if event == "" {
+        return
+    }
+    
+    pushed := map[string]interface{}{"event": event}
+    for key, value := range payload {
+        pushed[key] = value
+    }
+    s.connections.SendToUsers(userIDs, pushed)
+}
+
+// publishSent publishes a newly sent message and notifies the users it
+// mentions.
+func (s *Server) publishSent(result *SendResult) {
+    // A retried send was already delivered the first time
+    if result.Duplicate {
+        return
+    }
+    
+    s.publishMessage(result.Message)
+    
+    if result.Mentions != nil {
+        s.connections.SendToUsers(result.Mentions.UserIDs, map[string]interface{}{
+            "event":   "mention",
+            "message": result.Message,
+        })
+    }
+}
+
+// publishMessage records a new message for everyone who can see it.
+func (s *Server) publishMessage(message *shared.Message) {
+    participants, err := s.messageHandler.GetParticipants(message)
+    if err != nil {
+        log.Printf("Failed to load participants for message %s: %v", message.ID, err)
+        return
+    }
+    
+    s.publish(participants, shared.UpdateMessageNew, "", map[string]interface{}{
+        "message": message,
+    })
+    s.deliveries.Deliver(message, participants)
+}
+
+// publishMembership records a membership change for the channel's members
+// and for the affected user, who may no longer be one of them.
+func (s *Server) publishMembership(channelID, userID, action string) {
+    recipients := []string{userID}
+    if channel, err := s.messageStore.GetChannel(channelID); err == nil {
+        recipients = append(recipients, channel.Members...)
+    }
+    
+    s.publish(recipients, shared.UpdateMembership, "", map[string]interface{}{
+        "action":     action,
+        "channel_id": channelID,
+        "user_id":    userID,
+    })
+}
+
+func (s *Server) pushReactionUpdate(message *shared.Message) {
+    participants, err := s.messageHandler.GetParticipants(message)
+    if err != nil {
+        log.Printf("Failed to load participants for message %s: %v", message.ID, err)
+        return
+    }
+    
+    s.publish(participants, shared.UpdateReaction, "reaction_updated", map[string]interface{}{
+        "message_id": message.ID,
+        "channel_id": message.ChannelID,
+        "reactions":  message.Reactions,
+    })
+}
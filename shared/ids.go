@@ -0,0 +1,59 @@
+package shared
+
+import (
+    "crypto/rand"
+    "encoding/base32"
+    "encoding/binary"
+    "sync"
+    "time"
+)
+
+// idEncoding is Crockford's base32 alphabet, whose characters sort in the
+// same order as the values they encode.
+var idEncoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+var (
+    idMu       sync.Mutex
+    idLastTime int64
+    idEntropy  [10]byte
+)
+
+// NewSortableID returns a 26 character ID made of a 48-bit millisecond
+// timestamp followed by 80 random bits. IDs sort by creation time, and IDs
+// created within the same millisecond in this process increment the random
+// part so they stay unique and ordered.
+func NewSortableID() string {
+    idMu.Lock()
+    defer idMu.Unlock()
+    
+    now := time.Now().UnixMilli()
+    if now <= idLastTime && incrementEntropy() {
+        now = idLastTime
+    } else {
+        if now <= idLastTime {
+            // The random part overflowed, borrow the next millisecond
+            now = idLastTime + 1
+        }
+        rand.Read(idEntropy[:])
+        idLastTime = now
+    }
+    
+    var id [16]byte
+    var timestamp [8]byte
+    binary.BigEndian.PutUint64(timestamp[:], uint64(now))
+    copy(id[:6], timestamp[2:])
+    copy(id[6:], idEntropy[:])
+    
+    return idEncoding.EncodeToString(id[:])
+}
+
+// incrementEntropy adds one to the random part, reporting false on overflow.
+func incrementEntropy() bool {
+    for i := len(idEntropy) - 1; i >= 0; i-- {
+        idEntropy[i]++
+        if idEntropy[i] != 0 {
+            return true
+        }
+    }
+    return false
+}
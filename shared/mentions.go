@@ -0,0 +1,28 @@
+package shared
+
+import (
+    "regexp"
+    "strings"
+)
+
+// mentionPattern matches @username that is not part of an email address.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([A-Za-z0-9_][A-Za-z0-9_.-]*)`)
+
+// ParseMentions extracts the distinct usernames mentioned in a message. The
+// server parses plaintext messages itself; clients parse encrypted ones and
+// send the result along.
+func ParseMentions(content string) []string {
+    var names []string
+    seen := make(map[string]bool)
+    
+    for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+        name := strings.TrimRight(match[1], ".-")
+        if name == "" || seen[name] {
+            continue
+        }
+        seen[name] = true
+        names = append(names, name)
+    }
+    
+    return names
+}
@@ -3,30 +3,40 @@ package shared
 import (
     "encoding/json"
     "net"
+    "sync"
 )
 
 type Protocol struct {
-    conn net.Conn
+    conn    net.Conn
+    decoder *json.Decoder
+    writeMu sync.Mutex
 }
 
 func NewProtocol(conn net.Conn) *Protocol {
-    return &Protocol{conn: conn}
+    return &Protocol{
+        conn:    conn,
+        decoder: json.NewDecoder(conn),
+    }
 }
 
+// SendMessage is safe to call from multiple goroutines, so server-pushed
+// events can be written while a response is being sent on the same connection.
 func (p *Protocol) SendMessage(msg map[string]interface{}) error {
     data, err := json.Marshal(msg)
     if err != nil {
         return err
     }
     
+    p.writeMu.Lock()
+    defer p.writeMu.Unlock()
+    
     _, err = p.conn.Write(append(data, '\n'))
     return err
 }
 
 func (p *Protocol) ReadMessage() (map[string]interface{}, error) {
     var msg map[string]interface{}
-    decoder := json.NewDecoder(p.conn)
-    err := decoder.Decode(&msg)
+    err := p.decoder.Decode(&msg)
     return msg, err
 }
 
@@ -1,6 +1,9 @@
 package shared
 
 import (
+    "encoding/json"
+    "fmt"
+    "strings"
     "time"
 )
 
@@ -19,6 +22,95 @@ type Message struct {
     Content   string    `json:"content"`
     Encrypted bool      `json:"encrypted"`
     Timestamp time.Time `json:"timestamp"`
+    Type      string    `json:"type"`
+    ReferenceID string  `json:"reference_id,omitempty"` // message a system entry refers to
+    ClientMessageID string `json:"client_message_id,omitempty"` // sender's ID for de-duplicating retries
+    Reactions []*Reaction `json:"reactions,omitempty"`
+    Attachments []*Attachment `json:"attachments,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"` // set when the conversation has a disappearing timer
+    Signature *MessageSignature `json:"signature,omitempty"`
+    Unverified bool `json:"unverified,omitempty"` // set by the receiving client when the signature does not check out
+}
+
+// MessageSignature is the sender's Ed25519 signature over a message as they
+// sent it: its content, the user or channel it was sent to, its client
+// message ID and the time it was signed. The server cannot alter any of
+// these without the signature failing.
+type MessageSignature struct {
+    SignedAt  time.Time `json:"signed_at"`
+    Signature []byte    `json:"signature"`
+}
+
+// Expired reports whether a disappearing message is past its expiry.
+func (m *Message) Expired(now time.Time) bool {
+    return m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
+const (
+    MessageTypeText   = "text"
+    MessageTypeSystem = "system"
+)
+
+const (
+    ChannelRoleOwner  = "owner"
+    ChannelRoleAdmin  = "admin"
+    ChannelRoleMember = "member"
+)
+
+// Attachment describes an encrypted file sent with a message. The server
+// stores only the ciphertext, addressed by its SHA-256 hash; Key is the
+// base64 AES key the recipients decrypt it with.
+type Attachment struct {
+    ID       string `json:"id"`
+    BlobHash string `json:"blob_hash"`
+    Name     string `json:"name"`
+    MimeType string `json:"mime_type"`
+    Size     int64  `json:"size"` // ciphertext size in bytes
+    Key      string `json:"key"`
+    
+    // Optional encrypted thumbnail of an image, under the same key
+    PreviewHash string `json:"preview_hash,omitempty"`
+    PreviewSize int64  `json:"preview_size,omitempty"`
+}
+
+// DefaultMimeType is the MIME type of an attachment sent without one.
+const DefaultMimeType = "application/octet-stream"
+
+// MaxChunkSize is the largest chunk accepted by upload_chunk and returned by
+// download_chunk, before base64 encoding.
+const MaxChunkSize = 256 * 1024
+
+// UploadStatus reports how much of an upload the server holds, so an
+// interrupted upload can resume at Received.
+type UploadStatus struct {
+    UploadID string `json:"upload_id"`
+    BlobHash string `json:"blob_hash"`
+    Size     int64  `json:"size"`
+    Received int64  `json:"received"`
+    Complete bool   `json:"complete"`
+}
+
+type Reaction struct {
+    Emoji string   `json:"emoji"`
+    Count int      `json:"count"`
+    Users []string `json:"users"`
+}
+
+// Page selects a slice of message history. Before and After are cursors,
+// either message IDs or the user's sync sequence numbers, which stand for
+// the newest message the user had been sent by then; with neither set the
+// newest messages are returned.
+type Page struct {
+    Before string `json:"before,omitempty"`
+    After  string `json:"after,omitempty"`
+    Limit  int    `json:"limit,omitempty"`
+}
+
+// MessagePage holds messages newest first and whether more exist beyond them
+// in the requested direction.
+type MessagePage struct {
+    Messages []*Message `json:"messages"`
+    HasMore  bool       `json:"has_more"`
 }
 
 type Channel struct {
@@ -28,6 +120,7 @@ type Channel struct {
     Members     []string `json:"members"`
     Created     time.Time `json:"created"`
     CreatedBy   string   `json:"created_by"`
+    KeyEpoch    int64    `json:"key_epoch"` // bumped whenever the members change
 }
 
 type LoginRequest struct {
@@ -41,21 +134,90 @@ type RegisterRequest struct {
     Password string `json:"password"`
 }
 
+type ChangePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+// PasswordResetRequest asks for a reset token to be mailed to the account
+// with the email.
+type PasswordResetRequest struct {
+    Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+    Token       string `json:"token"`
+    NewPassword string `json:"new_password"`
+}
+
+// AuthResponse answers a login or registration. When the user has to give
+// a two-factor code first, it carries a Challenge instead of a token, and a
+// TwoFactorSetup if they have to enroll an authenticator app before that.
 type AuthResponse struct {
-    Success bool   `json:"success"`
-    Token   string `json:"token"`
-    User    *User  `json:"user"`
-    Error   string `json:"error"`
+    Success        bool            `json:"success"`
+    Token          string          `json:"token"`
+    User           *User           `json:"user"`
+    Error          string          `json:"error"`
+    Challenge      string          `json:"challenge,omitempty"`
+    TwoFactorSetup *TwoFactorSetup `json:"two_factor_setup,omitempty"`
+    RecoveryCodes  []string        `json:"recovery_codes,omitempty"` // given once, when two-factor authentication is enabled
+}
+
+// TwoFactorLoginRequest completes a login that was answered with a
+// challenge, with a code from the authenticator app or a recovery code.
+type TwoFactorLoginRequest struct {
+    Challenge string `json:"challenge"`
+    Code      string `json:"code"`
+}
+
+// TwoFactorSetup is a new TOTP secret, and the otpauth URI authenticator
+// apps enroll it with.
+type TwoFactorSetup struct {
+    Secret string `json:"secret"`
+    URI    string `json:"uri"`
+}
+
+type TwoFactorStatus struct {
+    Enabled       bool `json:"enabled"`
+    Required      bool `json:"required"`       // by the server, so it cannot be disabled
+    RecoveryCodes int  `json:"recovery_codes"` // unused ones left
+}
+
+type TwoFactorCodeRequest struct {
+    Code string `json:"code"`
+}
+
+type DisableTwoFactorRequest struct {
+    Password string `json:"password"`
+    Code     string `json:"code"`
 }
 
 type MessageRequest struct {
-    To      string `json:"to"`
-    Content string `json:"content"`
+    To              string `json:"to"`
+    Content         string `json:"content"`
+    Encrypted       bool   `json:"encrypted,omitempty"` // content is end-to-end encrypted by the client
+    ClientMessageID string `json:"client_message_id,omitempty"`
+    Attachments     []*Attachment `json:"attachments,omitempty"`
+    Signature       *MessageSignature `json:"signature,omitempty"`
 }
 
 type ChannelMessageRequest struct {
-    ChannelID string `json:"channel_id"`
-    Content   string `json:"content"`
+    ChannelID string   `json:"channel_id"`
+    Content   string   `json:"content"`
+    Encrypted bool     `json:"encrypted,omitempty"`
+    Mentions  []string `json:"mentions,omitempty"` // usernames, for content the server cannot parse
+    ClientMessageID string `json:"client_message_id,omitempty"`
+    Attachments     []*Attachment `json:"attachments,omitempty"`
+    KeyEpoch        int64         `json:"key_epoch,omitempty"` // of the sender key encrypting the content
+    Signature       *MessageSignature `json:"signature,omitempty"`
+}
+
+type SendMessageResponse struct {
+    Success           bool     `json:"success"`
+    Message           *Message `json:"message"`
+    NonMemberMentions []*User  `json:"non_member_mentions,omitempty"`
+    Duplicate         bool     `json:"duplicate,omitempty"` // the client message ID was already sent
+    Error             string   `json:"error"`
 }
 
 type ChannelRequest struct {
@@ -63,3 +225,242 @@ type ChannelRequest struct {
     Description string   `json:"description"`
     Members     []string `json:"members"`
 }
+
+type ReactionRequest struct {
+    MessageID string `json:"message_id"`
+    Emoji     string `json:"emoji"`
+}
+
+type PinRequest struct {
+    MessageID string `json:"message_id"`
+}
+
+// ScheduledMessage is a message the server holds until SendAt and then
+// sends like any other. Exactly one of To and ChannelID is set.
+type ScheduledMessage struct {
+    ID          string        `json:"id"`
+    From        string        `json:"from"`
+    To          string        `json:"to,omitempty"`
+    ChannelID   string        `json:"channel_id,omitempty"`
+    Content     string        `json:"content"`
+    Encrypted   bool          `json:"encrypted,omitempty"`
+    Mentions    []string      `json:"mentions,omitempty"`
+    Attachments []*Attachment `json:"attachments,omitempty"`
+    KeyEpoch    int64         `json:"key_epoch,omitempty"` // of the sender key encrypting a channel message
+    ClientMessageID string    `json:"client_message_id,omitempty"` // used for the message once sent
+    Signature   *MessageSignature `json:"signature,omitempty"`
+    SendAt      time.Time     `json:"send_at"`
+    Status      string        `json:"status"`
+    Error       string        `json:"error,omitempty"` // why sending failed
+    Created     time.Time     `json:"created"`
+}
+
+const (
+    ScheduledStatusPending = "pending"
+    ScheduledStatusFailed  = "failed"
+)
+
+// ScheduleMessageRequest schedules a message, or edits a scheduled message
+// when ID is set. The recipient of a scheduled message cannot be changed.
+type ScheduleMessageRequest struct {
+    ID          string        `json:"id,omitempty"`
+    To          string        `json:"to,omitempty"`
+    ChannelID   string        `json:"channel_id,omitempty"`
+    Content     string        `json:"content"`
+    Encrypted   bool          `json:"encrypted,omitempty"`
+    Mentions    []string      `json:"mentions,omitempty"`
+    Attachments []*Attachment `json:"attachments,omitempty"`
+    KeyEpoch    int64         `json:"key_epoch,omitempty"`
+    ClientMessageID string    `json:"client_message_id,omitempty"`
+    Signature   *MessageSignature `json:"signature,omitempty"`
+    SendAt      time.Time     `json:"send_at"`
+}
+
+// MaxDraftSize bounds the stored size of a draft.
+const MaxDraftSize = 64 * 1024
+
+// Draft is an unsent message of a conversation, saved so it follows the user
+// across devices. Content is encrypted by the client with a key the server
+// does not know; an empty content clears the draft.
+type Draft struct {
+    ChannelID   string    `json:"channel_id,omitempty"`
+    OtherUserID string    `json:"other_user_id,omitempty"`
+    Content     string    `json:"content"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// MaxOneTimePrekeys bounds how many unused one-time prekeys the server
+// keeps for a user.
+const MaxOneTimePrekeys = 200
+
+// OneTimePrekey is an X25519 public key handed out to a single session
+// initiator and then discarded.
+type OneTimePrekey struct {
+    ID        string `json:"id"`
+    PublicKey []byte `json:"public_key"`
+}
+
+// PrekeyUpload publishes a user's X25519 identity key and signed prekey,
+// replacing any earlier ones, along with one-time prekeys to add. Signature
+// is made with the user's RSA key over both public keys.
+type PrekeyUpload struct {
+    IdentityKey    []byte           `json:"identity_key"`
+    SignedPrekeyID uint32           `json:"signed_prekey_id"`
+    SignedPrekey   []byte           `json:"signed_prekey"`
+    Signature      []byte           `json:"signature"`
+    OneTimePrekeys []*OneTimePrekey `json:"one_time_prekeys,omitempty"`
+}
+
+// PrekeyBundle is what an initiator needs to start a forward secret session
+// with a user without them being online. OneTimePrekey is nil once the user
+// has run out of them.
+type PrekeyBundle struct {
+    UserID         string         `json:"user_id"`
+    IdentityKey    []byte         `json:"identity_key"`
+    SignedPrekeyID uint32         `json:"signed_prekey_id"`
+    SignedPrekey   []byte         `json:"signed_prekey"`
+    Signature      []byte         `json:"signature"`
+    OneTimePrekey  *OneTimePrekey `json:"one_time_prekey,omitempty"`
+}
+
+// SenderKeyUpload hands a member's new sender key for a channel to every
+// other member, encrypted for each like a direct message and keyed by their
+// user ID.
+type SenderKeyUpload struct {
+    ChannelID string            `json:"channel_id"`
+    KeyEpoch  int64             `json:"key_epoch"`
+    Keys      map[string]string `json:"keys"`
+}
+
+// SenderKeyDistribution is one member's sender key for a channel as held for
+// another member until they fetch it.
+type SenderKeyDistribution struct {
+    ID        string    `json:"id"`
+    ChannelID string    `json:"channel_id"`
+    From      string    `json:"from"`
+    To        string    `json:"to"`
+    KeyEpoch  int64     `json:"key_epoch"`
+    Content   string    `json:"content"`
+    Created   time.Time `json:"created"`
+}
+
+// DisappearingTimers are the durations a conversation's messages can be set
+// to disappear after. A timer of zero turns disappearing messages off.
+var DisappearingTimers = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// DisappearingTimerLabel describes a timer for display, such as "1 day".
+func DisappearingTimerLabel(timer time.Duration) string {
+    switch {
+    case timer <= 0:
+        return "off"
+    case timer%(24*time.Hour) == 0:
+        return pluralize(int64(timer/(24*time.Hour)), "day")
+    case timer%time.Hour == 0:
+        return pluralize(int64(timer/time.Hour), "hour")
+    default:
+        return pluralize(int64(timer/time.Minute), "minute")
+    }
+}
+
+func pluralize(n int64, unit string) string {
+    if n == 1 {
+        return fmt.Sprintf("1 %s", unit)
+    }
+    return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// Actions recorded in system messages, whose content is the acting user's
+// name followed by the action.
+const (
+    SystemActionPinned   = "pinned a message"
+    SystemActionUnpinned = "unpinned a message"
+    SystemActionTimerOff = "turned off disappearing messages"
+)
+
+// SystemActionTimer is the action of setting a disappearing timer.
+func SystemActionTimer(timer time.Duration) string {
+    if timer <= 0 {
+        return SystemActionTimerOff
+    }
+    return fmt.Sprintf("set messages to disappear after %s", DisappearingTimerLabel(timer))
+}
+
+// SystemActionRole is the action of giving a channel member a role.
+func SystemActionRole(username, role string) string {
+    return fmt.Sprintf("made %s %s", username, ChannelRoleName(role))
+}
+
+// ChannelRoleName describes a channel role, such as "an admin".
+func ChannelRoleName(role string) string {
+    if role == ChannelRoleAdmin {
+        return "an admin"
+    }
+    return "a member"
+}
+
+// IsSystemMessageContent reports whether content follows one of the system
+// actions. System messages are not signed and their type is set by the
+// server, so clients only show those that do as coming from the server.
+func IsSystemMessageContent(content string) bool {
+    actions := []string{SystemActionPinned, SystemActionUnpinned, SystemActionTimerOff}
+    for _, timer := range DisappearingTimers {
+        actions = append(actions, SystemActionTimer(timer))
+    }
+    for _, action := range actions {
+        if actor := strings.TrimSuffix(content, " "+action); actor != content && actor != "" {
+            return true
+        }
+    }
+    
+    for _, role := range []string{ChannelRoleAdmin, ChannelRoleMember} {
+        rest := strings.TrimSuffix(content, " "+ChannelRoleName(role))
+        if rest == content {
+            continue
+        }
+        if actor, target, ok := strings.Cut(rest, " made "); ok && actor != "" && target != "" {
+            return true
+        }
+    }
+    return false
+}
+
+// ChannelRoleRequest makes a channel member an admin, or a plain member
+// again.
+type ChannelRoleRequest struct {
+    ChannelID string `json:"channel_id"`
+    UserID    string `json:"user_id"`
+    Role      string `json:"role"`
+}
+
+// DisappearingTimerRequest sets the timer of a channel, or of the direct
+// conversation with OtherUserID.
+type DisappearingTimerRequest struct {
+    ChannelID   string `json:"channel_id,omitempty"`
+    OtherUserID string `json:"other_user_id,omitempty"`
+    Seconds     int64  `json:"seconds"`
+}
+
+// Update is an entry in a user's update log. Sequences are per user and
+// increase by one for every update, so clients can detect missed updates.
+type Update struct {
+    Sequence  int64           `json:"seq"`
+    Type      string          `json:"type"`
+    Payload   json.RawMessage `json:"payload"`
+    Timestamp time.Time       `json:"timestamp"`
+}
+
+const (
+    UpdateMessageNew = "message_new"
+    UpdateReaction   = "reaction"
+    UpdatePin        = "pin"
+    UpdateMembership = "membership"
+    UpdateMessagesDeleted = "messages_deleted"
+    UpdateRedacted = "redacted" // an update about a since deleted message, kept so sequences stay contiguous
+)
+
+type SyncResult struct {
+    Updates        []*Update `json:"updates"`
+    LatestSequence int64     `json:"latest_seq"`
+    HasMore        bool      `json:"has_more"`
+    ResyncRequired bool      `json:"resync_required"` // the log no longer covers the requested range
+}
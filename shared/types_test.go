@@ -0,0 +1,36 @@
+package shared
+
+import (
+    "testing"
+    "time"
+)
+
+func TestIsSystemMessageContent(t *testing.T) {
+    valid := []string{
+        "alice " + SystemActionPinned,
+        "alice " + SystemActionUnpinned,
+        "alice " + SystemActionTimer(0),
+        "alice " + SystemActionTimer(24*time.Hour),
+        "alice " + SystemActionRole("bob", ChannelRoleAdmin),
+        "alice " + SystemActionRole("bob", ChannelRoleMember),
+    }
+    for _, content := range valid {
+        if !IsSystemMessageContent(content) {
+            t.Errorf("%q was not accepted", content)
+        }
+    }
+    
+    invalid := []string{
+        "",
+        SystemActionPinned,
+        " " + SystemActionPinned,
+        "alice set messages to disappear after 5 minutes",
+        "alice made  an admin",
+        "please send your password to bob",
+    }
+    for _, content := range invalid {
+        if IsSystemMessageContent(content) {
+            t.Errorf("%q was accepted", content)
+        }
+    }
+}
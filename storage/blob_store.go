@@ -0,0 +1,377 @@
+package storage
+
+import (
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "secure-messenger/shared"
+    "time"
+)
+
+// BlobStore keeps encrypted attachment blobs in the data directory, named
+// by the SHA-256 of their contents so identical uploads are stored once.
+type BlobStore struct {
+    db  *sql.DB
+    dir string
+}
+
+func NewBlobStore(db *sql.DB, dataDir string) (*BlobStore, error) {
+    dir := filepath.Join(dataDir, "blobs")
+    if err := os.MkdirAll(filepath.Join(dir, "uploads"), 0700); err != nil {
+        return nil, err
+    }
+    
+    return &BlobStore{db: db, dir: dir}, nil
+}
+
+// ValidBlobHash reports whether hash is a lowercase hex SHA-256, which also
+// keeps it safe to use in file paths.
+func ValidBlobHash(hash string) bool {
+    if len(hash) != sha256.Size*2 {
+        return false
+    }
+    for _, c := range hash {
+        if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+            return false
+        }
+    }
+    return true
+}
+
+func (bs *BlobStore) blobPath(hash string) string {
+    return filepath.Join(bs.dir, hash[:2], hash)
+}
+
+func (bs *BlobStore) uploadPath(uploadID string) string {
+    return filepath.Join(bs.dir, "uploads", uploadID)
+}
+
+// GetBlobSize returns the size of a stored blob.
+func (bs *BlobStore) GetBlobSize(hash string) (int64, error) {
+    var size int64
+    err := bs.db.QueryRow(`SELECT size FROM blobs WHERE hash = ?`, hash).Scan(&size)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return 0, fmt.Errorf("blob not found")
+        }
+        return 0, err
+    }
+    return size, nil
+}
+
+// GetUserBlobSize returns the size of a stored blob the user uploaded, or
+// that was counted against their quota when they tried to.
+func (bs *BlobStore) GetUserBlobSize(userID, hash string) (int64, error) {
+    var size int64
+    query := `SELECT b.size FROM blobs b JOIN user_blobs ub ON ub.hash = b.hash WHERE ub.user_id = ? AND b.hash = ?`
+    err := bs.db.QueryRow(query, userID, hash).Scan(&size)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return 0, fmt.Errorf("blob not found")
+        }
+        return 0, err
+    }
+    return size, nil
+}
+
+func (bs *BlobStore) BlobExists(hash string) (bool, error) {
+    var count int
+    if err := bs.db.QueryRow(`SELECT COUNT(*) FROM blobs WHERE hash = ?`, hash).Scan(&count); err != nil {
+        return false, err
+    }
+    return count > 0, nil
+}
+
+// AddUserBlob counts an existing blob against the user's quota.
+func (bs *BlobStore) AddUserBlob(userID, hash string) error {
+    _, err := bs.db.Exec(`INSERT OR IGNORE INTO user_blobs (user_id, hash) VALUES (?, ?)`, userID, hash)
+    return err
+}
+
+// UsedBytes returns the size of the user's stored blobs plus the full size
+// of their uploads in progress.
+func (bs *BlobStore) UsedBytes(userID string) (int64, error) {
+    query := `
+    SELECT
+        (SELECT COALESCE(SUM(b.size), 0) FROM user_blobs ub JOIN blobs b ON b.hash = ub.hash WHERE ub.user_id = ?) +
+        (SELECT COALESCE(SUM(size), 0) FROM uploads WHERE user_id = ?)`
+    
+    var used int64
+    if err := bs.db.QueryRow(query, userID, userID).Scan(&used); err != nil {
+        return 0, err
+    }
+    return used, nil
+}
+
+// CreateUpload starts an upload of a blob with the given hash and size.
+func (bs *BlobStore) CreateUpload(uploadID, userID, hash string, size int64) (*shared.UploadStatus, error) {
+    file, err := os.OpenFile(bs.uploadPath(uploadID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+    if err != nil {
+        return nil, err
+    }
+    file.Close()
+    
+    query := `
+    INSERT INTO uploads (id, user_id, hash, size, received, updated_at)
+    VALUES (?, ?, ?, ?, 0, ?)`
+    
+    if _, err := bs.db.Exec(query, uploadID, userID, hash, size, time.Now()); err != nil {
+        os.Remove(bs.uploadPath(uploadID))
+        return nil, err
+    }
+    
+    return &shared.UploadStatus{UploadID: uploadID, BlobHash: hash, Size: size}, nil
+}
+
+// FindUpload returns the user's unfinished upload of a blob, or nil.
+func (bs *BlobStore) FindUpload(userID, hash string) (*shared.UploadStatus, error) {
+    query := `SELECT id, hash, size, received FROM uploads WHERE user_id = ? AND hash = ? LIMIT 1`
+    
+    var status shared.UploadStatus
+    err := bs.db.QueryRow(query, userID, hash).Scan(&status.UploadID, &status.BlobHash, &status.Size, &status.Received)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return &status, nil
+}
+
+// GetUpload returns one of the user's uploads.
+func (bs *BlobStore) GetUpload(uploadID, userID string) (*shared.UploadStatus, error) {
+    query := `SELECT id, hash, size, received FROM uploads WHERE id = ? AND user_id = ?`
+    
+    var status shared.UploadStatus
+    err := bs.db.QueryRow(query, uploadID, userID).Scan(&status.UploadID, &status.BlobHash, &status.Size, &status.Received)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("upload not found")
+        }
+        return nil, err
+    }
+    return &status, nil
+}
+
+// AppendChunk writes a chunk at offset, which must be where the previous
+// chunk ended, and returns the number of bytes received so far.
+func (bs *BlobStore) AppendChunk(status *shared.UploadStatus, offset int64, chunk []byte) (int64, error) {
+    if offset != status.Received {
+        return status.Received, fmt.Errorf("expected chunk at offset %d", status.Received)
+    }
+    if offset+int64(len(chunk)) > status.Size {
+        return status.Received, fmt.Errorf("chunk exceeds upload size")
+    }
+    
+    file, err := os.OpenFile(bs.uploadPath(status.UploadID), os.O_WRONLY, 0600)
+    if err != nil {
+        return status.Received, err
+    }
+    defer file.Close()
+    
+    if _, err := file.WriteAt(chunk, offset); err != nil {
+        return status.Received, err
+    }
+    
+    received := offset + int64(len(chunk))
+    query := `UPDATE uploads SET received = ?, updated_at = ? WHERE id = ?`
+    if _, err := bs.db.Exec(query, received, time.Now(), status.UploadID); err != nil {
+        return status.Received, err
+    }
+    
+    return received, nil
+}
+
+// CompleteUpload verifies the uploaded data against its hash and moves it
+// into the blob store.
+func (bs *BlobStore) CompleteUpload(status *shared.UploadStatus, userID string) error {
+    if status.Received != status.Size {
+        return fmt.Errorf("upload is incomplete: %d of %d bytes received", status.Received, status.Size)
+    }
+    
+    path := bs.uploadPath(status.UploadID)
+    hash, err := hashFile(path)
+    if err != nil {
+        return err
+    }
+    
+    if hash != status.BlobHash {
+        bs.removeUpload(status.UploadID)
+        return fmt.Errorf("uploaded data does not match its hash")
+    }
+    
+    if err := os.MkdirAll(filepath.Dir(bs.blobPath(hash)), 0700); err != nil {
+        return err
+    }
+    if err := os.Rename(path, bs.blobPath(hash)); err != nil {
+        return err
+    }
+    
+    tx, err := bs.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    if _, err := tx.Exec(`INSERT OR IGNORE INTO blobs (hash, size, created_at) VALUES (?, ?, ?)`, hash, status.Size, time.Now()); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`INSERT OR IGNORE INTO user_blobs (user_id, hash) VALUES (?, ?)`, userID, hash); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`DELETE FROM uploads WHERE id = ?`, status.UploadID); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
+}
+
+// ReadBlob reads up to length bytes of a blob starting at offset.
+func (bs *BlobStore) ReadBlob(hash string, offset int64, length int) ([]byte, error) {
+    file, err := os.Open(bs.blobPath(hash))
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    
+    buf := make([]byte, length)
+    n, err := file.ReadAt(buf, offset)
+    if err != nil && err != io.EOF {
+        return nil, err
+    }
+    return buf[:n], nil
+}
+
+// referencedBlobs selects the hash of every blob still in use, either by an
+// attachment or by a scheduled message waiting to be sent. It must never
+// select NULL, which attachments without a preview would give, as NOT IN
+// then matches nothing and IN gives NULL.
+const referencedBlobs = `
+    SELECT blob_hash FROM attachments
+    UNION SELECT preview_hash FROM attachments
+    UNION SELECT COALESCE(json_extract(a.value, '$.blob_hash'), '') FROM scheduled_messages s, json_each(s.attachments) a
+    UNION SELECT COALESCE(json_extract(a.value, '$.preview_hash'), '') FROM scheduled_messages s, json_each(s.attachments) a`
+
+// CollectGarbage deletes blobs nothing refers to and abandoned
+// uploads, provided they are older than before. Blobs are given that grace
+// period because they are uploaded before the message referring to them is
+// sent. It returns the number of blobs and uploads removed.
+func (bs *BlobStore) CollectGarbage(before time.Time) (int, error) {
+    query := `
+    SELECT hash FROM blobs
+    WHERE created_at < ?
+    AND hash NOT IN (` + referencedBlobs + `)`
+    
+    hashes, err := bs.queryStrings(query, before)
+    if err != nil {
+        return 0, err
+    }
+    
+    removed := 0
+    for _, hash := range hashes {
+        if err := bs.removeBlob(hash); err != nil {
+            return removed, err
+        }
+        removed++
+    }
+    
+    uploadIDs, err := bs.queryStrings(`SELECT id FROM uploads WHERE updated_at < ?`, before)
+    if err != nil {
+        return removed, err
+    }
+    
+    for _, uploadID := range uploadIDs {
+        if err := bs.removeUpload(uploadID); err != nil {
+            return removed, err
+        }
+        removed++
+    }
+    
+    return removed, nil
+}
+
+// RemoveUnreferenced deletes those of the given blobs that nothing
+// refers to anymore, without waiting for garbage collection. It returns the
+// number of blobs removed.
+func (bs *BlobStore) RemoveUnreferenced(hashes []string) (int, error) {
+    query := `SELECT ? IN (` + referencedBlobs + `)`
+    
+    removed := 0
+    for _, hash := range hashes {
+        var referenced bool
+        if err := bs.db.QueryRow(query, hash).Scan(&referenced); err != nil {
+            return removed, err
+        }
+        if referenced {
+            continue
+        }
+        
+        if err := bs.removeBlob(hash); err != nil {
+            return removed, err
+        }
+        removed++
+    }
+    
+    return removed, nil
+}
+
+func (bs *BlobStore) removeBlob(hash string) error {
+    if _, err := bs.db.Exec(`DELETE FROM user_blobs WHERE hash = ?`, hash); err != nil {
+        return err
+    }
+    if _, err := bs.db.Exec(`DELETE FROM blobs WHERE hash = ?`, hash); err != nil {
+        return err
+    }
+    if err := os.Remove(bs.blobPath(hash)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+func (bs *BlobStore) removeUpload(uploadID string) error {
+    if _, err := bs.db.Exec(`DELETE FROM uploads WHERE id = ?`, uploadID); err != nil {
+        return err
+    }
+    if err := os.Remove(bs.uploadPath(uploadID)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+func (bs *BlobStore) queryStrings(query string, args ...interface{}) ([]string, error) {
+    rows, err := bs.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var values []string
+    for rows.Next() {
+        var value string
+        if err := rows.Scan(&value); err != nil {
+            return nil, err
+        }
+        values = append(values, value)
+    }
+    
+    return values, rows.Err()
+}
+
+func hashFile(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    
+    hasher := sha256.New()
+    if _, err := io.Copy(hasher, file); err != nil {
+        return "", err
+    }
+    
+    return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "testing"
+    "time"
+    
+    "secure-messenger/shared"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+    t.Helper()
+    
+    db, err := NewDatabase(t.TempDir())
+    if err != nil {
+        t.Fatalf("NewDatabase: %v", err)
+    }
+    t.Cleanup(func() { db.Close() })
+    return db
+}
+
+// storeBlob uploads data as a blob of userID and returns its hash.
+func storeBlob(t *testing.T, bs *BlobStore, userID, data string) string {
+    t.Helper()
+    
+    sum := sha256.Sum256([]byte(data))
+    hash := hex.EncodeToString(sum[:])
+    status, err := bs.CreateUpload("upl_"+hash[:8], userID, hash, int64(len(data)))
+    if err != nil {
+        t.Fatalf("CreateUpload: %v", err)
+    }
+    if status.Received, err = bs.AppendChunk(status, 0, []byte(data)); err != nil {
+        t.Fatalf("AppendChunk: %v", err)
+    }
+    if err := bs.CompleteUpload(status, userID); err != nil {
+        t.Fatalf("CompleteUpload: %v", err)
+    }
+    return hash
+}
+
+func TestCollectGarbageKeepsScheduledAttachments(t *testing.T) {
+    db := newTestDatabase(t)
+    bs, err := NewBlobStore(db.GetDB(), db.DataDir())
+    if err != nil {
+        t.Fatalf("NewBlobStore: %v", err)
+    }
+    
+    scheduled := storeBlob(t, bs, "usr_1", "scheduled file")
+    orphan := storeBlob(t, bs, "usr_1", "orphan file")
+    removedOrphan := storeBlob(t, bs, "usr_1", "removed file")
+    
+    // An attachment without a preview, as every non-image file is
+    err = NewScheduleStore(db.GetDB()).CreateScheduled(&shared.ScheduledMessage{
+        ID:          "sch_1",
+        From:        "usr_1",
+        To:          "usr_2",
+        Content:     "later",
+        Attachments: []*shared.Attachment{{BlobHash: scheduled, Name: "report.pdf", Size: 14, Key: "key"}},
+        SendAt:      time.Now().Add(time.Hour),
+        Status:      shared.ScheduledStatusPending,
+        Created:     time.Now(),
+    })
+    if err != nil {
+        t.Fatalf("CreateScheduled: %v", err)
+    }
+    
+    removed, err := bs.RemoveUnreferenced([]string{scheduled, removedOrphan})
+    if err != nil || removed != 1 {
+        t.Fatalf("RemoveUnreferenced removed %d blobs, want 1: %v", removed, err)
+    }
+    
+    removed, err = bs.CollectGarbage(time.Now().Add(time.Minute))
+    if err != nil {
+        t.Fatalf("CollectGarbage: %v", err)
+    }
+    if removed != 1 {
+        t.Fatalf("CollectGarbage removed %d blobs, want 1", removed)
+    }
+    if exists, _ := bs.BlobExists(orphan); exists {
+        t.Fatal("orphan blob was kept")
+    }
+    if exists, _ := bs.BlobExists(scheduled); !exists {
+        t.Fatal("blob of a scheduled message was removed")
+    }
+}
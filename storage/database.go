@@ -9,7 +9,8 @@ import (
 )
 
 type Database struct {
-    db *sql.DB
+    db      *sql.DB
+    dataDir string
 }
 
 func NewDatabase(dataDir string) (*Database, error) {
@@ -30,7 +31,7 @@ func NewDatabase(dataDir string) (*Database, error) {
         return nil, err
     }
     
-    database := &Database{db: db}
+    database := &Database{db: db, dataDir: dataDir}
     
     // Create tables
     if err := database.createTables(); err != nil {
@@ -48,8 +49,16 @@ func (d *Database) createTables() error {
         username TEXT UNIQUE NOT NULL,
         email TEXT UNIQUE NOT NULL,
         password_hash TEXT NOT NULL,
-        password_salt TEXT NOT NULL,
+        password_salt TEXT NOT NULL DEFAULT '',
         public_key TEXT,
+        signing_key BLOB,
+        signing_key_signature BLOB,
+        previous_public_key TEXT,
+        key_rotation_signature BLOB,
+        key_backup BLOB,
+        totp_secret TEXT NOT NULL DEFAULT '',
+        totp_enabled BOOLEAN NOT NULL DEFAULT 0,
+        totp_last_step INTEGER NOT NULL DEFAULT 0,
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP
     );`
     
@@ -63,6 +72,11 @@ func (d *Database) createTables() error {
         content TEXT NOT NULL,
         encrypted BOOLEAN DEFAULT 0,
         timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+        type TEXT NOT NULL DEFAULT 'text',
+        reference_id TEXT NOT NULL DEFAULT '',
+        client_message_id TEXT NOT NULL DEFAULT '',
+        expires_at DATETIME,
+        signature TEXT NOT NULL DEFAULT '',
         FOREIGN KEY (from_user) REFERENCES users(id),
         FOREIGN KEY (to_user) REFERENCES users(id),
         FOREIGN KEY (channel_id) REFERENCES channels(id)
@@ -76,6 +90,7 @@ func (d *Database) createTables() error {
         description TEXT,
         created_by TEXT NOT NULL,
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        key_epoch INTEGER NOT NULL DEFAULT 0,
         FOREIGN KEY (created_by) REFERENCES users(id)
     );`
     
@@ -84,6 +99,7 @@ func (d *Database) createTables() error {
     CREATE TABLE IF NOT EXISTS channel_members (
         channel_id TEXT NOT NULL,
         user_id TEXT NOT NULL,
+        role TEXT NOT NULL DEFAULT 'member',
         joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
         PRIMARY KEY (channel_id, user_id),
         FOREIGN KEY (channel_id) REFERENCES channels(id),
@@ -100,7 +116,233 @@ func (d *Database) createTables() error {
         FOREIGN KEY (user_id) REFERENCES users(id)
     );`
     
-    tables := []string{usersTable, messagesTable, channelsTable, channelMembersTable, sessionsTable}
+    // Reactions table
+    reactionsTable := `
+    CREATE TABLE IF NOT EXISTS reactions (
+        message_id TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        emoji TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (message_id, user_id, emoji),
+        FOREIGN KEY (message_id) REFERENCES messages(id),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // Mentions table
+    mentionsTable := `
+    CREATE TABLE IF NOT EXISTS mentions (
+        message_id TEXT NOT NULL,
+        user_id TEXT NOT NULL,
+        channel_id TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (message_id, user_id),
+        FOREIGN KEY (message_id) REFERENCES messages(id),
+        FOREIGN KEY (user_id) REFERENCES users(id),
+        FOREIGN KEY (channel_id) REFERENCES channels(id)
+    );`
+    
+    // Pins table, keyed by channel ID or direct conversation key
+    pinsTable := `
+    CREATE TABLE IF NOT EXISTS pins (
+        conversation_id TEXT NOT NULL,
+        message_id TEXT NOT NULL,
+        pinned_by TEXT NOT NULL,
+        pinned_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (conversation_id, message_id),
+        FOREIGN KEY (message_id) REFERENCES messages(id),
+        FOREIGN KEY (pinned_by) REFERENCES users(id)
+    );`
+    
+    // Per-user update log used for incremental sync
+    updatesTable := `
+    CREATE TABLE IF NOT EXISTS updates (
+        user_id TEXT NOT NULL,
+        seq INTEGER NOT NULL,
+        type TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, seq),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // Latest update sequence per user, kept even after old updates are pruned
+    updateSequencesTable := `
+    CREATE TABLE IF NOT EXISTS update_sequences (
+        user_id TEXT PRIMARY KEY,
+        last_seq INTEGER NOT NULL DEFAULT 0,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // Messages waiting to be acknowledged by each recipient
+    pendingDeliveriesTable := `
+    CREATE TABLE IF NOT EXISTS pending_deliveries (
+        user_id TEXT NOT NULL,
+        message_id TEXT NOT NULL,
+        enqueued_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, message_id),
+        FOREIGN KEY (user_id) REFERENCES users(id),
+        FOREIGN KEY (message_id) REFERENCES messages(id)
+    );`
+    
+    // Files attached to messages, pointing at blobs by content hash
+    attachmentsTable := `
+    CREATE TABLE IF NOT EXISTS attachments (
+        id TEXT PRIMARY KEY,
+        message_id TEXT NOT NULL,
+        blob_hash TEXT NOT NULL,
+        name TEXT NOT NULL,
+        mime_type TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        file_key TEXT NOT NULL,
+        preview_hash TEXT NOT NULL DEFAULT '',
+        preview_size INTEGER NOT NULL DEFAULT 0,
+        FOREIGN KEY (message_id) REFERENCES messages(id)
+    );`
+    
+    // Encrypted blobs stored in the data directory, keyed by SHA-256
+    blobsTable := `
+    CREATE TABLE IF NOT EXISTS blobs (
+        hash TEXT PRIMARY KEY,
+        size INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+    
+    // Blobs counted against each user's storage quota
+    userBlobsTable := `
+    CREATE TABLE IF NOT EXISTS user_blobs (
+        user_id TEXT NOT NULL,
+        hash TEXT NOT NULL,
+        PRIMARY KEY (user_id, hash),
+        FOREIGN KEY (user_id) REFERENCES users(id),
+        FOREIGN KEY (hash) REFERENCES blobs(hash)
+    );`
+    
+    // Uploads in progress
+    uploadsTable := `
+    CREATE TABLE IF NOT EXISTS uploads (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        hash TEXT NOT NULL,
+        size INTEGER NOT NULL,
+        received INTEGER NOT NULL DEFAULT 0,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // Per-conversation settings, keyed by channel ID or direct conversation key
+    conversationSettingsTable := `
+    CREATE TABLE IF NOT EXISTS conversation_settings (
+        conversation_id TEXT PRIMARY KEY,
+        disappear_after INTEGER NOT NULL DEFAULT 0,
+        updated_by TEXT NOT NULL,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (updated_by) REFERENCES users(id)
+    );`
+    
+    // Server-wide retention limits per channel; an empty channel ID holds
+    // the default for channels without their own policy
+    retentionPoliciesTable := `
+    CREATE TABLE IF NOT EXISTS retention_policies (
+        channel_id TEXT PRIMARY KEY,
+        max_age INTEGER NOT NULL DEFAULT 0,
+        max_count INTEGER NOT NULL DEFAULT 0,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+    
+    // Messages held until their send time
+    scheduledMessagesTable := `
+    CREATE TABLE IF NOT EXISTS scheduled_messages (
+        id TEXT PRIMARY KEY,
+        from_user TEXT NOT NULL,
+        to_user TEXT NOT NULL DEFAULT '',
+        channel_id TEXT NOT NULL DEFAULT '',
+        content TEXT NOT NULL,
+        encrypted BOOLEAN NOT NULL DEFAULT 0,
+        mentions TEXT NOT NULL DEFAULT '[]',
+        attachments TEXT NOT NULL DEFAULT '[]',
+        key_epoch INTEGER NOT NULL DEFAULT 0,
+        client_message_id TEXT NOT NULL DEFAULT '',
+        signature TEXT NOT NULL DEFAULT '',
+        send_at DATETIME NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending',
+        error TEXT NOT NULL DEFAULT '',
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (from_user) REFERENCES users(id)
+    );`
+    
+    // Encrypted unsent messages, one per user and conversation
+    draftsTable := `
+    CREATE TABLE IF NOT EXISTS drafts (
+        user_id TEXT NOT NULL,
+        channel_id TEXT NOT NULL DEFAULT '',
+        other_user_id TEXT NOT NULL DEFAULT '',
+        content TEXT NOT NULL,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, channel_id, other_user_id),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // Prekeys tables, for starting forward secret sessions with a user
+    // while they are offline
+    prekeyBundlesTable := `
+    CREATE TABLE IF NOT EXISTS prekey_bundles (
+        user_id TEXT PRIMARY KEY,
+        identity_key BLOB NOT NULL,
+        signed_prekey_id INTEGER NOT NULL,
+        signed_prekey BLOB NOT NULL,
+        signature BLOB NOT NULL,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    oneTimePrekeysTable := `
+    CREATE TABLE IF NOT EXISTS one_time_prekeys (
+        user_id TEXT NOT NULL,
+        id TEXT NOT NULL,
+        public_key BLOB NOT NULL,
+        PRIMARY KEY (user_id, id),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // Sender keys of channel members, encrypted for each other member,
+    // the latest per sender and recipient
+    senderKeysTable := `
+    CREATE TABLE IF NOT EXISTS sender_keys (
+        id TEXT PRIMARY KEY,
+        channel_id TEXT NOT NULL,
+        from_user TEXT NOT NULL,
+        to_user TEXT NOT NULL,
+        key_epoch INTEGER NOT NULL,
+        content TEXT NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (channel_id, from_user, to_user),
+        FOREIGN KEY (channel_id) REFERENCES channels(id),
+        FOREIGN KEY (from_user) REFERENCES users(id),
+        FOREIGN KEY (to_user) REFERENCES users(id)
+    );`
+    
+    // Password reset tokens, stored hashed, each usable once
+    passwordResetsTable := `
+    CREATE TABLE IF NOT EXISTS password_resets (
+        token_hash TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        expires_at DATETIME NOT NULL,
+        used_at DATETIME,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    // One-time recovery codes for two-factor authentication, stored hashed
+    recoveryCodesTable := `
+    CREATE TABLE IF NOT EXISTS recovery_codes (
+        user_id TEXT NOT NULL,
+        code_hash TEXT NOT NULL,
+        used_at DATETIME,
+        PRIMARY KEY (user_id, code_hash),
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );`
+    
+    tables := []string{usersTable, messagesTable, channelsTable, channelMembersTable, sessionsTable, reactionsTable, mentionsTable, pinsTable, updatesTable, updateSequencesTable, pendingDeliveriesTable, attachmentsTable, blobsTable, userBlobsTable, uploadsTable, conversationSettingsTable, retentionPoliciesTable, scheduledMessagesTable, draftsTable, prekeyBundlesTable, oneTimePrekeysTable, senderKeysTable, passwordResetsTable, recoveryCodesTable}
     
     for _, table := range tables {
         if _, err := d.db.Exec(table); err != nil {
@@ -108,9 +350,122 @@ func (d *Database) createTables() error {
         }
     }
     
+    return d.migrate()
+}
+
+// migrate adds columns introduced after a table was first created, so
+// existing databases keep working without a manual upgrade.
+func (d *Database) migrate() error {
+    columns := []struct {
+        table      string
+        column     string
+        definition string
+    }{
+        {"messages", "type", "TEXT NOT NULL DEFAULT 'text'"},
+        {"messages", "reference_id", "TEXT NOT NULL DEFAULT ''"},
+        {"channel_members", "role", "TEXT NOT NULL DEFAULT 'member'"},
+        {"messages", "client_message_id", "TEXT NOT NULL DEFAULT ''"},
+        {"attachments", "preview_hash", "TEXT NOT NULL DEFAULT ''"},
+        {"attachments", "preview_size", "INTEGER NOT NULL DEFAULT 0"},
+        {"messages", "expires_at", "DATETIME"},
+        {"scheduled_messages", "encrypted", "BOOLEAN NOT NULL DEFAULT 0"},
+        {"channels", "key_epoch", "INTEGER NOT NULL DEFAULT 0"},
+        {"users", "signing_key", "BLOB"},
+        {"users", "signing_key_signature", "BLOB"},
+        {"users", "key_backup", "BLOB"},
+        {"users", "previous_public_key", "TEXT"},
+        {"users", "key_rotation_signature", "BLOB"},
+        {"messages", "signature", "TEXT NOT NULL DEFAULT ''"},
+        {"scheduled_messages", "client_message_id", "TEXT NOT NULL DEFAULT ''"},
+        {"scheduled_messages", "signature", "TEXT NOT NULL DEFAULT ''"},
+        {"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+        {"users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+        {"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+        {"scheduled_messages", "key_epoch", "INTEGER NOT NULL DEFAULT 0"},
+    }
+    
+    for _, c := range columns {
+        if err := d.addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+            return fmt.Errorf("failed to migrate %s.%s: %v", c.table, c.column, err)
+        }
+    }
+    
+    // Password hashes used to be PBKDF2-SHA256 with 100000 iterations, the
+    // salt in a column of its own and both in padded base64. They move into
+    // the self-describing form newer hashes use, and are upgraded to Argon2id
+    // when their users next log in.
+    upgradeHashes := `
+    UPDATE users
+    SET password_hash = '$pbkdf2-sha256$i=100000$' || rtrim(password_salt, '=') || '$' || rtrim(password_hash, '='),
+        password_salt = ''
+    WHERE password_hash NOT LIKE '$%'`
+    if _, err := d.db.Exec(upgradeHashes); err != nil {
+        return fmt.Errorf("failed to migrate password hashes: %v", err)
+    }
+    
+    // Members of channels created before there were roles all became plain
+    // members, which would leave nobody able to pin or set the timer. The
+    // creator, if still a member, becomes the owner of a channel without one.
+    backfillOwners := `
+    UPDATE channel_members SET role = 'owner'
+    WHERE user_id = (SELECT created_by FROM channels WHERE channels.id = channel_members.channel_id)
+    AND NOT EXISTS (SELECT 1 FROM channel_members owner WHERE owner.channel_id = channel_members.channel_id AND owner.role = 'owner')`
+    if _, err := d.db.Exec(backfillOwners); err != nil {
+        return fmt.Errorf("failed to migrate channel owners: %v", err)
+    }
+    
+    // Indexes may cover migrated columns, so they are created last
+    indexes := []string{
+        `CREATE INDEX IF NOT EXISTS idx_messages_client_id ON messages (from_user, client_message_id)`,
+        `CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments (message_id)`,
+        `CREATE INDEX IF NOT EXISTS idx_attachments_blob ON attachments (blob_hash)`,
+        `CREATE INDEX IF NOT EXISTS idx_attachments_preview ON attachments (preview_hash)`,
+        `CREATE INDEX IF NOT EXISTS idx_messages_channel ON messages (channel_id)`,
+        `CREATE INDEX IF NOT EXISTS idx_scheduled_send_at ON scheduled_messages (status, send_at)`,
+        `CREATE INDEX IF NOT EXISTS idx_scheduled_user ON scheduled_messages (from_user, send_at)`,
+        `CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages (expires_at) WHERE expires_at IS NOT NULL`,
+        `CREATE INDEX IF NOT EXISTS idx_sender_keys_recipient ON sender_keys (to_user, channel_id)`,
+        `CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets (user_id)`,
+        `CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions (user_id)`,
+        `CREATE INDEX IF NOT EXISTS idx_updates_message ON updates (json_extract(payload, '$.message.id'))`,
+        `CREATE INDEX IF NOT EXISTS idx_updates_message_id ON updates (json_extract(payload, '$.message_id'))`,
+    }
+    
+    for _, index := range indexes {
+        if _, err := d.db.Exec(index); err != nil {
+            return fmt.Errorf("failed to create index: %v", err)
+        }
+    }
+    
     return nil
 }
 
+func (d *Database) addColumnIfMissing(table, column, definition string) error {
+    rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    
+    for rows.Next() {
+        var cid, notNull, pk int
+        var name, columnType string
+        var defaultValue sql.NullString
+        if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+            return err
+        }
+        if name == column {
+            return nil
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    
+    _, err = d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    return err
+}
+
 func (d *Database) Close() error {
     return d.db.Close()
 }
@@ -118,3 +473,8 @@ func (d *Database) Close() error {
 func (d *Database) GetDB() *sql.DB {
     return d.db
 }
+
+// DataDir returns the directory holding the database and stored files.
+func (d *Database) DataDir() string {
+    return d.dataDir
+}
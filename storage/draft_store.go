@@ -0,0 +1,61 @@
+package storage
+
+import (
+    "database/sql"
+    "secure-messenger/shared"
+)
+
+// DraftStore keeps each user's unsent message per conversation. Drafts are
+// encrypted by the client, so they are stored as given.
+type DraftStore struct {
+    db *sql.DB
+}
+
+func NewDraftStore(db *sql.DB) *DraftStore {
+    return &DraftStore{db: db}
+}
+
+// SaveDraft stores the user's draft of a conversation, replacing the
+// previous one. A draft with empty content is deleted instead.
+func (ds *DraftStore) SaveDraft(userID string, draft *shared.Draft) error {
+    if draft.Content == "" {
+        _, err := ds.db.Exec(`DELETE FROM drafts WHERE user_id = ? AND channel_id = ? AND other_user_id = ?`,
+            userID, draft.ChannelID, draft.OtherUserID)
+        return err
+    }
+    
+    query := `
+    INSERT INTO drafts (user_id, channel_id, other_user_id, content, updated_at)
+    VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT (user_id, channel_id, other_user_id)
+    DO UPDATE SET content = excluded.content, updated_at = excluded.updated_at`
+    
+    _, err := ds.db.Exec(query, userID, draft.ChannelID, draft.OtherUserID, draft.Content, draft.UpdatedAt)
+    return err
+}
+
+// GetDrafts returns all of the user's drafts, most recently updated first.
+func (ds *DraftStore) GetDrafts(userID string) ([]*shared.Draft, error) {
+    query := `
+    SELECT channel_id, other_user_id, content, updated_at
+    FROM drafts
+    WHERE user_id = ?
+    ORDER BY updated_at DESC`
+    
+    rows, err := ds.db.Query(query, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var drafts []*shared.Draft
+    for rows.Next() {
+        var draft shared.Draft
+        if err := rows.Scan(&draft.ChannelID, &draft.OtherUserID, &draft.Content, &draft.UpdatedAt); err != nil {
+            return nil, err
+        }
+        drafts = append(drafts, &draft)
+    }
+    
+    return drafts, rows.Err()
+}
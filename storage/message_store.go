@@ -2,8 +2,11 @@ package storage
 
 import (
     "database/sql"
+    "encoding/json"
     "fmt"
     "secure-messenger/shared"
+    "strconv"
+    "strings"
     "time"
 )
 
@@ -15,69 +18,815 @@ func NewMessageStore(db *sql.DB) *MessageStore {
     return &MessageStore{db: db}
 }
 
+// messageColumns lists the columns scanned by scanMessage, in order.
+const messageColumns = "m.id, m.from_user, m.to_user, m.channel_id, m.content, m.encrypted, m.timestamp, m.type, m.reference_id, m.client_message_id, m.expires_at, m.signature"
+
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner) (*shared.Message, error) {
+    var msg shared.Message
+    var signature string
+    err := row.Scan(&msg.ID, &msg.From, &msg.To, &msg.ChannelID, &msg.Content, &msg.Encrypted, &msg.Timestamp, &msg.Type, &msg.ReferenceID, &msg.ClientMessageID, &msg.ExpiresAt, &signature)
+    if err != nil {
+        return nil, err
+    }
+    
+    if msg.Signature, err = decodeSignature(signature); err != nil {
+        return nil, fmt.Errorf("invalid signature of message %s: %v", msg.ID, err)
+    }
+    return &msg, nil
+}
+
+// encodeSignature stores a message signature as JSON, or as an empty string
+// for unsigned messages.
+func encodeSignature(signature *shared.MessageSignature) (string, error) {
+    if signature == nil {
+        return "", nil
+    }
+    data, err := json.Marshal(signature)
+    return string(data), err
+}
+
+func decodeSignature(data string) (*shared.MessageSignature, error) {
+    if data == "" {
+        return nil, nil
+    }
+    var signature shared.MessageSignature
+    if err := json.Unmarshal([]byte(data), &signature); err != nil {
+        return nil, err
+    }
+    return &signature, nil
+}
+
+// queryMessages runs a query selecting messageColumns and attaches reactions
+// to the results.
+func (ms *MessageStore) queryMessages(query string, args ...interface{}) ([]*shared.Message, error) {
+    rows, err := ms.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var messages []*shared.Message
+    for rows.Next() {
+        msg, err := scanMessage(rows)
+        if err != nil {
+            return nil, err
+        }
+        messages = append(messages, msg)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    if err := ms.attachReactions(messages); err != nil {
+        return nil, err
+    }
+    
+    if err := ms.attachAttachments(messages); err != nil {
+        return nil, err
+    }
+    
+    return messages, nil
+}
+
+// queryPage selects the messages matching filter within the page of the
+// user's history. Messages are ordered by rowid, which follows insertion
+// order and never ties, so cursors stay stable even when timestamps collide.
+func (ms *MessageStore) queryPage(userID, filter string, args []interface{}, page shared.Page) (*shared.MessagePage, error) {
+    query := `
+    SELECT ` + messageColumns + `
+    FROM messages m
+    WHERE (` + filter + `)`
+    
+    if page.Before != "" {
+        before, err := ms.pagePosition(userID, page.Before)
+        if err != nil {
+            return nil, err
+        }
+        query += ` AND m.rowid < ?`
+        args = append(args, before)
+    }
+    
+    // Paging forward walks up from the cursor, otherwise down from the newest
+    ascending := false
+    if page.After != "" {
+        after, err := ms.pagePosition(userID, page.After)
+        if err != nil {
+            return nil, err
+        }
+        query += ` AND m.rowid > ?`
+        args = append(args, after)
+        ascending = page.Before == ""
+    }
+    
+    if ascending {
+        query += ` ORDER BY m.rowid ASC LIMIT ?`
+    } else {
+        query += ` ORDER BY m.rowid DESC LIMIT ?`
+    }
+    
+    // Fetch one extra row to learn whether another page exists
+    args = append(args, page.Limit+1)
+    
+    messages, err := ms.queryMessages(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    
+    hasMore := len(messages) > page.Limit
+    if hasMore {
+        messages = messages[:page.Limit]
+    }
+    
+    if ascending {
+        for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+            messages[i], messages[j] = messages[j], messages[i]
+        }
+    }
+    
+    return &shared.MessagePage{Messages: messages, HasMore: hasMore}, nil
+}
+
+// pagePosition resolves a history cursor, either a message ID or one of the
+// user's sync sequence numbers. A sequence stands for the newest message the
+// user had been sent by then, so a client can page on from where it last
+// synced.
+func (ms *MessageStore) pagePosition(userID, cursor string) (int64, error) {
+    seq, err := strconv.ParseInt(cursor, 10, 64)
+    if err != nil {
+        return ms.cursorPosition(cursor)
+    }
+    
+    var position int64
+    query := `
+    SELECT m.rowid FROM updates u
+    JOIN messages m ON m.id = json_extract(u.payload, '$.message.id')
+    WHERE u.user_id = ? AND u.type = ? AND u.seq <= ?
+    ORDER BY u.seq DESC LIMIT 1`
+    err = ms.db.QueryRow(query, userID, shared.UpdateMessageNew, seq).Scan(&position)
+    if err == nil {
+        return position, nil
+    }
+    if err != sql.ErrNoRows {
+        return 0, err
+    }
+    
+    // No message came before the sequence, unless the log no longer reaches
+    // back that far
+    var oldest sql.NullInt64
+    if err := ms.db.QueryRow(`SELECT MIN(seq) FROM updates WHERE user_id = ?`, userID).Scan(&oldest); err != nil {
+        return 0, err
+    }
+    if seq < 0 || (oldest.Valid && seq < oldest.Int64-1) {
+        return 0, fmt.Errorf("invalid cursor")
+    }
+    return 0, nil
+}
+
+func (ms *MessageStore) cursorPosition(messageID string) (int64, error) {
+    var position int64
+    
+    row := ms.db.QueryRow(`SELECT rowid FROM messages WHERE id = ?`, messageID)
+    if err := row.Scan(&position); err != nil {
+        if err == sql.ErrNoRows {
+            return 0, fmt.Errorf("invalid cursor")
+        }
+        return 0, err
+    }
+    
+    return position, nil
+}
+
 func (ms *MessageStore) CreateMessage(message *shared.Message) error {
+    if message.Type == "" {
+        message.Type = shared.MessageTypeText
+    }
+    
+    signature, err := encodeSignature(message.Signature)
+    if err != nil {
+        return err
+    }
+    
+    tx, err := ms.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
     query := `
-    INSERT INTO messages (id, from_user, to_user, channel_id, content, encrypted, timestamp)
-    VALUES (?, ?, ?, ?, ?, ?, ?)`
+    INSERT INTO messages (id, from_user, to_user, channel_id, content, encrypted, timestamp, type, reference_id, client_message_id, expires_at, signature)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
     
-    _, err := ms.db.Exec(query, message.ID, message.From, message.To, message.ChannelID, message.Content, message.Encrypted, message.Timestamp)
-    return err
+    _, err = tx.Exec(query, message.ID, message.From, message.To, message.ChannelID, message.Content, message.Encrypted, message.Timestamp, message.Type, message.ReferenceID, message.ClientMessageID, message.ExpiresAt, signature)
+    if err != nil {
+        return err
+    }
+    
+    attachmentQuery := `
+    INSERT INTO attachments (id, message_id, blob_hash, name, mime_type, size, file_key, preview_hash, preview_size)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+    
+    for _, attachment := range message.Attachments {
+        _, err := tx.Exec(attachmentQuery, attachment.ID, message.ID, attachment.BlobHash, attachment.Name, attachment.MimeType, attachment.Size, attachment.Key, attachment.PreviewHash, attachment.PreviewSize)
+        if err != nil {
+            return err
+        }
+    }
+    
+    return tx.Commit()
 }
 
-func (ms *MessageStore) GetMessagesBetweenUsers(user1ID, user2ID string, limit int) ([]*shared.Message, error) {
+// FindMessageByClientID returns the latest message the user sent with the
+// given client message ID since the given time, or nil if there is none.
+func (ms *MessageStore) FindMessageByClientID(fromUserID, clientMessageID string, since time.Time) (*shared.Message, error) {
     query := `
-    SELECT id, from_user, to_user, content, encrypted, timestamp
-    FROM messages
-    WHERE (from_user = ? AND to_user = ?) OR (from_user = ? AND to_user = ?)
-    ORDER BY timestamp DESC
-    LIMIT ?`
+    SELECT ` + messageColumns + `
+    FROM messages m
+    WHERE m.from_user = ? AND m.client_message_id = ? AND m.timestamp > ?
+    ORDER BY m.rowid DESC
+    LIMIT 1`
     
-    rows, err := ms.db.Query(query, user1ID, user2ID, user2ID, user1ID, limit)
+    msg, err := scanMessage(ms.db.QueryRow(query, fromUserID, clientMessageID, since))
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        return nil, err
+    }
+    
+    return msg, nil
+}
+
+func (ms *MessageStore) GetMessagesBetweenUsers(user1ID, user2ID string, page shared.Page) (*shared.MessagePage, error) {
+    filter := `(m.from_user = ? AND m.to_user = ?) OR (m.from_user = ? AND m.to_user = ?)`
+    return ms.queryPage(user1ID, filter, []interface{}{user1ID, user2ID, user2ID, user1ID}, page)
+}
+
+// GetContacts returns the users who have exchanged direct messages with the
+// user or share a channel with them.
+func (ms *MessageStore) GetContacts(userID string) ([]string, error) {
+    query := `
+    SELECT to_user FROM messages WHERE from_user = ? AND to_user != '' AND to_user != from_user
+    UNION
+    SELECT from_user FROM messages WHERE to_user = ? AND from_user != to_user
+    UNION
+    SELECT other.user_id FROM channel_members mine
+    JOIN channel_members other ON other.channel_id = mine.channel_id
+    WHERE mine.user_id = ? AND other.user_id != mine.user_id`
+    
+    rows, err := ms.db.Query(query, userID, userID, userID)
     if err != nil {
         return nil, err
     }
     defer rows.Close()
     
-    var messages []*shared.Message
+    var contacts []string
     for rows.Next() {
-        var msg shared.Message
-        err := rows.Scan(&msg.ID, &msg.From, &msg.To, &msg.Content, &msg.Encrypted, &msg.Timestamp)
-        if err != nil {
+        var contactID string
+        if err := rows.Scan(&contactID); err != nil {
             return nil, err
         }
-        messages = append(messages, &msg)
+        contacts = append(contacts, contactID)
     }
     
-    return messages, nil
+    return contacts, rows.Err()
 }
 
-func (ms *MessageStore) GetChannelMessages(channelID string, limit int) ([]*shared.Message, error) {
+// GetChannelMessages returns a page of a channel's messages, as read by the
+// user, whose sync sequence numbers the cursors may be.
+func (ms *MessageStore) GetChannelMessages(userID, channelID string, page shared.Page) (*shared.MessagePage, error) {
+    filter := `m.channel_id = ?`
+    return ms.queryPage(userID, filter, []interface{}{channelID}, page)
+}
+
+func (ms *MessageStore) GetMessage(messageID string) (*shared.Message, error) {
     query := `
-    SELECT id, from_user, to_user, content, encrypted, timestamp
-    FROM messages
-    WHERE channel_id = ?
-    ORDER BY timestamp DESC
-    LIMIT ?`
+    SELECT ` + messageColumns + `
+    FROM messages m WHERE m.id = ?`
+    
+    msg, err := scanMessage(ms.db.QueryRow(query, messageID))
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("message not found")
+        }
+        return nil, err
+    }
+    
+    if err := ms.attachAttachments([]*shared.Message{msg}); err != nil {
+        return nil, err
+    }
+    
+    return msg, nil
+}
+
+func (ms *MessageStore) AddReaction(messageID, userID, emoji string) error {
+    query := `
+    INSERT OR IGNORE INTO reactions (message_id, user_id, emoji, created_at)
+    VALUES (?, ?, ?, ?)`
+    
+    _, err := ms.db.Exec(query, messageID, userID, emoji, time.Now())
+    return err
+}
+
+func (ms *MessageStore) RemoveReaction(messageID, userID, emoji string) error {
+    query := `DELETE FROM reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`
+    _, err := ms.db.Exec(query, messageID, userID, emoji)
+    return err
+}
+
+func (ms *MessageStore) GetReactions(messageID string) ([]*shared.Reaction, error) {
+    reactions, err := ms.getReactions([]string{messageID})
+    if err != nil {
+        return nil, err
+    }
+    
+    return reactions[messageID], nil
+}
+
+// getReactions aggregates reactions per message and emoji, keeping emojis in
+// the order they were first used on each message.
+func (ms *MessageStore) getReactions(messageIDs []string) (map[string][]*shared.Reaction, error) {
+    result := make(map[string][]*shared.Reaction)
+    if len(messageIDs) == 0 {
+        return result, nil
+    }
+    
+    placeholders := make([]string, len(messageIDs))
+    args := make([]interface{}, len(messageIDs))
+    for i, id := range messageIDs {
+        placeholders[i] = "?"
+        args[i] = id
+    }
     
-    rows, err := ms.db.Query(query, channelID, limit)
+    query := `
+    SELECT message_id, emoji, user_id
+    FROM reactions
+    WHERE message_id IN (` + strings.Join(placeholders, ", ") + `)
+    ORDER BY created_at ASC`
+    
+    rows, err := ms.db.Query(query, args...)
     if err != nil {
         return nil, err
     }
     defer rows.Close()
     
-    var messages []*shared.Message
+    index := make(map[string]*shared.Reaction)
     for rows.Next() {
-        var msg shared.Message
-        err := rows.Scan(&msg.ID, &msg.From, &msg.To, &msg.Content, &msg.Encrypted, &msg.Timestamp)
+        var messageID, emoji, userID string
+        if err := rows.Scan(&messageID, &emoji, &userID); err != nil {
+            return nil, err
+        }
+        
+        key := messageID + "\x00" + emoji
+        reaction, ok := index[key]
+        if !ok {
+            reaction = &shared.Reaction{Emoji: emoji}
+            index[key] = reaction
+            result[messageID] = append(result[messageID], reaction)
+        }
+        reaction.Count++
+        reaction.Users = append(reaction.Users, userID)
+    }
+    
+    return result, rows.Err()
+}
+
+func (ms *MessageStore) attachReactions(messages []*shared.Message) error {
+    ids := make([]string, len(messages))
+    for i, msg := range messages {
+        ids[i] = msg.ID
+    }
+    
+    reactions, err := ms.getReactions(ids)
+    if err != nil {
+        return err
+    }
+    
+    for _, msg := range messages {
+        msg.Reactions = reactions[msg.ID]
+    }
+    
+    return nil
+}
+
+// attachmentColumns lists the columns scanned by scanAttachment, in order.
+const attachmentColumns = "id, blob_hash, name, mime_type, size, file_key, preview_hash, preview_size"
+
+// scanAttachment scans the message ID followed by attachmentColumns.
+func scanAttachment(row rowScanner, messageID *string) (*shared.Attachment, error) {
+    var a shared.Attachment
+    err := row.Scan(messageID, &a.ID, &a.BlobHash, &a.Name, &a.MimeType, &a.Size, &a.Key, &a.PreviewHash, &a.PreviewSize)
+    if err != nil {
+        return nil, err
+    }
+    return &a, nil
+}
+
+func (ms *MessageStore) attachAttachments(messages []*shared.Message) error {
+    if len(messages) == 0 {
+        return nil
+    }
+    
+    placeholders := make([]string, len(messages))
+    args := make([]interface{}, len(messages))
+    index := make(map[string]*shared.Message)
+    for i, msg := range messages {
+        placeholders[i] = "?"
+        args[i] = msg.ID
+        index[msg.ID] = msg
+    }
+    
+    query := `
+    SELECT message_id, ` + attachmentColumns + `
+    FROM attachments
+    WHERE message_id IN (` + strings.Join(placeholders, ", ") + `)
+    ORDER BY rowid ASC`
+    
+    rows, err := ms.db.Query(query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    
+    for rows.Next() {
+        var messageID string
+        attachment, err := scanAttachment(rows, &messageID)
         if err != nil {
+            return err
+        }
+        
+        if msg, ok := index[messageID]; ok {
+            msg.Attachments = append(msg.Attachments, attachment)
+        }
+    }
+    
+    return rows.Err()
+}
+
+// GetAttachment returns an attachment and the ID of the message carrying it.
+func (ms *MessageStore) GetAttachment(attachmentID string) (*shared.Attachment, string, error) {
+    query := `
+    SELECT message_id, ` + attachmentColumns + `
+    FROM attachments WHERE id = ?`
+    
+    var messageID string
+    attachment, err := scanAttachment(ms.db.QueryRow(query, attachmentID), &messageID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, "", fmt.Errorf("attachment not found")
+        }
+        return nil, "", err
+    }
+    
+    return attachment, messageID, nil
+}
+
+// PinMessage pins a message in a conversation and reports whether it was
+// newly pinned.
+func (ms *MessageStore) PinMessage(conversationID, messageID, pinnedBy string) (bool, error) {
+    query := `
+    INSERT OR IGNORE INTO pins (conversation_id, message_id, pinned_by, pinned_at)
+    VALUES (?, ?, ?, ?)`
+    
+    result, err := ms.db.Exec(query, conversationID, messageID, pinnedBy, time.Now())
+    if err != nil {
+        return false, err
+    }
+    
+    affected, err := result.RowsAffected()
+    return affected > 0, err
+}
+
+// UnpinMessage removes a pin and reports whether the message was pinned.
+func (ms *MessageStore) UnpinMessage(conversationID, messageID string) (bool, error) {
+    query := `DELETE FROM pins WHERE conversation_id = ? AND message_id = ?`
+    
+    result, err := ms.db.Exec(query, conversationID, messageID)
+    if err != nil {
+        return false, err
+    }
+    
+    affected, err := result.RowsAffected()
+    return affected > 0, err
+}
+
+func (ms *MessageStore) GetPinnedMessages(conversationID string) ([]*shared.Message, error) {
+    query := `
+    SELECT ` + messageColumns + `
+    FROM messages m
+    JOIN pins p ON m.id = p.message_id
+    WHERE p.conversation_id = ?
+    ORDER BY p.pinned_at DESC`
+    
+    return ms.queryMessages(query, conversationID)
+}
+
+func (ms *MessageStore) CreateMentions(messageID, channelID string, userIDs []string) error {
+    tx, err := ms.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    query := `
+    INSERT OR IGNORE INTO mentions (message_id, user_id, channel_id, created_at)
+    VALUES (?, ?, ?, ?)`
+    
+    now := time.Now()
+    for _, userID := range userIDs {
+        if _, err := tx.Exec(query, messageID, userID, channelID, now); err != nil {
+            return err
+        }
+    }
+    
+    return tx.Commit()
+}
+
+// GetMentions returns a page of the messages mentioning the user in
+// channels they are still a member of.
+func (ms *MessageStore) GetMentions(userID string, page shared.Page) (*shared.MessagePage, error) {
+    filter := `m.id IN (
+        SELECT message_id FROM mentions WHERE user_id = ?
+    ) AND m.channel_id IN (
+        SELECT channel_id FROM channel_members WHERE user_id = ?
+    )`
+    return ms.queryPage(userID, filter, []interface{}{userID, userID}, page)
+}
+
+// EnqueueDelivery queues a message for each recipient until they
+// acknowledge having received it.
+func (ms *MessageStore) EnqueueDelivery(messageID string, userIDs []string) error {
+    tx, err := ms.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    query := `
+    INSERT OR IGNORE INTO pending_deliveries (user_id, message_id, enqueued_at)
+    VALUES (?, ?, ?)`
+    
+    now := time.Now()
+    for _, userID := range userIDs {
+        if _, err := tx.Exec(query, userID, messageID, now); err != nil {
+            return err
+        }
+    }
+    
+    return tx.Commit()
+}
+
+// GetPendingDeliveries returns up to limit unacknowledged messages for the
+// user, oldest first, starting after the message ID after when it is set.
+func (ms *MessageStore) GetPendingDeliveries(userID, after string, limit int) ([]*shared.Message, error) {
+    var position int64
+    if after != "" {
+        var err error
+        if position, err = ms.cursorPosition(after); err != nil {
             return nil, err
         }
-        messages = append(messages, &msg)
+    }
+    
+    query := `
+    SELECT ` + messageColumns + `
+    FROM messages m
+    JOIN pending_deliveries pd ON m.id = pd.message_id
+    WHERE pd.user_id = ? AND m.rowid > ?
+    ORDER BY m.rowid ASC
+    LIMIT ?`
+    
+    return ms.queryMessages(query, userID, position, limit)
+}
+
+// AcknowledgeDeliveries removes delivered messages from the user's queue and
+// returns how many were removed.
+func (ms *MessageStore) AcknowledgeDeliveries(userID string, messageIDs []string) (int64, error) {
+    tx, err := ms.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    
+    query := `DELETE FROM pending_deliveries WHERE user_id = ? AND message_id = ?`
+    
+    var removed int64
+    for _, messageID := range messageIDs {
+        result, err := tx.Exec(query, userID, messageID)
+        if err != nil {
+            return 0, err
+        }
+        n, err := result.RowsAffected()
+        if err != nil {
+            return 0, err
+        }
+        removed += n
+    }
+    
+    return removed, tx.Commit()
+}
+
+// SetDisappearingTimer stores how long messages of a conversation are kept,
+// with zero meaning forever.
+func (ms *MessageStore) SetDisappearingTimer(conversationID string, timer time.Duration, updatedBy string) error {
+    query := `
+    INSERT INTO conversation_settings (conversation_id, disappear_after, updated_by, updated_at)
+    VALUES (?, ?, ?, ?)
+    ON CONFLICT (conversation_id) DO UPDATE SET
+        disappear_after = excluded.disappear_after,
+        updated_by = excluded.updated_by,
+        updated_at = excluded.updated_at`
+    
+    _, err := ms.db.Exec(query, conversationID, int64(timer/time.Second), updatedBy, time.Now())
+    return err
+}
+
+// GetDisappearingTimer returns the disappearing timer of a conversation, or
+// zero when it has none.
+func (ms *MessageStore) GetDisappearingTimer(conversationID string) (time.Duration, error) {
+    var seconds int64
+    err := ms.db.QueryRow(`SELECT disappear_after FROM conversation_settings WHERE conversation_id = ?`, conversationID).Scan(&seconds)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return 0, nil
+        }
+        return 0, err
+    }
+    return time.Duration(seconds) * time.Second, nil
+}
+
+// DeleteExpiredMessages permanently deletes up to limit messages that
+// expired before the given time, along with their reactions, mentions, pins,
+// queued deliveries and attachment records, and returns them. Blobs are left
+// to the caller since other attachments may share them.
+func (ms *MessageStore) DeleteExpiredMessages(before time.Time, limit int) ([]*shared.Message, error) {
+    query := `
+    SELECT ` + messageColumns + `
+    FROM messages m
+    WHERE m.expires_at IS NOT NULL AND m.expires_at <= ?
+    ORDER BY m.expires_at ASC
+    LIMIT ?`
+    
+    messages, err := ms.queryMessages(query, before, limit)
+    if err != nil || len(messages) == 0 {
+        return nil, err
+    }
+    
+    if err := ms.DeleteMessages(messages); err != nil {
+        return nil, err
     }
     
     return messages, nil
 }
 
+// GetPurgeableChannelMessages returns up to limit of the oldest channel
+// messages that are older than before or not among the newest maxCount.
+// A zero before or maxCount disables that limit.
+func (ms *MessageStore) GetPurgeableChannelMessages(channelID string, before time.Time, maxCount, limit int) ([]*shared.Message, error) {
+    filter, args, err := ms.purgeableFilter(channelID, before, maxCount)
+    if err != nil || filter == "" {
+        return nil, err
+    }
+    
+    query := `
+    SELECT ` + messageColumns + `
+    FROM messages m
+    WHERE m.channel_id = ? AND (` + filter + `)
+    ORDER BY m.rowid ASC
+    LIMIT ?`
+    
+    return ms.queryMessages(query, append(append([]interface{}{channelID}, args...), limit)...)
+}
+
+// CountPurgeableChannelMessages counts the messages GetPurgeableChannelMessages
+// would return without a limit, and returns the timestamp of the oldest.
+func (ms *MessageStore) CountPurgeableChannelMessages(channelID string, before time.Time, maxCount int) (int, *time.Time, error) {
+    filter, args, err := ms.purgeableFilter(channelID, before, maxCount)
+    if err != nil || filter == "" {
+        return 0, nil, err
+    }
+    
+    args = append([]interface{}{channelID}, args...)
+    
+    countQuery := `SELECT COUNT(*) FROM messages m WHERE m.channel_id = ? AND (` + filter + `)`
+    
+    var count int
+    if err := ms.db.QueryRow(countQuery, args...).Scan(&count); err != nil {
+        return 0, nil, err
+    }
+    if count == 0 {
+        return 0, nil, nil
+    }
+    
+    oldestQuery := `
+    SELECT m.timestamp FROM messages m
+    WHERE m.channel_id = ? AND (` + filter + `)
+    ORDER BY m.rowid ASC LIMIT 1`
+    
+    var oldest time.Time
+    if err := ms.db.QueryRow(oldestQuery, args...).Scan(&oldest); err != nil {
+        return 0, nil, err
+    }
+    return count, &oldest, nil
+}
+
+// CountPurgeableChannelUpdates counts the sync log entries that would be
+// redacted along with the messages GetPurgeableChannelMessages would return
+// without a limit.
+func (ms *MessageStore) CountPurgeableChannelUpdates(channelID string, before time.Time, maxCount int) (int, error) {
+    filter, args, err := ms.purgeableFilter(channelID, before, maxCount)
+    if err != nil || filter == "" {
+        return 0, err
+    }
+    
+    purgeable := `SELECT m.id FROM messages m WHERE m.channel_id = ? AND (` + filter + `)`
+    
+    query := `
+    SELECT COUNT(*) FROM updates
+    WHERE type != ? AND (json_extract(payload, '$.message.id') IN (` + purgeable + `)
+        OR json_extract(payload, '$.message_id') IN (` + purgeable + `))`
+    
+    queryArgs := []interface{}{shared.UpdateRedacted, channelID}
+    queryArgs = append(queryArgs, args...)
+    queryArgs = append(queryArgs, channelID)
+    queryArgs = append(queryArgs, args...)
+    
+    var count int
+    err = ms.db.QueryRow(query, queryArgs...).Scan(&count)
+    return count, err
+}
+
+// purgeableFilter builds the condition selecting messages of a channel that
+// exceed its retention limits, or an empty filter when there are none.
+func (ms *MessageStore) purgeableFilter(channelID string, before time.Time, maxCount int) (string, []interface{}, error) {
+    var conditions []string
+    var args []interface{}
+    
+    if !before.IsZero() {
+        conditions = append(conditions, "m.timestamp < ?")
+        args = append(args, before)
+    }
+    
+    if maxCount > 0 {
+        // Everything up to the first message past the newest maxCount
+        query := `SELECT rowid FROM messages WHERE channel_id = ? ORDER BY rowid DESC LIMIT 1 OFFSET ?`
+        
+        var threshold int64
+        err := ms.db.QueryRow(query, channelID, maxCount).Scan(&threshold)
+        if err != nil && err != sql.ErrNoRows {
+            return "", nil, err
+        }
+        if err == nil {
+            conditions = append(conditions, "m.rowid <= ?")
+            args = append(args, threshold)
+        }
+    }
+    
+    return strings.Join(conditions, " OR "), args, nil
+}
+
+// DeleteMessages permanently deletes messages along with their reactions,
+// mentions, pins, queued deliveries and attachment records, in a single
+// transaction. Sync log entries about the messages are redacted rather than
+// removed, so clients do not see a sequence gap and resync. Blobs are left
+// to the caller since other attachments may share them.
+func (ms *MessageStore) DeleteMessages(messages []*shared.Message) error {
+    tx, err := ms.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    deletes := []string{
+        `DELETE FROM reactions WHERE message_id = ?`,
+        `DELETE FROM mentions WHERE message_id = ?`,
+        `DELETE FROM pins WHERE message_id = ?`,
+        `DELETE FROM pending_deliveries WHERE message_id = ?`,
+        `DELETE FROM attachments WHERE message_id = ?`,
+        `DELETE FROM messages WHERE id = ?`,
+    }
+    
+    redact := `
+    UPDATE updates SET type = ?, payload = '{}'
+    WHERE json_extract(payload, '$.message.id') = ? OR json_extract(payload, '$.message_id') = ?`
+    
+    for _, message := range messages {
+        for _, query := range deletes {
+            if _, err := tx.Exec(query, message.ID); err != nil {
+                return err
+            }
+        }
+        
+        if _, err := tx.Exec(redact, shared.UpdateRedacted, message.ID, message.ID); err != nil {
+            return err
+        }
+    }
+    
+    return tx.Commit()
+}
+
 func (ms *MessageStore) CreateChannel(channel *shared.Channel) error {
     // Start transaction
     tx, err := ms.db.Begin()
@@ -96,13 +845,18 @@ func (ms *MessageStore) CreateChannel(channel *shared.Channel) error {
         return err
     }
     
-    // Add members
+    // Add members, the creator owns the channel
     for _, memberID := range channel.Members {
         memberQuery := `
-        INSERT INTO channel_members (channel_id, user_id, joined_at)
-        VALUES (?, ?, ?)`
+        INSERT INTO channel_members (channel_id, user_id, role, joined_at)
+        VALUES (?, ?, ?, ?)`
         
-        _, err = tx.Exec(memberQuery, channel.ID, memberID, time.Now())
+        role := shared.ChannelRoleMember
+        if memberID == channel.CreatedBy {
+            role = shared.ChannelRoleOwner
+        }
+        
+        _, err = tx.Exec(memberQuery, channel.ID, memberID, role, time.Now())
         if err != nil {
             return err
         }
@@ -115,11 +869,11 @@ func (ms *MessageStore) GetChannel(channelID string) (*shared.Channel, error) {
     var channel shared.Channel
     
     query := `
-    SELECT id, name, description, created_by, created_at
+    SELECT id, name, description, created_by, created_at, key_epoch
     FROM channels WHERE id = ?`
     
     row := ms.db.QueryRow(query, channelID)
-    err := row.Scan(&channel.ID, &channel.Name, &channel.Description, &channel.CreatedBy, &channel.Created)
+    err := row.Scan(&channel.ID, &channel.Name, &channel.Description, &channel.CreatedBy, &channel.Created, &channel.KeyEpoch)
     
     if err != nil {
         if err == sql.ErrNoRows {
@@ -154,7 +908,7 @@ func (ms *MessageStore) GetChannel(channelID string) (*shared.Channel, error) {
 
 func (ms *MessageStore) GetUserChannels(userID string) ([]*shared.Channel, error) {
     query := `
-    SELECT c.id, c.name, c.description, c.created_by, c.created_at
+    SELECT c.id, c.name, c.description, c.created_by, c.created_at, c.key_epoch
     FROM channels c
     JOIN channel_members cm ON c.id = cm.channel_id
     WHERE cm.user_id = ?
@@ -169,7 +923,7 @@ func (ms *MessageStore) GetUserChannels(userID string) ([]*shared.Channel, error
     var channels []*shared.Channel
     for rows.Next() {
         var channel shared.Channel
-        err := rows.Scan(&channel.ID, &channel.Name, &channel.Description, &channel.CreatedBy, &channel.Created)
+        err := rows.Scan(&channel.ID, &channel.Name, &channel.Description, &channel.CreatedBy, &channel.Created, &channel.KeyEpoch)
         if err != nil {
             return nil, err
         }
@@ -202,46 +956,91 @@ func (ms *MessageStore) GetUserChannels(userID string) ([]*shared.Channel, error
     return channels, nil
 }
 
+// AddUserToChannel adds a member and moves the channel to a new key epoch,
+// so members rotate their sender keys before the newcomer can read them.
 func (ms *MessageStore) AddUserToChannel(channelID, userID string) error {
+    tx, err := ms.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
     query := `
     INSERT INTO channel_members (channel_id, user_id, joined_at)
     VALUES (?, ?, ?)`
     
-    _, err := ms.db.Exec(query, channelID, userID, time.Now())
-    return err
+    if _, err := tx.Exec(query, channelID, userID, time.Now()); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`UPDATE channels SET key_epoch = key_epoch + 1 WHERE id = ?`, channelID); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
 }
 
-func (ms *MessageStore) RemoveUserFromChannel(channelID, userID string) error {
-    query := `DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?`
-    _, err := ms.db.Exec(query, channelID, userID)
-    return err
+func (ms *MessageStore) GetChannelRole(channelID, userID string) (string, error) {
+    var role string
+    
+    query := `SELECT role FROM channel_members WHERE channel_id = ? AND user_id = ?`
+    row := ms.db.QueryRow(query, channelID, userID)
+    err := row.Scan(&role)
+    
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", fmt.Errorf("user is not a member of this channel")
+        }
+        return "", err
+    }
+    
+    return role, nil
 }
 
-func (ms *MessageStore) GetRecentMessages(userID string, limit int) ([]*shared.Message, error) {
-    query := `
-    SELECT m.id, m.from_user, m.to_user, m.channel_id, m.content, m.encrypted, m.timestamp
-    FROM messages m
-    WHERE m.from_user = ? OR m.to_user = ? OR m.channel_id IN (
-        SELECT channel_id FROM channel_members WHERE user_id = ?
-    )
-    ORDER BY m.timestamp DESC
-    LIMIT ?`
+// SetChannelRole changes the role of a channel member.
+func (ms *MessageStore) SetChannelRole(channelID, userID, role string) error {
+    query := `UPDATE channel_members SET role = ? WHERE channel_id = ? AND user_id = ?`
+    result, err := ms.db.Exec(query, role, channelID, userID)
+    if err != nil {
+        return err
+    }
     
-    rows, err := ms.db.Query(query, userID, userID, userID, limit)
+    if n, err := result.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return fmt.Errorf("user is not a member of this channel")
+    }
+    return nil
+}
+
+// RemoveUserFromChannel removes a member along with the sender keys they
+// sent or were sent, and moves the channel to a new key epoch so the
+// remaining members stop using keys the former member holds.
+func (ms *MessageStore) RemoveUserFromChannel(channelID, userID string) error {
+    tx, err := ms.db.Begin()
     if err != nil {
-        return nil, err
+        return err
     }
-    defer rows.Close()
+    defer tx.Rollback()
     
-    var messages []*shared.Message
-    for rows.Next() {
-        var msg shared.Message
-        err := rows.Scan(&msg.ID, &msg.From, &msg.To, &msg.ChannelID, &msg.Content, &msg.Encrypted, &msg.Timestamp)
-        if err != nil {
-            return nil, err
-        }
-        messages = append(messages, &msg)
+    query := `DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?`
+    if _, err := tx.Exec(query, channelID, userID); err != nil {
+        return err
     }
     
-    return messages, nil
+    query = `DELETE FROM sender_keys WHERE channel_id = ? AND (from_user = ? OR to_user = ?)`
+    if _, err := tx.Exec(query, channelID, userID, userID); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`UPDATE channels SET key_epoch = key_epoch + 1 WHERE id = ?`, channelID); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
+}
+
+func (ms *MessageStore) GetRecentMessages(userID string, page shared.Page) (*shared.MessagePage, error) {
+    filter := `m.from_user = ? OR m.to_user = ? OR m.channel_id IN (
+        SELECT channel_id FROM channel_members WHERE user_id = ?
+    )`
+    return ms.queryPage(userID, filter, []interface{}{userID, userID, userID}, page)
 }
@@ -0,0 +1,121 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "secure-messenger/shared"
+)
+
+// PrekeyStore keeps each user's published prekeys. One-time prekeys are
+// handed out once and deleted as they are.
+type PrekeyStore struct {
+    db *sql.DB
+}
+
+func NewPrekeyStore(db *sql.DB) *PrekeyStore {
+    return &PrekeyStore{db: db}
+}
+
+// SavePrekeys replaces the user's identity key and signed prekey and adds the
+// uploaded one-time prekeys. One-time prekeys of an earlier identity key are
+// dropped, as their private halves went with it. Nothing is saved if the
+// user would end up with more than shared.MaxOneTimePrekeys.
+func (ps *PrekeyStore) SavePrekeys(userID string, upload *shared.PrekeyUpload) error {
+    tx, err := ps.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    var identityKey []byte
+    err = tx.QueryRow(`SELECT identity_key FROM prekey_bundles WHERE user_id = ?`, userID).Scan(&identityKey)
+    if err != nil && err != sql.ErrNoRows {
+        return err
+    }
+    if err == nil && string(identityKey) != string(upload.IdentityKey) {
+        if _, err := tx.Exec(`DELETE FROM one_time_prekeys WHERE user_id = ?`, userID); err != nil {
+            return err
+        }
+    }
+    
+    query := `
+    INSERT INTO prekey_bundles (user_id, identity_key, signed_prekey_id, signed_prekey, signature, updated_at)
+    VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+    ON CONFLICT (user_id)
+    DO UPDATE SET identity_key = excluded.identity_key, signed_prekey_id = excluded.signed_prekey_id,
+        signed_prekey = excluded.signed_prekey, signature = excluded.signature, updated_at = excluded.updated_at`
+    
+    if _, err := tx.Exec(query, userID, upload.IdentityKey, upload.SignedPrekeyID, upload.SignedPrekey, upload.Signature); err != nil {
+        return err
+    }
+    
+    for _, prekey := range upload.OneTimePrekeys {
+        _, err := tx.Exec(`INSERT OR IGNORE INTO one_time_prekeys (user_id, id, public_key) VALUES (?, ?, ?)`,
+            userID, prekey.ID, prekey.PublicKey)
+        if err != nil {
+            return err
+        }
+    }
+    
+    var count int
+    if err := tx.QueryRow(`SELECT COUNT(*) FROM one_time_prekeys WHERE user_id = ?`, userID).Scan(&count); err != nil {
+        return err
+    }
+    if count > shared.MaxOneTimePrekeys {
+        return fmt.Errorf("too many one-time prekeys, at most %d are kept", shared.MaxOneTimePrekeys)
+    }
+    
+    return tx.Commit()
+}
+
+// TakeBundle returns the user's prekey bundle with one of their one-time
+// prekeys, which is deleted so no one else gets it. It returns nil if the
+// user has not published prekeys.
+func (ps *PrekeyStore) TakeBundle(userID string) (*shared.PrekeyBundle, error) {
+    tx, err := ps.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    
+    bundle := &shared.PrekeyBundle{UserID: userID}
+    query := `SELECT identity_key, signed_prekey_id, signed_prekey, signature FROM prekey_bundles WHERE user_id = ?`
+    err = tx.QueryRow(query, userID).Scan(&bundle.IdentityKey, &bundle.SignedPrekeyID, &bundle.SignedPrekey, &bundle.Signature)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    var prekey shared.OneTimePrekey
+    err = tx.QueryRow(`SELECT id, public_key FROM one_time_prekeys WHERE user_id = ? LIMIT 1`, userID).Scan(&prekey.ID, &prekey.PublicKey)
+    if err != nil && err != sql.ErrNoRows {
+        return nil, err
+    }
+    if err == nil {
+        if _, err := tx.Exec(`DELETE FROM one_time_prekeys WHERE user_id = ? AND id = ?`, userID, prekey.ID); err != nil {
+            return nil, err
+        }
+        bundle.OneTimePrekey = &prekey
+    }
+    
+    return bundle, tx.Commit()
+}
+
+// GetPrekeyStatus returns the ID of the user's signed prekey, zero if they
+// have none, and how many one-time prekeys they have left.
+func (ps *PrekeyStore) GetPrekeyStatus(userID string) (uint32, int, error) {
+    var signedPrekeyID uint32
+    err := ps.db.QueryRow(`SELECT signed_prekey_id FROM prekey_bundles WHERE user_id = ?`, userID).Scan(&signedPrekeyID)
+    if err != nil && err != sql.ErrNoRows {
+        return 0, 0, err
+    }
+    
+    var count int
+    if err := ps.db.QueryRow(`SELECT COUNT(*) FROM one_time_prekeys WHERE user_id = ?`, userID).Scan(&count); err != nil {
+        return 0, 0, err
+    }
+    
+    return signedPrekeyID, count, nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+    "database/sql"
+    "time"
+)
+
+// RetentionPolicy limits how long messages of a channel are kept. A zero
+// MaxAge or MaxCount means there is no limit of that kind.
+type RetentionPolicy struct {
+    ChannelID string // empty for the default policy
+    MaxAge    time.Duration
+    MaxCount  int
+    UpdatedAt time.Time
+}
+
+// RetentionStore keeps the retention policies configured by the server
+// administrator. Channels without a policy of their own use the default.
+type RetentionStore struct {
+    db *sql.DB
+}
+
+func NewRetentionStore(db *sql.DB) *RetentionStore {
+    return &RetentionStore{db: db}
+}
+
+// SetPolicy creates or replaces the policy of policy.ChannelID, or the
+// default policy when it is empty.
+func (rs *RetentionStore) SetPolicy(policy *RetentionPolicy) error {
+    query := `
+    INSERT INTO retention_policies (channel_id, max_age, max_count, updated_at)
+    VALUES (?, ?, ?, ?)
+    ON CONFLICT (channel_id) DO UPDATE SET
+        max_age = excluded.max_age,
+        max_count = excluded.max_count,
+        updated_at = excluded.updated_at`
+    
+    _, err := rs.db.Exec(query, policy.ChannelID, int64(policy.MaxAge/time.Second), policy.MaxCount, time.Now())
+    return err
+}
+
+// DeletePolicy removes the policy of a channel so the default applies to it
+// again, or removes the default when channelID is empty.
+func (rs *RetentionStore) DeletePolicy(channelID string) (bool, error) {
+    result, err := rs.db.Exec(`DELETE FROM retention_policies WHERE channel_id = ?`, channelID)
+    if err != nil {
+        return false, err
+    }
+    
+    removed, err := result.RowsAffected()
+    if err != nil {
+        return false, err
+    }
+    return removed > 0, nil
+}
+
+// GetPolicies returns every configured policy, the default first.
+func (rs *RetentionStore) GetPolicies() ([]*RetentionPolicy, error) {
+    query := `
+    SELECT channel_id, max_age, max_count, updated_at
+    FROM retention_policies
+    ORDER BY channel_id`
+    
+    rows, err := rs.db.Query(query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var policies []*RetentionPolicy
+    for rows.Next() {
+        var policy RetentionPolicy
+        var maxAge int64
+        if err := rows.Scan(&policy.ChannelID, &maxAge, &policy.MaxCount, &policy.UpdatedAt); err != nil {
+            return nil, err
+        }
+        policy.MaxAge = time.Duration(maxAge) * time.Second
+        policies = append(policies, &policy)
+    }
+    
+    return policies, rows.Err()
+}
+
+// GetChannelNames returns the name of every channel by ID.
+func (rs *RetentionStore) GetChannelNames() (map[string]string, error) {
+    rows, err := rs.db.Query(`SELECT id, name FROM channels ORDER BY id`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    names := make(map[string]string)
+    for rows.Next() {
+        var id, name string
+        if err := rows.Scan(&id, &name); err != nil {
+            return nil, err
+        }
+        names[id] = name
+    }
+    
+    return names, rows.Err()
+}
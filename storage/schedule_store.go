@@ -0,0 +1,192 @@
+package storage
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "secure-messenger/shared"
+    "time"
+)
+
+// ScheduleStore keeps messages that are waiting for their send time. Send
+// times are stored in UTC since SQLite compares them as text, and clients
+// may send them with any offset.
+type ScheduleStore struct {
+    db *sql.DB
+}
+
+func NewScheduleStore(db *sql.DB) *ScheduleStore {
+    return &ScheduleStore{db: db}
+}
+
+const scheduledColumns = "id, from_user, to_user, channel_id, content, encrypted, mentions, attachments, key_epoch, client_message_id, signature, send_at, status, error, created_at"
+
+func scanScheduled(row rowScanner) (*shared.ScheduledMessage, error) {
+    var msg shared.ScheduledMessage
+    var mentions, attachments, signature string
+    err := row.Scan(&msg.ID, &msg.From, &msg.To, &msg.ChannelID, &msg.Content, &msg.Encrypted, &mentions, &attachments, &msg.KeyEpoch, &msg.ClientMessageID, &signature, &msg.SendAt, &msg.Status, &msg.Error, &msg.Created)
+    if err != nil {
+        return nil, err
+    }
+    
+    if msg.Signature, err = decodeSignature(signature); err != nil {
+        return nil, fmt.Errorf("invalid signature of scheduled message %s: %v", msg.ID, err)
+    }
+    
+    if err := json.Unmarshal([]byte(mentions), &msg.Mentions); err != nil {
+        return nil, fmt.Errorf("invalid mentions of scheduled message %s: %v", msg.ID, err)
+    }
+    if err := json.Unmarshal([]byte(attachments), &msg.Attachments); err != nil {
+        return nil, fmt.Errorf("invalid attachments of scheduled message %s: %v", msg.ID, err)
+    }
+    return &msg, nil
+}
+
+func (ss *ScheduleStore) queryScheduled(query string, args ...interface{}) ([]*shared.ScheduledMessage, error) {
+    rows, err := ss.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var messages []*shared.ScheduledMessage
+    for rows.Next() {
+        msg, err := scanScheduled(rows)
+        if err != nil {
+            return nil, err
+        }
+        messages = append(messages, msg)
+    }
+    
+    return messages, rows.Err()
+}
+
+// encodeLists stores mentions and attachments as JSON arrays, which lets
+// blob garbage collection see the attachments of scheduled messages.
+func encodeLists(msg *shared.ScheduledMessage) (string, string, error) {
+    mentions := msg.Mentions
+    if mentions == nil {
+        mentions = []string{}
+    }
+    attachments := msg.Attachments
+    if attachments == nil {
+        attachments = []*shared.Attachment{}
+    }
+    
+    mentionsJSON, err := json.Marshal(mentions)
+    if err != nil {
+        return "", "", err
+    }
+    attachmentsJSON, err := json.Marshal(attachments)
+    if err != nil {
+        return "", "", err
+    }
+    return string(mentionsJSON), string(attachmentsJSON), nil
+}
+
+func (ss *ScheduleStore) CreateScheduled(msg *shared.ScheduledMessage) error {
+    mentions, attachments, err := encodeLists(msg)
+    if err != nil {
+        return err
+    }
+    signature, err := encodeSignature(msg.Signature)
+    if err != nil {
+        return err
+    }
+    
+    query := `
+    INSERT INTO scheduled_messages (id, from_user, to_user, channel_id, content, encrypted, mentions, attachments, key_epoch, client_message_id, signature, send_at, status, error, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+    
+    _, err = ss.db.Exec(query, msg.ID, msg.From, msg.To, msg.ChannelID, msg.Content, msg.Encrypted, mentions, attachments, msg.KeyEpoch, msg.ClientMessageID, signature, msg.SendAt.UTC(), msg.Status, msg.Error, msg.Created)
+    return err
+}
+
+// UpdateScheduled saves the editable fields and status of a scheduled
+// message.
+func (ss *ScheduleStore) UpdateScheduled(msg *shared.ScheduledMessage) error {
+    mentions, attachments, err := encodeLists(msg)
+    if err != nil {
+        return err
+    }
+    signature, err := encodeSignature(msg.Signature)
+    if err != nil {
+        return err
+    }
+    
+    query := `
+    UPDATE scheduled_messages
+    SET content = ?, encrypted = ?, mentions = ?, attachments = ?, key_epoch = ?, signature = ?, send_at = ?, status = ?, error = ?
+    WHERE id = ?`
+    
+    _, err = ss.db.Exec(query, msg.Content, msg.Encrypted, mentions, attachments, msg.KeyEpoch, signature, msg.SendAt.UTC(), msg.Status, msg.Error, msg.ID)
+    return err
+}
+
+// GetScheduled returns one of the user's scheduled messages.
+func (ss *ScheduleStore) GetScheduled(id, userID string) (*shared.ScheduledMessage, error) {
+    query := `SELECT ` + scheduledColumns + ` FROM scheduled_messages WHERE id = ? AND from_user = ?`
+    
+    msg, err := scanScheduled(ss.db.QueryRow(query, id, userID))
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("scheduled message not found")
+        }
+        return nil, err
+    }
+    return msg, nil
+}
+
+// GetUserScheduled lists the user's scheduled messages, soonest first.
+func (ss *ScheduleStore) GetUserScheduled(userID string) ([]*shared.ScheduledMessage, error) {
+    query := `
+    SELECT ` + scheduledColumns + `
+    FROM scheduled_messages
+    WHERE from_user = ?
+    ORDER BY send_at ASC`
+    
+    return ss.queryScheduled(query, userID)
+}
+
+func (ss *ScheduleStore) CountUserScheduled(userID string) (int, error) {
+    var count int
+    err := ss.db.QueryRow(`SELECT COUNT(*) FROM scheduled_messages WHERE from_user = ?`, userID).Scan(&count)
+    return count, err
+}
+
+// GetDueScheduled returns up to limit pending messages whose send time is
+// not after now, oldest first.
+func (ss *ScheduleStore) GetDueScheduled(now time.Time, limit int) ([]*shared.ScheduledMessage, error) {
+    query := `
+    SELECT ` + scheduledColumns + `
+    FROM scheduled_messages
+    WHERE status = ? AND send_at <= ?
+    ORDER BY send_at ASC
+    LIMIT ?`
+    
+    return ss.queryScheduled(query, shared.ScheduledStatusPending, now.UTC(), limit)
+}
+
+// NextSendAt returns the send time of the next pending message, or nil if
+// there is none.
+func (ss *ScheduleStore) NextSendAt() (*time.Time, error) {
+    query := `
+    SELECT send_at FROM scheduled_messages
+    WHERE status = ?
+    ORDER BY send_at ASC
+    LIMIT 1`
+    
+    var sendAt time.Time
+    if err := ss.db.QueryRow(query, shared.ScheduledStatusPending).Scan(&sendAt); err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return &sendAt, nil
+}
+
+func (ss *ScheduleStore) DeleteScheduled(id string) error {
+    _, err := ss.db.Exec(`DELETE FROM scheduled_messages WHERE id = ?`, id)
+    return err
+}
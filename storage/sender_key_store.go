@@ -0,0 +1,78 @@
+package storage
+
+import (
+    "database/sql"
+    "secure-messenger/shared"
+)
+
+// SenderKeyStore holds the sender keys channel members hand to each other,
+// already encrypted for their recipient. Only the latest key from each
+// member to each other member is kept.
+type SenderKeyStore struct {
+    db *sql.DB
+}
+
+func NewSenderKeyStore(db *sql.DB) *SenderKeyStore {
+    return &SenderKeyStore{db: db}
+}
+
+// SaveDistributions replaces the sender's keys for the recipients of the
+// distributions, which all belong to one channel and key epoch. It reports
+// false and saves nothing if the channel has moved to another epoch in the
+// meantime.
+func (ss *SenderKeyStore) SaveDistributions(channelID string, keyEpoch int64, distributions []*shared.SenderKeyDistribution) (bool, error) {
+    tx, err := ss.db.Begin()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+    
+    var current int64
+    if err := tx.QueryRow(`SELECT key_epoch FROM channels WHERE id = ?`, channelID).Scan(&current); err != nil {
+        return false, err
+    }
+    if current != keyEpoch {
+        return false, nil
+    }
+    
+    query := `
+    INSERT INTO sender_keys (id, channel_id, from_user, to_user, key_epoch, content, created_at)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT (channel_id, from_user, to_user)
+    DO UPDATE SET id = excluded.id, key_epoch = excluded.key_epoch, content = excluded.content,
+        created_at = excluded.created_at`
+    
+    for _, d := range distributions {
+        if _, err := tx.Exec(query, d.ID, channelID, d.From, d.To, d.KeyEpoch, d.Content, d.Created); err != nil {
+            return false, err
+        }
+    }
+    
+    return true, tx.Commit()
+}
+
+// GetDistributions returns the sender keys held for a user, in one channel
+// or in all of them when channelID is empty.
+func (ss *SenderKeyStore) GetDistributions(userID, channelID string) ([]*shared.SenderKeyDistribution, error) {
+    query := `
+    SELECT id, channel_id, from_user, to_user, key_epoch, content, created_at
+    FROM sender_keys WHERE to_user = ? AND (? = '' OR channel_id = ?)
+    ORDER BY created_at`
+    
+    rows, err := ss.db.Query(query, userID, channelID, channelID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var distributions []*shared.SenderKeyDistribution
+    for rows.Next() {
+        var d shared.SenderKeyDistribution
+        if err := rows.Scan(&d.ID, &d.ChannelID, &d.From, &d.To, &d.KeyEpoch, &d.Content, &d.Created); err != nil {
+            return nil, err
+        }
+        distributions = append(distributions, &d)
+    }
+    
+    return distributions, rows.Err()
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+    "database/sql"
+    "fmt"
+    "time"
+)
+
+// TwoFactor is a user's TOTP enrollment. A secret that is not enabled yet
+// is waiting to be confirmed with a first code.
+type TwoFactor struct {
+    Secret   string
+    Enabled  bool
+    LastStep int64 // period of the last code used, which cannot be used again
+}
+
+// TwoFactorStore keeps users' TOTP secrets and their one-time recovery
+// codes, which are stored hashed.
+type TwoFactorStore struct {
+    db *sql.DB
+}
+
+func NewTwoFactorStore(db *sql.DB) *TwoFactorStore {
+    return &TwoFactorStore{db: db}
+}
+
+// GetTwoFactor returns a user's enrollment, with an empty secret if they
+// have none.
+func (ts *TwoFactorStore) GetTwoFactor(userID string) (*TwoFactor, error) {
+    var twoFactor TwoFactor
+    
+    query := `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?`
+    err := ts.db.QueryRow(query, userID).Scan(&twoFactor.Secret, &twoFactor.Enabled, &twoFactor.LastStep)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("user not found")
+        }
+        return nil, err
+    }
+    
+    return &twoFactor, nil
+}
+
+// SetPendingSecret saves a secret the user has yet to confirm, replacing
+// any earlier one. It fails if two-factor authentication is already enabled.
+func (ts *TwoFactorStore) SetPendingSecret(userID, secret string) error {
+    result, err := ts.db.Exec(`UPDATE users SET totp_secret = ? WHERE id = ? AND NOT totp_enabled`, secret, userID)
+    if err != nil {
+        return err
+    }
+    if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+        return fmt.Errorf("two-factor authentication is already enabled")
+    }
+    return nil
+}
+
+// EnableTwoFactor turns on two-factor authentication with a confirmed
+// secret, the period of the code that confirmed it and a fresh set of
+// recovery codes.
+func (ts *TwoFactorStore) EnableTwoFactor(userID, secret string, step int64, codeHashes []string) error {
+    tx, err := ts.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    query := `UPDATE users SET totp_secret = ?, totp_enabled = 1, totp_last_step = ? WHERE id = ?`
+    if _, err := tx.Exec(query, secret, step, userID); err != nil {
+        return err
+    }
+    if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
+}
+
+// DisableTwoFactor removes a user's secret and recovery codes.
+func (ts *TwoFactorStore) DisableTwoFactor(userID string) error {
+    tx, err := ts.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    query := `UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?`
+    if _, err := tx.Exec(query, userID); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
+}
+
+// UseStep records that the code of a period was used, and reports false if
+// it or a later one already was. Concurrent logins with the same code can
+// only have one succeed.
+func (ts *TwoFactorStore) UseStep(userID string, step int64) (bool, error) {
+    query := `UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_enabled AND totp_last_step < ?`
+    result, err := ts.db.Exec(query, step, userID, step)
+    if err != nil {
+        return false, err
+    }
+    
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return false, err
+    }
+    return affected == 1, nil
+}
+
+// UseRecoveryCode marks a recovery code used and reports whether it was one
+// of the user's unused codes.
+func (ts *TwoFactorStore) UseRecoveryCode(userID, codeHash string, now time.Time) (bool, error) {
+    query := `
+    UPDATE recovery_codes SET used_at = ?
+    WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`
+    result, err := ts.db.Exec(query, now, userID, codeHash)
+    if err != nil {
+        return false, err
+    }
+    
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return false, err
+    }
+    return affected == 1, nil
+}
+
+// ReplaceRecoveryCodes swaps a user's recovery codes for new ones, used or
+// not.
+func (ts *TwoFactorStore) ReplaceRecoveryCodes(userID string, codeHashes []string) error {
+    tx, err := ts.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
+}
+
+// CountRecoveryCodes returns how many of a user's recovery codes are left.
+func (ts *TwoFactorStore) CountRecoveryCodes(userID string) (int, error) {
+    var count int
+    err := ts.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&count)
+    return count, err
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string, codeHashes []string) error {
+    if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+        return err
+    }
+    
+    for _, codeHash := range codeHashes {
+        if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, codeHash); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+    "database/sql"
+    "encoding/json"
+    "secure-messenger/shared"
+    "sync"
+    "time"
+)
+
+// MaxRetainedUpdates is how many updates are kept per user. Clients further
+// behind than this must do a full resync.
+const MaxRetainedUpdates = 5000
+
+type UpdateStore struct {
+    db *sql.DB
+    mu sync.Mutex
+}
+
+func NewUpdateStore(db *sql.DB) *UpdateStore {
+    return &UpdateStore{db: db}
+}
+
+// AppendUpdate adds an update to the log of every given user, assigning each
+// the next sequence number of that user.
+func (us *UpdateStore) AppendUpdate(userIDs []string, updateType string, payload interface{}) error {
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    
+    // Sequences must not be handed out twice
+    us.mu.Lock()
+    defer us.mu.Unlock()
+    
+    tx, err := us.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    sequenceQuery := `
+    INSERT INTO update_sequences (user_id, last_seq) VALUES (?, 1)
+    ON CONFLICT(user_id) DO UPDATE SET last_seq = last_seq + 1
+    RETURNING last_seq`
+    
+    insertQuery := `
+    INSERT INTO updates (user_id, seq, type, payload, created_at)
+    VALUES (?, ?, ?, ?, ?)`
+    
+    pruneQuery := `DELETE FROM updates WHERE user_id = ? AND seq <= ?`
+    
+    now := time.Now()
+    seen := make(map[string]bool)
+    for _, userID := range userIDs {
+        if seen[userID] {
+            continue
+        }
+        seen[userID] = true
+        
+        var seq int64
+        if err := tx.QueryRow(sequenceQuery, userID).Scan(&seq); err != nil {
+            return err
+        }
+        
+        if _, err := tx.Exec(insertQuery, userID, seq, updateType, string(data), now); err != nil {
+            return err
+        }
+        
+        if seq > MaxRetainedUpdates {
+            if _, err := tx.Exec(pruneQuery, userID, seq-MaxRetainedUpdates); err != nil {
+                return err
+            }
+        }
+    }
+    
+    return tx.Commit()
+}
+
+// GetUpdates returns up to limit updates with a sequence greater than since,
+// in sequence order.
+func (us *UpdateStore) GetUpdates(userID string, since int64, limit int) ([]*shared.Update, error) {
+    query := `
+    SELECT seq, type, payload, created_at
+    FROM updates
+    WHERE user_id = ? AND seq > ?
+    ORDER BY seq ASC
+    LIMIT ?`
+    
+    rows, err := us.db.Query(query, userID, since, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var updates []*shared.Update
+    for rows.Next() {
+        var update shared.Update
+        var payload string
+        if err := rows.Scan(&update.Sequence, &update.Type, &payload, &update.Timestamp); err != nil {
+            return nil, err
+        }
+        update.Payload = json.RawMessage(payload)
+        updates = append(updates, &update)
+    }
+    
+    return updates, rows.Err()
+}
+
+// GetSequenceRange returns the oldest retained and the latest sequence of a
+// user's update log. Both are zero for users without updates.
+func (us *UpdateStore) GetSequenceRange(userID string) (int64, int64, error) {
+    var latest int64
+    err := us.db.QueryRow(`SELECT last_seq FROM update_sequences WHERE user_id = ?`, userID).Scan(&latest)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return 0, 0, nil
+        }
+        return 0, 0, err
+    }
+    
+    var oldest sql.NullInt64
+    if err := us.db.QueryRow(`SELECT MIN(seq) FROM updates WHERE user_id = ?`, userID).Scan(&oldest); err != nil {
+        return 0, 0, err
+    }
+    if !oldest.Valid {
+        return latest + 1, latest, nil
+    }
+    
+    return oldest.Int64, latest, nil
+}
@@ -15,34 +15,42 @@ func NewUserStore(db *sql.DB) *UserStore {
     return &UserStore{db: db}
 }
 
-func (us *UserStore) CreateUser(user *shared.User, passwordHash, passwordSalt string) error {
+// CreateUser saves a new user with their password hash, a PHC string that
+// carries its own salt. The salt column is only filled by older databases.
+func (us *UserStore) CreateUser(user *shared.User, passwordHash string) error {
     query := `
     INSERT INTO users (id, username, email, password_hash, password_salt, created_at)
-    VALUES (?, ?, ?, ?, ?, ?)`
+    VALUES (?, ?, ?, ?, '', ?)`
     
-    _, err := us.db.Exec(query, user.ID, user.Username, user.Email, passwordHash, passwordSalt, user.Created)
+    _, err := us.db.Exec(query, user.ID, user.Username, user.Email, passwordHash, user.Created)
     return err
 }
 
-func (us *UserStore) GetUserByUsername(username string) (*shared.User, string, string, error) {
+func (us *UserStore) GetUserByUsername(username string) (*shared.User, string, error) {
     var user shared.User
-    var passwordHash, passwordSalt string
+    var passwordHash string
     
     query := `
-    SELECT id, username, email, password_hash, password_salt, created_at
+    SELECT id, username, email, password_hash, created_at
     FROM users WHERE username = ?`
     
     row := us.db.QueryRow(query, username)
-    err := row.Scan(&user.ID, &user.Username, &user.Email, &passwordHash, &passwordSalt, &user.Created)
+    err := row.Scan(&user.ID, &user.Username, &user.Email, &passwordHash, &user.Created)
     
     if err != nil {
         if err == sql.ErrNoRows {
-            return nil, "", "", fmt.Errorf("user not found")
+            return nil, "", fmt.Errorf("user not found")
         }
-        return nil, "", "", err
+        return nil, "", err
     }
     
-    return &user, passwordHash, passwordSalt, nil
+    return &user, passwordHash, nil
+}
+
+// UpdatePasswordHash replaces a user's password hash.
+func (us *UserStore) UpdatePasswordHash(userID, passwordHash string) error {
+    _, err := us.db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, userID)
+    return err
 }
 
 func (us *UserStore) GetUserByID(id string) (*shared.User, error) {
@@ -85,16 +93,49 @@ func (us *UserStore) GetUserByEmail(email string) (*shared.User, error) {
     return &user, nil
 }
 
-func (us *UserStore) UpdateUserPublicKey(userID, publicKey string) error {
-    query := `UPDATE users SET public_key = ? WHERE id = ?`
-    _, err := us.db.Exec(query, publicKey, userID)
+// UpdateUserPublicKey publishes a user's public key along with the signing
+// key their messages are signed with and the public key's signature over it.
+// Any earlier rotation no longer applies to the new key and is cleared.
+func (us *UserStore) UpdateUserPublicKey(userID, publicKey string, signingKey, signingKeySignature []byte) error {
+    return us.RotateUserPublicKey(userID, publicKey, signingKey, signingKeySignature, "", nil)
+}
+
+// RotateUserPublicKey publishes a user's public key like
+// UpdateUserPublicKey, along with the key it replaces and that key's
+// signature over the new one.
+func (us *UserStore) RotateUserPublicKey(userID, publicKey string, signingKey, signingKeySignature []byte, previousPublicKey string, rotationSignature []byte) error {
+    query := `
+    UPDATE users SET public_key = ?, signing_key = ?, signing_key_signature = ?,
+        previous_public_key = ?, key_rotation_signature = ?
+    WHERE id = ?`
+    _, err := us.db.Exec(query, publicKey, signingKey, signingKeySignature, previousPublicKey, rotationSignature, userID)
     return err
 }
 
+// GetUserKeyRotation returns the public key a user's current one replaced
+// and its signature over the current one, both empty unless the current key
+// came from a rotation.
+func (us *UserStore) GetUserKeyRotation(userID string) (string, []byte, error) {
+    var previousPublicKey string
+    var signature []byte
+    
+    query := `SELECT COALESCE(previous_public_key, ''), key_rotation_signature FROM users WHERE id = ?`
+    err := us.db.QueryRow(query, userID).Scan(&previousPublicKey, &signature)
+    
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", nil, fmt.Errorf("user not found")
+        }
+        return "", nil, err
+    }
+    
+    return previousPublicKey, signature, nil
+}
+
 func (us *UserStore) GetUserPublicKey(userID string) (string, error) {
     var publicKey string
     
-    query := `SELECT public_key FROM users WHERE id = ?`
+    query := `SELECT COALESCE(public_key, '') FROM users WHERE id = ?`
     row := us.db.QueryRow(query, userID)
     err := row.Scan(&publicKey)
     
@@ -108,6 +149,47 @@ func (us *UserStore) GetUserPublicKey(userID string) (string, error) {
     return publicKey, nil
 }
 
+// SetKeyBackup stores a user's encrypted key backup, or removes it when
+// backup is nil.
+func (us *UserStore) SetKeyBackup(userID string, backup []byte) error {
+    _, err := us.db.Exec(`UPDATE users SET key_backup = ? WHERE id = ?`, backup, userID)
+    return err
+}
+
+// GetKeyBackup returns a user's encrypted key backup, or nil if they have
+// not stored one.
+func (us *UserStore) GetKeyBackup(userID string) ([]byte, error) {
+    var backup []byte
+    
+    err := us.db.QueryRow(`SELECT key_backup FROM users WHERE id = ?`, userID).Scan(&backup)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, fmt.Errorf("user not found")
+        }
+        return nil, err
+    }
+    
+    return backup, nil
+}
+
+// GetUserSigningKey returns a user's signing key and the signature vouching
+// for it, both empty if they have not published one.
+func (us *UserStore) GetUserSigningKey(userID string) ([]byte, []byte, error) {
+    var signingKey, signature []byte
+    
+    query := `SELECT signing_key, signing_key_signature FROM users WHERE id = ?`
+    err := us.db.QueryRow(query, userID).Scan(&signingKey, &signature)
+    
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return nil, nil, fmt.Errorf("user not found")
+        }
+        return nil, nil, err
+    }
+    
+    return signingKey, signature, nil
+}
+
 func (us *UserStore) CreateSession(token, userID string) error {
     query := `
     INSERT INTO sessions (token, user_id, created_at, last_seen)
@@ -152,6 +234,104 @@ func (us *UserStore) DeleteSession(token string) error {
     return err
 }
 
+// DeleteUserSessions logs a user out everywhere except the session with the
+// given token, which may be empty to end them all.
+func (us *UserStore) DeleteUserSessions(userID, exceptToken string) error {
+    query := `DELETE FROM sessions WHERE user_id = ? AND token != ?`
+    _, err := us.db.Exec(query, userID, exceptToken)
+    return err
+}
+
+// CreatePasswordReset stores a password reset token by its hash, replacing
+// any earlier tokens of the user that are still unused.
+func (us *UserStore) CreatePasswordReset(tokenHash, userID string, createdAt, expiresAt time.Time) error {
+    tx, err := us.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    
+    if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL`, userID); err != nil {
+        return err
+    }
+    
+    query := `
+    INSERT INTO password_resets (token_hash, user_id, created_at, expires_at)
+    VALUES (?, ?, ?, ?)`
+    if _, err := tx.Exec(query, tokenHash, userID, createdAt, expiresAt); err != nil {
+        return err
+    }
+    
+    return tx.Commit()
+}
+
+// LastPasswordReset returns when a reset token was last issued to a user,
+// or the zero time if none was.
+func (us *UserStore) LastPasswordReset(userID string) (time.Time, error) {
+    var createdAt time.Time
+    
+    query := `SELECT created_at FROM password_resets WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`
+    err := us.db.QueryRow(query, userID).Scan(&createdAt)
+    if err != nil && err != sql.ErrNoRows {
+        return time.Time{}, err
+    }
+    
+    return createdAt, nil
+}
+
+// GetPasswordResetUser returns the user a reset token was issued to, if it
+// is unused and has not expired, without using it up.
+func (us *UserStore) GetPasswordResetUser(tokenHash string, now time.Time) (string, error) {
+    var userID string
+    
+    query := `SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`
+    err := us.db.QueryRow(query, tokenHash, now).Scan(&userID)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return "", fmt.Errorf("invalid or expired reset token")
+        }
+        return "", err
+    }
+    
+    return userID, nil
+}
+
+// DeletePasswordResets removes a user's unused reset tokens, once their
+// password was changed some other way.
+func (us *UserStore) DeletePasswordResets(userID string) error {
+    _, err := us.db.Exec(`DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL`, userID)
+    return err
+}
+
+// ConsumePasswordReset marks a reset token used, if it is unused and has not
+// expired, and returns the user it was issued to. A token can only be
+// consumed once, even by concurrent requests.
+func (us *UserStore) ConsumePasswordReset(tokenHash string, now time.Time) (string, error) {
+    tx, err := us.db.Begin()
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+    
+    query := `
+    UPDATE password_resets SET used_at = ?
+    WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`
+    result, err := tx.Exec(query, now, tokenHash, now)
+    if err != nil {
+        return "", err
+    }
+    if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+        return "", fmt.Errorf("invalid or expired reset token")
+    }
+    
+    var userID string
+    if err := tx.QueryRow(`SELECT user_id FROM password_resets WHERE token_hash = ?`, tokenHash).Scan(&userID); err != nil {
+        return "", err
+    }
+    
+    return userID, tx.Commit()
+}
+
 func (us *UserStore) GetAllUsers() ([]*shared.User, error) {
     query := `
     SELECT id, username, email, created_at